@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/utils"
+)
+
+// handleListInstanceIDs lists instance IDs, pinned IDs and orphaned preference files
+func handleListInstanceIDs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListInstanceIDs(w, r)
+}
+
+// handlePinInstanceID pins the ID of an instance, optionally renaming it
+func handlePinInstanceID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		http.Error(w, "Missing or invalid uuid parameter", http.StatusBadRequest)
+		return
+	}
+	// Optional, rename the instance to this ID while pinning
+	newID, _ := utils.PostPara(r, "new_uuid")
+	dezkvmManager.HandlePinInstanceID(w, r, instanceUUID, newID)
+}
+
+// handleUnpinInstanceID removes the pinned ID of an instance
+func handleUnpinInstanceID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		http.Error(w, "Missing or invalid uuid parameter", http.StatusBadRequest)
+		return
+	}
+	dezkvmManager.HandleUnpinInstanceID(w, r, instanceUUID)
+}
+
+// handleMigratePreferences moves an orphaned preference file to another instance
+func handleMigratePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fromID, err := utils.PostPara(r, "from")
+	if err != nil {
+		http.Error(w, "Missing or invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	toID, err := utils.PostPara(r, "to")
+	if err != nil {
+		http.Error(w, "Missing or invalid to parameter", http.StatusBadRequest)
+		return
+	}
+	overwrite, _ := utils.PostBool(r, "overwrite")
+	dezkvmManager.HandleMigratePreferences(w, r, fromID, toID, overwrite)
+}
+
+// handleManualInstances handles GET (list), POST (add) and DELETE (remove) of manually defined instances
+func handleManualInstances(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleListManualInstances(w, r)
+	case http.MethodPost:
+		dezkvmManager.HandleAddManualInstance(w, r)
+	case http.MethodDelete:
+		hidDevicePath, err := utils.GetPara(r, "usb_kvm_device_path")
+		if err != nil {
+			http.Error(w, "Missing or invalid usb_kvm_device_path parameter", http.StatusBadRequest)
+			return
+		}
+		dezkvmManager.HandleRemoveManualInstance(w, r, hidDevicePath)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleChipConfig reads (GET) or updates (POST) the CH9329 configuration of
+// a local instance. Peers do not accept API tokens on admin routes, so the
+// chip of a remote instance is configured on its own node.
+func handleChipConfig(w http.ResponseWriter, r *http.Request) {
+	instanceUUID := r.PathValue("uuid")
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleGetChipConfig(w, r, instanceUUID)
+	case http.MethodPost:
+		dezkvmManager.HandleSetChipConfig(w, r, instanceUUID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -21,18 +21,57 @@ func register_ipkvm_apis(mux *http.ServeMux) {
 	authManager.HandleFunc("/api/v1/stream/{uuid}/video", handleVideoStream, mux)
 	authManager.HandleFunc("/api/v1/stream/{uuid}/audio", handleAudioStream, mux)
 	authManager.HandleFunc("/api/v1/hid/{uuid}/events", handleHIDEvents, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/type", handleTypeText, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/status", handleChipStatus, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/stats", handleHIDStats, mux)
+	authManager.HandleFunc("/api/v1/hid/layouts", handleListKeyboardLayouts, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/consumer/{key}", handleConsumerKey, mux)
+	authManager.HandleFunc("/api/v1/hid/consumer-keys", handleListConsumerKeys, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro", handleInstanceMacro, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/{action}", handleInstanceMacro, mux)
+	authManager.HandleFunc("/api/v1/macros", handleListMacros, mux)
+	authManager.HandleFunc("/api/v1/macros/{name}", handleMacro, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/script", handleInstanceScript, mux)
+	authManager.HandleFunc("/api/v1/hid/{uuid}/script/{action}", handleInstanceScript, mux)
+	authManager.HandleFunc("/api/v1/scripts", handleListScripts, mux)
+	authManager.HandleFunc("/api/v1/scripts/validate", handleValidateScript, mux)
+	authManager.HandleFunc("/api/v1/scripts/{name}", handleScript, mux)
 	authManager.HandleFunc("/api/v1/instances", handleListInstances, mux)
+	authManager.HandleFunc("/api/v1/node", handleNodeInfo, mux)
 	authManager.HandleFunc("/api/v1/resolutions/{uuid}", handleGetSupportedResolutions, mux)
 	authManager.HandleFunc("/api/v1/resolution/{uuid}", handleGetCurrentResolution, mux)
+	authManager.HandleFunc("/api/v1/capture/{uuid}/profile", handleGetCaptureProfile, mux)
 	authManager.HandleFunc("/api/v1/screenshot/{uuid}", handleScreenshot, mux)
 	authManager.HandleFunc("/api/v1/mouse_jiggler/{uuid}", handleMouseJiggler, mux)
 	authManager.HandleFunc("/api/v1/preferences/{uuid}", handlePreferences, mux)
+	authManager.HandleFunc("/api/v1/registry", handleListRegistry, mux)
+	authManager.HandleFunc("/api/v1/registry/{uuid}", handleRegistryEntry, mux)
+	authManager.HandleFunc("/api/v1/groups", handleListGroups, mux)
+	authManager.HandleFunc("/api/v1/groups/{name}", handleGroup, mux)
+	authManager.HandleFunc("/api/v1/broadcast/events", handleBroadcastHIDEvents, mux)
 	// Runtime APIs
 	authManager.HandleFunc("/api/v1/mass_storage/switch", handleMassStorageSwitch, mux)
 	authManager.HandleFunc("/api/v1/resolution/change", handleChangeResolution, mux)
+	authManager.HandleFunc("/api/v1/audio/quality", handleSetAudioQuality, mux)
 	authManager.HandleFunc("/api/v1/reconnect/{uuid}", handleReconnectCapture, mux)
 }
 
+// register_admin_apis registers administration API endpoints
+func register_admin_apis(mux *http.ServeMux) {
+	authManager.HandleFunc("/api/v1/admin/instance_ids", handleListInstanceIDs, mux)
+	authManager.HandleFunc("/api/v1/admin/instance_ids/pin", handlePinInstanceID, mux)
+	authManager.HandleFunc("/api/v1/admin/instance_ids/unpin", handleUnpinInstanceID, mux)
+	authManager.HandleFunc("/api/v1/admin/instance_ids/migrate", handleMigratePreferences, mux)
+	authManager.HandleFunc("/api/v1/admin/manual_instances", handleManualInstances, mux)
+	authManager.HandleFunc("/api/v1/admin/chip/{uuid}/config", handleChipConfig, mux)
+	authManager.HandleFunc("/api/v1/admin/backup/export", handleExportBackup, mux)
+	authManager.HandleFunc("/api/v1/admin/backup/import", handleImportBackup, mux)
+	authManager.HandleFunc("/api/v1/admin/tokens", handleAPITokens, mux)
+	authManager.HandleFunc("/api/v1/admin/tokens/{id}", handleAPIToken, mux)
+	authManager.HandleFunc("/api/v1/admin/federation/peers", handleFederationPeers, mux)
+	authManager.HandleFunc("/api/v1/admin/federation/peers/{id}", handleFederationPeer, mux)
+}
+
 // register_terminal_apis registers terminal-related API endpoints
 func register_terminal_apis(mux *http.ServeMux) {
 	authManager.HandleFunc("/api/tools/webssh", handleCreateSSHSession, mux)
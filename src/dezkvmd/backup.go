@@ -0,0 +1,145 @@
+package main
+
+/*
+	backup.go
+
+	Backup and restore of the daemon configuration. Bundles can be
+	exported and imported via the admin API, or restored with
+	-mode=restore while the daemon is stopped (e.g. after reflashing).
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/backup"
+	"imuslab.com/dezkvm/dezkvmd/mod/utils"
+)
+
+var backupFile = flag.String("backup-file", "", "Backup bundle to restore, must be used with -mode=restore")
+
+// backup_layout returns the files of this installation included in a backup
+func backup_layout() *backup.Layout {
+	return &backup.Layout{
+		ConfigDir: CONFIG_PATH,
+		ConfigFiles: []string{
+			filepath.Base(USB_KVM_CFG_PATH),
+			filepath.Base(UUID_FILE),
+			filepath.Base(INSTANCE_ID_FILE),
+			filepath.Base(MANUAL_INSTANCE_FILE),
+			filepath.Base(SCAN_FILTER_PATH),
+		},
+		InstanceDir: INSTANCE_CFG_PATH,
+		TLSFiles:    []string{TLS_CERT_FILE, TLS_KEY_FILE},
+		DBPath:      DB_FILE_PATH,
+	}
+}
+
+// handleExportBackup returns a signed backup bundle, TLS material is only
+// included if include_tls is set
+func handleExportBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	passphrase, err := utils.PostPara(r, "passphrase")
+	if err != nil {
+		http.Error(w, "Missing or invalid passphrase parameter", http.StatusBadRequest)
+		return
+	}
+	includeTLS, _ := utils.PostBool(r, "include_tls")
+
+	buf := new(bytes.Buffer)
+	err = backup.Export(buf, backup_layout(), systemDB, includeTLS, passphrase)
+	if err != nil {
+		http.Error(w, "Failed to export backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("dezkvm-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.Write(buf.Bytes())
+}
+
+// handleImportBackup verifies an uploaded bundle and restores it. The
+// database is replaced immediately, other settings apply after a restart.
+func handleImportBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, backup.MaxBundleSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	passphrase := r.FormValue("passphrase")
+	if passphrase == "" {
+		http.Error(w, "Missing or invalid passphrase parameter", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("backup")
+	if err != nil {
+		http.Error(w, "Missing backup file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	bundle, err := backup.Read(file, passphrase)
+	if err != nil {
+		http.Error(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bundle.Restore(backup_layout(), systemDB); err != nil {
+		http.Error(w, "Failed to restore backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Backup created at %s restored\n", time.Unix(bundle.Manifest.CreatedAt, 0).Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":           "ok",
+		"format_version":   bundle.Manifest.FormatVersion,
+		"created_at":       bundle.Manifest.CreatedAt,
+		"includes_tls":     bundle.Manifest.IncludesTLS,
+		"restart_required": true,
+	})
+}
+
+// run_restore_mode restores the bundle given by -backup-file, the daemon must not be running
+func run_restore_mode() error {
+	if *backupFile == "" {
+		return fmt.Errorf("please specify the backup bundle with -backup-file")
+	}
+	f, err := os.Open(*backupFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var passphrase string
+	fmt.Print("Enter backup passphrase: ")
+	_, err = fmt.Scanln(&passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	bundle, err := backup.Read(f, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restoring backup created at %s (format version %d, %d files)\n",
+		time.Unix(bundle.Manifest.CreatedAt, 0).Format(time.RFC3339),
+		bundle.Manifest.FormatVersion, len(bundle.Manifest.Files))
+	if err := bundle.Restore(backup_layout(), nil); err != nil {
+		return err
+	}
+	fmt.Println("Backup restored successfully.")
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+/*
+	chipcfg.go
+
+	The -mode=chipcfg command line tool reads and writes the CH9329
+	configuration of the USB KVM in usbkvm.json, or the one given with
+	-chip-dev and -chip-baud:
+
+		dezkvmd -mode=chipcfg get
+		dezkvmd -mode=chipcfg set vid=0x046D pid=0xC31C product="USB Keyboard" custom_descriptors=product
+
+	Keys of set are the JSON field names of kvmhid.ChipConfig.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+// run_chipcfg_mode runs the chipcfg get or set command
+func run_chipcfg_mode(args []string) error {
+	if len(args) == 0 || (args[0] != "get" && args[0] != "set") {
+		return errors.New("usage: -mode=chipcfg get | set key=value...")
+	}
+	if args[0] == "set" && len(args) == 1 {
+		return errors.New("nothing to set, e.g. -mode=chipcfg set vid=0x1A86 pid=0xE129")
+	}
+
+	kvmCfg, err := loadUsbKvmConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load USB KVM config: %v", err)
+	}
+	if *chipDev != "" {
+		kvmCfg.USBKVMDevicePath = *chipDev
+	}
+	if *chipBaud > 0 {
+		kvmCfg.USBKVMBaudrate = *chipBaud
+	}
+	controller := kvmhid.NewHIDController(&kvmhid.Config{
+		PortName:          kvmCfg.USBKVMDevicePath,
+		BaudRate:          kvmCfg.USBKVMBaudrate,
+		ScrollSensitivity: 0x01,
+	})
+	if err := controller.Connect(); err != nil {
+		return err
+	}
+	defer controller.Close()
+
+	var cfg *kvmhid.ChipConfig
+	for i := 0; i < 3; i++ {
+		time.Sleep(1 * time.Second) // Wait for the controller to initialize
+		cfg, err = controller.ReadChipConfig()
+		if err == nil {
+			break
+		}
+		log.Printf("Attempt %d: Failed to get chip configuration: %v\n", i+1, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "set" {
+		for _, arg := range args[1:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("invalid argument %q, want key=value", arg)
+			}
+			if err := setChipConfigField(cfg, key, value); err != nil {
+				return err
+			}
+		}
+		if err := controller.WriteChipConfig(cfg); err != nil {
+			return err
+		}
+		log.Println("Configuration written. Unplug the device and plug it back in to apply the changes.")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
+
+// setChipConfigField sets a field of the chip configuration from its
+// command line value. Numbers can be given in hex with a 0x prefix.
+func setChipConfigField(cfg *kvmhid.ChipConfig, key string, value string) error {
+	parseUint := func(bits int) (uint64, error) {
+		n, err := strconv.ParseUint(value, 0, bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", key, value)
+		}
+		return n, nil
+	}
+
+	switch key {
+	case "mode", "serial_mode", "address":
+		n, err := parseUint(8)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "mode":
+			cfg.Mode = uint8(n)
+		case "serial_mode":
+			cfg.SerialMode = uint8(n)
+		default:
+			cfg.Address = uint8(n)
+		}
+	case "baudrate":
+		n, err := parseUint(32)
+		if err != nil {
+			return err
+		}
+		cfg.Baudrate = uint32(n)
+	case "packet_interval", "vid", "pid", "keyboard_upload_interval", "keyboard_release_delay":
+		n, err := parseUint(16)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "packet_interval":
+			cfg.PacketInterval = uint16(n)
+		case "vid":
+			cfg.VID = uint16(n)
+		case "pid":
+			cfg.PID = uint16(n)
+		case "keyboard_upload_interval":
+			cfg.KeyboardUploadInterval = uint16(n)
+		default:
+			cfg.KeyboardReleaseDelay = uint16(n)
+		}
+	case "keyboard_fast_upload":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		cfg.KeyboardFastUpload = enabled
+	case "manufacturer":
+		cfg.Manufacturer = value
+	case "product":
+		cfg.Product = value
+	case "serial_number":
+		cfg.SerialNumber = value
+	case "custom_descriptors":
+		// Comma separated list of the custom strings, or "none"
+		descriptors := kvmhid.ChipCustomDescriptors{}
+		if value != "none" && value != "" {
+			descriptors.Enabled = true
+			for _, name := range strings.Split(value, ",") {
+				switch strings.TrimSpace(name) {
+				case "manufacturer":
+					descriptors.Manufacturer = true
+				case "product":
+					descriptors.Product = true
+				case "serial_number":
+					descriptors.SerialNumber = true
+				default:
+					return fmt.Errorf("unknown custom descriptor %q, want manufacturer, product or serial_number", name)
+				}
+			}
+		}
+		cfg.CustomDescriptors = descriptors
+	default:
+		return fmt.Errorf("unknown chip configuration key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+	federation.go
+
+	Aggregate the instances of other dezkvmd nodes. Peers are registered
+	with their URL and an API token created on the peer. Requests for the
+	instances of a peer are proxied to it transparently.
+*/
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/federation"
+	"imuslab.com/dezkvm/dezkvmd/mod/utils"
+)
+
+var federationManager *federation.Manager
+
+func init_federation_manager() error {
+	var err error
+	federationManager, err = federation.NewManager(federation.Options{
+		DB:            systemDB,
+		LocalNodeUUID: nodeUUID,
+		Authorize: func(r *http.Request) bool {
+			// API tokens of this node must not be turned into the tokens of its peers
+			return authManager.HasSession(r)
+		},
+	})
+	return err
+}
+
+// proxy_remote_instance forwards the request to the peer owning the
+// instance if it is not a local instance. Returns true if the request was
+// handled by the proxy.
+func proxy_remote_instance(w http.ResponseWriter, r *http.Request, instanceUUID string) bool {
+	if federationManager == nil {
+		return false
+	}
+	if _, err := dezkvmManager.GetInstanceByUUID(instanceUUID); err == nil {
+		return false
+	}
+	if r.PostForm != nil {
+		// The body was consumed while parsing the uuid parameter, forward the parsed form
+		body := r.PostForm.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return federationManager.ProxyInstanceRequest(w, r, instanceUUID)
+}
+
+// handleNodeInfo returns the identity of this node, used by aggregators
+// to identify their peers
+func handleNodeInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_uuid":      strings.TrimSpace(nodeUUID),
+		"host_name":      mdns_host_name(),
+		"api":            API_VERSION,
+		"instance_count": len(dezkvmManager.Instances()),
+	})
+}
+
+// handleFederationPeers lists (GET) or registers (POST) peer nodes
+func handleFederationPeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(federationManager.ListPeers())
+	case http.MethodPost:
+		var peer federation.Peer
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+		if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := federationManager.AddPeer(peer)
+		if err != nil {
+			http.Error(w, "Failed to add peer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Federation peer %s (%s) added\n", info.Name, info.URL)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFederationPeer returns (GET) or removes (DELETE) a peer node
+func handleFederationPeer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		info, err := federationManager.GetPeer(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case http.MethodDelete:
+		if err := federationManager.RemovePeer(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPITokens lists (GET) or creates (POST) API tokens. The token value
+// is only returned when it is created.
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := authManager.ListAPITokens()
+		if err != nil {
+			http.Error(w, "Failed to list tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	case http.MethodPost:
+		name, err := utils.PostPara(r, "name")
+		if err != nil {
+			http.Error(w, "Missing or invalid name parameter", http.StatusBadRequest)
+			return
+		}
+		token, info, err := authManager.CreateAPIToken(name)
+		if err != nil {
+			http.Error(w, "Failed to create token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": token,
+			"info":  info,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPIToken revokes an API token
+func handleAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := authManager.RevokeAPIToken(r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
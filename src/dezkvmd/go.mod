@@ -1,14 +1,13 @@
 module imuslab.com/dezkvm/dezkvmd
 
-go 1.23.4
+go 1.24.0
 
 require (
-	github.com/boltdb/bolt v1.3.1
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/csrf v1.7.2
 	github.com/gorilla/websocket v1.5.3
-	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	github.com/vladimirvivien/go4vl v0.0.5
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/sys v0.31.0
 )
 
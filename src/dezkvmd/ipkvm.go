@@ -70,31 +70,42 @@ func init_ipkvm_mode() error {
 		return err
 	}
 
+	// Initialize the federation manager, peers are checked in background
+	err = init_federation_manager()
+	if err != nil {
+		log.Fatal("Failed to initialize federation manager:", err)
+		return err
+	}
+
 	// Initialize SSH Proxy Manager
 	sshproxManager = sshprox.NewSSHProxyManager()
 
 	//Create a new DezkVM manager
 	dezkvmManager = dezkvm.NewKvmHostInstance(&dezkvm.RuntimeOptions{
 		EnableLog:        true,
-		ConfigFolderPath: "./config/instances",
+		ConfigFolderPath: INSTANCE_CFG_PATH,
+		IdentityFilePath: INSTANCE_ID_FILE,
+		ManualFilePath:   MANUAL_INSTANCE_FILE,
+		DB:               systemDB,
+
+		HIDStatusPollInterval: *hidPoll,
 	})
 
 	// Experimental
-	connectedUsbKvms, err := dezkvm.ScanConnectedUsbKvmDevices()
+	if *mode == "simulate" {
+		err = add_simulated_devices()
+	} else {
+		err = add_usb_kvm_devices()
+	}
 	if err != nil {
 		return err
 	}
 
-	for _, dev := range connectedUsbKvms {
-		err := dezkvmManager.AddUsbKvmDevice(dev)
-		if err != nil {
-			return err
-		}
-	}
-
+	// Failed instances are retried in background and reported via the instances API,
+	// so a single faulty port should not prevent the others from being served
 	err = dezkvmManager.StartAllUsbKvmDevices()
 	if err != nil {
-		return err
+		log.Println("Some USB KVM devices failed to start:", err)
 	}
 	// ~Experimental
 
@@ -107,10 +118,15 @@ func init_ipkvm_mode() error {
 	go func() {
 		<-c
 		log.Println("Shutting down DezKVM...")
+		stop_mdns_advertisement()
 
+		if federationManager != nil {
+			federationManager.Close()
+		}
 		if dezkvmManager != nil {
 			dezkvmManager.Close()
 		}
+		close_simulated_devices()
 		if authManager != nil {
 			authManager.Close()
 		}
@@ -127,10 +143,20 @@ func init_ipkvm_mode() error {
 	// Register DezkVM related APIs
 	register_ipkvm_apis(listeningServerMux)
 
+	// Register administration APIs
+	register_admin_apis(listeningServerMux)
+
 	// Register Terminal related APIs
 	register_terminal_apis(listeningServerMux)
 
-	fmt.Println("Listening on https://localhost:9000")
+	if *mode == "simulate" {
+		register_simulator_apis(listeningServerMux)
+	}
+
+	// Advertise the node on the LAN
+	start_mdns_advertisement()
+
+	fmt.Printf("Listening on https://localhost:%d\n", LISTENING_PORT)
 
 	// Ensure TLS certificate exists (generate self-signed if missing)
 	certPath, keyPath, err := ensureTLSCert(CONFIG_PATH)
@@ -138,10 +164,52 @@ func init_ipkvm_mode() error {
 		log.Fatal("Failed to ensure TLS certificate:", err)
 	}
 
-	err = http.ListenAndServeTLS(":9000", certPath, keyPath, listeningServerMux)
+	err = http.ListenAndServeTLS(fmt.Sprintf(":%d", LISTENING_PORT), certPath, keyPath, listeningServerMux)
 	return err
 }
 
+// add_usb_kvm_devices adds the manually defined and auto-detected USB KVM devices
+func add_usb_kvm_devices() error {
+	// Manually defined instances come first, so they take precedence over
+	// auto-detected instances using the same devices
+	manualUsbKvms, err := dezkvmManager.LoadManualInstances()
+	if err != nil {
+		return err
+	}
+	for _, dev := range manualUsbKvms {
+		err := dezkvmManager.AddUsbKvmDevice(dev)
+		if err != nil {
+			log.Println("Skipping invalid manual instance definition:", err)
+		}
+	}
+
+	// Only devices that are known or allowed by the scan filter are opened
+	scanFilter, err := dezkvm.LoadScanFilter(SCAN_FILTER_PATH)
+	if err != nil {
+		return err
+	}
+
+	connectedUsbKvms, err := dezkvm.ScanConnectedUsbKvmDevices(scanFilter)
+	if err != nil {
+		if len(manualUsbKvms) == 0 {
+			return err
+		}
+		log.Println("USB KVM auto-detection failed:", err)
+	}
+
+	for _, dev := range connectedUsbKvms {
+		if dezkvmManager.IsDeviceInUse(dev) {
+			log.Printf("Skipping auto-detected USB KVM device %s, already defined manually\n", dev.USBKVMDevicePath)
+			continue
+		}
+		err := dezkvmManager.AddUsbKvmDevice(dev)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func request_url_allow_unauthenticated(r *http.Request) bool {
 	// Define a list of URL paths that can be accessed without authentication
 	allowedPaths := []string{
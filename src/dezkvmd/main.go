@@ -8,25 +8,33 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/google/uuid"
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
 )
 
 const (
-	DEFAULT_DEV_MODE = true
-	CONFIG_PATH      = "./config"
-	USB_KVM_CFG_PATH = CONFIG_PATH + "/usbkvm.json"
-	UUID_FILE        = CONFIG_PATH + "/uuid.cfg"
-	DB_FILE_PATH     = CONFIG_PATH + "/sys.db"
+	DEFAULT_DEV_MODE  = true
+	CONFIG_PATH       = "./config"
+	USB_KVM_CFG_PATH  = CONFIG_PATH + "/usbkvm.json"
+	UUID_FILE         = CONFIG_PATH + "/uuid.cfg"
+	DB_FILE_PATH      = CONFIG_PATH + "/sys.db"
+	INSTANCE_CFG_PATH = CONFIG_PATH + "/instances"
+	INSTANCE_ID_FILE  = CONFIG_PATH + "/instance_ids.json"
+	SCAN_FILTER_PATH  = CONFIG_PATH + "/scan_filter.json"
+
+	MANUAL_INSTANCE_FILE = CONFIG_PATH + "/manual_instances.json"
+	LISTENING_PORT       = 9000
 )
 
 var (
 	nodeUUID   = "00000000-0000-0000-0000-000000000000"
 	developent = flag.Bool("dev", DEFAULT_DEV_MODE, "Enable development mode with local static files")
-	mode       = flag.String("mode", "ipkvm", "Mode of operation: usbkvm, ipkvm or debug")
-	tool       = flag.String("tool", "", "Run debug tool, must be used with -mode=debug")
+	mode       = flag.String("mode", "ipkvm", "Mode of operation: ipkvm, simulate, debug, cfgchip, chipcfg, hidgadget, setpw or restore")
+	tool       = flag.String("tool", "", "Run debug tool, must be used with -mode=debug, e.g. discover")
+	chipDev    = flag.String("chip-dev", "", "Serial device of the CH9329 configured by -mode=chipcfg, defaults to the one in usbkvm.json")
+	chipBaud   = flag.Int("chip-baud", 0, "Baudrate of the CH9329 configured by -mode=chipcfg, defaults to the one in usbkvm.json")
+	hidPoll    = flag.Duration("hid-poll", kvmhid.DefaultStatusPollInterval, "Interval of polling the keyboard LEDs and USB state of the targets, 0 to disable")
 )
 
 /* Web Server Static Files */
@@ -89,36 +97,25 @@ func main() {
 			log.Fatal(err)
 		}
 
-	case "getchipcfg":
-		//Get and print the current chip configuration
-		kvmCfg, err := loadUsbKvmConfig()
+	case "chipcfg":
+		//Read or write the chip configuration, e.g. -mode=chipcfg get
+		err := run_chipcfg_mode(flag.Args())
 		if err != nil {
-			log.Fatal("Failed to load or create USB KVM config:", err)
+			log.Fatal(err)
 		}
-		// Initiate the HID controller
-		usbKVM = kvmhid.NewHIDController(&kvmhid.Config{
-			PortName:          kvmCfg.USBKVMDevicePath,
-			BaudRate:          kvmCfg.USBKVMBaudrate,
-			ScrollSensitivity: 0x01, // Set mouse scroll sensitivity
-		})
-
-		//Start the HID controller
-		err = usbKVM.Connect()
+	case "getchipcfg":
+		//Deprecated, same as -mode=chipcfg get
+		err := run_chipcfg_mode([]string{"get"})
 		if err != nil {
 			log.Fatal(err)
 		}
-		for i := 0; i < 3; i++ {
-			time.Sleep(1 * time.Second)
-			cfgData, err := usbKVM.GetChipCurrentConfiguration()
-			if err == nil {
-				fmt.Printf("Current Chip Configuration: %x\n", cfgData)
-				break
-			} else {
-				log.Printf("Attempt %d: Failed to get chip configuration: %v\n", i+1, err)
-			}
+	case "hidgadget":
+		//Create the USB HID gadget used by the gadget HID backend, needs root
+		err := kvmhid.CreateHIDGadget(kvmhid.DefaultConfigFSGadgetRoot, kvmhid.DefaultGadgetSetup())
+		if err != nil {
+			log.Fatal("Failed to create HID gadget: ", err)
 		}
-
-		usbKVM.Close()
+		log.Println("HID gadget created, set hid_backend to \"gadget\" in the instance config to use it")
 	case "ipkvm":
 		//Check runtime dependencies
 		err := run_dependency_precheck()
@@ -131,6 +128,18 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case "simulate":
+		//Start IP-KVM mode with simulated devices, no hardware dependencies needed
+		err := init_ipkvm_mode()
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "debug":
+		//Run debug tools
+		err := handle_debug_tool()
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "setpw":
 		// Set system access password interactively
 		err := init_auth_manager()
@@ -149,7 +158,13 @@ func main() {
 		}
 		fmt.Println("Password set successfully.")
 		authManager.Close()
+	case "restore":
+		// Restore a backup bundle, the daemon must be stopped
+		err := run_restore_mode()
+		if err != nil {
+			log.Fatal("Failed to restore backup:", err)
+		}
 	default:
-		log.Fatalf("Unknown mode: %s. Supported modes are: usbkvm, ipkvm, cfgchip, updateprop, getcfg, setpw", *mode)
+		log.Fatalf("Unknown mode: %s. Supported modes are: ipkvm, simulate, debug, cfgchip, chipcfg, hidgadget, setpw, restore", *mode)
 	}
 }
@@ -0,0 +1,167 @@
+package main
+
+/*
+	mdns.go
+
+	Advertise the daemon over mDNS / DNS-SD, so DezKVM hosts can be found
+	on the LAN without knowing their DHCP address. Use -tool=discover to
+	list the nodes on the network.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/mdns"
+)
+
+const (
+	API_VERSION      = "v1"
+	MDNS_SERVICE     = "_dezkvm._tcp"
+	DISCOVER_TIMEOUT = 3 * time.Second
+	MDNS_TXT_REFRESH = 30 * time.Second // Interval of checking the TXT records for changes
+)
+
+var (
+	enableMDNS    = flag.Bool("mdns", true, "Advertise this node over mDNS / DNS-SD")
+	mdnsName      = flag.String("mdns-name", "", "Friendly name advertised over mDNS, defaults to DezKVM <hostname>")
+	mdnsInterface = flag.String("mdns-iface", "", "Network interface used for mDNS, all multicast interfaces if empty")
+	mdnsResponder *mdns.Responder
+	mdnsStopChan  chan struct{}
+)
+
+// mdns_config returns the mDNS config of the given host name and the
+// interface selected with -mdns-iface
+func mdns_config(hostName string) (*mdns.Config, error) {
+	config := &mdns.Config{
+		HostName: hostName,
+		Logger:   log.Default(),
+	}
+	if *mdnsInterface != "" {
+		iface, err := net.InterfaceByName(*mdnsInterface)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mDNS interface: %w", err)
+		}
+		config.Interfaces = []*net.Interface{iface}
+	}
+	return config, nil
+}
+
+// mdns_host_name returns the host name used in the mDNS records
+func mdns_host_name() string {
+	hostName, err := os.Hostname()
+	if err != nil || hostName == "" {
+		return "dezkvm"
+	}
+	// Only use the first label if the host name is fully qualified
+	hostName, _, _ = strings.Cut(hostName, ".")
+	return hostName
+}
+
+// mdns_txt_records returns the TXT records describing this node
+func mdns_txt_records(friendlyName string) []string {
+	instanceCount := 0
+	if dezkvmManager != nil {
+		instanceCount = len(dezkvmManager.Instances())
+	}
+	return []string{
+		"node_uuid=" + strings.TrimSpace(nodeUUID),
+		"name=" + friendlyName,
+		"api=" + API_VERSION,
+		fmt.Sprintf("instances=%d", instanceCount),
+		"path=/",
+	}
+}
+
+// start_mdns_advertisement advertises _dezkvm._tcp and _https._tcp,
+// failures are logged and do not stop the daemon
+func start_mdns_advertisement() {
+	if !*enableMDNS {
+		return
+	}
+	hostName := mdns_host_name()
+	friendlyName := *mdnsName
+	if friendlyName == "" {
+		friendlyName = "DezKVM " + hostName
+	}
+	config, err := mdns_config(hostName)
+	if err != nil {
+		log.Println("mDNS advertisement disabled:", err)
+		return
+	}
+	text := mdns_txt_records(friendlyName)
+	mdnsResponder, err = mdns.NewResponder(config, []*mdns.Service{
+		{Instance: friendlyName, Service: MDNS_SERVICE, Port: LISTENING_PORT, Text: text},
+		{Instance: friendlyName, Service: "_https._tcp", Port: LISTENING_PORT, Text: text},
+	})
+	if err != nil {
+		log.Println("mDNS advertisement disabled:", err)
+		return
+	}
+	log.Printf("Advertising %q as %s.local over mDNS\n", friendlyName, hostName)
+	mdnsStopChan = make(chan struct{})
+	go refresh_mdns_txt_records(friendlyName, text, mdnsStopChan)
+}
+
+// refresh_mdns_txt_records announces the TXT records again when they change,
+// e.g. when manual instances are added or removed
+func refresh_mdns_txt_records(friendlyName string, text []string, stop chan struct{}) {
+	ticker := time.NewTicker(MDNS_TXT_REFRESH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		updated := mdns_txt_records(friendlyName)
+		if strings.Join(updated, "\n") != strings.Join(text, "\n") {
+			mdnsResponder.SetText(updated)
+			text = updated
+		}
+	}
+}
+
+// stop_mdns_advertisement sends the mDNS goodbye packets
+func stop_mdns_advertisement() {
+	if mdnsStopChan != nil {
+		close(mdnsStopChan)
+	}
+	if mdnsResponder != nil {
+		mdnsResponder.Close()
+	}
+}
+
+// run_discover_tool lists the dezkvmd nodes found on the LAN
+func run_discover_tool() error {
+	config, err := mdns_config(mdns_host_name())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Browsing %s for %s...\n", MDNS_SERVICE, DISCOVER_TIMEOUT)
+	entries, err := mdns.Browse(config, MDNS_SERVICE, DISCOVER_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No dezkvmd node found.")
+		return nil
+	}
+	for _, e := range entries {
+		addrs := []string{}
+		for _, ip := range e.Addrs {
+			addrs = append(addrs, ip.String())
+		}
+		fmt.Printf("%s\n", e.Instance)
+		fmt.Printf("  Host:      %s:%d (%s)\n", strings.TrimSuffix(e.Host, "."), e.Port, strings.Join(addrs, ", "))
+		fmt.Printf("  Node UUID: %s\n", e.Text["node_uuid"])
+		fmt.Printf("  API:       %s\n", e.Text["api"])
+		fmt.Printf("  Instances: %s\n", e.Text["instances"])
+	}
+	return nil
+}
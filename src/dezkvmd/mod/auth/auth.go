@@ -1,9 +1,18 @@
 package auth
 
 import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"imuslab.com/dezkvm/dezkvmd/mod/db"
 )
@@ -21,40 +30,106 @@ type Options struct {
 type AuthManager struct {
 	db  *db.DB
 	log LogFunc
+
+	sessions   map[string]time.Time // Expiry of the login sessions, keyed by the hash of the session ID
+	sessionsMu sync.Mutex
 }
 
 const (
 	authBucket = "auth"
 	passKey    = "password"
+
+	/* Password hashing */
+	hashPrefix     = "pbkdf2-sha256"
+	hashIterations = 100000
+	hashSaltSize   = 16
+	hashKeySize    = 32
 )
 
+// hashPassword returns the salted PBKDF2 hash of the password in the format
+// pbkdf2-sha256$iterations$salt$hash
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashKeySize)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		hashPrefix,
+		strconv.Itoa(hashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// verifyPassword checks the password against the stored value. Passwords set
+// by older versions are stored in plain text, legacy is true for those.
+func verifyPassword(stored string, password string) (ok bool, legacy bool) {
+	fields := strings.Split(stored, "$")
+	if len(fields) != 4 || fields[0] != hashPrefix {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false, false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false, false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false, false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1, false
+}
+
 // NewAuthManager creates a new AuthManager with an existing DB instance.
 func NewAuthManager(opt Options) (*AuthManager, error) {
 	if opt.DB == nil {
 		return nil, errors.New("DB instance is required")
 	}
-	// Ensure bucket exists
+	// Ensure buckets exist
 	if err := opt.DB.NewBucket(authBucket); err != nil {
 		return nil, err
 	}
-	return &AuthManager{db: opt.DB, log: opt.Log}, nil
+	if err := opt.DB.NewBucket(tokenBucket); err != nil {
+		return nil, err
+	}
+	return &AuthManager{
+		db:       opt.DB,
+		log:      opt.Log,
+		sessions: map[string]time.Time{},
+	}, nil
 }
 
-// SetPassword sets the password (overwrites any existing).
+// SetPassword sets the password (overwrites any existing). Only the hash of
+// the password is stored.
 func (a *AuthManager) SetPassword(password string) error {
-	return a.db.Write(authBucket, passKey, []byte(password))
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return a.db.Write(authBucket, passKey, []byte(hash))
 }
 
 // ChangePassword changes password if oldpassword matches.
 func (a *AuthManager) ChangePassword(oldPassword, newPassword string) error {
-	stored, err := a.db.Read(authBucket, passKey)
+	ok, err := a.ValidatePassword(oldPassword)
 	if err != nil {
 		return err
 	}
-	if stored == nil || string(stored) != oldPassword {
+	if !ok {
 		return errors.New("old password incorrect")
 	}
-	return a.db.Write(authBucket, passKey, []byte(newPassword))
+	return a.SetPassword(newPassword)
 }
 
 // ResetPassword removes the password.
@@ -62,20 +137,35 @@ func (a *AuthManager) ResetPassword() error {
 	return a.db.Delete(authBucket, passKey)
 }
 
-// ValidatePassword checks password from request
+// ValidatePassword checks password from request. A password stored in plain
+// text by an older version is replaced by its hash on success.
 func (a *AuthManager) ValidatePassword(password string) (bool, error) {
 	stored, err := a.db.Read(authBucket, passKey)
 	if err != nil {
 		return false, err
 	}
-	ok := stored != nil && string(stored) == password
+	if stored == nil {
+		return false, nil
+	}
+	ok, legacy := verifyPassword(string(stored), password)
+	if ok && legacy {
+		if err := a.SetPassword(password); err != nil && a.log != nil {
+			a.log("Failed to upgrade stored password to hash: %v", err)
+		}
+	}
 	return ok, nil
 }
 
-// UserIsLoggedIn checks if the user is logged in via cookie.
+// UserIsLoggedIn checks if the user has a login session or the request
+// carries a valid API token. Tokens are not accepted on the admin routes.
 func (a *AuthManager) UserIsLoggedIn(r *http.Request) bool {
-	cookie, err := r.Cookie("dezkvm_auth")
-	return err == nil && cookie.Value == "1"
+	if a.HasSession(r) {
+		return true
+	}
+	if token := bearerToken(r); token != "" && tokenAllowedPath(r.URL.Path) {
+		return a.ValidateAPIToken(token)
+	}
+	return false
 }
 
 // HandleFunc wraps an http.HandlerFunc with auth check.
@@ -91,7 +181,7 @@ func (a *AuthManager) HandleFunc(pattern string, handler http.HandlerFunc, mux *
 	})
 }
 
-// LoginUser sets a session/cookie if password is correct
+// LoginUser starts a session and sets its cookie if password is correct
 func (a *AuthManager) LoginUser(w http.ResponseWriter, r *http.Request) error {
 	var req struct {
 		Password string `json:"password"`
@@ -99,28 +189,32 @@ func (a *AuthManager) LoginUser(w http.ResponseWriter, r *http.Request) error {
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		return err
 	}
-	stored, err := a.db.Read(authBucket, passKey)
+	ok, err := a.ValidatePassword(req.Password)
 	if err != nil {
 		return err
 	}
-	if stored == nil || string(stored) != req.Password {
+	if !ok {
 		return errors.New("unauthorized")
 	}
-	// Set a simple session cookie
+	sessionID, err := a.createSession()
+	if err != nil {
+		return err
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:     "dezkvm_auth",
-		Value:    "1",
+		Name:     sessionCookieName,
+		Value:    sessionID,
 		Path:     "/",
 		HttpOnly: true,
-		MaxAge:   86400,
+		MaxAge:   int(sessionMaxAge.Seconds()),
 	})
 	return nil
 }
 
-// LogoutUser removes the session/cookie for the user.
+// LogoutUser ends the session and removes its cookie.
 func (a *AuthManager) LogoutUser(w http.ResponseWriter, r *http.Request) error {
+	a.deleteSession(r)
 	http.SetCookie(w, &http.Cookie{
-		Name:     "dezkvm_auth",
+		Name:     sessionCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
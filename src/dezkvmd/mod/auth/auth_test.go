@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+)
+
+func TestAdminRoutesRequireSession(t *testing.T) {
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer database.Close()
+	a, err := NewAuthManager(Options{DB: database})
+	if err != nil {
+		t.Fatalf("NewAuthManager: %v", err)
+	}
+	if err := a.SetPassword("secret"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	token, _, err := a.CreateAPIToken("aggregator")
+	if err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	for _, pattern := range []string{"/api/v1/instances", "/api/v1/hid/{uuid}/events", "/api/v1/admin/tokens", "/api/tools/webssh"} {
+		a.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {}, mux)
+	}
+	for path, want := range map[string]int{
+		"/api/v1/instances":      http.StatusOK,
+		"/api/v1/hid/abc/events": http.StatusOK,
+		"/api/v1/admin/tokens":   http.StatusUnauthorized,
+		"/api/tools/webssh":      http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s with token = %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// A session of a login reaches the admin routes, a forged cookie does not
+	login := httptest.NewRecorder()
+	if err := a.LoginUser(login, httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"password":"secret"}`))); err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	session := login.Result().Cookies()[0]
+	for cookie, want := range map[*http.Cookie]int{
+		session:                          http.StatusOK,
+		{Name: session.Name, Value: "1"}: http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/admin/tokens", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("admin route with cookie %q = %d, want %d", cookie.Value, w.Code, want)
+		}
+	}
+
+	// Logging out ends the session
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/logout", nil)
+	r.AddCookie(session)
+	a.LogoutUser(httptest.NewRecorder(), r)
+	if a.HasSession(r) {
+		t.Error("session still valid after logout")
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+/*
+	sessions.go
+
+	Login sessions of the web UI. The session cookie carries a random ID,
+	only its SHA-256 hash is kept in memory together with the expiry time,
+	so a cookie cannot be forged and all sessions end when the daemon
+	restarts.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookieName = "dezkvm_auth"
+	sessionMaxAge     = 24 * time.Hour
+)
+
+// createSession starts a new session and returns its ID
+func (a *AuthManager) createSession() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	for hash, expires := range a.sessions {
+		if now.After(expires) {
+			delete(a.sessions, hash)
+		}
+	}
+	a.sessions[hashToken(id)] = now.Add(sessionMaxAge)
+	return id, nil
+}
+
+// deleteSession ends the session of the request, if any
+func (a *AuthManager) deleteSession(r *http.Request) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return
+	}
+	a.sessionsMu.Lock()
+	delete(a.sessions, hashToken(cookie.Value))
+	a.sessionsMu.Unlock()
+}
+
+// HasSession checks if the request carries the cookie of a valid login
+// session. API tokens do not count.
+func (a *AuthManager) HasSession(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	hash := hashToken(cookie.Value)
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	expires, ok := a.sessions[hash]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(a.sessions, hash)
+		return false
+	}
+	return true
+}
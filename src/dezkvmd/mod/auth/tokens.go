@@ -0,0 +1,171 @@
+package auth
+
+/*
+	tokens.go
+
+	API tokens authenticate other programs, e.g. an aggregating dezkvmd
+	node, with an Authorization: Bearer header instead of the login
+	cookie. Only the SHA-256 hash of a token is stored, the token itself
+	is shown once when it is created.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	tokenBucket = "api_tokens"
+	tokenPrefix = "dzk"
+
+	// Minimum interval between updates of the last used time of a token
+	tokenLastUsedInterval = time.Minute
+)
+
+// tokenDeniedPrefixes are the routes API tokens cannot use. Tokens are for
+// the instance, stream and HID routes of aggregating nodes, a token leaked
+// by one of them must not give admin access, e.g. to create more tokens,
+// import a backup or open SSH sessions.
+var tokenDeniedPrefixes = []string{
+	"/api/v1/admin/",
+	"/api/tools/",
+	"/web.ssh/",
+}
+
+// tokenAllowedPath checks if API tokens are accepted for the request path
+func tokenAllowedPath(path string) bool {
+	for _, prefix := range tokenDeniedPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// APIToken describes an API token
+type APIToken struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash,omitempty"` // SHA-256 of the token, not returned by the API
+	CreatedAt int64  `json:"created_at"`
+	LastUsed  int64  `json:"last_used"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken creates a new API token and returns the token value. The
+// value cannot be retrieved again later.
+func (a *AuthManager) CreateAPIToken(name string) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("token name is required")
+	}
+	idBytes := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	token := tokenPrefix + "_" + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	info := &APIToken{
+		ID:        id,
+		Name:      name,
+		Hash:      hashToken(token),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := a.writeAPIToken(info); err != nil {
+		return "", nil, err
+	}
+	if a.log != nil {
+		a.log("API token %s (%s) created", id, name)
+	}
+	info.Hash = ""
+	return token, info, nil
+}
+
+func (a *AuthManager) writeAPIToken(info *APIToken) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return a.db.Write(tokenBucket, info.ID, data)
+}
+
+// ListAPITokens returns all API tokens without their hashes, sorted by creation time
+func (a *AuthManager) ListAPITokens() ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	err := a.db.List(tokenBucket, func(key, value []byte) error {
+		info := &APIToken{}
+		if err := json.Unmarshal(value, info); err != nil {
+			return nil
+		}
+		info.Hash = ""
+		tokens = append(tokens, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt < tokens[j].CreatedAt
+	})
+	return tokens, nil
+}
+
+// RevokeAPIToken deletes an API token
+func (a *AuthManager) RevokeAPIToken(id string) error {
+	if !a.db.KeyExists(tokenBucket, id) {
+		return errors.New("token not found")
+	}
+	return a.db.Delete(tokenBucket, id)
+}
+
+// ValidateAPIToken checks if the token is a valid API token
+func (a *AuthManager) ValidateAPIToken(token string) bool {
+	// The secret is base64url encoded and may contain underscores
+	fields := strings.SplitN(token, "_", 3)
+	if len(fields) != 3 || fields[0] != tokenPrefix {
+		return false
+	}
+	data, err := a.db.Read(tokenBucket, fields[1])
+	if err != nil || data == nil {
+		return false
+	}
+	info := &APIToken{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(info.Hash)) != 1 {
+		return false
+	}
+	if time.Since(time.Unix(info.LastUsed, 0)) > tokenLastUsedInterval {
+		info.LastUsed = time.Now().Unix()
+		a.writeAPIToken(info)
+	}
+	return true
+}
+
+// bearerToken returns the token of the Authorization header, or an empty string
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,422 @@
+package backup
+
+/*
+	backup.go
+
+	A backup bundle is a gzip compressed tar archive with the daemon config,
+	the instance preferences, optional TLS material and a snapshot of the
+	system database (instance registry, groups and credentials).
+
+	The manifest lists the size and SHA-256 of every file and is signed
+	with a key derived from a passphrase, so a bundle can be verified on a
+	freshly flashed device that does not share any secret with the old one.
+*/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+)
+
+const (
+	FormatVersion = 1         // Version of the bundle format written by this build
+	MaxBundleSize = 256 << 20 // Maximum uncompressed size of a bundle
+
+	manifestFile  = "manifest.json"
+	signatureFile = "manifest.sig"
+	databaseFile  = "sys.db"
+	configDir     = "config"
+	instanceDir   = "instances"
+	tlsDir        = "tls"
+
+	keyIterations = 100000
+	keySaltSize   = 16
+)
+
+// Layout describes where the backed up files are stored on disk
+type Layout struct {
+	ConfigDir   string   // Folder of the daemon config files
+	ConfigFiles []string // Daemon config files relative to ConfigDir, missing files are skipped
+	InstanceDir string   // Folder of the instance preference files
+	TLSFiles    []string // TLS certificate and key files relative to ConfigDir
+	DBPath      string   // Path of the system database
+}
+
+// FileEntry is a file in the bundle
+type FileEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes the content of a bundle
+type Manifest struct {
+	FormatVersion int         `json:"format_version"`
+	CreatedAt     int64       `json:"created_at"`   // Unix timestamp of the export
+	IncludesTLS   bool        `json:"includes_tls"` // The bundle contains the TLS certificate and key
+	Salt          string      `json:"salt"`         // Base64 salt of the signing key
+	Iterations    int         `json:"iterations"`   // PBKDF2 iterations of the signing key
+	Files         []FileEntry `json:"files"`
+}
+
+// Bundle is a verified backup bundle
+type Bundle struct {
+	Manifest *Manifest
+	files    map[string][]byte
+}
+
+// Export writes a signed bundle of the files in layout and a snapshot of the
+// database to w.
+func Export(w io.Writer, layout *Layout, database *db.DB, includeTLS bool, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase is required")
+	}
+	if database == nil {
+		return errors.New("database is required")
+	}
+	files := map[string][]byte{}
+
+	for _, name := range layout.ConfigFiles {
+		data, err := os.ReadFile(filepath.Join(layout.ConfigDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		files[path.Join(configDir, name)] = data
+	}
+
+	entries, err := os.ReadDir(layout.InstanceDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(layout.InstanceDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		files[path.Join(instanceDir, entry.Name())] = data
+	}
+
+	if includeTLS {
+		for _, name := range layout.TLSFiles {
+			data, err := os.ReadFile(filepath.Join(layout.ConfigDir, name))
+			if err != nil {
+				return fmt.Errorf("failed to read TLS file: %w", err)
+			}
+			files[path.Join(tlsDir, name)] = data
+		}
+	}
+
+	snapshot := new(bytes.Buffer)
+	if _, err := database.WriteTo(snapshot); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	files[databaseFile] = snapshot.Bytes()
+
+	manifest := &Manifest{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now().Unix(),
+		IncludesTLS:   includeTLS,
+	}
+	return writeBundle(w, manifest, files, passphrase)
+}
+
+// writeBundle fills in the file list and signature of the manifest and
+// writes the bundle
+func writeBundle(w io.Writer, manifest *Manifest, files map[string][]byte, passphrase string) error {
+	salt := make([]byte, keySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	manifest.Salt = base64.StdEncoding.EncodeToString(salt)
+	manifest.Iterations = keyIterations
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifest.Files = []FileEntry{}
+	for _, name := range names {
+		sum := sha256.Sum256(files[name])
+		manifest.Files = append(manifest.Files, FileEntry{
+			Path:   name,
+			Size:   int64(len(files[name])),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	signature, err := sign(manifestData, passphrase, salt, manifest.Iterations)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte, mode int64) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    mode,
+			Size:    int64(len(data)),
+			ModTime: time.Unix(manifest.CreatedAt, 0),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	if err := write(manifestFile, manifestData, 0644); err != nil {
+		return err
+	}
+	if err := write(signatureFile, []byte(signature), 0644); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := write(name, files[name], 0600); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// sign returns the hex encoded HMAC-SHA256 of data
+func sign(data []byte, passphrase string, salt []byte, iterations int) (string, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// validEntryPath checks that an archive entry is one of the files a bundle
+// can contain, so a crafted bundle cannot write outside of the layout
+func validEntryPath(name string) bool {
+	if name == manifestFile || name == signatureFile || name == databaseFile {
+		return true
+	}
+	dir, file := path.Split(name)
+	switch dir {
+	case configDir + "/", instanceDir + "/", tlsDir + "/":
+		return file != "" && file != "." && file != ".." && !strings.ContainsAny(file, "\\")
+	}
+	return false
+}
+
+// Read reads a bundle and verifies its signature, file hashes, format
+// version and content. Nothing is replaced.
+func Read(r io.Reader, passphrase string) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	limited := &io.LimitedReader{R: gz, N: MaxBundleSize + 1}
+	tr := tar.NewReader(limited)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("invalid bundle: unexpected entry type of %s", header.Name)
+		}
+		if !validEntryPath(header.Name) {
+			return nil, fmt.Errorf("invalid bundle: unexpected file %s", header.Name)
+		}
+		if _, ok := files[header.Name]; ok {
+			return nil, fmt.Errorf("invalid bundle: duplicated file %s", header.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle: %w", err)
+		}
+		if limited.N <= 0 {
+			return nil, errors.New("invalid bundle: bundle is too large")
+		}
+		files[header.Name] = data
+	}
+
+	manifestData, ok := files[manifestFile]
+	if !ok {
+		return nil, errors.New("invalid bundle: manifest not found")
+	}
+	signature, ok := files[signatureFile]
+	if !ok {
+		return nil, errors.New("invalid bundle: signature not found")
+	}
+	delete(files, manifestFile)
+	delete(files, signatureFile)
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(manifest.Salt)
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid manifest: invalid salt")
+	}
+	if manifest.Iterations < 1 || manifest.Iterations > 10*keyIterations {
+		return nil, errors.New("invalid manifest: invalid iteration count")
+	}
+	expected, err := sign(manifestData, passphrase, salt, manifest.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(expected), bytes.TrimSpace(signature)) {
+		return nil, errors.New("signature mismatch, wrong passphrase or modified bundle")
+	}
+
+	// The signature is valid, check the versions before looking at the content
+	if manifest.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("bundle format version %d is newer than the supported version %d, please update dezkvmd", manifest.FormatVersion, FormatVersion)
+	}
+	if manifest.FormatVersion < 1 {
+		return nil, fmt.Errorf("unsupported bundle format version %d", manifest.FormatVersion)
+	}
+
+	if len(manifest.Files) != len(files) {
+		return nil, errors.New("bundle content does not match the manifest")
+	}
+	for _, entry := range manifest.Files {
+		data, ok := files[entry.Path]
+		if !ok {
+			return nil, fmt.Errorf("file %s is missing from the bundle", entry.Path)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, fmt.Errorf("file %s does not match the manifest", entry.Path)
+		}
+	}
+
+	// Validate the content, so a restore never replaces working files with broken ones
+	snapshot, ok := files[databaseFile]
+	if !ok {
+		return nil, errors.New("database snapshot is missing from the bundle")
+	}
+	if err := db.ValidateSnapshot(snapshot); err != nil {
+		return nil, fmt.Errorf("invalid database snapshot: %w", err)
+	}
+	for name, data := range files {
+		if strings.HasSuffix(name, ".json") && !json.Valid(data) {
+			return nil, fmt.Errorf("file %s is not valid JSON", name)
+		}
+	}
+	return &Bundle{Manifest: manifest, files: files}, nil
+}
+
+// Restore replaces the database and files in layout with the content of the
+// bundle. If database is nil, the database file is replaced directly, which
+// requires the daemon to be stopped. Files not in the bundle are kept.
+func (b *Bundle) Restore(layout *Layout, database *db.DB) error {
+	// Map the bundle files to the layout before replacing anything
+	targets := map[string]string{}
+	for _, entry := range b.Manifest.Files {
+		if entry.Path == databaseFile {
+			continue
+		}
+		target := layout.targetPath(entry.Path)
+		if target == "" {
+			return fmt.Errorf("file %s is not part of this installation", entry.Path)
+		}
+		targets[entry.Path] = target
+	}
+
+	// The database is the only part that can be in use, restore it first so
+	// nothing is replaced if it fails
+	snapshot := b.files[databaseFile]
+	if database != nil {
+		if err := database.Restore(snapshot); err != nil {
+			return fmt.Errorf("failed to restore database: %w", err)
+		}
+	} else {
+		if err := db.RestoreFile(layout.DBPath, snapshot); err != nil {
+			return fmt.Errorf("failed to restore database: %w", err)
+		}
+	}
+
+	for name, target := range targets {
+		var perm os.FileMode = 0644
+		if strings.HasPrefix(name, tlsDir+"/") {
+			perm = 0600
+		}
+		if err := writeFileAtomic(target, b.files[name], perm); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// targetPath returns the path on disk of a bundle file, or an empty string
+// if the file is not part of the layout
+func (l *Layout) targetPath(name string) string {
+	dir, file := path.Split(name)
+	switch dir {
+	case configDir + "/":
+		for _, f := range l.ConfigFiles {
+			if f == file {
+				return filepath.Join(l.ConfigDir, file)
+			}
+		}
+	case tlsDir + "/":
+		for _, f := range l.TLSFiles {
+			if f == file {
+				return filepath.Join(l.ConfigDir, file)
+			}
+		}
+	case instanceDir + "/":
+		if filepath.Ext(file) == ".json" {
+			return filepath.Join(l.InstanceDir, file)
+		}
+	}
+	return ""
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path
+func writeFileAtomic(target string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmpPath := target + ".restore"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+)
+
+// newTestLayout creates a layout in a temporary folder
+func newTestLayout(t *testing.T) *Layout {
+	t.Helper()
+	root := t.TempDir()
+	layout := &Layout{
+		ConfigDir:   root,
+		ConfigFiles: []string{"usbkvm.json", "uuid.cfg", "scan_filter.json"},
+		InstanceDir: filepath.Join(root, "instances"),
+		TLSFiles:    []string{"cert.pem", "key.pem"},
+		DBPath:      filepath.Join(root, "sys.db"),
+	}
+	if err := os.MkdirAll(layout.InstanceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exportTestBundle exports a bundle of a populated layout
+func exportTestBundle(t *testing.T, includeTLS bool) []byte {
+	t.Helper()
+	layout := newTestLayout(t)
+	writeTestFile(t, filepath.Join(layout.ConfigDir, "usbkvm.json"), `{"USBKVMBaudrate":115200}`)
+	writeTestFile(t, filepath.Join(layout.ConfigDir, "uuid.cfg"), "node-uuid")
+	writeTestFile(t, filepath.Join(layout.ConfigDir, "cert.pem"), "certificate")
+	writeTestFile(t, filepath.Join(layout.ConfigDir, "key.pem"), "private key")
+	writeTestFile(t, filepath.Join(layout.InstanceDir, "rack1-a.json"), `{"enable_mouse_jiggler":true}`)
+
+	database, err := db.NewDB(layout.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Write("instance_registry", "rack1-a", []byte(`{"display_name":"Rack 1"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Export(buf, layout, database, includeTLS, "correct horse"); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportAndRestore(t *testing.T) {
+	data := exportTestBundle(t, true)
+	bundle, err := Read(bytes.NewReader(data), "correct horse")
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bundle.Manifest.IncludesTLS || bundle.Manifest.FormatVersion != FormatVersion {
+		t.Errorf("unexpected manifest %+v", bundle.Manifest)
+	}
+
+	// Restore into an empty installation
+	target := newTestLayout(t)
+	if err := bundle.Restore(target, nil); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	for name, want := range map[string]string{
+		"uuid.cfg": "node-uuid",
+		"key.pem":  "private key",
+		filepath.Join("instances", "rack1-a.json"): `{"enable_mouse_jiggler":true}`,
+	} {
+		got, err := os.ReadFile(filepath.Join(target.ConfigDir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("restored %s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target.ConfigDir, "scan_filter.json")); !os.IsNotExist(err) {
+		t.Errorf("file missing from the source was created: %v", err)
+	}
+
+	database, err := db.NewDB(target.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	value, err := database.Read("instance_registry", "rack1-a")
+	if err != nil || string(value) != `{"display_name":"Rack 1"}` {
+		t.Errorf("restored registry entry = %q, %v", value, err)
+	}
+}
+
+func TestRestoreIntoOpenDatabase(t *testing.T) {
+	bundle, err := Read(bytes.NewReader(exportTestBundle(t, false)), "correct horse")
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	target := newTestLayout(t)
+	database, err := db.NewDB(target.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Write("auth", "password", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bundle.Restore(target, database); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if value, _ := database.Read("auth", "password"); value != nil {
+		t.Errorf("database was not replaced, password = %q", value)
+	}
+	if value, _ := database.Read("instance_registry", "rack1-a"); value == nil {
+		t.Error("restored registry entry not found in the open database")
+	}
+	if _, err := os.Stat(filepath.Join(target.ConfigDir, "key.pem")); !os.IsNotExist(err) {
+		t.Errorf("TLS key restored from a bundle without TLS: %v", err)
+	}
+}
+
+func TestReadRejectsInvalidBundles(t *testing.T) {
+	data := exportTestBundle(t, false)
+	if _, err := Read(bytes.NewReader(data), "wrong passphrase"); err == nil {
+		t.Error("bundle accepted with a wrong passphrase")
+	}
+
+	// Modify a file without updating the manifest
+	tampered := rewriteBundle(t, data, func(name string, content []byte) []byte {
+		if name == "config/uuid.cfg" {
+			return []byte("other-node")
+		}
+		return content
+	})
+	if _, err := Read(bytes.NewReader(tampered), "correct horse"); err == nil || !strings.Contains(err.Error(), "manifest") {
+		t.Errorf("tampered bundle: err = %v", err)
+	}
+
+	// A correctly signed bundle of a newer format must not be restored
+	newer := new(bytes.Buffer)
+	err := writeBundle(newer, &Manifest{FormatVersion: FormatVersion + 1}, map[string][]byte{"config/uuid.cfg": []byte("x")}, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(newer, "correct horse"); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer bundle: err = %v", err)
+	}
+}
+
+// rewriteBundle copies a bundle and replaces the file contents using modify
+func rewriteBundle(t *testing.T, data []byte, modify func(name string, content []byte) []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	out := new(bytes.Buffer)
+	gzw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gzw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		content = modify(header.Name, content)
+		header.Size = int64(len(content))
+		tw.WriteHeader(header)
+		tw.Write(content)
+	}
+	tw.Close()
+	gzw.Close()
+	return out.Bytes()
+}
@@ -1,16 +1,21 @@
 package db
 
 import (
+	"errors"
+	"io"
+	"os"
 	"sync"
+	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 )
 
 // DB wraps a BoltDB instance and provides bucket-based key-value operations.
 // It includes a RWMutex for safe concurrent access.
 type DB struct {
-	db *bolt.DB
-	mu sync.RWMutex
+	db   *bolt.DB
+	path string
+	mu   sync.RWMutex
 }
 
 // NewDB opens a new BoltDB database at the given path.
@@ -19,7 +24,7 @@ func NewDB(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	return &DB{db: db, path: path}, nil
 }
 
 // NewBucket creates a new bucket if it doesn't exist.
@@ -126,6 +131,90 @@ func (d *DB) List(bucketID string, walker func(key, value []byte) error) error {
 	})
 }
 
+// WriteTo writes a consistent snapshot of the whole database to w.
+func (d *DB) WriteTo(w io.Writer) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var n int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// ValidateSnapshot checks that data is a readable BoltDB database.
+func ValidateSnapshot(data []byte) error {
+	tmp, err := os.CreateTemp("", "dezkvm-db-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	snapshot, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	return snapshot.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return nil
+		})
+	})
+}
+
+// Restore replaces the whole database with the given snapshot. The database
+// stays usable, pending operations wait until the snapshot is in place.
+func (d *DB) Restore(data []byte) error {
+	if err := ValidateSnapshot(data); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := writeSnapshotFile(d.path, data); err != nil {
+		return err
+	}
+	if err := d.db.Close(); err != nil {
+		return err
+	}
+	db, err := bolt.Open(d.path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	d.db = db
+	return nil
+}
+
+// RestoreFile replaces the database file at path with the snapshot. It fails
+// if the database is opened by another process, e.g. a running daemon.
+func RestoreFile(path string, data []byte) error {
+	if err := ValidateSnapshot(data); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		current, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return errors.New("database is in use by another process")
+		}
+		current.Close()
+	}
+	return writeSnapshotFile(path, data)
+}
+
+// writeSnapshotFile replaces the database file at path with the snapshot
+func writeSnapshotFile(path string, data []byte) error {
+	tmpPath := path + ".restore"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 // Close closes the underlying BoltDB database.
 func (d *DB) Close() error {
 	return d.db.Close()
@@ -0,0 +1,367 @@
+package dezkvm
+
+/*
+	broadcast.go
+
+	A broadcast session takes one stream of HID commands over a WebSocket
+	and fans it out to the HID controllers of several instances. Each
+	target has its own queue, so a slow or offline target does not delay
+	the others. Targets can be excluded and included again while the
+	session is running.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+// Size of the command queue of each broadcast target
+const broadcastQueueSize = 10
+
+// HID absolute mouse positions range from 0 to 4095 on both axes
+const hidAbsoluteRange = 4096
+
+var broadcastUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// broadcastMessage is a message sent by the broadcast client. It is either a
+// HID command, or a control message if Control is set.
+type broadcastMessage struct {
+	kvmhid.HIDCommand
+	Control string `json:"control,omitempty"` // "exclude", "include" or "targets"
+	Target  string `json:"target,omitempty"`  // UUID of the target to exclude or include
+}
+
+// BroadcastTargetResult is the result of a command on a single target
+type BroadcastTargetResult struct {
+	UUID   string `json:"uuid"`
+	Status string `json:"status"` // "ok", "error" or "excluded"
+	Error  string `json:"error,omitempty"`
+}
+
+// BroadcastTargetState is the state of a target in a broadcast session
+type BroadcastTargetState struct {
+	UUID     string `json:"uuid"`
+	Excluded bool   `json:"excluded"`
+	Running  bool   `json:"running"`
+}
+
+// broadcastReply is sent to the broadcast client
+type broadcastReply struct {
+	Type    string                  `json:"type"`             // "ack", "error" or "targets"
+	Rid     string                  `json:"rid,omitempty"`    // Reply ID of the acknowledged command
+	Status  string                  `json:"status,omitempty"` // "ok" if the command succeeded on all included targets
+	Results []BroadcastTargetResult `json:"results,omitempty"`
+	Targets []BroadcastTargetState  `json:"targets,omitempty"`
+}
+
+type broadcastJob struct {
+	cmd *kvmhid.HIDCommand
+	ack *broadcastAck // nil if the client did not request an ACK
+}
+
+// broadcastAck collects the results of a command until all targets replied
+type broadcastAck struct {
+	mu        sync.Mutex
+	rid       string
+	remaining int
+	results   []BroadcastTargetResult
+}
+
+type broadcastTarget struct {
+	uuid     string
+	instance *UsbKvmDeviceInstance
+	excluded atomic.Bool
+	queue    chan *broadcastJob
+	attached *kvmhid.Controller // Controller the session is attached to, keys are released on detach
+}
+
+type broadcastSession struct {
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	reference usbcapture.CaptureResolution // Resolution the client positions the mouse in
+	targets   []*broadcastTarget
+}
+
+// HandleBroadcastHIDEvents serves a broadcast session to the given instances.
+// Absolute mouse positions are relative to the reference resolution and are
+// scaled to the resolution of each target. If reference is nil, the current
+// resolution of the first target is used.
+func (d *DezkVM) HandleBroadcastHIDEvents(w http.ResponseWriter, r *http.Request, targetUUIDs []string, reference *usbcapture.CaptureResolution) {
+	targets := []*broadcastTarget{}
+	seen := map[string]bool{}
+	for _, uuid := range targetUUIDs {
+		uuid = strings.TrimSpace(uuid)
+		if uuid == "" || seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		instance, err := d.GetInstanceByUUID(uuid)
+		if err != nil {
+			http.Error(w, "Instance with specified UUID not found: "+uuid, http.StatusNotFound)
+			return
+		}
+		targets = append(targets, &broadcastTarget{
+			uuid:     uuid,
+			instance: instance,
+			queue:    make(chan *broadcastJob, broadcastQueueSize),
+		})
+	}
+	if len(targets) == 0 {
+		http.Error(w, "No broadcast targets specified", http.StatusBadRequest)
+		return
+	}
+	if reference == nil {
+		res := targets[0].instance.CurrentResolution()
+		reference = &res
+	}
+
+	conn, err := broadcastUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade to websocket:", err)
+		return
+	}
+	defer conn.Close()
+
+	session := &broadcastSession{
+		conn:      conn,
+		reference: *reference,
+		targets:   targets,
+	}
+	for _, target := range targets {
+		if controller := target.instance.hidController(); controller != nil {
+			controller.AttachClient()
+			target.attached = controller
+		}
+	}
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *broadcastTarget) {
+			defer wg.Done()
+			session.runTarget(target)
+		}(target)
+	}
+	session.sendTargets()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if !strings.Contains(err.Error(), "close") {
+				log.Println("Error reading message:", err)
+			}
+			break
+		}
+
+		var msg broadcastMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Println("Error parsing message:", err)
+			continue
+		}
+		if msg.Control != "" {
+			session.handleControl(&msg)
+			continue
+		}
+		session.dispatch(&msg.HIDCommand)
+	}
+
+	// WebSocket closed, drain the queues and wait for the workers to finish
+	for _, target := range targets {
+		close(target.queue)
+	}
+	wg.Wait()
+	for _, target := range targets {
+		if target.attached != nil {
+			target.attached.DetachClient()
+		}
+	}
+}
+
+// handleControl excludes or includes a target, or reports the target states
+func (s *broadcastSession) handleControl(msg *broadcastMessage) {
+	switch msg.Control {
+	case "exclude", "include":
+		target := s.getTarget(msg.Target)
+		if target == nil {
+			s.writeReply(&broadcastReply{
+				Type:    "error",
+				Results: []BroadcastTargetResult{{UUID: msg.Target, Status: "error", Error: "target not in this session"}},
+			})
+			return
+		}
+		target.excluded.Store(msg.Control == "exclude")
+	case "targets":
+	default:
+		s.writeReply(&broadcastReply{
+			Type:    "error",
+			Results: []BroadcastTargetResult{{Status: "error", Error: "unknown control: " + msg.Control}},
+		})
+		return
+	}
+	s.sendTargets()
+}
+
+func (s *broadcastSession) getTarget(uuid string) *broadcastTarget {
+	for _, target := range s.targets {
+		if target.uuid == uuid {
+			return target
+		}
+	}
+	return nil
+}
+
+// sendTargets sends the current state of all targets to the client
+func (s *broadcastSession) sendTargets() {
+	states := []BroadcastTargetState{}
+	for _, target := range s.targets {
+		states = append(states, BroadcastTargetState{
+			UUID:     target.uuid,
+			Excluded: target.excluded.Load(),
+			Running:  target.instance.IsRunning(),
+		})
+	}
+	s.writeReply(&broadcastReply{Type: "targets", Targets: states})
+}
+
+// dispatch queues the command on all targets that are not excluded
+func (s *broadcastSession) dispatch(cmd *kvmhid.HIDCommand) {
+	var ack *broadcastAck
+	if cmd.Rid != "" {
+		ack = &broadcastAck{rid: cmd.Rid, remaining: len(s.targets)}
+	}
+	for _, target := range s.targets {
+		if target.excluded.Load() {
+			if ack != nil {
+				s.complete(ack, BroadcastTargetResult{UUID: target.uuid, Status: "excluded"})
+			}
+			continue
+		}
+		job := &broadcastJob{cmd: cmd, ack: ack}
+		// Commands with rid must not be dropped, they expect an ACK
+		if ack != nil {
+			target.queue <- job
+			continue
+		}
+		// Fire-and-forget: if the queue is full, drop the oldest command first
+		select {
+		case target.queue <- job:
+		default:
+			select {
+			case dropped := <-target.queue:
+				if dropped.ack != nil {
+					s.complete(dropped.ack, BroadcastTargetResult{UUID: target.uuid, Status: "error", Error: "command dropped"})
+				}
+			default:
+			}
+			target.queue <- job
+		}
+	}
+}
+
+// runTarget sends the queued commands to the HID controller of a target
+func (s *broadcastSession) runTarget(target *broadcastTarget) {
+	for job := range target.queue {
+		result := BroadcastTargetResult{UUID: target.uuid, Status: "ok"}
+		if target.excluded.Load() {
+			// Excluded after the command was queued
+			result.Status = "excluded"
+		} else if err := s.send(target, job.cmd); err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+		}
+
+		if job.ack != nil {
+			s.complete(job.ack, result)
+		} else if result.Status == "error" {
+			s.writeReply(&broadcastReply{Type: "error", Results: []BroadcastTargetResult{result}})
+		}
+	}
+}
+
+// send scales the command to the target resolution and sends it
+func (s *broadcastSession) send(target *broadcastTarget, cmd *kvmhid.HIDCommand) error {
+	controller := target.instance.hidController()
+	if controller == nil {
+		return errors.New("HID controller is not available")
+	}
+	scaled := *cmd
+	if scaled.Event == kvmhid.EventTypeMouseMove && (scaled.MouseAbsX != 0 || scaled.MouseAbsY != 0) {
+		scaled.MouseAbsX, scaled.MouseAbsY = scaleAbsolutePosition(scaled.MouseAbsX, scaled.MouseAbsY,
+			s.reference, target.instance.CurrentResolution())
+	}
+	controller.RecordActivity()
+	_, err := controller.ConstructAndSendCmd(&scaled)
+	return err
+}
+
+// complete records the result of a target and sends the ACK once all
+// targets have replied
+func (s *broadcastSession) complete(ack *broadcastAck, result BroadcastTargetResult) {
+	ack.mu.Lock()
+	ack.results = append(ack.results, result)
+	ack.remaining--
+	done := ack.remaining == 0
+	ack.mu.Unlock()
+	if !done {
+		return
+	}
+
+	status := "ok"
+	for _, r := range ack.results {
+		if r.Status == "error" {
+			status = "error"
+		}
+	}
+	s.writeReply(&broadcastReply{Type: "ack", Rid: ack.rid, Status: status, Results: ack.results})
+}
+
+func (s *broadcastSession) writeReply(reply *broadcastReply) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteJSON(reply); err != nil {
+		log.Println("Error writing broadcast reply:", err)
+	}
+}
+
+// scaleAbsolutePosition maps an absolute mouse position from the reference
+// resolution to the target resolution. Like the scale to fit mode of the web
+// UI, the reference frame is fitted into the target frame keeping its aspect
+// ratio, so the position is the same on targets with the same aspect ratio.
+func scaleAbsolutePosition(x int, y int, reference usbcapture.CaptureResolution, target usbcapture.CaptureResolution) (int, int) {
+	if reference.Width <= 0 || reference.Height <= 0 || target.Width <= 0 || target.Height <= 0 {
+		return x, y
+	}
+	refWidth := float64(reference.Width)
+	refHeight := float64(reference.Height)
+	targetWidth := float64(target.Width)
+	targetHeight := float64(target.Height)
+
+	scale := math.Min(targetWidth/refWidth, targetHeight/refHeight)
+	fittedWidth := refWidth * scale
+	fittedHeight := refHeight * scale
+	offsetX := (targetWidth - fittedWidth) / 2
+	offsetY := (targetHeight - fittedHeight) / 2
+
+	px := offsetX + float64(x)/hidAbsoluteRange*fittedWidth
+	py := offsetY + float64(y)/hidAbsoluteRange*fittedHeight
+	return clampAbsolute(px / targetWidth * hidAbsoluteRange), clampAbsolute(py / targetHeight * hidAbsoluteRange)
+}
+
+func clampAbsolute(v float64) int {
+	return int(math.Max(0, math.Min(hidAbsoluteRange-1, math.Round(v))))
+}
@@ -0,0 +1,107 @@
+package dezkvm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+func TestScaleAbsolutePosition(t *testing.T) {
+	hd := usbcapture.CaptureResolution{Width: 1920, Height: 1080}
+	tests := []struct {
+		name   string
+		x, y   int
+		target usbcapture.CaptureResolution
+		wantX  int
+		wantY  int
+	}{
+		{"same aspect ratio", 1024, 3000, usbcapture.CaptureResolution{Width: 1280, Height: 720}, 1024, 3000},
+		{"unknown target", 1024, 3000, usbcapture.CaptureResolution{}, 1024, 3000},
+		// 16:9 fitted into 4:3 leaves a bar of 60 pixels above and below
+		{"letterboxed top", 0, 0, usbcapture.CaptureResolution{Width: 640, Height: 480}, 0, 512},
+		{"letterboxed center", 2048, 2048, usbcapture.CaptureResolution{Width: 640, Height: 480}, 2048, 2048},
+		{"letterboxed bottom", 4095, 4095, usbcapture.CaptureResolution{Width: 640, Height: 480}, 4095, 3583},
+	}
+	for _, tt := range tests {
+		x, y := scaleAbsolutePosition(tt.x, tt.y, hd, tt.target)
+		if x != tt.wantX || y != tt.wantY {
+			t.Errorf("%s: got (%d, %d), want (%d, %d)", tt.name, x, y, tt.wantX, tt.wantY)
+		}
+	}
+}
+
+func TestBroadcastHIDEvents(t *testing.T) {
+	d, devices := newSimulatedManager(t, 2)
+	instances := d.Instances()
+	uuids := []string{instances[0].UUID(), instances[1].UUID()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.HandleBroadcastHIDEvents(w, r, uuids, nil)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var reply broadcastReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "targets" || len(reply.Targets) != 2 {
+		t.Fatalf("initial targets reply = %+v, %v", reply, err)
+	}
+
+	// JavaScript keycode 65 is the A key, HID usage 0x04
+	conn.WriteJSON(kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyPress, Keycode: 65, Rid: "1"})
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if reply.Type != "ack" || reply.Rid != "1" || reply.Status != "ok" || len(reply.Results) != 2 {
+		t.Fatalf("unexpected ACK %+v", reply)
+	}
+	for i, dev := range devices {
+		if keys := dev.CH9329.State().Keys; keys[0] != 0x04 {
+			t.Errorf("target %d keys = %v, want A pressed", i, keys)
+		}
+	}
+
+	// Exclude the second target, the release must only reach the first one
+	conn.WriteJSON(broadcastMessage{Control: "exclude", Target: uuids[1]})
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "targets" || !reply.Targets[1].Excluded {
+		t.Fatalf("exclude reply = %+v, %v", reply, err)
+	}
+	conn.WriteJSON(kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyRelease, Keycode: 65, Rid: "2"})
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	statuses := map[string]string{}
+	for _, result := range reply.Results {
+		statuses[result.UUID] = result.Status
+	}
+	if statuses[uuids[0]] != "ok" || statuses[uuids[1]] != "excluded" {
+		t.Errorf("unexpected results %+v", reply.Results)
+	}
+	if keys := devices[0].CH9329.State().Keys; keys[0] != 0x00 {
+		t.Errorf("included target keys = %v, want released", keys)
+	}
+	if keys := devices[1].CH9329.State().Keys; keys[0] != 0x04 {
+		t.Errorf("excluded target keys = %v, want A still pressed", keys)
+	}
+
+	// A failing target is reported without affecting the others
+	conn.WriteJSON(broadcastMessage{Control: "include", Target: uuids[1]})
+	conn.ReadJSON(&reply)
+	conn.WriteJSON(kvmhid.HIDCommand{Event: kvmhid.EventTypeMousePress, MouseButton: 9, Rid: "3"})
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if reply.Status != "error" || len(reply.Results) != 2 || reply.Results[0].Error == "" {
+		t.Errorf("unexpected ACK for invalid command %+v", reply)
+	}
+}
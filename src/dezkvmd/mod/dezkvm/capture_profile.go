@@ -0,0 +1,212 @@
+package dezkvm
+
+/*
+	capture_profile.go
+
+	Capture profiles store the last used capture settings of an instance in
+	the system database, so a resolution, frame rate or audio quality change
+	survives reconnects and restarts of the daemon.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+const captureProfileBucket = "capture_profiles"
+
+// Audio quality of the audio stream, see usbcapture.AudioStreamingHandler
+const (
+	AudioQualityLow      = "low"
+	AudioQualityStandard = "standard"
+	AudioQualityHigh     = "high"
+)
+
+// CaptureProfile is the saved capture settings of an instance
+type CaptureProfile struct {
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FPS          int    `json:"fps"`
+	PixelFormat  string `json:"pixel_format"`  // FourCC of the pixel format, e.g. MJPG
+	AudioQuality string `json:"audio_quality"` // low, standard or high
+	UpdatedAt    int64  `json:"updated_at"`    // Unix timestamp of the last update
+}
+
+// IsValidAudioQuality checks if quality is a supported audio quality
+func IsValidAudioQuality(quality string) bool {
+	switch quality {
+	case AudioQualityLow, AudioQualityStandard, AudioQualityHigh:
+		return true
+	}
+	return false
+}
+
+// resolution returns the video settings of the profile
+func (p *CaptureProfile) resolution() usbcapture.CaptureResolution {
+	return usbcapture.CaptureResolution{
+		Width:  p.Width,
+		Height: p.Height,
+		FPS:    p.FPS,
+		Format: p.PixelFormat,
+	}
+}
+
+// LoadCaptureProfile returns the saved capture profile of an instance.
+// Returns nil (no error) if no profile has been saved or the database is not
+// available.
+func (d *DezkVM) LoadCaptureProfile(uuid string) (*CaptureProfile, error) {
+	if d.db == nil || uuid == "" {
+		return nil, nil
+	}
+	data, err := d.db.Read(captureProfileBucket, uuid)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	profile := &CaptureProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, err
+	}
+	if profile.Width <= 0 || profile.Height <= 0 || profile.FPS <= 0 {
+		return nil, errors.New("invalid capture profile")
+	}
+	if !IsValidAudioQuality(profile.AudioQuality) {
+		profile.AudioQuality = AudioQualityStandard
+	}
+	return profile, nil
+}
+
+// SaveCaptureProfile saves the current capture settings of an instance
+func (d *DezkVM) SaveCaptureProfile(instance *UsbKvmDeviceInstance) error {
+	if d.db == nil {
+		return errors.New("capture profiles are not available")
+	}
+	uuid := instance.UUID()
+	if uuid == "" {
+		return errors.New("instance has no UUID")
+	}
+	profile := instance.CaptureProfile()
+	profile.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return d.db.Write(captureProfileBucket, uuid, data)
+}
+
+// renameCaptureProfile moves the capture profile of oldID to newID, an
+// existing profile of newID is kept
+func (d *DezkVM) renameCaptureProfile(oldID string, newID string) error {
+	if d.db == nil || oldID == newID {
+		return nil
+	}
+	data, err := d.db.Read(captureProfileBucket, oldID)
+	if err != nil || data == nil {
+		return err
+	}
+	existing, err := d.db.Read(captureProfileBucket, newID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := d.db.Write(captureProfileBucket, newID, data); err != nil {
+			return err
+		}
+	}
+	return d.db.Delete(captureProfileBucket, oldID)
+}
+
+// saveCaptureProfile saves the capture profile of an instance if the
+// database is available, failures are only logged
+func (i *UsbKvmDeviceInstance) saveCaptureProfile() {
+	if i.parent == nil || i.parent.db == nil {
+		return
+	}
+	if err := i.parent.SaveCaptureProfile(i); err != nil {
+		log.Printf("Warning: failed to save capture profile for %s: %v\n", i.UUID(), err)
+	}
+}
+
+// CaptureProfile returns the current capture settings of the instance
+func (i *UsbKvmDeviceInstance) CaptureProfile() CaptureProfile {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	profile := CaptureProfile{
+		Width:        i.videoResoltuionConfig.Width,
+		Height:       i.videoResoltuionConfig.Height,
+		FPS:          i.videoResoltuionConfig.FPS,
+		PixelFormat:  i.videoResoltuionConfig.Format,
+		AudioQuality: i.audioQuality,
+	}
+	if !IsValidAudioQuality(profile.AudioQuality) {
+		profile.AudioQuality = AudioQualityStandard
+	}
+	return profile
+}
+
+// AudioQuality returns the audio quality used if a client does not request one
+func (i *UsbKvmDeviceInstance) AudioQuality() string {
+	return i.CaptureProfile().AudioQuality
+}
+
+// SetAudioQuality changes the default audio quality and saves the capture profile
+func (i *UsbKvmDeviceInstance) SetAudioQuality(quality string) error {
+	if !IsValidAudioQuality(quality) {
+		return errors.New("invalid audio quality")
+	}
+	i.stateMu.Lock()
+	i.audioQuality = quality
+	i.stateMu.Unlock()
+	i.saveCaptureProfile()
+	return nil
+}
+
+// applyCaptureProfile loads the saved capture profile of the instance, if any,
+// as the resolution and audio quality to start the capture with
+func (i *UsbKvmDeviceInstance) applyCaptureProfile(uuid string) {
+	if i.parent == nil {
+		return
+	}
+	profile, err := i.parent.LoadCaptureProfile(uuid)
+	if err != nil {
+		log.Printf("Warning: failed to load capture profile for %s: %v\n", uuid, err)
+		return
+	}
+	if profile == nil {
+		return
+	}
+	resolution := profile.resolution()
+	i.setResolution(&resolution)
+	i.stateMu.Lock()
+	i.audioQuality = profile.AudioQuality
+	i.stateMu.Unlock()
+}
+
+// setResolution stores the resolution as current resolution of the instance
+// and in the instance config
+func (i *UsbKvmDeviceInstance) setResolution(resolution *usbcapture.CaptureResolution) {
+	copied := *resolution
+	i.stateMu.Lock()
+	i.videoResoltuionConfig = &copied
+	i.Config.CaptureVideoResolutionWidth = copied.Width
+	i.Config.CaptureeVideoResolutionHeight = copied.Height
+	i.Config.CaptureeVideoFPS = copied.FPS
+	i.stateMu.Unlock()
+}
+
+// supportedResolution returns the current resolution if the capture device
+// supports it, or the closest mode the device supports otherwise
+func (i *UsbKvmDeviceInstance) supportedResolution(device *usbcapture.Instance) usbcapture.CaptureResolution {
+	want := i.CurrentResolution()
+	closest, exact, found := usbcapture.ClosestResolution(device.SupportedResolutions, &want)
+	if !found || exact {
+		return want
+	}
+	log.Printf("Capture mode %dx%d@%d %s is not supported by %s, falling back to %dx%d@%d %s\n",
+		want.Width, want.Height, want.FPS, want.Format, device.Config.VideoDeviceName,
+		closest.Width, closest.Height, closest.FPS, closest.Format)
+	return closest
+}
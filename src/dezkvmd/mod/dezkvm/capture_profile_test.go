@@ -0,0 +1,84 @@
+package dezkvm
+
+import (
+	"testing"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+func TestClosestResolution(t *testing.T) {
+	formats := []usbcapture.FormatInfo{
+		{Format: "YUYV", Sizes: []usbcapture.SizeInfo{{Width: 1366, Height: 768, FPS: []int{60}}}},
+		{Format: "MJPG", Sizes: []usbcapture.SizeInfo{
+			{Width: 640, Height: 480, FPS: []int{30, 25}},
+			{Width: 1280, Height: 720, FPS: []int{30, 25, 10}},
+			{Width: 1920, Height: 1080, FPS: []int{30, 25}},
+		}},
+	}
+	tests := []struct {
+		want      usbcapture.CaptureResolution
+		closest   usbcapture.CaptureResolution
+		wantExact bool
+	}{
+		{usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 25, Format: "MJPG"}, usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 25, Format: "MJPG"}, true},
+		{usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 25}, usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 25, Format: "MJPG"}, true},
+		// YUYV cannot be streamed, so the closest MJPEG mode is used
+		{usbcapture.CaptureResolution{Width: 1366, Height: 768, FPS: 60, Format: "YUYV"}, usbcapture.CaptureResolution{Width: 1280, Height: 720, FPS: 30, Format: "MJPG"}, false},
+		{usbcapture.CaptureResolution{Width: 1280, Height: 720, FPS: 15, Format: "MJPG"}, usbcapture.CaptureResolution{Width: 1280, Height: 720, FPS: 10, Format: "MJPG"}, false},
+		{usbcapture.CaptureResolution{Width: 3840, Height: 2160, FPS: 20}, usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 25, Format: "MJPG"}, false},
+	}
+	for _, tt := range tests {
+		closest, exact, found := usbcapture.ClosestResolution(formats, &tt.want)
+		if !found || closest != tt.closest || exact != tt.wantExact {
+			t.Errorf("ClosestResolution(%+v) = %+v, %v, %v, want %+v, %v", tt.want, closest, exact, found, tt.closest, tt.wantExact)
+		}
+	}
+}
+
+func TestCaptureProfilePersistsAcrossRestart(t *testing.T) {
+	d, _ := newSimulatedManagerWithDB(t, 1)
+	instance := d.Instances()[0]
+	uuid := instance.UUID()
+
+	err := instance.ChangeResolution(&usbcapture.CaptureResolution{Width: 1920, Height: 1080, FPS: 30})
+	if err != nil {
+		t.Fatalf("ChangeResolution: %v", err)
+	}
+	if err := instance.SetAudioQuality(AudioQualityHigh); err != nil {
+		t.Fatalf("SetAudioQuality: %v", err)
+	}
+
+	// The saved profile is applied when the instance starts again
+	instance.Stop()
+	instance.setResolution(&usbcapture.CaptureResolution{Width: 640, Height: 480, FPS: 10})
+	instance.stateMu.Lock()
+	instance.audioQuality = ""
+	instance.stateMu.Unlock()
+	if err := instance.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	profile := instance.CaptureProfile()
+	if profile.Width != 1920 || profile.Height != 1080 || profile.FPS != 30 || profile.AudioQuality != AudioQualityHigh {
+		t.Errorf("profile after restart = %+v", profile)
+	}
+	if got := instance.Config.CaptureVideoResolutionWidth; got != 1920 {
+		t.Errorf("instance config width = %d, want 1920", got)
+	}
+
+	// A saved mode the device does not support falls back to the closest one
+	err = d.db.Write(captureProfileBucket, uuid, []byte(`{"width":1366,"height":768,"fps":60,"pixel_format":"MJPG","audio_quality":"low"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Stop()
+	if err := instance.Start(); err != nil {
+		t.Fatalf("Start with unsupported profile: %v", err)
+	}
+	resolution := instance.CurrentResolution()
+	if resolution.Width != 1280 || resolution.Height != 720 || resolution.FPS != 30 {
+		t.Errorf("fallback resolution = %+v, want 1280x720@30", resolution)
+	}
+	if instance.AudioQuality() != AudioQualityLow {
+		t.Errorf("audio quality = %s, want low", instance.AudioQuality())
+	}
+}
@@ -0,0 +1,88 @@
+package dezkvm
+
+/*
+	chipconfig.go
+
+	Admin access to the CH9329 configuration of an instance, e.g. to give
+	the HID device the VID/PID and USB strings of a generic keyboard. The
+	chip applies a new configuration after the DezKVM is power cycled.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+// ChipConfigResult is the reply of a chip configuration update
+type ChipConfigResult struct {
+	Config        *kvmhid.ChipConfig `json:"config"`
+	RestartNeeded bool               `json:"restart_needed"` // The DezKVM must be power cycled to apply the changes
+	Warning       string             `json:"warning,omitempty"`
+}
+
+// HandleGetChipConfig returns the decoded CH9329 configuration of an instance
+func (d *DezkVM) HandleGetChipConfig(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+	cfg, err := usbKVM.ReadChipConfig()
+	if err != nil {
+		http.Error(w, "Failed to read chip configuration: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// HandleSetChipConfig updates the CH9329 configuration of an instance. The
+// JSON body only needs the fields to change, the others keep the values
+// read from the chip.
+func (d *DezkVM) HandleSetChipConfig(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+	cfg, err := usbKVM.ReadChipConfig()
+	if err != nil {
+		http.Error(w, "Failed to read chip configuration: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	oldBaudrate, oldAddress := cfg.Baudrate, cfg.Address
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		http.Error(w, "Invalid chip configuration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := usbKVM.WriteChipConfig(cfg); err != nil {
+		http.Error(w, "Failed to write chip configuration: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	result := ChipConfigResult{Config: cfg, RestartNeeded: true}
+	if cfg.Baudrate != oldBaudrate {
+		result.Warning = "The baudrate of the instance must be changed to match the new chip baudrate"
+	} else if cfg.Address != oldAddress && cfg.Address != 0x00 {
+		result.Warning = "The chip only answers commands sent to its address, DezKVM addresses the chip as 0x00"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,173 @@
+package dezkvm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+	"imuslab.com/dezkvm/dezkvmd/mod/simulator"
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+// newSimulatedManager creates a manager with count running instances backed
+// by the simulator, in the same order as the returned devices
+func newSimulatedManager(t *testing.T, count int) (*DezkVM, []*simulator.Device) {
+	t.Helper()
+	return newSimulatedManagerWithOptions(t, count, &RuntimeOptions{
+		ConfigFolderPath: t.TempDir(),
+	})
+}
+
+// newSimulatedManagerWithDB is newSimulatedManager with a system database,
+// which is closed after the manager has shut down
+func newSimulatedManagerWithDB(t *testing.T, count int) (*DezkVM, []*simulator.Device) {
+	t.Helper()
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run in reverse, so this one runs after the manager is closed
+	t.Cleanup(func() { database.Close() })
+	return newSimulatedManagerWithOptions(t, count, &RuntimeOptions{
+		ConfigFolderPath: t.TempDir(),
+		DB:               database,
+	})
+}
+
+// newSimulatedManagerWithOptions is newSimulatedManager with custom runtime options
+func newSimulatedManagerWithOptions(t *testing.T, count int, option *RuntimeOptions) (*DezkVM, []*simulator.Device) {
+	t.Helper()
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo terminals not available")
+	}
+	d := NewKvmHostInstance(option)
+	t.Cleanup(func() { d.Close() })
+
+	devices := []*simulator.Device{}
+	for i := 0; i < count; i++ {
+		dev, err := simulator.NewDevice(&simulator.Options{Index: i})
+		if err != nil {
+			t.Fatalf("NewDevice: %v", err)
+		}
+		t.Cleanup(func() { dev.Close() })
+		devices = append(devices, dev)
+
+		err = d.AddUsbKvmDevice(&UsbKvmDeviceOption{
+			USBKVMDevicePath:              dev.HIDDevicePath(),
+			AuxMCUDevicePath:              dev.AuxMCUDevicePath(),
+			VideoCaptureDevicePath:        fmt.Sprintf("simulator:%d:video", i),
+			AudioCaptureDevicePath:        fmt.Sprintf("simulator:%d:audio", i),
+			CaptureVideoResolutionWidth:   1280,
+			CaptureeVideoResolutionHeight: 720,
+			CaptureeVideoFPS:              25,
+			USBKVMBaudrate:                115200,
+			AuxMCUBaudrate:                115200,
+			VideoSource:                   dev.Video,
+			AudioSource:                   dev.Audio,
+		})
+		if err != nil {
+			t.Fatalf("AddUsbKvmDevice: %v", err)
+		}
+	}
+	if err := d.StartAllUsbKvmDevices(); err != nil {
+		t.Fatalf("StartAllUsbKvmDevices: %v", err)
+	}
+	for _, instance := range d.Instances() {
+		if !instance.IsRunning() {
+			t.Fatalf("simulated instance is not running: %v", instance.LastError())
+		}
+	}
+	return d, devices
+}
+
+func TestConcurrentStreamReconnectAndResolutionChange(t *testing.T) {
+	d, _ := newSimulatedManager(t, 1)
+	instance := d.Instances()[0]
+	uuid := instance.UUID()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.HandleAudioStreams(w, r, uuid)
+	}))
+	defer server.Close()
+	audioURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/?quality=low"
+
+	var wg sync.WaitGroup
+	run := func(n int, fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	run(4, func(i int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(ctx)
+		d.HandleVideoStreams(httptest.NewRecorder(), req, uuid)
+	})
+	run(4, func(i int) {
+		conn, _, err := websocket.DefaultDialer.Dial(audioURL, nil)
+		if err != nil {
+			// The instance may be reconnecting
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		conn.ReadMessage()
+	})
+	run(2, func(i int) {
+		d.HandleReconnectCapture(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), uuid)
+	})
+	run(4, func(i int) {
+		resolution := &usbcapture.CaptureResolution{Width: 640, Height: 480, FPS: 25}
+		if i%2 == 1 {
+			resolution = &usbcapture.CaptureResolution{Width: 1280, Height: 720, FPS: 25}
+		}
+		d.HandleChangeResolution(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), uuid, resolution)
+	})
+	run(20, func(i int) {
+		// Preferences change the scroll settings of the HID controller in use
+		body := fmt.Sprintf(`{"scroll_sensitivity": %d, "invert_scroll_direction": %t}`, 1+i%3, i%2 == 0)
+		d.HandleSetPreferences(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body)), uuid, true)
+	})
+	run(20, func(i int) {
+		if controller := instance.hidController(); controller != nil {
+			controller.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeMouseScroll, MouseScroll: 1 - 2*(i%2)})
+		}
+		time.Sleep(10 * time.Millisecond)
+	})
+	run(20, func(i int) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		d.HandleListInstances(httptest.NewRecorder(), r, "")
+		d.HandleGetCurrentResolution(httptest.NewRecorder(), r, uuid)
+		d.HandleScreenshot(httptest.NewRecorder(), r, uuid)
+		time.Sleep(20 * time.Millisecond)
+	})
+	wg.Wait()
+
+	// The instance must still serve frames at the last requested resolution
+	if !instance.IsRunning() {
+		t.Fatalf("instance stopped: %v", instance.LastError())
+	}
+	if res := instance.CurrentResolution(); res.Width != 1280 || res.Height != 720 {
+		t.Errorf("current resolution = %dx%d, want 1280x720", res.Width, res.Height)
+	}
+	rec := httptest.NewRecorder()
+	d.HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, "/", nil), uuid)
+	if rec.Code != http.StatusOK {
+		t.Errorf("screenshot after concurrent calls returned %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -17,9 +17,10 @@ package dezkvm
 
 import (
 	"fmt"
+	"io"
 	"time"
 
-	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux/serial"
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
 )
 
 type DeviceCatergory string
@@ -48,7 +49,7 @@ const (
 // It also returns the full UUID string so callers can reuse it without reopening.
 // Uses direct serial I/O (no bufio.Reader) to avoid Close() hanging on Linux CDC ACM devices.
 func sniffDeviceType(devicePath string) (DeviceCatergory, DeviceType, string, error) {
-	port, err := serial.OpenPort(&serial.Config{
+	port, err := serial.Open(&serial.Config{
 		Name:        devicePath,
 		Baud:        115200,
 		ReadTimeout: time.Second * 2,
@@ -66,7 +67,7 @@ func sniffDeviceType(devicePath string) (DeviceCatergory, DeviceType, string, er
 
 	// Read response: <Length> 0x62 <UUID String>
 	header := make([]byte, 2)
-	_, err = port.ReadFull(header)
+	_, err = io.ReadFull(port, header)
 	if err != nil {
 		return "", "", "", fmt.Errorf("failed to read response header from %s: %w", devicePath, err)
 	}
@@ -81,7 +82,7 @@ func sniffDeviceType(devicePath string) (DeviceCatergory, DeviceType, string, er
 	}
 
 	uuidBuf := make([]byte, length-1)
-	_, err = port.ReadFull(uuidBuf)
+	_, err = io.ReadFull(port, uuidBuf)
 	if err != nil {
 		return "", "", "", fmt.Errorf("failed to read UUID from %s: %w", devicePath, err)
 	}
@@ -3,28 +3,65 @@ package dezkvm
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
 )
 
+const (
+	startRetryMinInterval = 5 * time.Second  // Delay before the first background retry of a failed instance
+	startRetryMaxInterval = 60 * time.Second // Upper bound of the retry backoff
+)
+
 // NewKvmHostInstance creates a new instance of DezkVM, which can manage multiple USB KVM devices.
 func NewKvmHostInstance(option *RuntimeOptions) *DezkVM {
 	confFolder := option.ConfigFolderPath
 	if confFolder == "" {
 		confFolder = "./config/instances"
 	}
+	identityFile := option.IdentityFilePath
+	if identityFile == "" {
+		identityFile = filepath.Join(filepath.Dir(confFolder), "instance_ids.json")
+	}
+	manualFile := option.ManualFilePath
+	if manualFile == "" {
+		manualFile = filepath.Join(filepath.Dir(confFolder), "manual_instances.json")
+	}
 	// Create the config folder if it doesn't exist
 	if err := os.MkdirAll(confFolder, 0750); err != nil {
 		log.Printf("Warning: failed to create config folder %s: %v\n", confFolder, err)
 	}
+	// Create the instance registry, group, capture profile, macro and script buckets if a database is provided
+	if option.DB != nil {
+		if err := option.DB.NewBucket(registryBucket); err != nil {
+			log.Printf("Warning: failed to create instance registry: %v\n", err)
+		}
+		if err := option.DB.NewBucket(groupBucket); err != nil {
+			log.Printf("Warning: failed to create instance groups: %v\n", err)
+		}
+		if err := option.DB.NewBucket(captureProfileBucket); err != nil {
+			log.Printf("Warning: failed to create capture profiles: %v\n", err)
+		}
+		if err := option.DB.NewBucket(macroBucket); err != nil {
+			log.Printf("Warning: failed to create HID macros: %v\n", err)
+		}
+		if err := option.DB.NewBucket(scriptBucket); err != nil {
+			log.Printf("Warning: failed to create scripts: %v\n", err)
+		}
+	}
 	return &DezkVM{
-		UsbKvmInstance:   []*UsbKvmDeviceInstance{},
-		ConfigFolderPath: confFolder,
-		occupiedUUIDs:    make(map[string]bool),
-		option:           option,
+		instances:              []*UsbKvmDeviceInstance{},
+		ConfigFolderPath:       confFolder,
+		IdentityFilePath:       identityFile,
+		ManualInstanceFilePath: manualFile,
+		option:                 option,
+		db:                     option.DB,
+		closeChan:              make(chan struct{}),
 	}
 }
 
@@ -83,6 +120,8 @@ func (d *DezkVM) AddUsbKvmDevice(config *UsbKvmDeviceOption) error {
 		AudioDeviceName: config.AudioCaptureDevicePath,
 		AudioConfig:     audioCaptureCfg,
 		VideoConfig:     videoConfig,
+		VideoSource:     config.VideoSource,
+		AudioSource:     config.AudioSource,
 	}
 
 	// video resolution config
@@ -104,43 +143,144 @@ func (d *DezkVM) AddUsbKvmDevice(config *UsbKvmDeviceOption) error {
 		usbCaptureDevice: nil,
 		parent:           d,
 	}
-	d.UsbKvmInstance = append(d.UsbKvmInstance, instance)
+	d.instancesMu.Lock()
+	d.instances = append(d.instances, instance)
+	d.instancesMu.Unlock()
 	return nil
 }
 
+// Instances returns a snapshot of all managed instances. The slice can be
+// iterated safely while instances are added or removed.
+func (d *DezkVM) Instances() []*UsbKvmDeviceInstance {
+	d.instancesMu.RLock()
+	defer d.instancesMu.RUnlock()
+	return append([]*UsbKvmDeviceInstance{}, d.instances...)
+}
+
 // RemoveUsbKvmDevice removes a USB KVM device instance by its UUID.
 func (d *DezkVM) RemoveUsbKvmDevice(uuid string) error {
-	for i, dev := range d.UsbKvmInstance {
+	d.instancesMu.Lock()
+	defer d.instancesMu.Unlock()
+	for i, dev := range d.instances {
 		if dev.UUID() == uuid {
-			d.UsbKvmInstance = append(d.UsbKvmInstance[:i], d.UsbKvmInstance[i+1:]...)
+			d.instances = append(d.instances[:i], d.instances[i+1:]...)
 			return nil
 		}
 	}
 	return errors.New("target USB KVM device not found")
 }
 
+// StartAllUsbKvmDevices starts all USB KVM device instances concurrently.
+// A failing instance does not prevent the others from starting; it is kept in
+// the error state and retried in the background until it starts or the manager
+// is closed. The returned error joins the errors of all failed instances.
 func (d *DezkVM) StartAllUsbKvmDevices() error {
-	for _, instance := range d.UsbKvmInstance {
-		err := instance.Start()
-		if err != nil {
-			return err
-		}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, instance := range d.Instances() {
+		wg.Add(1)
+		go func(instance *UsbKvmDeviceInstance) {
+			defer wg.Done()
+			err := d.StartUsbKvmDevice(instance)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("%s: %w", instance.Config.USBKVMDevicePath, err))
+			mu.Unlock()
+		}(instance)
 	}
-	return nil
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// StartUsbKvmDevice starts a single instance. If it fails, the instance is
+// retried in the background and the error of the first attempt is returned.
+func (d *DezkVM) StartUsbKvmDevice(instance *UsbKvmDeviceInstance) error {
+	err := instance.Start()
+	if err != nil {
+		log.Printf("Failed to start USB KVM device %s: %v\n", instance.Config.USBKVMDevicePath, err)
+		d.scheduleStartRetry(instance)
+	}
+	return err
+}
+
+// scheduleStartRetry keeps retrying to start a failed instance in the background
+// with exponential backoff, until it succeeds or the manager is closed.
+func (d *DezkVM) scheduleStartRetry(instance *UsbKvmDeviceInstance) {
+	d.retryWg.Add(1)
+	go func() {
+		defer d.retryWg.Done()
+		delay := startRetryMinInterval
+		for {
+			instance.stateMu.Lock()
+			instance.nextRetryTime = time.Now().Add(delay)
+			instance.stateMu.Unlock()
+
+			select {
+			case <-d.closeChan:
+				return
+			case <-time.After(delay):
+			}
+
+			if instance.Status() != InstanceStatusError {
+				// Started or stopped by someone else in the meantime
+				return
+			}
+
+			err := instance.Start()
+			if err == nil {
+				log.Printf("USB KVM device %s started after retry\n", instance.Config.USBKVMDevicePath)
+				return
+			}
+			log.Printf("Retry failed for USB KVM device %s: %v\n", instance.Config.USBKVMDevicePath, err)
+
+			delay *= 2
+			if delay > startRetryMaxInterval {
+				delay = startRetryMaxInterval
+			}
+		}
+	}()
 }
 
 func (d *DezkVM) StopAllUsbKvmDevices() error {
-	for _, instance := range d.UsbKvmInstance {
+	var errs []error
+	for _, instance := range d.Instances() {
 		err := instance.Stop()
 		if err != nil {
-			return err
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// getInstanceByConfig returns the instance created from the given device option.
+func (d *DezkVM) getInstanceByConfig(config *UsbKvmDeviceOption) *UsbKvmDeviceInstance {
+	for _, instance := range d.Instances() {
+		if instance.Config == config {
+			return instance
 		}
 	}
 	return nil
 }
 
+// removeInstance removes the given instance from the manager. Unlike
+// RemoveUsbKvmDevice, this also works for instances that never started
+// and therefore have no UUID.
+func (d *DezkVM) removeInstance(target *UsbKvmDeviceInstance) {
+	d.instancesMu.Lock()
+	defer d.instancesMu.Unlock()
+	for i, instance := range d.instances {
+		if instance == target {
+			d.instances = append(d.instances[:i], d.instances[i+1:]...)
+			return
+		}
+	}
+}
+
 func (d *DezkVM) GetInstanceByUUID(uuid string) (*UsbKvmDeviceInstance, error) {
-	for _, instance := range d.UsbKvmInstance {
+	for _, instance := range d.Instances() {
 		if instance.UUID() == uuid {
 			return instance, nil
 		}
@@ -149,6 +289,10 @@ func (d *DezkVM) GetInstanceByUUID(uuid string) (*UsbKvmDeviceInstance, error) {
 }
 
 func (d *DezkVM) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closeChan)
+	})
+	d.retryWg.Wait()
 	return d.StopAllUsbKvmDevices()
 }
 
@@ -159,18 +303,16 @@ func (d *DezkVM) preferencesFilePath(uuid string) string {
 
 // SavePreferences writes the instance preferences to disk as pretty-printed JSON.
 func (d *DezkVM) SavePreferences(instance *UsbKvmDeviceInstance) error {
-	if instance.Preferences == nil {
-		return nil
-	}
-	data, err := json.MarshalIndent(instance.Preferences, "", "  ")
+	prefs := instance.GetPreferences()
+	data, err := json.MarshalIndent(prefs, "", "  ")
 	if err != nil {
 		return err
 	}
 	return os.WriteFile(d.preferencesFilePath(instance.UUID()), data, 0644)
 }
 
-// LoadPreferences reads preferences from disk for a given UUID.
-// Returns nil (no error) if the file does not exist.
+// LoadPreferences reads preferences from disk for a given UUID and migrates
+// files of older schema versions. Returns nil (no error) if the file does not exist.
 func (d *DezkVM) LoadPreferences(uuid string) (*UsbKvmPreferences, error) {
 	path := d.preferencesFilePath(uuid)
 	data, err := os.ReadFile(path)
@@ -180,9 +322,19 @@ func (d *DezkVM) LoadPreferences(uuid string) (*UsbKvmPreferences, error) {
 		}
 		return nil, err
 	}
-	var prefs UsbKvmPreferences
-	if err := json.Unmarshal(data, &prefs); err != nil {
+	prefs, migrated, err := parsePreferences(data)
+	if err != nil {
 		return nil, err
 	}
-	return &prefs, nil
+	if migrated {
+		// Write back the migrated file, so it matches the current schema
+		migratedData, err := json.MarshalIndent(prefs, "", "  ")
+		if err == nil {
+			err = os.WriteFile(path, migratedData, 0644)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to save migrated preferences for %s: %v\n", uuid, err)
+		}
+	}
+	return prefs, nil
 }
@@ -0,0 +1,143 @@
+package dezkvm
+
+/*
+	groups.go
+
+	Instance groups are named lists of instance UUIDs stored in the system
+	database. They are used to select the targets of a broadcast session,
+	e.g. all machines of a rack that should receive the same input.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const groupBucket = "instance_groups"
+
+// InstanceGroup is a named set of instances
+type InstanceGroup struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`    // UUIDs of the member instances
+	UpdatedAt   int64    `json:"updated_at"` // Unix timestamp of the last update
+}
+
+// normalize trims whitespace and removes empty or duplicated members.
+func (g *InstanceGroup) normalize() {
+	g.Description = strings.TrimSpace(g.Description)
+	members := []string{}
+	seen := map[string]bool{}
+	for _, m := range g.Members {
+		m = strings.TrimSpace(m)
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		members = append(members, m)
+	}
+	g.Members = members
+}
+
+// GetGroup returns the group with the given name.
+func (d *DezkVM) GetGroup(name string) (*InstanceGroup, error) {
+	if d.db == nil {
+		return nil, errors.New("instance groups are not available")
+	}
+	data, err := d.db.Read(groupBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("group not found")
+	}
+	group := &InstanceGroup{}
+	if err := json.Unmarshal(data, group); err != nil {
+		return nil, err
+	}
+	group.Name = name
+	return group, nil
+}
+
+// SetGroup creates or replaces a group. Members do not need to be online.
+func (d *DezkVM) SetGroup(group *InstanceGroup) error {
+	if d.db == nil {
+		return errors.New("instance groups are not available")
+	}
+	if !IsValidInstanceID(group.Name) {
+		return errors.New("invalid group name")
+	}
+	group.normalize()
+	for _, member := range group.Members {
+		if !IsValidInstanceID(member) {
+			return errors.New("invalid member instance ID: " + member)
+		}
+	}
+	group.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return d.db.Write(groupBucket, group.Name, data)
+}
+
+// DeleteGroup removes a group. The member instances are not affected.
+func (d *DezkVM) DeleteGroup(name string) error {
+	if d.db == nil {
+		return errors.New("instance groups are not available")
+	}
+	return d.db.Delete(groupBucket, name)
+}
+
+// ListGroups returns all groups sorted by name.
+func (d *DezkVM) ListGroups() ([]*InstanceGroup, error) {
+	if d.db == nil {
+		return nil, errors.New("instance groups are not available")
+	}
+	result := []*InstanceGroup{}
+	err := d.db.List(groupBucket, func(key, value []byte) error {
+		group := &InstanceGroup{}
+		if err := json.Unmarshal(value, group); err != nil {
+			return nil // Skip corrupted entries
+		}
+		group.Name = string(key)
+		result = append(result, group)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// renameGroupMember replaces oldID with newID in all groups.
+func (d *DezkVM) renameGroupMember(oldID string, newID string) error {
+	if d.db == nil || oldID == newID {
+		return nil
+	}
+	groups, err := d.ListGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		changed := false
+		for i, member := range group.Members {
+			if member == oldID {
+				group.Members[i] = newID
+				changed = true
+			}
+		}
+		if changed {
+			if err := d.SetGroup(group); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
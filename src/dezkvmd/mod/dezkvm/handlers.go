@@ -2,47 +2,98 @@ package dezkvm
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"sort"
 	"time"
 
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
 	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
 )
 
-func (d *DezkVM) HandleVideoStreams(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+// getRunningInstance looks up the instance with the given UUID and writes an
+// error response if it does not exist or has not started successfully.
+func (d *DezkVM) getRunningInstance(w http.ResponseWriter, instanceUuid string) (*UsbKvmDeviceInstance, bool) {
 	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
 	if err != nil {
 		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !targetInstance.IsRunning() {
+		msg := "Instance is not running"
+		if lastErr := targetInstance.LastError(); lastErr != nil {
+			msg += ": " + lastErr.Error()
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return targetInstance, true
+}
+
+// getRunningCaptureDevice looks up the capture device of a running instance and
+// writes an error response if it is not available, e.g. during a reconnect.
+func (d *DezkVM) getRunningCaptureDevice(w http.ResponseWriter, instanceUuid string) (*usbcapture.Instance, bool) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return nil, false
+	}
+	usbCaptureDevice := targetInstance.captureDevice()
+	if usbCaptureDevice == nil {
+		http.Error(w, "Capture device is not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return usbCaptureDevice, true
+}
+
+func (d *DezkVM) HandleVideoStreams(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	usbCaptureDevice, ok := d.getRunningCaptureDevice(w, instanceUuid)
+	if !ok {
 		return
 	}
 	// Serve the video stream
-	targetInstance.usbCaptureDevice.ServeVideoStream(w, r)
+	usbCaptureDevice.ServeVideoStream(w, r)
 }
 
 func (d *DezkVM) HandleAudioStreams(w http.ResponseWriter, r *http.Request, instanceUuid string) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	usbCaptureDevice, ok := d.getRunningCaptureDevice(w, instanceUuid)
+	if !ok {
 		return
 	}
-	pcmDevicePath := targetInstance.captureConfig.AudioDeviceName
-	targetInstance.usbCaptureDevice.AudioStreamingHandler(w, r, pcmDevicePath)
+	// Use the saved audio quality if the client does not request one
+	if r.URL.Query().Get("quality") == "" {
+		if targetInstance, err := d.GetInstanceByUUID(instanceUuid); err == nil {
+			query := r.URL.Query()
+			query.Set("quality", targetInstance.AudioQuality())
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	pcmDevicePath := usbCaptureDevice.Config.AudioDeviceName
+	usbCaptureDevice.AudioStreamingHandler(w, r, pcmDevicePath)
 }
 
 func (d *DezkVM) HandleHIDEvents(w http.ResponseWriter, r *http.Request, instanceUuid string) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
 		return
 	}
+	auxMCU := targetInstance.auxController()
 	// Set status LED to blinking pattern while connection is active
-	if targetInstance.auxMCUController != nil {
-		_ = targetInstance.auxMCUController.SetStatusLED(kvmaux.StatusLEDOn)
+	if auxMCU != nil {
+		_ = auxMCU.SetStatusLED(kvmaux.StatusLEDOn)
 	}
-	targetInstance.usbKVMController.HIDWebSocketHandler(w, r)
-	if targetInstance.auxMCUController != nil {
+	usbKVM.HIDWebSocketHandler(w, r)
+	if auxMCU != nil {
 		// Set status LED back to solid on after connection ends
-		_ = targetInstance.auxMCUController.SetStatusLED(kvmaux.StatusLEDOff)
+		_ = auxMCU.SetStatusLED(kvmaux.StatusLEDOff)
 	}
 }
 
@@ -50,19 +101,20 @@ func (d *DezkVM) HandleHIDEvents(w http.ResponseWriter, r *http.Request, instanc
 // there is only two state for the USB mass storage side, KVM side or Remote side.
 // isKvmSide = true means switch to KVM side, otherwise switch to Remote side.
 func (d *DezkVM) HandleMassStorageSideSwitch(w http.ResponseWriter, r *http.Request, instanceUuid string, isKvmSide bool) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
 		return
 	}
-	if targetInstance.auxMCUController == nil {
+	auxMCU := targetInstance.auxController()
+	if auxMCU == nil {
 		http.Error(w, "Auxiliary MCU controller not initialized or missing", http.StatusInternalServerError)
 		return
 	}
+	var err error
 	if isKvmSide {
-		err = targetInstance.auxMCUController.SwitchUSBToKVM()
+		err = auxMCU.SwitchUSBToKVM()
 	} else {
-		err = targetInstance.auxMCUController.SwitchUSBToRemote()
+		err = auxMCU.SwitchUSBToRemote()
 	}
 	if err != nil {
 		http.Error(w, "Failed to switch USB mass storage side: "+err.Error(), http.StatusInternalServerError)
@@ -72,38 +124,112 @@ func (d *DezkVM) HandleMassStorageSideSwitch(w http.ResponseWriter, r *http.Requ
 	w.Write([]byte("OK"))
 }
 
-func (d *DezkVM) HandleListInstances(w http.ResponseWriter, r *http.Request) {
+// HandleListInstances lists all instances together with their registry metadata.
+// If tagFilter is not empty, only instances with the given tag are returned.
+func (d *DezkVM) HandleListInstances(w http.ResponseWriter, r *http.Request, tagFilter string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.ListInstanceInfo(tagFilter))
+}
+
+// ListInstanceInfo returns the status and registry metadata of all
+// instances, filtered by tag if tagFilter is not empty. Like the registry,
+// the list is sorted by sort order and display name.
+func (d *DezkVM) ListInstanceInfo(tagFilter string) []map[string]interface{} {
 	instances := []map[string]interface{}{}
-	for _, instance := range d.UsbKvmInstance {
-		instances = append(instances, map[string]interface{}{
-			"uuid":                    instance.UUID(),
+	sortKeys := []InstanceMetadata{}
+	for _, instance := range d.Instances() {
+		uuid := instance.UUID()
+		var metadata *InstanceMetadata
+		if uuid != "" && d.db != nil {
+			meta, err := d.GetInstanceMetadata(uuid)
+			if err == nil {
+				metadata = meta
+			}
+		}
+		if tagFilter != "" && (metadata == nil || !metadata.HasTag(tagFilter)) {
+			continue
+		}
+		streamInfo := ""
+		if usbCaptureDevice := instance.captureDevice(); usbCaptureDevice != nil {
+			streamInfo = usbCaptureDevice.GetStreamInfo()
+		}
+		// GetUSBMassStorageSide handles a nil controller
+		massStorageSide := instance.auxController().GetUSBMassStorageSide()
+		resolution := instance.CurrentResolution()
+		lastError := ""
+		if err := instance.LastError(); err != nil {
+			lastError = err.Error()
+		}
+		instance.stateMu.RLock()
+		retryCount := instance.retryCount
+		nextRetryTime := instance.nextRetryTime
+		instance.stateMu.RUnlock()
+
+		instanceInfo := map[string]interface{}{
+			"uuid":                    uuid,
+			"status":                  instance.Status(),
+			"last_error":              lastError,
+			"retry_count":             retryCount,
 			"video_capture_dev":       instance.Config.VideoCaptureDevicePath,
 			"audio_capture_dev":       instance.Config.AudioCaptureDevicePath,
-			"video_resolution_width":  instance.Config.CaptureVideoResolutionWidth,
-			"video_resolution_height": instance.Config.CaptureeVideoResolutionHeight,
-			"video_framerate":         instance.Config.CaptureeVideoFPS,
+			"video_resolution_width":  resolution.Width,
+			"video_resolution_height": resolution.Height,
+			"video_framerate":         resolution.FPS,
 			"audio_sample_rate":       instance.Config.CaptureAudioSampleRate,
 			"audio_channels":          instance.Config.CaptureAudioChannels,
-			"stream_info":             instance.usbCaptureDevice.GetStreamInfo(),
+			"stream_info":             streamInfo,
 			"usb_kvm_device":          instance.Config.USBKVMDevicePath,
+			"hid_backend":             instance.Config.HIDBackend,
 			"aux_mcu_device":          instance.Config.AuxMCUDevicePath,
-			"usb_mass_storage_side":   instance.auxMCUController.GetUSBMassStorageSide(),
-		})
+			"usb_mass_storage_side":   massStorageSide,
+		}
+		if metadata != nil {
+			instanceInfo["display_name"] = metadata.DisplayName
+			instanceInfo["description"] = metadata.Description
+			instanceInfo["location"] = metadata.Location
+			instanceInfo["asset_tag"] = metadata.AssetTag
+			instanceInfo["target_os"] = metadata.TargetOS
+			instanceInfo["tags"] = metadata.Tags
+			instanceInfo["sort_order"] = metadata.SortOrder
+			instanceInfo["notes"] = metadata.Notes
+		}
+		if instance.Status() == InstanceStatusError && !nextRetryTime.IsZero() {
+			instanceInfo["next_retry"] = nextRetryTime.Unix()
+		}
+		instances = append(instances, instanceInfo)
+		sortKey := InstanceMetadata{}
+		if metadata != nil {
+			sortKey = *metadata
+		}
+		sortKeys = append(sortKeys, sortKey)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(instances)
+	order := make([]int, len(instances))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ka, kb := sortKeys[order[a]], sortKeys[order[b]]
+		if ka.SortOrder != kb.SortOrder {
+			return ka.SortOrder < kb.SortOrder
+		}
+		return ka.DisplayName < kb.DisplayName
+	})
+	sorted := make([]map[string]interface{}, 0, len(instances))
+	for _, i := range order {
+		sorted = append(sorted, instances[i])
+	}
+	return sorted
 }
 
 // HandleGetSupportedResolutions returns the supported resolutions for a given USB KVM device instance
 func (d *DezkVM) HandleGetSupportedResolutions(w http.ResponseWriter, r *http.Request, instanceUuid string) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	usbCaptureDevice, ok := d.getRunningCaptureDevice(w, instanceUuid)
+	if !ok {
 		return
 	}
 
 	// Get the supported resolutions from the capture device
-	supportedResolutions := targetInstance.usbCaptureDevice.GetSupportedResolutions()
+	supportedResolutions := usbCaptureDevice.GetSupportedResolutions()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(supportedResolutions)
@@ -118,11 +244,7 @@ func (d *DezkVM) HandleGetCurrentResolution(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Get the current resolution from the instance config
-	currentResolution := targetInstance.videoResoltuionConfig
-	if currentResolution == nil {
-		http.Error(w, "Current resolution not set", http.StatusInternalServerError)
-		return
-	}
+	currentResolution := targetInstance.CurrentResolution()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(currentResolution)
@@ -130,25 +252,18 @@ func (d *DezkVM) HandleGetCurrentResolution(w http.ResponseWriter, r *http.Reque
 
 // HandleChangeResolution handles the request to change the capture device resolution
 func (d *DezkVM) HandleChangeResolution(w http.ResponseWriter, r *http.Request, instanceUuid string, newResolution *usbcapture.CaptureResolution) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
 		return
 	}
 
-	// Change the resolution
-	err = targetInstance.usbCaptureDevice.ChangeResolution(newResolution)
+	// Change the resolution, this also updates the instance config
+	err := targetInstance.ChangeResolution(newResolution)
 	if err != nil {
 		http.Error(w, "Failed to change resolution: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Update the instance config
-	targetInstance.videoResoltuionConfig = newResolution
-	targetInstance.Config.CaptureVideoResolutionWidth = newResolution.Width
-	targetInstance.Config.CaptureeVideoResolutionHeight = newResolution.Height
-	targetInstance.Config.CaptureeVideoFPS = newResolution.FPS
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -157,32 +272,62 @@ func (d *DezkVM) HandleChangeResolution(w http.ResponseWriter, r *http.Request,
 	})
 }
 
-// HandleScreenshot handles the request to capture a screenshot from the video device
-func (d *DezkVM) HandleScreenshot(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+// HandleGetCaptureProfile returns the current capture settings of an instance
+func (d *DezkVM) HandleGetCaptureProfile(w http.ResponseWriter, r *http.Request, instanceUuid string) {
 	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
 	if err != nil {
 		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetInstance.CaptureProfile())
+}
+
+// HandleSetAudioQuality sets the audio quality used when a client does not
+// request one, the change is saved in the capture profile
+func (d *DezkVM) HandleSetAudioQuality(w http.ResponseWriter, r *http.Request, instanceUuid string, quality string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if err := targetInstance.SetAudioQuality(quality); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetInstance.CaptureProfile())
+}
+
+// HandleScreenshot handles the request to capture a screenshot from the video device
+func (d *DezkVM) HandleScreenshot(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	usbCaptureDevice, ok := d.getRunningCaptureDevice(w, instanceUuid)
+	if !ok {
+		return
+	}
 
 	// Serve the screenshot
-	targetInstance.usbCaptureDevice.ServeScreenshot(w, r)
+	usbCaptureDevice.ServeScreenshot(w, r)
 }
 
 // HandleMouseJiggler toggles the mouse jiggler for a given instance.
 // POST enables or disables based on the JSON body {"enabled": true/false}.
 // GET returns the current state.
 func (d *DezkVM) HandleMouseJiggler(w http.ResponseWriter, r *http.Request, instanceUuid string) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
-	if err != nil {
-		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
 		return
 	}
 
 	if r.Method == http.MethodGet {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{
-			"enabled": targetInstance.usbKVMController.IsMouseJigglerEnabled(),
+			"enabled": usbKVM.IsMouseJigglerEnabled(),
 		})
 		return
 	}
@@ -195,17 +340,10 @@ func (d *DezkVM) HandleMouseJiggler(w http.ResponseWriter, r *http.Request, inst
 		return
 	}
 
-	if req.Enabled {
-		targetInstance.usbKVMController.StartMouseJiggler()
-	} else {
-		targetInstance.usbKVMController.StopMouseJiggler()
-	}
-
-	// Update preferences
-	if targetInstance.Preferences == nil {
-		targetInstance.Preferences = DefaultPreferences()
-	}
-	targetInstance.Preferences.EnableMouseJiggler = req.Enabled
+	// Update preferences, which starts or stops the jiggler
+	prefs := targetInstance.GetPreferences()
+	prefs.EnableMouseJiggler = req.Enabled
+	targetInstance.SetPreferences(&prefs)
 	_ = d.SavePreferences(targetInstance)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -214,6 +352,53 @@ func (d *DezkVM) HandleMouseJiggler(w http.ResponseWriter, r *http.Request, inst
 	})
 }
 
+// HandleChipStatus returns the keyboard LEDs and the USB enumeration state
+// reported by the HID chip. The chip is queried directly if it is not polled.
+func (d *DezkVM) HandleChipStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+	status, polled := usbKVM.LastChipStatus()
+	if !polled {
+		var err error
+		status, err = usbKVM.GetChipInfo()
+		if err != nil {
+			http.Error(w, "Failed to read chip status: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		status.UpdatedAt = time.Now().Unix()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleHIDStats returns the command pipeline statistics of the HID chip,
+// including the reply latency of the recent commands
+func (d *DezkVM) HandleHIDStats(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+	stats, err := usbKVM.PipelineStats()
+	if err != nil {
+		http.Error(w, "HID statistics are "+err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 // HandleGetPreferences returns the current preferences for a given instance.
 func (d *DezkVM) HandleGetPreferences(w http.ResponseWriter, r *http.Request, instanceUuid string) {
 	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
@@ -221,29 +406,38 @@ func (d *DezkVM) HandleGetPreferences(w http.ResponseWriter, r *http.Request, in
 		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
 		return
 	}
-	if targetInstance.Preferences == nil {
-		targetInstance.Preferences = DefaultPreferences()
-	}
+	prefs := targetInstance.GetPreferences()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(targetInstance.Preferences)
+	json.NewEncoder(w).Encode(prefs)
 }
 
 // HandleSetPreferences updates the preferences for a given instance and persists them to disk.
-func (d *DezkVM) HandleSetPreferences(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+// If partial is false, all preferences are replaced and missing fields get their
+// default values. If partial is true, only the fields in the request are changed.
+func (d *DezkVM) HandleSetPreferences(w http.ResponseWriter, r *http.Request, instanceUuid string, partial bool) {
 	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
 	if err != nil {
 		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
 		return
 	}
 
-	var prefs UsbKvmPreferences
-	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	base := DefaultPreferences()
+	if partial {
+		current := targetInstance.GetPreferences()
+		base = &current
+	}
+	prefs, err := decodePreferencesUpdate(body, base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	targetInstance.Preferences = &prefs
-	targetInstance.ApplyPreferences()
+	targetInstance.SetPreferences(prefs)
 
 	// Persist to disk
 	if err := d.SavePreferences(targetInstance); err != nil {
@@ -252,48 +446,581 @@ func (d *DezkVM) HandleSetPreferences(w http.ResponseWriter, r *http.Request, in
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(targetInstance.Preferences)
+	json.NewEncoder(w).Encode(prefs)
 }
 
 // HandleReconnectCapture closes the V4L2 and audio devices and restarts them.
 // The frontend should reload the page after this completes to re-establish streams.
 func (d *DezkVM) HandleReconnectCapture(w http.ResponseWriter, r *http.Request, instanceUuid string) {
-	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+
+	err := targetInstance.ReconnectCapture()
 	if err != nil {
+		http.Error(w, "Failed to reconnect capture device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "ok",
+		"message": "Capture device reconnected",
+	})
+}
+
+// HandleListInstanceIDs returns the ID and hardware identity of every instance,
+// the pinned IDs and preference files that do not belong to any instance.
+func (d *DezkVM) HandleListInstanceIDs(w http.ResponseWriter, r *http.Request) {
+	instances := []map[string]interface{}{}
+	for _, instance := range d.Instances() {
+		instances = append(instances, map[string]interface{}{
+			"uuid":           instance.UUID(),
+			"usb_kvm_device": instance.Config.USBKVMDevicePath,
+			"identity":       instance.Identity(),
+		})
+	}
+	pins, err := d.ListPinnedIDs()
+	if err != nil {
+		http.Error(w, "Failed to load pinned IDs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	orphaned, err := d.ListOrphanedPreferences()
+	if err != nil {
+		http.Error(w, "Failed to list preference files: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"instances":            instances,
+		"pinned":               pins,
+		"orphaned_preferences": orphaned,
+	})
+}
+
+// HandlePinInstanceID pins an instance to its current ID, or renames it to newID if given.
+func (d *DezkVM) HandlePinInstanceID(w http.ResponseWriter, r *http.Request, instanceUuid string, newID string) {
+	if _, err := d.GetInstanceByUUID(instanceUuid); err != nil {
 		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
 		return
 	}
+	if err := d.PinInstanceID(instanceUuid, newID); err != nil {
+		http.Error(w, "Failed to pin instance ID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if newID == "" {
+		newID = instanceUuid
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+		"uuid":   newID,
+	})
+}
+
+// HandleUnpinInstanceID removes a pinned instance ID.
+func (d *DezkVM) HandleUnpinInstanceID(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if err := d.UnpinInstanceID(instanceUuid); err != nil {
+		http.Error(w, "Failed to unpin instance ID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleMigratePreferences moves an orphaned preference file to another instance ID.
+func (d *DezkVM) HandleMigratePreferences(w http.ResponseWriter, r *http.Request, fromID string, toID string, overwrite bool) {
+	if err := d.MigratePreferences(fromID, toID, overwrite); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Preference file not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to migrate preferences: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleListRegistry returns all instance registry entries, including the ones
+// of instances that are currently offline. Filter by tag if tag is not empty.
+func (d *DezkVM) HandleListRegistry(w http.ResponseWriter, r *http.Request, tag string) {
+	entries, err := d.ListInstanceMetadata(tag)
+	if err != nil {
+		http.Error(w, "Failed to list instance registry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// HandleGetRegistryEntry returns the registry entry of an instance.
+func (d *DezkVM) HandleGetRegistryEntry(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	meta, err := d.GetInstanceMetadata(instanceUuid)
+	if err != nil {
+		http.Error(w, "Failed to read instance registry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// HandleSetRegistryEntry creates or replaces the registry entry of an instance.
+// The instance does not need to be online.
+func (d *DezkVM) HandleSetRegistryEntry(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	var meta InstanceMetadata
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	meta.UUID = instanceUuid
+	if err := d.SetInstanceMetadata(&meta); err != nil {
+		http.Error(w, "Failed to save instance registry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// HandleDeleteRegistryEntry removes the registry entry of an instance.
+func (d *DezkVM) HandleDeleteRegistryEntry(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if err := d.DeleteInstanceMetadata(instanceUuid); err != nil {
+		http.Error(w, "Failed to delete instance registry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleListManualInstances returns all manually defined instances and their status.
+func (d *DezkVM) HandleListManualInstances(w http.ResponseWriter, r *http.Request) {
+	result := []map[string]interface{}{}
+	for _, instance := range d.ListManualInstances() {
+		lastError := ""
+		if err := instance.LastError(); err != nil {
+			lastError = err.Error()
+		}
+		result = append(result, map[string]interface{}{
+			"uuid":       instance.UUID(),
+			"status":     instance.Status(),
+			"last_error": lastError,
+			"definition": instance.Config,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleAddManualInstance adds a manually defined instance from the JSON body.
+func (d *DezkVM) HandleAddManualInstance(w http.ResponseWriter, r *http.Request) {
+	var config UsbKvmDeviceOption
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	instance, err := d.AddManualInstance(&config)
+	if err != nil {
+		http.Error(w, "Failed to add manual instance: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastError := ""
+	if err := instance.LastError(); err != nil {
+		lastError = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uuid":       instance.UUID(),
+		"status":     instance.Status(),
+		"last_error": lastError,
+	})
+}
+
+// HandleRemoveManualInstance removes the manually defined instance using the given HID device.
+func (d *DezkVM) HandleRemoveManualInstance(w http.ResponseWriter, r *http.Request, hidDevicePath string) {
+	if err := d.RemoveManualInstance(hidDevicePath); err != nil {
+		http.Error(w, "Failed to remove manual instance: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleListGroups returns all instance groups.
+func (d *DezkVM) HandleListGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := d.ListGroups()
+	if err != nil {
+		http.Error(w, "Failed to list instance groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
 
-	if targetInstance.usbCaptureDevice == nil {
-		http.Error(w, "Capture device not initialized", http.StatusInternalServerError)
+// HandleGetGroup returns a single instance group.
+func (d *DezkVM) HandleGetGroup(w http.ResponseWriter, r *http.Request, name string) {
+	group, err := d.GetGroup(name)
+	if err != nil {
+		http.Error(w, "Failed to read instance group: "+err.Error(), http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
 
-	// Close the existing capture device (stops video + audio)
-	targetInstance.usbCaptureDevice.Close()
-	targetInstance.usbCaptureDevice = nil
+// HandleSetGroup creates or replaces an instance group.
+func (d *DezkVM) HandleSetGroup(w http.ResponseWriter, r *http.Request, name string) {
+	var group InstanceGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	group.Name = name
+	if err := d.SetGroup(&group); err != nil {
+		http.Error(w, "Failed to save instance group: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
 
-	time.Sleep(1 * time.Second) // Short delay to ensure device is released
+// HandleDeleteGroup removes an instance group.
+func (d *DezkVM) HandleDeleteGroup(w http.ResponseWriter, r *http.Request, name string) {
+	if err := d.DeleteGroup(name); err != nil {
+		http.Error(w, "Failed to delete instance group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
 
-	// Re-create and start the capture device
-	newDevice, err := usbcapture.NewInstance(targetInstance.captureConfig)
+// HandleListMacros returns the summary of all HID macros.
+func (d *DezkVM) HandleListMacros(w http.ResponseWriter, r *http.Request) {
+	macros, err := d.ListMacros()
 	if err != nil {
-		http.Error(w, "Failed to re-initialize capture device: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to list macros: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macros)
+}
 
-	err = newDevice.StartVideoCapture(targetInstance.videoResoltuionConfig)
+// HandleGetMacro returns a HID macro including its steps.
+func (d *DezkVM) HandleGetMacro(w http.ResponseWriter, r *http.Request, name string) {
+	macro, err := d.GetMacro(name)
 	if err != nil {
-		newDevice.Close()
-		http.Error(w, "Failed to restart video capture: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to read macro: "+err.Error(), http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macro)
+}
 
-	targetInstance.usbCaptureDevice = newDevice
+// HandleSetMacro creates or replaces a HID macro, e.g. to import or edit one.
+func (d *DezkVM) HandleSetMacro(w http.ResponseWriter, r *http.Request, name string) {
+	var macro Macro
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024*1024)).Decode(&macro); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	macro.Name = name
+	if err := d.SaveMacro(&macro); err != nil {
+		http.Error(w, "Failed to save macro: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macro.Info())
+}
 
+// HandleDeleteMacro removes a HID macro.
+func (d *DezkVM) HandleDeleteMacro(w http.ResponseWriter, r *http.Request, name string) {
+	if err := d.DeleteMacro(name); err != nil {
+		http.Error(w, "Failed to delete macro: "+err.Error(), http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "ok",
-		"message": "Capture device reconnected",
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleMacroStatus returns the macro recording and playback state of an instance.
+func (d *DezkVM) HandleMacroStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	recording, recordedSteps := false, 0
+	if usbKVM := targetInstance.hidController(); usbKVM != nil {
+		recording, recordedSteps = usbKVM.MacroRecordingStatus()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recording":      recording,
+		"recorded_steps": recordedSteps,
+		"playback":       d.MacroPlaybackStatus(instanceUuid),
 	})
 }
+
+// HandleStartMacroRecording starts recording the HID commands of an instance.
+func (d *DezkVM) HandleStartMacroRecording(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if err := d.StartMacroRecording(instanceUuid); err != nil {
+		http.Error(w, "Failed to start recording: "+err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleStopMacroRecording stops the recording of an instance. The JSON body
+// {"name": "...", "description": "..."} saves it, without a name it is discarded.
+func (d *DezkVM) HandleStopMacroRecording(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	macro, err := d.StopMacroRecording(instanceUuid, req.Name, req.Description)
+	if err != nil {
+		http.Error(w, "Failed to stop recording: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if macro == nil {
+		json.NewEncoder(w).Encode(map[string]string{"status": "discarded"})
+		return
+	}
+	json.NewEncoder(w).Encode(macro.Info())
+}
+
+// HandlePlayMacro starts playing a macro on an instance. The JSON body is
+// {"name": "...", "speed": 1.0, "loops": 1}, speed and loops are optional.
+func (d *DezkVM) HandlePlayMacro(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	req := struct {
+		Name  string  `json:"name"`
+		Speed float64 `json:"speed"`
+		Loops int     `json:"loops"`
+	}{Speed: 1, Loops: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	playback, err := d.PlayMacro(instanceUuid, req.Name, req.Speed, req.Loops)
+	if err != nil {
+		http.Error(w, "Failed to play macro: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(playback)
+}
+
+// HandleAbortMacro stops the macro playing on an instance.
+func (d *DezkVM) HandleAbortMacro(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if err := d.AbortMacroPlayback(instanceUuid); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleListScripts returns the summary of all DuckyScripts.
+func (d *DezkVM) HandleListScripts(w http.ResponseWriter, r *http.Request) {
+	scripts, err := d.ListScripts()
+	if err != nil {
+		http.Error(w, "Failed to list scripts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scripts)
+}
+
+// HandleGetScript returns a DuckyScript including its source.
+func (d *DezkVM) HandleGetScript(w http.ResponseWriter, r *http.Request, name string) {
+	script, err := d.GetScript(name)
+	if err != nil {
+		http.Error(w, "Failed to read script: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(script)
+}
+
+// HandleSetScript creates or replaces a DuckyScript. The JSON body is
+// {"description": "...", "source": "..."}, scripts with parse errors are
+// rejected with 422 and the errors of each line.
+func (d *DezkVM) HandleSetScript(w http.ResponseWriter, r *http.Request, name string) {
+	var script Script
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxScriptLength)).Decode(&script); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	script.Name = name
+	if err := d.SaveScript(&script); err != nil {
+		var validationErr *ScriptValidationError
+		if errors.As(err, &validationErr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": validationErr.Errors})
+			return
+		}
+		http.Error(w, "Failed to save script: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(script.Info())
+}
+
+// HandleDeleteScript removes a DuckyScript.
+func (d *DezkVM) HandleDeleteScript(w http.ResponseWriter, r *http.Request, name string) {
+	if err := d.DeleteScript(name); err != nil {
+		http.Error(w, "Failed to delete script: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleValidateScript parses a DuckyScript without running it. The JSON body
+// is {"source": "...", "layout": "de"}, the layout is optional. The result
+// lists the errors and the characters that cannot be typed per line.
+func (d *DezkVM) HandleValidateScript(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source string `json:"source"`
+		Layout string `json:"layout"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxScriptLength)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	parsed, err := ParseScript(req.Source, req.Layout)
+	var validationErr *ScriptValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := map[string]interface{}{
+		"valid":       err == nil,
+		"errors":      []kvmhid.ScriptError{},
+		"layout":      parsed.LayoutID,
+		"commands":    len(parsed.Commands),
+		"key_strokes": parsed.KeyStrokes,
+		"untypable":   parsed.Untypable,
+	}
+	if validationErr != nil {
+		result["errors"] = validationErr.Errors
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleScriptStatus returns the state of the last script run of an instance.
+func (d *DezkVM) HandleScriptStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if _, ok := d.getRunningInstance(w, instanceUuid); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.ScriptRunStatus(instanceUuid))
+}
+
+// HandleRunScript runs a stored or ad-hoc DuckyScript on an instance. The JSON
+// body is {"name": "..."} or {"source": "..."}, with the optional "layout"
+// (the instance preference if empty) and "delay_ms" between the key strokes
+// of STRING commands. The progress is streamed as one JSON object per line
+// until the script has finished, closing the request cancels the script.
+func (d *DezkVM) HandleRunScript(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name    string `json:"name"`
+		Source  string `json:"source"`
+		Layout  string `json:"layout"`
+		DelayMs *int   `json:"delay_ms"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxScriptLength)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name != "" {
+		script, err := d.GetScript(req.Name)
+		if err != nil {
+			http.Error(w, "Failed to read script: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		req.Source = script.Source
+	}
+	delay := kvmhid.DefaultTypeKeyDelay
+	if req.DelayMs != nil {
+		delay = time.Duration(*req.DelayMs) * time.Millisecond
+		if delay < 0 || delay > kvmhid.MaxTypeKeyDelay {
+			http.Error(w, fmt.Sprintf("delay_ms must be between 0 and %d", kvmhid.MaxTypeKeyDelay.Milliseconds()), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Layout == "" {
+		req.Layout = targetInstance.GetPreferences().KeyboardLayout
+	}
+	parsed, err := ParseScript(req.Source, req.Layout)
+	if err != nil {
+		var validationErr *ScriptValidationError
+		if errors.As(err, &validationErr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": validationErr.Errors})
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The response becomes a stream once the script has started, errors
+	// before that are returned with their status code
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	streaming := false
+	send := func(event string, run ScriptRun) {
+		if !streaming {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Cache-Control", "no-cache")
+			streaming = true
+		}
+		encoder.Encode(struct {
+			Event string `json:"event"`
+			ScriptRun
+		}{event, run})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	run, err := d.RunScript(r.Context(), instanceUuid, req.Name, parsed, delay, func(run ScriptRun) {
+		send("progress", run)
+	})
+	switch {
+	case errors.Is(err, errScriptAlreadyRunning):
+		http.Error(w, "A script is already running on this instance", http.StatusConflict)
+		return
+	case errors.Is(err, errScriptInstanceNotRunning):
+		http.Error(w, "Instance is not running", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	send("done", *run)
+}
+
+// HandleCancelScript stops the script running on an instance.
+func (d *DezkVM) HandleCancelScript(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if err := d.CancelScript(instanceUuid); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
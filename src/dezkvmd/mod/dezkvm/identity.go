@@ -0,0 +1,311 @@
+package dezkvm
+
+/*
+	identity.go
+
+	Instances with an AuxMCU are identified by the UUID stored in the MCU.
+	Third party or older port modules do not have one, so their ID is derived
+	from the USB topology path and the serial numbers of the capture card and
+	the USB-UART (CH340 / CH9329) bridge read from sysfs. The same hardware
+	plugged into the same ports will therefore always get the same ID.
+
+	Admins can also pin an ID to a piece of hardware (so it survives moving
+	to another port), or rename it to something else. Pins are stored in a
+	JSON file next to the instance preference folder.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+)
+
+// instanceIDNamespace is the namespace used to derive deterministic instance IDs.
+var instanceIDNamespace = uuid.MustParse("5f3c1e0a-6b1d-4c77-9d2e-0d65b7a1c4e2")
+
+// validInstanceID restricts instance IDs to characters that are safe to use in file names and URLs.
+var validInstanceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// InstanceIdentity holds the hardware properties used to identify an instance.
+type InstanceIdentity struct {
+	TopologyPath  string `json:"topology_path"`  // USB port path of the capture card and HID bridge, e.g. 1-1.2|1-1.1
+	CaptureSerial string `json:"capture_serial"` // USB serial number of the capture card, if any
+	HIDSerial     string `json:"hid_serial"`     // USB serial number of the HID bridge, if any
+	AuxMCUUUID    string `json:"aux_mcu_uuid"`   // UUID reported by the AuxMCU, if present
+}
+
+// DerivedID returns the deterministic instance ID for this identity.
+// USB KVM device category is "1", type is "0" (unknown/unspecified).
+func (id *InstanceIdentity) DerivedID() string {
+	if id.AuxMCUUUID != "" {
+		return id.AuxMCUUUID
+	}
+	key := strings.Join([]string{id.TopologyPath, id.CaptureSerial, id.HIDSerial}, "|")
+	derived := uuid.NewSHA1(instanceIDNamespace, []byte(key)).String()
+	return "10" + derived[2:]
+}
+
+// matches checks if the given identity belongs to the same hardware as this one.
+// AuxMCU UUIDs are compared first, then serial numbers (which survive moving the
+// device to another port) and lastly the USB topology path.
+func (id *InstanceIdentity) matches(other *InstanceIdentity) bool {
+	if id.AuxMCUUUID != "" || other.AuxMCUUUID != "" {
+		return id.AuxMCUUUID == other.AuxMCUUUID
+	}
+	if id.CaptureSerial != "" && id.HIDSerial != "" &&
+		id.CaptureSerial == other.CaptureSerial && id.HIDSerial == other.HIDSerial {
+		return true
+	}
+	return id.TopologyPath != "" && id.TopologyPath == other.TopologyPath
+}
+
+// PinnedInstanceID maps a piece of hardware to a fixed instance ID.
+type PinnedInstanceID struct {
+	ID       string           `json:"id"`
+	Identity InstanceIdentity `json:"identity"`
+}
+
+// ResolveInstanceIdentity reads the hardware identity of an instance from sysfs.
+func ResolveInstanceIdentity(config *UsbKvmDeviceOption) (*InstanceIdentity, error) {
+	identity := &InstanceIdentity{}
+	topology := []string{}
+	devPaths := []string{config.VideoCaptureDevicePath, config.USBKVMDevicePath}
+	if config.HIDBackend == HIDBackendGadget {
+		// The gadget is a function of this host, not a USB device plugged into it
+		devPaths = devPaths[:1]
+	}
+	for _, devPath := range devPaths {
+		if devPath == "" || serial.IsNetworkPath(devPath) {
+			// Devices shared over the network are plugged into another host
+			continue
+		}
+		sysPath, err := getDeviceFullPath(devPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve sysfs path of %s: %w", devPath, err)
+		}
+		usbDir := usbDeviceDir(sysPath)
+		if usbDir == "" {
+			return nil, fmt.Errorf("%s is not a USB device", devPath)
+		}
+		topology = append(topology, filepath.Base(usbDir))
+		serialNumber := readSysfsAttr(usbDir, "serial")
+		if devPath == config.VideoCaptureDevicePath {
+			identity.CaptureSerial = serialNumber
+		} else {
+			identity.HIDSerial = serialNumber
+		}
+	}
+	if len(topology) == 0 {
+		return nil, errors.New("no device path to derive identity from")
+	}
+	identity.TopologyPath = strings.Join(topology, "|")
+	return identity, nil
+}
+
+// IsValidInstanceID checks if the given ID can be used as an instance ID.
+func IsValidInstanceID(id string) bool {
+	return validInstanceID.MatchString(id)
+}
+
+// loadPinnedIDs reads the pinned instance IDs from disk.
+func (d *DezkVM) loadPinnedIDs() ([]*PinnedInstanceID, error) {
+	data, err := os.ReadFile(d.IdentityFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*PinnedInstanceID{}, nil
+		}
+		return nil, err
+	}
+	pins := []*PinnedInstanceID{}
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// savePinnedIDs writes the pinned instance IDs to disk.
+func (d *DezkVM) savePinnedIDs(pins []*PinnedInstanceID) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.IdentityFilePath, data, 0644)
+}
+
+// ListPinnedIDs returns all pinned instance IDs.
+func (d *DezkVM) ListPinnedIDs() ([]*PinnedInstanceID, error) {
+	d.identityMu.Lock()
+	defer d.identityMu.Unlock()
+	return d.loadPinnedIDs()
+}
+
+// resolveInstanceID returns the pinned ID for the given identity if there is
+// one, otherwise the derived ID.
+func (d *DezkVM) resolveInstanceID(identity *InstanceIdentity) string {
+	d.identityMu.Lock()
+	defer d.identityMu.Unlock()
+	pins, err := d.loadPinnedIDs()
+	if err == nil {
+		for _, pin := range pins {
+			if pin.Identity.matches(identity) {
+				return pin.ID
+			}
+		}
+	}
+	return identity.DerivedID()
+}
+
+// PinInstanceID pins the instance to the given ID. If newID is empty, the
+// current ID is pinned. When the ID changes, the preference file of the
+// instance is renamed to follow it.
+func (d *DezkVM) PinInstanceID(oldID string, newID string) error {
+	instance, err := d.GetInstanceByUUID(oldID)
+	if err != nil {
+		return err
+	}
+	if newID == "" {
+		newID = oldID
+	}
+	if !IsValidInstanceID(newID) {
+		return errors.New("invalid instance ID")
+	}
+	if newID != oldID {
+		if _, err := d.GetInstanceByUUID(newID); err == nil {
+			return errors.New("instance ID already in use")
+		}
+	}
+
+	instance.lifecycleMu.Lock()
+	defer instance.lifecycleMu.Unlock()
+	identity := instance.Identity()
+	if identity == nil {
+		return errors.New("instance identity is not resolved yet")
+	}
+
+	d.identityMu.Lock()
+	pins, err := d.loadPinnedIDs()
+	if err != nil {
+		d.identityMu.Unlock()
+		return err
+	}
+	updated := []*PinnedInstanceID{}
+	for _, pin := range pins {
+		if pin.ID == oldID || pin.ID == newID || pin.Identity.matches(identity) {
+			continue
+		}
+		updated = append(updated, pin)
+	}
+	updated = append(updated, &PinnedInstanceID{
+		ID:       newID,
+		Identity: *identity,
+	})
+	err = d.savePinnedIDs(updated)
+	d.identityMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if newID != oldID {
+		// Renamed first, so MigratePreferences finds the instance under its
+		// new ID and applies the migrated preferences to it
+		instance.stateMu.Lock()
+		instance.uuid = newID
+		instance.stateMu.Unlock()
+		if err := d.MigratePreferences(oldID, newID, false); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := d.renameInstanceMetadata(oldID, newID); err != nil {
+			return err
+		}
+		if err := d.renameGroupMember(oldID, newID); err != nil {
+			return err
+		}
+		if err := d.renameCaptureProfile(oldID, newID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpinInstanceID removes the pin of an instance. The instance will use its
+// derived ID again after the next restart.
+func (d *DezkVM) UnpinInstanceID(id string) error {
+	d.identityMu.Lock()
+	defer d.identityMu.Unlock()
+	pins, err := d.loadPinnedIDs()
+	if err != nil {
+		return err
+	}
+	updated := []*PinnedInstanceID{}
+	found := false
+	for _, pin := range pins {
+		if pin.ID == id {
+			found = true
+			continue
+		}
+		updated = append(updated, pin)
+	}
+	if !found {
+		return errors.New("instance ID is not pinned")
+	}
+	return d.savePinnedIDs(updated)
+}
+
+// ListOrphanedPreferences returns the IDs of preference files in the config
+// folder that do not belong to any known instance.
+func (d *DezkVM) ListOrphanedPreferences() ([]string, error) {
+	entries, err := os.ReadDir(d.ConfigFolderPath)
+	if err != nil {
+		return nil, err
+	}
+	orphaned := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if _, err := d.GetInstanceByUUID(id); err != nil {
+			orphaned = append(orphaned, id)
+		}
+	}
+	return orphaned, nil
+}
+
+// MigratePreferences moves the preference file of fromID to toID. If the
+// target instance is running, the migrated preferences are applied immediately.
+func (d *DezkVM) MigratePreferences(fromID string, toID string, overwrite bool) error {
+	if !IsValidInstanceID(fromID) || !IsValidInstanceID(toID) {
+		return errors.New("invalid instance ID")
+	}
+	src := d.preferencesFilePath(fromID)
+	dst := d.preferencesFilePath(toID)
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil && !overwrite {
+		return errors.New("target instance already has a preference file")
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	// Reload preferences of the target instance if it is already running
+	// (the caller may already hold the instance lifecycle lock during a rename)
+	if instance, err := d.GetInstanceByUUID(toID); err == nil && instance.IsRunning() {
+		prefs, err := d.LoadPreferences(toID)
+		if err != nil {
+			return err
+		}
+		if prefs != nil {
+			instance.SetPreferences(prefs)
+		}
+	}
+	return nil
+}
@@ -3,8 +3,6 @@ package dezkvm
 import (
 	"errors"
 	"log"
-	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -82,8 +80,9 @@ func GetScannedTTYDevicesByCategory(cat DeviceCatergory) []*ScannedTTYDevice {
 }
 
 // ScanConnectedUsbKvmDevices scans and lists all connected USB KVM devices in the system.
-func ScanConnectedUsbKvmDevices() ([]*UsbKvmDeviceOption, error) {
-	possibleKvmDeviceGroup, err := DiscoverUsbKvmSubtree()
+// Only devices accepted by the filter are opened during the scan.
+func ScanConnectedUsbKvmDevices(filter *ScanFilter) ([]*UsbKvmDeviceOption, error) {
+	possibleKvmDeviceGroup, err := DiscoverUsbKvmSubtree(filter)
 	if err != nil {
 		return nil, err
 	}
@@ -116,47 +115,32 @@ func ScanConnectedUsbKvmDevices() ([]*UsbKvmDeviceOption, error) {
 	return result, nil
 }
 
-func DiscoverUsbKvmSubtree() ([]*UsbKvmDevice, error) {
-	// Scan all /dev/tty*, /dev/video*, /dev/snd/pcmC* devices
-	getMatchingDevs := func(pattern string) ([]string, error) {
-		files, err := filepath.Glob(pattern)
-		if err != nil {
-			return nil, err
-		}
-		return files, nil
-	}
-
-	// Get all ttyUSB*, ttyACM*
-	ttyDevs1, _ := getMatchingDevs("/dev/ttyUSB*")
-	ttyDevs2, _ := getMatchingDevs("/dev/ttyACM*")
-	ttyDevs := append(ttyDevs1, ttyDevs2...)
-
-	// Get all video*
-	videoDevs, _ := getMatchingDevs("/dev/video*")
-
-	// Get all ALSA PCM devices (USB audio is usually card > 0)
-	alsaDevs, _ := getMatchingDevs("/dev/snd/pcmC*")
-
+// DiscoverUsbKvmSubtree groups the devices accepted by the filter by their USB
+// hub. Candidates are identified from sysfs first, so only known (or allowed)
+// ACM devices receive the 'u' sniff command.
+func DiscoverUsbKvmSubtree(filter *ScanFilter) ([]*UsbKvmDevice, error) {
 	type devInfo struct {
 		path    string
 		sysPath string
 	}
 
-	getSys := func(devs []string) []devInfo {
-		var out []devInfo
-		for _, d := range devs {
-			sys, err := getDeviceFullPath(d)
-			if err == nil {
-				out = append(out, devInfo{d, sys})
-			}
+	var ttys, videos, alsas []devInfo
+	for _, candidate := range ScanCandidates(filter) {
+		if !candidate.Accepted {
+			log.Printf("Skipping %s: %s", candidate.DevicePath, candidate.Reason)
+			continue
+		}
+		info := devInfo{candidate.DevicePath, candidate.SysPath}
+		switch candidate.Kind {
+		case ScanDeviceKindUSBSerial, ScanDeviceKindACMSerial:
+			ttys = append(ttys, info)
+		case ScanDeviceKindVideo:
+			videos = append(videos, info)
+		case ScanDeviceKindAudio:
+			alsas = append(alsas, info)
 		}
-		return out
 	}
 
-	ttys := getSys(ttyDevs)
-	videos := getSys(videoDevs)
-	alsas := getSys(alsaDevs)
-
 	// Find common USB root hub prefix
 	hubPattern := regexp.MustCompile(`^\d+-\d+(\.\d+)*$`)
 	getHub := func(sys string) string {
@@ -282,31 +266,3 @@ func DiscoverUsbKvmSubtree() ([]*UsbKvmDevice, error) {
 	}
 	return result, nil
 }
-
-func resolveSymlink(path string) (string, error) {
-	resolved, err := filepath.EvalSymlinks(path)
-	if err != nil {
-		return "", err
-	}
-	return resolved, nil
-}
-
-func getDeviceFullPath(devicePath string) (string, error) {
-	resolvedPath, err := resolveSymlink(devicePath)
-	if err != nil {
-		return "", err
-	}
-
-	// Use udevadm to get the device chain
-	out, err := exec.Command("udevadm", "info", "-q", "path", "-n", resolvedPath).Output()
-	if err != nil {
-		return "", err
-	}
-	sysPath := strings.TrimSpace(string(out))
-	if sysPath == "" {
-		return "", errors.New("could not resolve sysfs path")
-	}
-
-	fullPath := "/sys" + sysPath
-	return fullPath, nil
-}
@@ -0,0 +1,355 @@
+package dezkvm
+
+/*
+	macro.go
+
+	HID macros are recorded from the commands received on the HID websocket
+	of an instance and stored by name in the system database. They can be
+	played back on any instance, absolute mouse positions are scaled from
+	the resolution they were recorded in to the resolution of the target.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+const macroBucket = "hid_macros"
+
+// Playback options range
+const (
+	MinMacroSpeed = 0.1
+	MaxMacroSpeed = 10.0
+	MaxMacroLoops = 1000
+)
+
+// Macro is a recorded sequence of HID commands
+type Macro struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Width       int                `json:"width"`  // Capture resolution the absolute mouse positions were recorded in
+	Height      int                `json:"height"` // Capture resolution the absolute mouse positions were recorded in
+	Steps       []kvmhid.MacroStep `json:"steps"`
+	CreatedAt   int64              `json:"created_at"`
+}
+
+// MacroInfo describes a macro without its steps
+type MacroInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StepCount   int    `json:"step_count"`
+	DurationMs  int64  `json:"duration_ms"` // Duration at normal speed
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// MacroPlayback is the state of a macro playback on an instance
+type MacroPlayback struct {
+	Instance   string  `json:"instance"`
+	Macro      string  `json:"macro"`
+	Speed      float64 `json:"speed"`
+	Loops      int     `json:"loops"`
+	Loop       int     `json:"loop"`  // Current loop, starting at 1
+	Step       int     `json:"step"`  // Steps sent in the current loop
+	Steps      int     `json:"steps"` // Steps of the macro
+	Running    bool    `json:"running"`
+	Aborted    bool    `json:"aborted"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  int64   `json:"started_at"`
+	FinishedAt int64   `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// macroPlaybacks tracks the last macro playback of each instance
+type macroPlaybacks struct {
+	mu        sync.Mutex
+	instances map[string]*MacroPlayback
+}
+
+// Info returns the summary of the macro
+func (m *Macro) Info() *MacroInfo {
+	info := &MacroInfo{
+		Name:        m.Name,
+		Description: m.Description,
+		StepCount:   len(m.Steps),
+		CreatedAt:   m.CreatedAt,
+	}
+	for _, step := range m.Steps {
+		info.DurationMs += step.DelayMs
+	}
+	return info
+}
+
+// validate checks the macro before it is stored
+func (m *Macro) validate() error {
+	if !IsValidInstanceID(m.Name) {
+		return errors.New("invalid macro name")
+	}
+	m.Description = strings.TrimSpace(m.Description)
+	if len(m.Steps) == 0 {
+		return errors.New("macro has no steps")
+	}
+	if len(m.Steps) > kvmhid.MaxMacroSteps {
+		return errors.New("macro has too many steps")
+	}
+	for _, step := range m.Steps {
+		if step.DelayMs < 0 {
+			return errors.New("macro step delay must not be negative")
+		}
+	}
+	return nil
+}
+
+// GetMacro returns the macro with the given name
+func (d *DezkVM) GetMacro(name string) (*Macro, error) {
+	if d.db == nil {
+		return nil, errors.New("macros are not available")
+	}
+	data, err := d.db.Read(macroBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("macro not found")
+	}
+	macro := &Macro{}
+	if err := json.Unmarshal(data, macro); err != nil {
+		return nil, err
+	}
+	macro.Name = name
+	return macro, nil
+}
+
+// SaveMacro creates or replaces a macro
+func (d *DezkVM) SaveMacro(macro *Macro) error {
+	if d.db == nil {
+		return errors.New("macros are not available")
+	}
+	if err := macro.validate(); err != nil {
+		return err
+	}
+	if macro.CreatedAt == 0 {
+		macro.CreatedAt = time.Now().Unix()
+	}
+	data, err := json.Marshal(macro)
+	if err != nil {
+		return err
+	}
+	return d.db.Write(macroBucket, macro.Name, data)
+}
+
+// DeleteMacro removes a macro
+func (d *DezkVM) DeleteMacro(name string) error {
+	if d.db == nil {
+		return errors.New("macros are not available")
+	}
+	if !d.db.KeyExists(macroBucket, name) {
+		return errors.New("macro not found")
+	}
+	return d.db.Delete(macroBucket, name)
+}
+
+// ListMacros returns the summary of all macros sorted by name
+func (d *DezkVM) ListMacros() ([]*MacroInfo, error) {
+	if d.db == nil {
+		return nil, errors.New("macros are not available")
+	}
+	result := []*MacroInfo{}
+	err := d.db.List(macroBucket, func(key, value []byte) error {
+		macro := &Macro{}
+		if err := json.Unmarshal(value, macro); err != nil {
+			return nil // Skip corrupted entries
+		}
+		macro.Name = string(key)
+		result = append(result, macro.Info())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// runningHIDController returns the HID controller of a running instance
+func (d *DezkVM) runningHIDController(instanceUUID string) (*UsbKvmDeviceInstance, *kvmhid.Controller, error) {
+	instance, err := d.GetInstanceByUUID(instanceUUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !instance.IsRunning() {
+		return nil, nil, errors.New("instance is not running")
+	}
+	controller := instance.hidController()
+	if controller == nil {
+		return nil, nil, errors.New("HID controller is not available")
+	}
+	return instance, controller, nil
+}
+
+// StartMacroRecording starts recording the HID commands of an instance
+func (d *DezkVM) StartMacroRecording(instanceUUID string) error {
+	_, controller, err := d.runningHIDController(instanceUUID)
+	if err != nil {
+		return err
+	}
+	return controller.StartMacroRecording()
+}
+
+// StopMacroRecording stops the recording of an instance and saves it as a
+// macro with the given name. The recording is discarded if name is empty.
+func (d *DezkVM) StopMacroRecording(instanceUUID string, name string, description string) (*Macro, error) {
+	instance, controller, err := d.runningHIDController(instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+	steps, truncated, err := controller.StopMacroRecording()
+	if err != nil || name == "" {
+		return nil, err
+	}
+	resolution := instance.CurrentResolution()
+	macro := &Macro{
+		Name:        name,
+		Description: description,
+		Width:       resolution.Width,
+		Height:      resolution.Height,
+		Steps:       steps,
+	}
+	if truncated {
+		log.Printf("Warning: macro %s recorded on %s was truncated to %d steps\n", name, instanceUUID, kvmhid.MaxMacroSteps)
+	}
+	if err := d.SaveMacro(macro); err != nil {
+		return nil, err
+	}
+	return macro, nil
+}
+
+// PlayMacro starts playing a macro on an instance. The speed scales the
+// delays between the steps, e.g. 2 plays the macro twice as fast.
+func (d *DezkVM) PlayMacro(instanceUUID string, name string, speed float64, loops int) (*MacroPlayback, error) {
+	if speed < MinMacroSpeed || speed > MaxMacroSpeed {
+		return nil, errors.New("speed must be between 0.1 and 10")
+	}
+	if loops < 1 || loops > MaxMacroLoops {
+		return nil, errors.New("loops must be between 1 and 1000")
+	}
+	instance, controller, err := d.runningHIDController(instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+	macro, err := d.GetMacro(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d.macroPlaybacks.mu.Lock()
+	defer d.macroPlaybacks.mu.Unlock()
+	if d.macroPlaybacks.instances == nil {
+		d.macroPlaybacks.instances = map[string]*MacroPlayback{}
+	}
+	if current, ok := d.macroPlaybacks.instances[instanceUUID]; ok && current.Running {
+		return nil, errors.New("a macro is already playing on this instance")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	playback := &MacroPlayback{
+		Instance:  instanceUUID,
+		Macro:     macro.Name,
+		Speed:     speed,
+		Loops:     loops,
+		Loop:      1,
+		Steps:     len(macro.Steps),
+		Running:   true,
+		StartedAt: time.Now().Unix(),
+		cancel:    cancel,
+	}
+	d.macroPlaybacks.instances[instanceUUID] = playback
+	go d.runMacroPlayback(ctx, instance, controller, macro, playback)
+	status := *playback
+	return &status, nil
+}
+
+// AbortMacroPlayback stops the macro playing on an instance
+func (d *DezkVM) AbortMacroPlayback(instanceUUID string) error {
+	d.macroPlaybacks.mu.Lock()
+	defer d.macroPlaybacks.mu.Unlock()
+	playback, ok := d.macroPlaybacks.instances[instanceUUID]
+	if !ok || !playback.Running {
+		return errors.New("no macro is playing on this instance")
+	}
+	playback.cancel()
+	return nil
+}
+
+// MacroPlaybackStatus returns the state of the last macro playback of an
+// instance, or nil if no macro has been played on it
+func (d *DezkVM) MacroPlaybackStatus(instanceUUID string) *MacroPlayback {
+	d.macroPlaybacks.mu.Lock()
+	defer d.macroPlaybacks.mu.Unlock()
+	playback, ok := d.macroPlaybacks.instances[instanceUUID]
+	if !ok {
+		return nil
+	}
+	status := *playback
+	return &status
+}
+
+// runMacroPlayback sends the steps of the macro through the HID controller.
+// Keys and buttons still pressed when the playback ends are released.
+func (d *DezkVM) runMacroPlayback(ctx context.Context, instance *UsbKvmDeviceInstance, controller *kvmhid.Controller, macro *Macro, playback *MacroPlayback) {
+	reference := usbcapture.CaptureResolution{Width: macro.Width, Height: macro.Height}
+	var playErr error
+loops:
+	for loop := 1; loop <= playback.Loops; loop++ {
+		target := instance.CurrentResolution()
+		for i, step := range macro.Steps {
+			if delay := time.Duration(float64(step.DelayMs) / playback.Speed * float64(time.Millisecond)); delay > 0 {
+				select {
+				case <-ctx.Done():
+					break loops
+				case <-time.After(delay):
+				}
+			}
+			if ctx.Err() != nil {
+				break loops
+			}
+			cmd := step.Command
+			if cmd.Event == kvmhid.EventTypeMouseMove && (cmd.MouseAbsX != 0 || cmd.MouseAbsY != 0) {
+				cmd.MouseAbsX, cmd.MouseAbsY = scaleAbsolutePosition(cmd.MouseAbsX, cmd.MouseAbsY, reference, target)
+			}
+			if _, err := controller.ConstructAndSendCmd(&cmd); err != nil {
+				playErr = err
+				break loops
+			}
+			controller.RecordActivity()
+
+			d.macroPlaybacks.mu.Lock()
+			playback.Loop, playback.Step = loop, i+1
+			d.macroPlaybacks.mu.Unlock()
+		}
+	}
+	if err := controller.ReleaseAll(); err != nil {
+		log.Printf("Warning: failed to release keys of %s after macro %s: %v\n", instance.UUID(), macro.Name, err)
+	}
+
+	d.macroPlaybacks.mu.Lock()
+	defer d.macroPlaybacks.mu.Unlock()
+	playback.Running = false
+	playback.Aborted = ctx.Err() != nil
+	playback.FinishedAt = time.Now().Unix()
+	if playErr != nil {
+		playback.Error = playErr.Error()
+		log.Printf("Macro %s stopped on %s: %v\n", macro.Name, instance.UUID(), playErr)
+	}
+	playback.cancel()
+}
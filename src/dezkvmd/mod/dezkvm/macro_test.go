@@ -0,0 +1,143 @@
+package dezkvm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+// waitForPlayback waits until the macro playback of the instance has finished
+func waitForPlayback(t *testing.T, d *DezkVM, uuid string) *MacroPlayback {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := d.MacroPlaybackStatus(uuid)
+		if status != nil && !status.Running {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("macro playback did not finish: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMacroRecordAndPlayback(t *testing.T) {
+	d, devices := newSimulatedManagerWithDB(t, 2)
+	instances := d.Instances()
+	source, target := instances[0].UUID(), instances[1].UUID()
+
+	if err := d.StartMacroRecording(source); err != nil {
+		t.Fatalf("StartMacroRecording: %v", err)
+	}
+	if err := d.StartMacroRecording(source); err == nil {
+		t.Fatal("second recording on the same instance accepted")
+	}
+
+	// Record a press and release of the A key sent over the HID websocket
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.HandleHIDEvents(w, r, source)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Keyboard reports are acknowledged after the chip has replied
+	send := func(cmd kvmhid.HIDCommand) {
+		t.Helper()
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatalf("WriteJSON: %v", err)
+		}
+		if err := conn.ReadJSON(&map[string]interface{}{}); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+	}
+	send(kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyPress, Keycode: 65, Rid: "1"})
+	if keys := devices[0].CH9329.State().Keys; keys[0] != 0x04 {
+		t.Fatalf("key press not sent to the source: %v", keys)
+	}
+	send(kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyRelease, Keycode: 65, Rid: "2"})
+
+	macro, err := d.StopMacroRecording(source, "bios-a", "Press A")
+	if err != nil {
+		t.Fatalf("StopMacroRecording: %v", err)
+	}
+	if len(macro.Steps) != 2 || macro.Steps[0].DelayMs != 0 || macro.Steps[1].DelayMs < 0 {
+		t.Fatalf("unexpected steps %+v", macro.Steps)
+	}
+	if macro.Steps[0].Command.Rid != "" || macro.Width != 1280 || macro.Height != 720 {
+		t.Fatalf("unexpected macro %+v", macro)
+	}
+	if macros, err := d.ListMacros(); err != nil || len(macros) != 1 || macros[0].StepCount != 2 {
+		t.Fatalf("ListMacros = %+v, %v", macros, err)
+	}
+
+	// Play it twice on the other instance at double speed
+	before := devices[1].CH9329.State().Packets
+	if _, err := d.PlayMacro(target, "bios-a", 2, 2); err != nil {
+		t.Fatalf("PlayMacro: %v", err)
+	}
+	status := waitForPlayback(t, d, target)
+	if status.Aborted || status.Error != "" || status.Loop != 2 || status.Step != 2 {
+		t.Fatalf("unexpected playback status %+v", status)
+	}
+	// 2 loops of press and release, the release at the end may add more
+	if packets := devices[1].CH9329.State().Packets - before; packets < 4 {
+		t.Errorf("target received %d packets, want at least 4", packets)
+	}
+	if keys := devices[1].CH9329.State().Keys; keys != [6]uint8{} {
+		t.Errorf("keys still pressed after playback: %v", keys)
+	}
+}
+
+func TestMacroPlaybackAbort(t *testing.T) {
+	d, devices := newSimulatedManagerWithDB(t, 1)
+	uuid := d.Instances()[0].UUID()
+
+	err := d.SaveMacro(&Macro{
+		Name: "hold-a",
+		Steps: []kvmhid.MacroStep{
+			{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyPress, Keycode: 65}},
+			{DelayMs: 60000, Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyRelease, Keycode: 65}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SaveMacro: %v", err)
+	}
+	if _, err := d.PlayMacro(uuid, "hold-a", 20, 1); err == nil {
+		t.Fatal("out of range speed accepted")
+	}
+	if _, err := d.PlayMacro(uuid, "hold-a", 1, 1); err != nil {
+		t.Fatalf("PlayMacro: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for devices[0].CH9329.State().Keys[0] != 0x04 {
+		if time.Now().After(deadline) {
+			t.Fatal("first step was not played")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := d.PlayMacro(uuid, "hold-a", 1, 1); err == nil {
+		t.Fatal("second playback on the same instance accepted")
+	}
+
+	if err := d.AbortMacroPlayback(uuid); err != nil {
+		t.Fatalf("AbortMacroPlayback: %v", err)
+	}
+	status := waitForPlayback(t, d, uuid)
+	if !status.Aborted || status.Step != 1 {
+		t.Fatalf("unexpected playback status %+v", status)
+	}
+	// The key pressed by the aborted macro is released
+	if keys := devices[0].CH9329.State().Keys; keys[0] != 0x00 {
+		t.Errorf("keys still pressed after abort: %v", keys)
+	}
+}
@@ -0,0 +1,219 @@
+package dezkvm
+
+/*
+	manual.go
+
+	Manually defined instances are used for hardware that cannot be
+	auto-detected by DiscoverUsbKvmSubtree, e.g. a plain CH9329 cable and
+	a separate MS2109 dongle connected to different USB hubs. Admins define
+	the device nodes explicitly, preferably with the stable
+	/dev/serial/by-id and /dev/v4l/by-id paths, and the definitions are
+	stored in a JSON file and merged with the auto-detected instances.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+)
+
+// LoadManualInstances reads the manually defined instances from disk. The
+// file may be edited by hand, definitions that are invalid or use devices
+// of another instance or definition are logged and skipped.
+func (d *DezkVM) LoadManualInstances() ([]*UsbKvmDeviceOption, error) {
+	data, err := os.ReadFile(d.ManualInstanceFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*UsbKvmDeviceOption{}, nil
+		}
+		return nil, err
+	}
+	definitions := []*UsbKvmDeviceOption{}
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, err
+	}
+	valid := []*UsbKvmDeviceOption{}
+	used := d.usedDevicePaths()
+	for i, def := range definitions {
+		if def == nil {
+			continue
+		}
+		if err := validateManualInstance(def); err != nil {
+			log.Printf("Warning: skipping manual instance %d in %s: %v\n", i, d.ManualInstanceFilePath, err)
+			continue
+		}
+		if devicesInUse(def, used) {
+			log.Printf("Warning: skipping manual instance %d in %s: one or more devices are already used by another instance\n", i, d.ManualInstanceFilePath)
+			continue
+		}
+		for _, p := range def.devicePaths() {
+			used[canonicalDevicePath(p)] = true
+		}
+		def.Manual = true
+		valid = append(valid, def)
+	}
+	return valid, nil
+}
+
+// saveManualInstances writes the manually defined instances of the manager to disk.
+func (d *DezkVM) saveManualInstances() error {
+	definitions := []UsbKvmDeviceOption{}
+	for _, instance := range d.Instances() {
+		// Copy the config under the state lock, resolution changes update it
+		instance.stateMu.RLock()
+		config := *instance.Config
+		instance.stateMu.RUnlock()
+		if config.Manual {
+			definitions = append(definitions, config)
+		}
+	}
+	data, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.ManualInstanceFilePath, data, 0644)
+}
+
+// validateManualInstance checks that a manual definition has all required device paths.
+func validateManualInstance(config *UsbKvmDeviceOption) error {
+	if config.USBKVMDevicePath == "" {
+		return errors.New("HID device path is not specified")
+	}
+	switch config.HIDBackend {
+	case "", HIDBackendCH9329:
+	case HIDBackendGadget:
+		if config.HIDMouseDevicePath == "" {
+			return errors.New("HID mouse device path of the gadget is not specified")
+		}
+		if serial.IsNetworkPath(config.USBKVMDevicePath) {
+			return errors.New("the gadget HID backend cannot use a network device path")
+		}
+	default:
+		return errors.New("unknown HID backend: " + config.HIDBackend)
+	}
+	for _, p := range []string{config.USBKVMDevicePath, config.AuxMCUDevicePath} {
+		if serial.IsNetworkPath(p) {
+			if _, _, err := serial.ParseNetworkPath(p); err != nil {
+				return err
+			}
+		}
+	}
+	if config.VideoCaptureDevicePath == "" {
+		return errors.New("video capture device path is not specified")
+	}
+	if config.AudioCaptureDevicePath == "" {
+		return errors.New("audio capture device path is not specified")
+	}
+	if config.InstanceID != "" && !IsValidInstanceID(config.InstanceID) {
+		return errors.New("invalid instance ID")
+	}
+	return nil
+}
+
+// AddManualInstance adds a manually defined instance, persists it and starts it.
+// Failing to start the instance is not an error, it is retried in background
+// like any other instance.
+func (d *DezkVM) AddManualInstance(config *UsbKvmDeviceOption) (*UsbKvmDeviceInstance, error) {
+	if err := validateManualInstance(config); err != nil {
+		return nil, err
+	}
+	d.manualMu.Lock()
+	defer d.manualMu.Unlock()
+	if d.IsDeviceInUse(config) {
+		return nil, errors.New("one or more devices are already used by another instance")
+	}
+	config.Manual = true
+	if err := d.AddUsbKvmDevice(config); err != nil {
+		return nil, err
+	}
+	instance := d.getInstanceByConfig(config)
+	if err := d.saveManualInstances(); err != nil {
+		d.removeInstance(instance)
+		return nil, err
+	}
+	d.StartUsbKvmDevice(instance)
+	return instance, nil
+}
+
+// RemoveManualInstance stops and removes the manually defined instance that
+// uses the given HID device path.
+func (d *DezkVM) RemoveManualInstance(hidDevicePath string) error {
+	d.manualMu.Lock()
+	defer d.manualMu.Unlock()
+	target := canonicalDevicePath(hidDevicePath)
+	for _, instance := range d.ListManualInstances() {
+		if canonicalDevicePath(instance.Config.USBKVMDevicePath) == target {
+			instance.Stop()
+			d.removeInstance(instance)
+			return d.saveManualInstances()
+		}
+	}
+	return errors.New("manual instance not found")
+}
+
+// ListManualInstances returns all manually defined instances.
+func (d *DezkVM) ListManualInstances() []*UsbKvmDeviceInstance {
+	result := []*UsbKvmDeviceInstance{}
+	for _, instance := range d.Instances() {
+		if instance.Config.Manual {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// IsDeviceInUse checks if any device node of the given config is already used
+// by a registered instance. Symlinks such as /dev/serial/by-id/* are resolved
+// before comparing, so the same device is detected under different names.
+func (d *DezkVM) IsDeviceInUse(config *UsbKvmDeviceOption) bool {
+	return devicesInUse(config, d.usedDevicePaths())
+}
+
+// usedDevicePaths returns the canonical device paths of all registered instances.
+func (d *DezkVM) usedDevicePaths() map[string]bool {
+	used := map[string]bool{}
+	for _, instance := range d.Instances() {
+		for _, p := range instance.Config.devicePaths() {
+			used[canonicalDevicePath(p)] = true
+		}
+	}
+	return used
+}
+
+// devicesInUse checks if any device path of the config is in the used set.
+func devicesInUse(config *UsbKvmDeviceOption, used map[string]bool) bool {
+	for _, p := range config.devicePaths() {
+		if used[canonicalDevicePath(p)] {
+			return true
+		}
+	}
+	return false
+}
+
+// devicePaths returns all non-empty device paths of the option.
+func (o *UsbKvmDeviceOption) devicePaths() []string {
+	paths := []string{}
+	for _, p := range []string{o.USBKVMDevicePath, o.AuxMCUDevicePath, o.VideoCaptureDevicePath, o.AudioCaptureDevicePath} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// canonicalDevicePath resolves symlinks of a device path, falling back to the
+// cleaned path if the device is not present. Network paths are kept as they are.
+func canonicalDevicePath(path string) string {
+	if serial.IsNetworkPath(path) {
+		return path
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return resolved
+}
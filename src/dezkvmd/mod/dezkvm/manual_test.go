@@ -0,0 +1,35 @@
+package dezkvm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadManualInstancesSkipsInvalidDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	manualFile := filepath.Join(dir, "manual_instances.json")
+	d := NewKvmHostInstance(&RuntimeOptions{
+		ConfigFolderPath: filepath.Join(dir, "instances"),
+		ManualFilePath:   manualFile,
+	})
+	defer d.Close()
+
+	definitions := `[
+		{"usb_kvm_device_path": "/dev/ttyUSB0", "video_capture_device_path": "/dev/video0", "audio_capture_device_path": "/dev/snd/pcmC1D0c"},
+		{"usb_kvm_device_path": "/dev/ttyUSB1", "audio_capture_device_path": "/dev/snd/pcmC2D0c"},
+		{"usb_kvm_device_path": "/dev/ttyUSB2", "video_capture_device_path": "/dev/video2", "audio_capture_device_path": "/dev/snd/pcmC3D0c", "hid_backend": "bluetooth"},
+		{"usb_kvm_device_path": "/dev/ttyUSB3", "video_capture_device_path": "/dev/video3", "audio_capture_device_path": "/dev/snd/pcmC4D0c", "instance_id": "not a valid id!"},
+		{"usb_kvm_device_path": "/dev/ttyUSB0", "video_capture_device_path": "/dev/video4", "audio_capture_device_path": "/dev/snd/pcmC5D0c"}
+	]`
+	if err := os.WriteFile(manualFile, []byte(definitions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := d.LoadManualInstances()
+	if err != nil {
+		t.Fatalf("LoadManualInstances: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].USBKVMDevicePath != "/dev/ttyUSB0" || !loaded[0].Manual {
+		t.Errorf("loaded %+v, want only the first definition", loaded)
+	}
+}
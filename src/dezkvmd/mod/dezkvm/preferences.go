@@ -0,0 +1,148 @@
+package dezkvm
+
+/*
+	preferences.go
+
+	Schema versioning, validation and migration of the per-instance
+	preference files. Files written before versioning was introduced have
+	schema version 0 and are migrated to the current version on load.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+// PreferencesSchemaVersion is the schema version of preference files written by this build
+const PreferencesSchemaVersion = 1
+
+// Sensitivity range of the scroll wheel and relative mouse mode, same as the web UI sliders
+const (
+	MinSensitivity = 1
+	MaxSensitivity = 10
+)
+
+// SupportedStackToggleKeys lists the event.code values that can toggle key stacking
+var SupportedStackToggleKeys = []string{
+	"ShiftRight", "ControlRight", "ContextMenu", "ScrollLock", "Pause", "NumLock",
+	"F1", "F2", "F3", "F4", "F5", "F6", "F7", "F8", "F9", "F10", "F11", "F12",
+}
+
+// fieldErrors returns the invalid fields of the preferences, keyed by their JSON name
+func (p *UsbKvmPreferences) fieldErrors() map[string]string {
+	errs := map[string]string{}
+	if p.ScrollSensitivity < MinSensitivity || p.ScrollSensitivity > MaxSensitivity {
+		errs["scroll_sensitivity"] = fmt.Sprintf("must be between %d and %d", MinSensitivity, MaxSensitivity)
+	}
+	if p.RelativeMouseSensitivity < MinSensitivity || p.RelativeMouseSensitivity > MaxSensitivity {
+		errs["relative_mouse_sensitivity"] = fmt.Sprintf("must be between %d and %d", MinSensitivity, MaxSensitivity)
+	}
+	if !isSupportedStackToggleKey(p.StackToggleKey) {
+		errs["stack_toggle_key"] = fmt.Sprintf("%q is not a supported key", p.StackToggleKey)
+	}
+	if _, err := kvmhid.GetKeyboardLayout(p.KeyboardLayout); err != nil {
+		errs["keyboard_layout"] = fmt.Sprintf("%q is not a supported layout", p.KeyboardLayout)
+	}
+	if maxTimeout := int(kvmhid.MaxStuckKeyTimeout.Seconds()); p.StuckKeyTimeout < 0 || p.StuckKeyTimeout > maxTimeout {
+		errs["stuck_key_timeout"] = fmt.Sprintf("must be between 0 and %d", maxTimeout)
+	}
+	return errs
+}
+
+// Validate checks that all fields of the preferences are within range
+func (p *UsbKvmPreferences) Validate() error {
+	errs := p.fieldErrors()
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for field, msg := range errs {
+		messages = append(messages, field+" "+msg)
+	}
+	sort.Strings(messages)
+	return fmt.Errorf("invalid preferences: %s", strings.Join(messages, "; "))
+}
+
+// sanitize resets invalid fields to their defaults and returns their names
+func (p *UsbKvmPreferences) sanitize() []string {
+	defaults := DefaultPreferences()
+	reset := []string{}
+	for field := range p.fieldErrors() {
+		switch field {
+		case "scroll_sensitivity":
+			p.ScrollSensitivity = defaults.ScrollSensitivity
+		case "relative_mouse_sensitivity":
+			p.RelativeMouseSensitivity = defaults.RelativeMouseSensitivity
+		case "stack_toggle_key":
+			p.StackToggleKey = defaults.StackToggleKey
+		case "keyboard_layout":
+			p.KeyboardLayout = defaults.KeyboardLayout
+		case "stuck_key_timeout":
+			p.StuckKeyTimeout = defaults.StuckKeyTimeout
+		}
+		reset = append(reset, field)
+	}
+	sort.Strings(reset)
+	return reset
+}
+
+func isSupportedStackToggleKey(code string) bool {
+	for _, key := range SupportedStackToggleKeys {
+		if key == code {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePreferences reads a preference file and migrates it to the current
+// schema version. Fields missing from older files get their default values
+// and invalid values are reset. migrated is true if the file content changed.
+func parsePreferences(data []byte) (prefs *UsbKvmPreferences, migrated bool, err error) {
+	var probe struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, false, err
+	}
+	if probe.SchemaVersion > PreferencesSchemaVersion {
+		return nil, false, fmt.Errorf("preferences schema version %d is newer than the supported version %d", probe.SchemaVersion, PreferencesSchemaVersion)
+	}
+
+	prefs = DefaultPreferences()
+	if err := json.Unmarshal(data, prefs); err != nil {
+		return nil, false, err
+	}
+	migrated = probe.SchemaVersion < PreferencesSchemaVersion
+	prefs.SchemaVersion = PreferencesSchemaVersion
+	if reset := prefs.sanitize(); len(reset) > 0 {
+		migrated = true
+	}
+	return prefs, migrated, nil
+}
+
+// decodePreferencesUpdate applies a JSON preferences update to base and
+// validates the result. Unknown fields are rejected, so typos do not get
+// silently ignored.
+func decodePreferencesUpdate(body []byte, base *UsbKvmPreferences) (*UsbKvmPreferences, error) {
+	prefs := *base
+	prefs.SchemaVersion = 0
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&prefs); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	if prefs.SchemaVersion != 0 && prefs.SchemaVersion != PreferencesSchemaVersion {
+		return nil, fmt.Errorf("unsupported preferences schema version %d", prefs.SchemaVersion)
+	}
+	prefs.SchemaVersion = PreferencesSchemaVersion
+	if err := prefs.Validate(); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
@@ -0,0 +1,112 @@
+package dezkvm
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadPreferencesMigratesOldFiles(t *testing.T) {
+	d := NewKvmHostInstance(&RuntimeOptions{ConfigFolderPath: t.TempDir()})
+	// Written before schema versioning, without the key stacking fields
+	// and with a scroll sensitivity the web UI could not set
+	old := `{"invert_scroll_direction":true,"scroll_sensitivity":0,"enable_mouse_jiggler":true}`
+	if err := os.WriteFile(d.preferencesFilePath("rack1-a"), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prefs, err := d.LoadPreferences("rack1-a")
+	if err != nil {
+		t.Fatalf("LoadPreferences: %v", err)
+	}
+	defaults := DefaultPreferences()
+	if !prefs.InvertScrollDirection || !prefs.EnableMouseJiggler {
+		t.Errorf("existing fields lost: %+v", prefs)
+	}
+	if prefs.StackToggleKey != defaults.StackToggleKey || prefs.AskOnPaste != defaults.AskOnPaste {
+		t.Errorf("missing fields not set to defaults: %+v", prefs)
+	}
+	if prefs.ScrollSensitivity != defaults.ScrollSensitivity {
+		t.Errorf("invalid scroll sensitivity not reset, got %d", prefs.ScrollSensitivity)
+	}
+	if prefs.SchemaVersion != PreferencesSchemaVersion {
+		t.Errorf("schema version = %d, want %d", prefs.SchemaVersion, PreferencesSchemaVersion)
+	}
+
+	// The migrated file is written back
+	data, _ := os.ReadFile(d.preferencesFilePath("rack1-a"))
+	var saved UsbKvmPreferences
+	if err := json.Unmarshal(data, &saved); err != nil || saved != *prefs {
+		t.Errorf("migrated file = %s, %v", data, err)
+	}
+
+	newer := `{"schema_version":99}`
+	os.WriteFile(d.preferencesFilePath("rack1-b"), []byte(newer), 0644)
+	if _, err := d.LoadPreferences("rack1-b"); err == nil {
+		t.Error("preferences of a newer schema version accepted")
+	}
+}
+
+func TestDecodePreferencesUpdate(t *testing.T) {
+	current := DefaultPreferences()
+	current.EnableMouseJiggler = true
+	current.ScrollSensitivity = 7
+
+	// PATCH only changes the given fields
+	prefs, err := decodePreferencesUpdate([]byte(`{"stack_toggle_key":"ScrollLock"}`), current)
+	if err != nil {
+		t.Fatalf("partial update: %v", err)
+	}
+	if prefs.StackToggleKey != "ScrollLock" || !prefs.EnableMouseJiggler || prefs.ScrollSensitivity != 7 {
+		t.Errorf("partial update changed other fields: %+v", prefs)
+	}
+	if current.StackToggleKey != "ShiftRight" {
+		t.Error("partial update modified the base preferences")
+	}
+
+	tests := []struct {
+		body    string
+		wantErr string
+	}{
+		{`{"scroll_sensitivity":11}`, "scroll_sensitivity must be between 1 and 10"},
+		{`{"relative_mouse_sensitivity":0}`, "relative_mouse_sensitivity must be between 1 and 10"},
+		{`{"stack_toggle_key":"KeyA"}`, `stack_toggle_key "KeyA" is not a supported key`},
+		{`{"scroll_sensitivty":3}`, "unknown field"},
+		{`{"schema_version":2}`, "unsupported preferences schema version"},
+		{`{"scroll_sensitivity":300}`, "invalid request body"},
+	}
+	for _, tt := range tests {
+		_, err := decodePreferencesUpdate([]byte(tt.body), current)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.body, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPinInstanceIDAppliesMigratedPreferences(t *testing.T) {
+	d, _ := newSimulatedManager(t, 1)
+	instance := d.Instances()[0]
+	oldID := instance.UUID()
+
+	// The preference file changed on disk since the instance started
+	prefs := instance.GetPreferences()
+	prefs.ScrollSensitivity = 7
+	data, _ := json.Marshal(prefs)
+	if err := os.WriteFile(d.preferencesFilePath(oldID), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PinInstanceID(oldID, "rack1-pinned"); err != nil {
+		t.Fatalf("PinInstanceID: %v", err)
+	}
+	if instance.UUID() != "rack1-pinned" {
+		t.Fatalf("instance ID = %s, want rack1-pinned", instance.UUID())
+	}
+	if got := instance.GetPreferences().ScrollSensitivity; got != 7 {
+		t.Errorf("scroll sensitivity = %d, migrated preferences not applied", got)
+	}
+	if _, err := os.Stat(d.preferencesFilePath("rack1-pinned")); err != nil {
+		t.Errorf("preference file not migrated: %v", err)
+	}
+}
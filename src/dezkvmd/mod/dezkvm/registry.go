@@ -0,0 +1,155 @@
+package dezkvm
+
+/*
+	registry.go
+
+	The instance registry stores user-defined metadata of each instance
+	(display name, location, asset tag, etc.) in the system database,
+	keyed by the instance UUID. Entries are independent from the runtime
+	instances, so they can be edited while the device is offline.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const registryBucket = "instance_registry"
+
+// InstanceMetadata holds the user-defined metadata of an instance
+type InstanceMetadata struct {
+	UUID        string   `json:"uuid"`
+	DisplayName string   `json:"display_name"` // Friendly name shown in the UI
+	Description string   `json:"description"`  // Short description of the target machine
+	Location    string   `json:"location"`     // Physical location, e.g. rack and slot
+	AssetTag    string   `json:"asset_tag"`    // Asset tag of the target machine
+	TargetOS    string   `json:"target_os"`    // Operating system running on the target machine
+	Tags        []string `json:"tags"`         // Free-form tags for grouping and filtering
+	SortOrder   int      `json:"sort_order"`   // Position of the instance in the UI, lower comes first
+	Notes       string   `json:"notes"`        // Free-form notes
+	UpdatedAt   int64    `json:"updated_at"`   // Unix timestamp of the last update
+}
+
+// HasTag checks if the metadata contains the given tag (case insensitive).
+func (m *InstanceMetadata) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize trims whitespace and removes empty or duplicated tags.
+func (m *InstanceMetadata) normalize() {
+	m.DisplayName = strings.TrimSpace(m.DisplayName)
+	m.Location = strings.TrimSpace(m.Location)
+	m.AssetTag = strings.TrimSpace(m.AssetTag)
+	m.TargetOS = strings.TrimSpace(m.TargetOS)
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, t := range m.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[strings.ToLower(t)] {
+			continue
+		}
+		seen[strings.ToLower(t)] = true
+		tags = append(tags, t)
+	}
+	m.Tags = tags
+}
+
+// GetInstanceMetadata returns the registry entry of the given instance.
+// If there is no entry, an empty one is returned.
+func (d *DezkVM) GetInstanceMetadata(uuid string) (*InstanceMetadata, error) {
+	if d.db == nil {
+		return nil, errors.New("instance registry is not available")
+	}
+	data, err := d.db.Read(registryBucket, uuid)
+	if err != nil {
+		return nil, err
+	}
+	meta := &InstanceMetadata{UUID: uuid, Tags: []string{}}
+	if data == nil {
+		return meta, nil
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	meta.UUID = uuid
+	return meta, nil
+}
+
+// SetInstanceMetadata creates or replaces the registry entry of an instance.
+func (d *DezkVM) SetInstanceMetadata(meta *InstanceMetadata) error {
+	if d.db == nil {
+		return errors.New("instance registry is not available")
+	}
+	if !IsValidInstanceID(meta.UUID) {
+		return errors.New("invalid instance ID")
+	}
+	meta.normalize()
+	meta.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return d.db.Write(registryBucket, meta.UUID, data)
+}
+
+// DeleteInstanceMetadata removes the registry entry of an instance.
+func (d *DezkVM) DeleteInstanceMetadata(uuid string) error {
+	if d.db == nil {
+		return errors.New("instance registry is not available")
+	}
+	return d.db.Delete(registryBucket, uuid)
+}
+
+// ListInstanceMetadata returns all registry entries, optionally filtered by tag,
+// sorted by sort order and display name.
+func (d *DezkVM) ListInstanceMetadata(tag string) ([]*InstanceMetadata, error) {
+	if d.db == nil {
+		return nil, errors.New("instance registry is not available")
+	}
+	result := []*InstanceMetadata{}
+	err := d.db.List(registryBucket, func(key, value []byte) error {
+		meta := &InstanceMetadata{}
+		if err := json.Unmarshal(value, meta); err != nil {
+			return nil // Skip corrupted entries
+		}
+		meta.UUID = string(key)
+		if tag != "" && !meta.HasTag(tag) {
+			return nil
+		}
+		result = append(result, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].SortOrder != result[j].SortOrder {
+			return result[i].SortOrder < result[j].SortOrder
+		}
+		return result[i].DisplayName < result[j].DisplayName
+	})
+	return result, nil
+}
+
+// renameInstanceMetadata moves the registry entry of an instance to a new ID.
+func (d *DezkVM) renameInstanceMetadata(oldID string, newID string) error {
+	if d.db == nil || oldID == newID {
+		return nil
+	}
+	data, err := d.db.Read(registryBucket, oldID)
+	if err != nil || data == nil {
+		return err
+	}
+	if err := d.db.Write(registryBucket, newID, data); err != nil {
+		return err
+	}
+	return d.db.Delete(registryBucket, oldID)
+}
@@ -0,0 +1,69 @@
+package dezkvm
+
+import "testing"
+
+func TestInstanceRegistry(t *testing.T) {
+	d, _ := newSimulatedManagerWithDB(t, 0)
+
+	meta, err := d.GetInstanceMetadata("rack-1")
+	if err != nil || meta.UUID != "rack-1" || meta.DisplayName != "" {
+		t.Fatalf("GetInstanceMetadata without entry = %+v, %v", meta, err)
+	}
+	if err := d.SetInstanceMetadata(&InstanceMetadata{UUID: "../escape"}); err == nil {
+		t.Error("entry with an invalid instance ID accepted")
+	}
+
+	entries := []*InstanceMetadata{
+		{UUID: "rack-1", DisplayName: " Web server ", Tags: []string{"prod", " PROD", "", "linux"}, SortOrder: 2},
+		{UUID: "rack-2", DisplayName: "Build box", Tags: []string{"linux"}, SortOrder: 1},
+		{UUID: "rack-3", DisplayName: "Alpha", Tags: []string{"windows"}, SortOrder: 2},
+	}
+	for _, entry := range entries {
+		if err := d.SetInstanceMetadata(entry); err != nil {
+			t.Fatalf("SetInstanceMetadata: %v", err)
+		}
+	}
+	meta, err = d.GetInstanceMetadata("rack-1")
+	if err != nil || meta.DisplayName != "Web server" || len(meta.Tags) != 2 || meta.UpdatedAt == 0 {
+		t.Errorf("stored entry = %+v, %v, want trimmed name and deduplicated tags", meta, err)
+	}
+
+	list, err := d.ListInstanceMetadata("")
+	if err != nil {
+		t.Fatalf("ListInstanceMetadata: %v", err)
+	}
+	order := []string{}
+	for _, entry := range list {
+		order = append(order, entry.UUID)
+	}
+	if len(order) != 3 || order[0] != "rack-2" || order[1] != "rack-3" || order[2] != "rack-1" {
+		t.Errorf("registry order = %v, want sort order then display name", order)
+	}
+	list, _ = d.ListInstanceMetadata("Linux")
+	if len(list) != 2 {
+		t.Errorf("tag filter returned %d entries, want 2", len(list))
+	}
+
+	if err := d.DeleteInstanceMetadata("rack-2"); err != nil {
+		t.Fatalf("DeleteInstanceMetadata: %v", err)
+	}
+	if list, _ := d.ListInstanceMetadata("linux"); len(list) != 1 || list[0].UUID != "rack-1" {
+		t.Errorf("entries after delete = %+v", list)
+	}
+}
+
+func TestListInstanceInfoSortOrder(t *testing.T) {
+	d, _ := newSimulatedManagerWithDB(t, 2)
+	instances := d.Instances()
+	first, second := instances[0].UUID(), instances[1].UUID()
+	d.SetInstanceMetadata(&InstanceMetadata{UUID: first, Tags: []string{"lab"}, SortOrder: 5})
+	d.SetInstanceMetadata(&InstanceMetadata{UUID: second, Tags: []string{"lab"}, SortOrder: 1})
+
+	infos := d.ListInstanceInfo("lab")
+	if len(infos) != 2 {
+		t.Fatalf("got %d instances, want 2", len(infos))
+	}
+	if infos[0]["uuid"] != second || infos[1]["uuid"] != first {
+		t.Errorf("instance order = %v, %v, want the lower sort order first", infos[0]["uuid"], infos[1]["uuid"])
+	}
+}
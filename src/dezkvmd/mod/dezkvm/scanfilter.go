@@ -0,0 +1,244 @@
+package dezkvm
+
+/*
+	scanfilter.go
+
+	Writing the 'u' sniff command to every /dev/ttyACM* device can reset or
+	confuse other serial gear on the host (3D printers, UPS links etc).
+	Before opening anything, each device node is identified from sysfs by
+	its USB VID:PID, product string and interface class, and only devices
+	that are known (or explicitly allowed) are used for KVM instances.
+
+	Filter rules are strings in one of the following forms:
+	  1a86:7523        exact USB VID:PID
+	  1a86:*           any product from the vendor
+	  /dev/ttyUSB0     a device node (symlinks are resolved)
+	  product:CH340    substring of the USB product string (case insensitive)
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ScanDeviceKind is the kind of device node found during scanning
+type ScanDeviceKind string
+
+const (
+	ScanDeviceKindUSBSerial ScanDeviceKind = "tty-usb" // USB-UART bridge, used as HID controller (CH340 -> CH9329)
+	ScanDeviceKindACMSerial ScanDeviceKind = "tty-acm" // USB CDC ACM device, possibly an AuxMCU
+	ScanDeviceKindVideo     ScanDeviceKind = "video"   // V4L2 video node
+	ScanDeviceKindAudio     ScanDeviceKind = "audio"   // ALSA PCM node
+)
+
+// ScanFilter holds the allow and deny rules used during device scanning.
+// Deny rules always win. Allow rules extend the built-in list of known devices.
+type ScanFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ScanCandidate is a device node considered during scanning, together with
+// the USB properties read from sysfs and the reason it was accepted or rejected.
+type ScanCandidate struct {
+	DevicePath     string         `json:"device_path"`
+	Kind           ScanDeviceKind `json:"kind"`
+	SysPath        string         `json:"sys_path"`
+	VendorID       string         `json:"vendor_id"`
+	ProductID      string         `json:"product_id"`
+	Manufacturer   string         `json:"manufacturer"`
+	Product        string         `json:"product"`
+	InterfaceClass string         `json:"interface_class"`
+	Accepted       bool           `json:"accepted"`
+	Reason         string         `json:"reason"`
+}
+
+// knownSerialDevice describes a USB serial device used by DezKVM port modules
+type knownSerialDevice struct {
+	VendorID  string
+	ProductID string
+	Kind      ScanDeviceKind
+	Name      string
+}
+
+// knownSerialDevices lists the serial devices that can be used without
+// adding them to the allow list.
+var knownSerialDevices = []knownSerialDevice{
+	{"1a86", "7523", ScanDeviceKindUSBSerial, "CH340 USB-UART (CH9329 HID bridge)"},
+	{"1a86", "7522", ScanDeviceKindUSBSerial, "CH340K USB-UART (CH9329 HID bridge)"},
+	{"1209", "c550", ScanDeviceKindACMSerial, "CH55x CDC (DezKVM AuxMCU)"},
+	{"1209", "c55d", ScanDeviceKindACMSerial, "CH55x CDC (DezKVM AuxMCU, v1/v2 PCB)"},
+}
+
+// USB interface classes expected for each device kind
+var expectedInterfaceClasses = map[ScanDeviceKind][]string{
+	ScanDeviceKindUSBSerial: {"ff"},       // Vendor specific
+	ScanDeviceKindACMSerial: {"02", "0a"}, // CDC control / CDC data
+	ScanDeviceKindVideo:     {"0e"},       // Video
+	ScanDeviceKindAudio:     {"01"},       // Audio
+}
+
+// DefaultScanFilter returns an empty filter that only accepts known devices.
+func DefaultScanFilter() *ScanFilter {
+	return &ScanFilter{
+		Allow: []string{},
+		Deny:  []string{},
+	}
+}
+
+// LoadScanFilter loads the scan filter from a JSON file. If the file does not
+// exist, the default filter is returned.
+func LoadScanFilter(path string) (*ScanFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultScanFilter(), nil
+		}
+		return nil, err
+	}
+	filter := DefaultScanFilter()
+	if err := json.Unmarshal(data, filter); err != nil {
+		return nil, fmt.Errorf("failed to parse scan filter %s: %w", path, err)
+	}
+	return filter, nil
+}
+
+// matchRule checks if the candidate matches a single filter rule.
+func (c *ScanCandidate) matchRule(rule string) bool {
+	rule = strings.TrimSpace(rule)
+	switch {
+	case rule == "":
+		return false
+	case strings.HasPrefix(rule, "/"):
+		return canonicalDevicePath(rule) == canonicalDevicePath(c.DevicePath)
+	case strings.HasPrefix(strings.ToLower(rule), "product:"):
+		substr := strings.ToLower(strings.TrimSpace(rule[len("product:"):]))
+		return substr != "" && strings.Contains(strings.ToLower(c.Product), substr)
+	case strings.Contains(rule, ":"):
+		parts := strings.SplitN(strings.ToLower(rule), ":", 2)
+		if parts[0] != c.VendorID {
+			return false
+		}
+		return parts[1] == "*" || parts[1] == c.ProductID
+	}
+	return false
+}
+
+// matchAny returns the first rule in the list matching the candidate.
+func (c *ScanCandidate) matchAny(rules []string) (string, bool) {
+	for _, rule := range rules {
+		if c.matchRule(rule) {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+// Evaluate decides whether the candidate can be used, and records the reason.
+func (f *ScanFilter) Evaluate(c *ScanCandidate) {
+	if c.SysPath == "" {
+		c.Accepted, c.Reason = false, "cannot resolve sysfs path"
+		return
+	}
+	if c.VendorID == "" {
+		c.Accepted, c.Reason = false, "not a USB device"
+		return
+	}
+	if rule, ok := c.matchAny(f.Deny); ok {
+		c.Accepted, c.Reason = false, fmt.Sprintf("matched deny rule %q", rule)
+		return
+	}
+	if rule, ok := c.matchAny(f.Allow); ok {
+		c.Accepted, c.Reason = true, fmt.Sprintf("matched allow rule %q", rule)
+		return
+	}
+
+	// A known device can expose several interfaces (e.g. UVC + UAC on a
+	// capture card), only the interface of the expected class is accepted
+	expected := expectedInterfaceClasses[c.Kind]
+	classOk := false
+	for _, class := range expected {
+		if c.InterfaceClass == class {
+			classOk = true
+			break
+		}
+	}
+	if !classOk {
+		c.Accepted, c.Reason = false, fmt.Sprintf("unexpected interface class %q for %s (expected %s)", c.InterfaceClass, c.Kind, strings.Join(expected, " or "))
+		return
+	}
+
+	switch c.Kind {
+	case ScanDeviceKindVideo, ScanDeviceKindAudio:
+		// Capture cards vary a lot, matching interface class is enough
+		c.Accepted, c.Reason = true, fmt.Sprintf("USB %s class interface", c.Kind)
+	default:
+		for _, known := range knownSerialDevices {
+			if known.VendorID == c.VendorID && known.ProductID == c.ProductID {
+				c.Accepted, c.Reason = true, "known device: "+known.Name
+				return
+			}
+		}
+		c.Accepted, c.Reason = false, fmt.Sprintf("unknown serial device %s:%s, add it to the allow list to use it", c.VendorID, c.ProductID)
+	}
+}
+
+// ScanCandidates lists all tty, video and ALSA capture nodes on the host and
+// evaluates them against the filter. No device is opened during this process.
+func ScanCandidates(filter *ScanFilter) []*ScanCandidate {
+	if filter == nil {
+		filter = DefaultScanFilter()
+	}
+	patterns := []struct {
+		glob string
+		kind ScanDeviceKind
+	}{
+		{filepath.Join(devRoot, "ttyUSB*"), ScanDeviceKindUSBSerial},
+		{filepath.Join(devRoot, "ttyACM*"), ScanDeviceKindACMSerial},
+		{filepath.Join(devRoot, "video*"), ScanDeviceKindVideo},
+		{filepath.Join(devRoot, "snd", "pcmC*c"), ScanDeviceKindAudio},
+	}
+
+	candidates := []*ScanCandidate{}
+	for _, p := range patterns {
+		devs, _ := filepath.Glob(p.glob)
+		for _, dev := range devs {
+			candidate := &ScanCandidate{
+				DevicePath: dev,
+				Kind:       p.kind,
+			}
+			if sysPath, err := getDeviceFullPath(dev); err == nil {
+				candidate.SysPath = sysPath
+				fillUsbProperties(candidate)
+			}
+			filter.Evaluate(candidate)
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// fillUsbProperties reads the USB properties of a candidate from sysfs.
+func fillUsbProperties(c *ScanCandidate) {
+	usbDir := usbDeviceDir(c.SysPath)
+	if usbDir == "" {
+		return
+	}
+	c.VendorID = strings.ToLower(readSysfsAttr(usbDir, "idVendor"))
+	c.ProductID = strings.ToLower(readSysfsAttr(usbDir, "idProduct"))
+	c.Manufacturer = readSysfsAttr(usbDir, "manufacturer")
+	c.Product = readSysfsAttr(usbDir, "product")
+
+	// The interface directory sits between the device node and the USB device
+	dir := c.SysPath
+	for dir != usbDir && dir != "/" && dir != "." {
+		if class := readSysfsAttr(dir, "bInterfaceClass"); class != "" {
+			c.InterfaceClass = strings.ToLower(class)
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,289 @@
+package dezkvm
+
+/*
+	script.go
+
+	DuckyScript keystroke scripts are stored by name in the system database
+	so a library of scripts can be shared between techs. Scripts are
+	validated with the keyboard layout of the target before they run, and
+	only one script runs on an instance at a time.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+const scriptBucket = "ducky_scripts"
+
+// MaxScriptLength is the maximum size of a script source in bytes
+const MaxScriptLength = 1024 * 1024
+
+// Script is a stored DuckyScript
+type Script struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Source      string `json:"source"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+// ScriptInfo describes a script without its source
+type ScriptInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Lines       int    `json:"lines"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+// ScriptValidationError is returned when a script does not parse
+type ScriptValidationError struct {
+	Errors []kvmhid.ScriptError
+}
+
+func (e *ScriptValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return "script has an error on " + e.Errors[0].Error()
+	}
+	return "script has errors on " + e.Errors[0].Error() + " and more lines"
+}
+
+// ScriptRun is the state of a script running on an instance
+type ScriptRun struct {
+	Instance   string `json:"instance"`
+	Script     string `json:"script"` // Name of the script, empty for ad-hoc scripts
+	Layout     string `json:"layout"`
+	Line       int    `json:"line"`    // Line of the command being run
+	Command    int    `json:"command"` // Commands started, including the current one
+	Commands   int    `json:"commands"`
+	Running    bool   `json:"running"`
+	Cancelled  bool   `json:"cancelled"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// scriptRuns tracks the last script run of each instance
+type scriptRuns struct {
+	mu        sync.Mutex
+	instances map[string]*ScriptRun
+}
+
+// Info returns the summary of the script
+func (s *Script) Info() *ScriptInfo {
+	return &ScriptInfo{
+		Name:        s.Name,
+		Description: s.Description,
+		Lines:       strings.Count(s.Source, "\n") + 1,
+		UpdatedAt:   s.UpdatedAt,
+	}
+}
+
+// ParseScript parses a script with a keyboard layout, the default layout
+// is used if layoutID is empty. Parse errors are returned as a
+// *ScriptValidationError.
+func ParseScript(source string, layoutID string) (*kvmhid.DuckyScript, error) {
+	if len(source) > MaxScriptLength {
+		return nil, errors.New("script is too long")
+	}
+	if layoutID == "" {
+		layoutID = kvmhid.DefaultKeyboardLayout
+	}
+	layout, err := kvmhid.GetKeyboardLayout(layoutID)
+	if err != nil {
+		return nil, err
+	}
+	parsed, errs := kvmhid.ParseDuckyScript(source, layout)
+	if len(errs) > 0 {
+		return parsed, &ScriptValidationError{Errors: errs}
+	}
+	return parsed, nil
+}
+
+// GetScript returns the script with the given name
+func (d *DezkVM) GetScript(name string) (*Script, error) {
+	if d.db == nil {
+		return nil, errors.New("scripts are not available")
+	}
+	data, err := d.db.Read(scriptBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("script not found")
+	}
+	script := &Script{}
+	if err := json.Unmarshal(data, script); err != nil {
+		return nil, err
+	}
+	script.Name = name
+	return script, nil
+}
+
+// SaveScript creates or replaces a script. Scripts that do not parse with
+// the default layout are rejected with a *ScriptValidationError.
+func (d *DezkVM) SaveScript(script *Script) error {
+	if d.db == nil {
+		return errors.New("scripts are not available")
+	}
+	if !IsValidInstanceID(script.Name) || script.Name == "validate" {
+		return errors.New("invalid script name")
+	}
+	script.Description = strings.TrimSpace(script.Description)
+	if strings.TrimSpace(script.Source) == "" {
+		return errors.New("script is empty")
+	}
+	if _, err := ParseScript(script.Source, ""); err != nil {
+		return err
+	}
+	script.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(script)
+	if err != nil {
+		return err
+	}
+	return d.db.Write(scriptBucket, script.Name, data)
+}
+
+// DeleteScript removes a script
+func (d *DezkVM) DeleteScript(name string) error {
+	if d.db == nil {
+		return errors.New("scripts are not available")
+	}
+	if !d.db.KeyExists(scriptBucket, name) {
+		return errors.New("script not found")
+	}
+	return d.db.Delete(scriptBucket, name)
+}
+
+// ListScripts returns the summary of all scripts sorted by name
+func (d *DezkVM) ListScripts() ([]*ScriptInfo, error) {
+	if d.db == nil {
+		return nil, errors.New("scripts are not available")
+	}
+	result := []*ScriptInfo{}
+	err := d.db.List(scriptBucket, func(key, value []byte) error {
+		script := &Script{}
+		if err := json.Unmarshal(value, script); err != nil {
+			return nil // Skip corrupted entries
+		}
+		script.Name = string(key)
+		result = append(result, script.Info())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// Errors of RunScript returned before the script has started
+var (
+	errScriptInstanceNotRunning = errors.New("instance is not running")
+	errScriptAlreadyRunning     = errors.New("a script is already running on this instance")
+)
+
+// claimScriptRun checks that the instance is running and claims its script
+// slot. Both happen under the lifecycle lock of the instance, so a run can
+// neither race with another run nor with the instance being stopped.
+func (d *DezkVM) claimScriptRun(ctx context.Context, instanceUUID string, name string, script *kvmhid.DuckyScript) (*ScriptRun, *kvmhid.Controller, context.Context, error) {
+	instance, err := d.GetInstanceByUUID(instanceUUID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	instance.lifecycleMu.Lock()
+	defer instance.lifecycleMu.Unlock()
+	controller := instance.hidController()
+	if !instance.IsRunning() || controller == nil {
+		return nil, nil, nil, errScriptInstanceNotRunning
+	}
+
+	d.scriptRuns.mu.Lock()
+	defer d.scriptRuns.mu.Unlock()
+	if d.scriptRuns.instances == nil {
+		d.scriptRuns.instances = map[string]*ScriptRun{}
+	}
+	if current, ok := d.scriptRuns.instances[instanceUUID]; ok && current.Running {
+		return nil, nil, nil, errScriptAlreadyRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	run := &ScriptRun{
+		Instance:  instanceUUID,
+		Script:    name,
+		Layout:    script.LayoutID,
+		Commands:  len(script.Commands),
+		Running:   true,
+		StartedAt: time.Now().Unix(),
+		cancel:    cancel,
+	}
+	d.scriptRuns.instances[instanceUUID] = run
+	return run, controller, ctx, nil
+}
+
+// RunScript runs a parsed script on an instance and returns when it has
+// finished, failed or was cancelled by ctx or CancelScript. progress is
+// called with the run state before each command. An error is only returned
+// if the script could not be started, progress is not called in that case.
+func (d *DezkVM) RunScript(ctx context.Context, instanceUUID string, name string, script *kvmhid.DuckyScript, keyDelay time.Duration, progress func(ScriptRun)) (*ScriptRun, error) {
+	run, controller, ctx, err := d.claimScriptRun(ctx, instanceUUID, name, script)
+	if err != nil {
+		return nil, err
+	}
+	defer run.cancel()
+
+	runErr := controller.RunDuckyScript(ctx, script, keyDelay, func(p kvmhid.DuckyProgress) {
+		d.scriptRuns.mu.Lock()
+		run.Line, run.Command = p.Line, p.Command+1
+		status := *run
+		d.scriptRuns.mu.Unlock()
+		if progress != nil {
+			progress(status)
+		}
+	})
+
+	d.scriptRuns.mu.Lock()
+	defer d.scriptRuns.mu.Unlock()
+	run.Running = false
+	run.Cancelled = ctx.Err() != nil
+	run.FinishedAt = time.Now().Unix()
+	if runErr != nil && !run.Cancelled {
+		run.Error = runErr.Error()
+	}
+	status := *run
+	return &status, nil
+}
+
+// CancelScript stops the script running on an instance
+func (d *DezkVM) CancelScript(instanceUUID string) error {
+	d.scriptRuns.mu.Lock()
+	defer d.scriptRuns.mu.Unlock()
+	run, ok := d.scriptRuns.instances[instanceUUID]
+	if !ok || !run.Running {
+		return errors.New("no script is running on this instance")
+	}
+	run.cancel()
+	return nil
+}
+
+// ScriptRunStatus returns the state of the last script run of an instance,
+// or nil if no script has run on it
+func (d *DezkVM) ScriptRunStatus(instanceUUID string) *ScriptRun {
+	d.scriptRuns.mu.Lock()
+	defer d.scriptRuns.mu.Unlock()
+	run, ok := d.scriptRuns.instances[instanceUUID]
+	if !ok {
+		return nil
+	}
+	status := *run
+	return &status
+}
@@ -0,0 +1,111 @@
+package dezkvm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptSaveAndRun(t *testing.T) {
+	d, devices := newSimulatedManagerWithDB(t, 1)
+	uuid := d.Instances()[0].UUID()
+
+	err := d.SaveScript(&Script{Name: "broken", Source: "STRING ok\nDELAY soon\nFOO"})
+	validationErr, ok := err.(*ScriptValidationError)
+	if !ok || len(validationErr.Errors) != 2 || validationErr.Errors[0].Line != 2 {
+		t.Fatalf("SaveScript of invalid script = %v", err)
+	}
+	if err := d.SaveScript(&Script{Name: "login", Source: "REM log in\nSTRING ab\nENTER\nREPEAT 1"}); err != nil {
+		t.Fatalf("SaveScript: %v", err)
+	}
+	if scripts, err := d.ListScripts(); err != nil || len(scripts) != 1 || scripts[0].Lines != 4 {
+		t.Fatalf("ListScripts = %+v, %v", scripts, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.HandleRunScript(w, r, uuid)
+	}))
+	defer server.Close()
+	before := devices[0].CH9329.State().Packets
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"name":"login","delay_ms":0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := []map[string]interface{}{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid progress line %q", scanner.Text())
+		}
+		events = append(events, event)
+	}
+	// STRING, ENTER and its repeat, then the result
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4: %v", len(events), events)
+	}
+	if events[0]["line"] != float64(2) || events[2]["line"] != float64(3) {
+		t.Errorf("unexpected progress %v", events)
+	}
+	done := events[3]
+	if done["event"] != "done" || done["running"] != false || done["cancelled"] != false || done["error"] != nil {
+		t.Errorf("unexpected result %v", done)
+	}
+	// a, b and 2x Enter, each a press and a release report
+	if packets := devices[0].CH9329.State().Packets - before; packets != 8 {
+		t.Errorf("chip received %d packets, want 8", packets)
+	}
+}
+
+func TestScriptCancel(t *testing.T) {
+	d, devices := newSimulatedManager(t, 1)
+	uuid := d.Instances()[0].UUID()
+
+	parsed, err := ParseScript("STRING a\nDELAY 60000\nSTRING b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan *ScriptRun, 1)
+	go func() {
+		run, err := d.RunScript(context.Background(), uuid, "", parsed, 0, nil)
+		if err != nil {
+			t.Errorf("RunScript: %v", err)
+		}
+		result <- run
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if status := d.ScriptRunStatus(uuid); status != nil && status.Line == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("script did not reach the delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := d.RunScript(context.Background(), uuid, "", parsed, 0, nil); err == nil {
+		t.Fatal("second script on the same instance accepted")
+	}
+	w := httptest.NewRecorder()
+	d.HandleRunScript(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"source":"STRING c"}`)), uuid)
+	if w.Code != http.StatusConflict || strings.Contains(w.Header().Get("Content-Type"), "ndjson") {
+		t.Fatalf("second script over HTTP: status %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	before := devices[0].CH9329.State().Packets
+	if err := d.CancelScript(uuid); err != nil {
+		t.Fatalf("CancelScript: %v", err)
+	}
+	run := <-result
+	if !run.Cancelled || run.Running || run.Error != "" || run.Command != 2 {
+		t.Fatalf("unexpected run %+v", run)
+	}
+	if packets := devices[0].CH9329.State().Packets - before; packets != 0 {
+		t.Errorf("chip received %d packets after cancel, want 0", packets)
+	}
+}
@@ -0,0 +1,70 @@
+package dezkvm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+func TestChipStatusPushedToHIDWebsocket(t *testing.T) {
+	d, devices := newSimulatedManagerWithOptions(t, 1, &RuntimeOptions{
+		ConfigFolderPath:      t.TempDir(),
+		HIDStatusPollInterval: 20 * time.Millisecond,
+	})
+	uuid := d.Instances()[0].UUID()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.HandleHIDEvents(w, r, uuid)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg struct {
+		Type       string            `json:"type"`
+		ChipStatus kvmhid.ChipStatus `json:"chip_status"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if msg.Type != "chip_status" || !msg.ChipStatus.USBEnumerated || msg.ChipStatus.CapsLock {
+		t.Fatalf("unexpected first message %+v", msg)
+	}
+
+	// The target turns on Caps Lock
+	devices[0].CH9329.SetLEDs(kvmhid.LED_CAPSLOCK)
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if !msg.ChipStatus.CapsLock {
+		t.Fatalf("unexpected update %+v", msg)
+	}
+
+	// The REST API returns the same state
+	recorder := httptest.NewRecorder()
+	d.HandleChipStatus(recorder, httptest.NewRequest(http.MethodGet, "/", nil), uuid)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"caps_lock":true`) {
+		t.Fatalf("HandleChipStatus = %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The polling shows up in the pipeline statistics
+	recorder = httptest.NewRecorder()
+	d.HandleHIDStats(recorder, httptest.NewRequest(http.MethodGet, "/", nil), uuid)
+	var stats kvmhid.PipelineStats
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &stats) != nil {
+		t.Fatalf("HandleHIDStats = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if stats.Replies == 0 || stats.LatencySamples == 0 || stats.LatencyMax < stats.LatencyP50 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
@@ -0,0 +1,99 @@
+package dezkvm
+
+/*
+	sysfs.go
+
+	Device nodes are mapped to their sysfs device directory by following
+	the /sys/class/{tty,video4linux,sound}/<name> links, instead of
+	running udevadm for every node. The resolved path contains the full
+	USB topology, e.g.
+
+	/sys/devices/pci0000:00/0000:00:14.0/usb1/1-1/1-1.2/1-1.2:1.0/tty/ttyACM0
+
+	The sysfs and /dev roots are variables so the scanner can be tested
+	against a fake tree in testdata.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	sysfsRoot = "/sys" // Root of the sysfs mount
+	devRoot   = "/dev" // Root of the device nodes
+)
+
+// sysfsClassPrefixes maps device node name prefixes to their sysfs class
+var sysfsClassPrefixes = []struct {
+	prefix string
+	class  string
+}{
+	{"tty", "tty"},
+	{"video", "video4linux"},
+	{"v4l-subdev", "video4linux"},
+	{"pcmC", "sound"},
+	{"controlC", "sound"},
+}
+
+func resolveSymlink(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// getDeviceFullPath returns the sysfs device directory of a device node,
+// e.g. /dev/ttyUSB0 -> /sys/devices/.../1-1.1/1-1.1:1.0/ttyUSB0/tty/ttyUSB0
+func getDeviceFullPath(devicePath string) (string, error) {
+	resolvedPath, err := resolveSymlink(devicePath)
+	if err != nil {
+		return "", err
+	}
+	return sysfsPathOfDeviceName(filepath.Base(resolvedPath))
+}
+
+// sysfsPathOfDeviceName resolves the class link of a device node name.
+func sysfsPathOfDeviceName(name string) (string, error) {
+	class := ""
+	for _, p := range sysfsClassPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			class = p.class
+			break
+		}
+	}
+	if class == "" {
+		return "", fmt.Errorf("unsupported device type: %s", name)
+	}
+	fullPath, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", class, name))
+	if err != nil {
+		return "", fmt.Errorf("could not resolve sysfs path of %s: %w", name, err)
+	}
+	return fullPath, nil
+}
+
+// usbDeviceDir walks up from a sysfs device path until it reaches the USB
+// device directory (the one with idVendor), e.g. /sys/devices/.../usb1/1-1/1-1.2
+func usbDeviceDir(sysPath string) string {
+	dir := sysPath
+	for dir != "/" && dir != "." && dir != sysfsRoot {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+	return ""
+}
+
+// readSysfsAttr reads a sysfs attribute file and returns its trimmed content,
+// or an empty string if the attribute does not exist.
+func readSysfsAttr(dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
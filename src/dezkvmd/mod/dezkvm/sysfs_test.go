@@ -0,0 +1,162 @@
+package dezkvm
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useFakeSysfs points the scanner to the fake sysfs and /dev tree in testdata.
+// The tree contains one KVM port module behind hub 1-1 (CH340, AuxMCU and a
+// MS2109 capture card) and an Arduino on port 1-2.
+func useFakeSysfs(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.Abs("testdata/fakesys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSys, oldDev := sysfsRoot, devRoot
+	sysfsRoot = filepath.Join(root, "sys")
+	devRoot = filepath.Join(root, "dev")
+	t.Cleanup(func() {
+		sysfsRoot, devRoot = oldSys, oldDev
+	})
+	return root
+}
+
+func TestGetDeviceFullPath(t *testing.T) {
+	useFakeSysfs(t)
+	tests := []struct {
+		device      string
+		expected    string
+		expectError bool
+	}{
+		{"ttyUSB0", "/usb1/1-1/1-1.1/1-1.1:1.0/ttyUSB0/tty/ttyUSB0", false},
+		{"serial/by-id/usb-1a86_USB_Serial-if00-port0", "/usb1/1-1/1-1.1/1-1.1:1.0/ttyUSB0/tty/ttyUSB0", false},
+		{"ttyACM0", "/usb1/1-1/1-1.2/1-1.2:1.0/tty/ttyACM0", false},
+		{"video0", "/usb1/1-1/1-1.3/1-1.3:1.0/video4linux/video0", false},
+		{"snd/pcmC1D0c", "/usb1/1-1/1-1.3/1-1.3:1.2/sound/card1/pcmC1D0c", false},
+		{"ttyS0", "/devices/platform/serial8250/tty/ttyS0", false},
+		{"ttyUSB9", "", true},
+	}
+
+	for _, test := range tests {
+		sysPath, err := getDeviceFullPath(filepath.Join(devRoot, test.device))
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", test.device, sysPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.device, err)
+			continue
+		}
+		if !strings.HasSuffix(sysPath, test.expected) {
+			t.Errorf("%s: expected path ending with %s, got %s", test.device, test.expected, sysPath)
+		}
+	}
+}
+
+func TestUsbDeviceDir(t *testing.T) {
+	useFakeSysfs(t)
+	sysPath, err := getDeviceFullPath(filepath.Join(devRoot, "video0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := usbDeviceDir(sysPath); filepath.Base(dir) != "1-1.3" {
+		t.Errorf("expected USB device 1-1.3, got %q", dir)
+	}
+
+	sysPath, err = getDeviceFullPath(filepath.Join(devRoot, "ttyS0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := usbDeviceDir(sysPath); dir != "" {
+		t.Errorf("expected no USB device for ttyS0, got %q", dir)
+	}
+}
+
+func TestScanCandidates(t *testing.T) {
+	useFakeSysfs(t)
+	tests := []struct {
+		name     string
+		filter   *ScanFilter
+		expected map[string]bool // device name -> accepted
+	}{
+		{
+			name:   "default filter",
+			filter: DefaultScanFilter(),
+			expected: map[string]bool{
+				"ttyUSB0":  true,
+				"ttyACM0":  true,
+				"ttyACM1":  false, // Arduino, unknown serial device
+				"video0":   true,
+				"pcmC1D0c": true,
+			},
+		},
+		{
+			name: "allow and deny rules",
+			filter: &ScanFilter{
+				Allow: []string{"product:arduino"},
+				Deny:  []string{"1a86:*", filepath.Join(devRoot, "video0")},
+			},
+			expected: map[string]bool{
+				"ttyUSB0":  false,
+				"ttyACM0":  true,
+				"ttyACM1":  true,
+				"video0":   false,
+				"pcmC1D0c": true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		candidates := ScanCandidates(test.filter)
+		if len(candidates) != len(test.expected) {
+			t.Errorf("%s: expected %d candidates, got %d", test.name, len(test.expected), len(candidates))
+		}
+		for _, c := range candidates {
+			accepted, ok := test.expected[filepath.Base(c.DevicePath)]
+			if !ok {
+				t.Errorf("%s: unexpected candidate %s", test.name, c.DevicePath)
+				continue
+			}
+			if c.Accepted != accepted {
+				t.Errorf("%s: %s accepted = %v, expected %v (%s)", test.name, c.DevicePath, c.Accepted, accepted, c.Reason)
+			}
+		}
+	}
+}
+
+func TestScanCandidateProperties(t *testing.T) {
+	useFakeSysfs(t)
+	for _, c := range ScanCandidates(DefaultScanFilter()) {
+		if filepath.Base(c.DevicePath) != "ttyACM0" {
+			continue
+		}
+		if c.Kind != ScanDeviceKindACMSerial || c.VendorID != "1209" || c.ProductID != "c550" ||
+			c.Product != "DezKVM AuxMCU" || c.InterfaceClass != "02" {
+			t.Errorf("unexpected properties for ttyACM0: %+v", c)
+		}
+		return
+	}
+	t.Error("ttyACM0 not found in scan candidates")
+}
+
+func TestResolveInstanceIdentity(t *testing.T) {
+	useFakeSysfs(t)
+	identity, err := ResolveInstanceIdentity(&UsbKvmDeviceOption{
+		USBKVMDevicePath:       filepath.Join(devRoot, "serial/by-id/usb-1a86_USB_Serial-if00-port0"),
+		VideoCaptureDevicePath: filepath.Join(devRoot, "video0"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.TopologyPath != "1-1.3|1-1.1" {
+		t.Errorf("expected topology path 1-1.3|1-1.1, got %s", identity.TopologyPath)
+	}
+	if identity.CaptureSerial != "CAP0001" || identity.HIDSerial != "" {
+		t.Errorf("unexpected serials: capture=%q hid=%q", identity.CaptureSerial, identity.HIDSerial)
+	}
+}
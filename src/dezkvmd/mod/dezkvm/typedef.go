@@ -1,6 +1,10 @@
 package dezkvm
 
 import (
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux"
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
 	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
@@ -8,8 +12,8 @@ import (
 
 type UsbKvmDeviceOption struct {
 	/* Device Paths */
-	USBKVMDevicePath       string `json:"usb_kvm_device_path"`       // Path to the USB KVM HID device (e.g., /dev/ttyUSB0)
-	AuxMCUDevicePath       string `json:"aux_mcu_device_path"`       // Path to the auxiliary MCU device (e.g., /dev/ttyACM0)
+	USBKVMDevicePath       string `json:"usb_kvm_device_path"`       // Path to the USB KVM HID device (e.g., /dev/ttyUSB0 or tcp://10.0.0.5:4001)
+	AuxMCUDevicePath       string `json:"aux_mcu_device_path"`       // Path to the auxiliary MCU device (e.g., /dev/ttyACM0 or rfc2217://10.0.0.5:4002)
 	VideoCaptureDevicePath string `json:"video_capture_device_path"` // Path to the video capture device (e.g., /dev/video0)
 	AudioCaptureDevicePath string `json:"audio_capture_device_path"` // Path to the audio capture device (e.g., /dev/snd/pcmC1D0c)
 
@@ -26,9 +30,24 @@ type UsbKvmDeviceOption struct {
 	USBKVMBaudrate int `json:"usb_kvm_baudrate"` // Baudrate for USB KVM HID communication, e.g., 115200
 	AuxMCUBaudrate int `json:"aux_mcu_baudrate"` // Baudrate for auxiliary MCU communication, e.g., 115200
 
+	/* HID Backend, USBKVMDevicePath is the keyboard device of the gadget backend */
+	HIDBackend            string `json:"hid_backend,omitempty"`               // HIDBackendCH9329 (default) or HIDBackendGadget
+	HIDMouseDevicePath    string `json:"hid_mouse_device_path,omitempty"`     // Absolute mouse device of the gadget backend, e.g. /dev/hidg1
+	HIDRelMouseDevicePath string `json:"hid_rel_mouse_device_path,omitempty"` // Relative mouse device of the gadget backend, optional
+	HIDGadgetUDC          string `json:"hid_gadget_udc,omitempty"`            // UDC of the gadget, e.g. fe980000.usb, enables the USB state
+
+	/* Identity Settings */
+	InstanceID string `json:"instance_id,omitempty"` // Fixed instance ID, overrides the AuxMCU UUID or derived ID if set
+	Manual     bool   `json:"-"`                     // Whether the instance is manually defined instead of auto-detected
+
+	/* Simulated Sources */
+	VideoSource usbcapture.VideoSource `json:"-"` // Optional video source used instead of the V4L2 device
+	AudioSource usbcapture.AudioSource `json:"-"` // Optional audio source used instead of arecord
 }
 
 type UsbKvmPreferences struct {
+	SchemaVersion int `json:"schema_version"` // Schema version of the preference file, see PreferencesSchemaVersion
+
 	/* HID Preferences */
 	InvertScrollDirection    bool   `json:"invert_scroll_direction"`    // Whether to invert the mouse scroll direction
 	ScrollSensitivity        uint8  `json:"scroll_sensitivity"`         // Mouse scroll sensitivity
@@ -39,10 +58,13 @@ type UsbKvmPreferences struct {
 	AskOnPaste               bool   `json:"ask_on_paste"`               // Whether to prompt the user when pasting
 	KeyStackingEnabled       bool   `json:"key_stacking_enabled"`       // Whether key stacking (sequential modifier combo) mode is enabled
 	StackToggleKey           string `json:"stack_toggle_key"`           // event.code string of the key used to toggle key stacking (e.g. "ShiftRight")
+	KeyboardLayout           string `json:"keyboard_layout"`            // Keyboard layout of the remote machine used for typing text, e.g. "us"
+	StuckKeyTimeout          int    `json:"stuck_key_timeout"`          // Seconds keys can be held without a keep-alive before they are released, 0 disables the watchdog
 }
 
 func DefaultPreferences() *UsbKvmPreferences {
 	return &UsbKvmPreferences{
+		SchemaVersion:            PreferencesSchemaVersion,
 		InvertScrollDirection:    false,
 		ScrollSensitivity:        3,
 		EnableMouseJiggler:       false,
@@ -52,36 +74,81 @@ func DefaultPreferences() *UsbKvmPreferences {
 		AskOnPaste:               true,
 		KeyStackingEnabled:       false,
 		StackToggleKey:           "ShiftRight",
+		KeyboardLayout:           kvmhid.DefaultKeyboardLayout,
 	}
 }
 
+// InstanceStatus describes the lifecycle state of a USB KVM device instance
+type InstanceStatus string
+
+const (
+	InstanceStatusStopped  InstanceStatus = "stopped"  // Not started or stopped by the manager
+	InstanceStatusStarting InstanceStatus = "starting" // Start() is in progress
+	InstanceStatusRunning  InstanceStatus = "running"  // All components started successfully
+	InstanceStatusError    InstanceStatus = "error"    // Last start attempt failed, will be retried in background
+)
+
+// HID backends of an instance, see kvmhid.HIDBackend
+const (
+	HIDBackendCH9329 = "ch9329" // CH9329 UART to USB HID bridge of the DezKVM
+	HIDBackendGadget = "gadget" // USB gadget HID functions of the host, /dev/hidg*
+)
+
 type UsbKvmDeviceInstance struct {
-	Config      *UsbKvmDeviceOption //
-	Preferences *UsbKvmPreferences
+	Config *UsbKvmDeviceOption // Device option, the capture resolution fields are protected by stateMu
 
 	/* Processed Configs */
-	captureConfig         *usbcapture.Config
+	captureConfig *usbcapture.Config
+	parent        *DezkVM
+
+	/* Runtime State */
+	lifecycleMu sync.Mutex   // Serialize Start(), Stop(), capture reconnects and resolution changes
+	stateMu     sync.RWMutex // Protect all fields below, use the getters to read them
+
+	/* Components */
+	uuid                  string            // Instance UUID obtained from AuxMCU, pinned or derived from hardware identity
+	identity              *InstanceIdentity // Hardware identity resolved during start
+	preferences           *UsbKvmPreferences
 	videoResoltuionConfig *usbcapture.CaptureResolution
+	audioQuality          string // Audio quality used if the client does not request one
+	usbKVMController      *kvmhid.Controller
+	auxMCUController      *kvmaux.AuxMcu
+	usbCaptureDevice      *usbcapture.Instance
 
-	/* Internals */
-	uuid             string // Session UUID obtained from AuxMCU
-	usbKVMController *kvmhid.Controller
-	auxMCUController *kvmaux.AuxMcu
-	usbCaptureDevice *usbcapture.Instance
-	parent           *DezkVM
+	/* Status */
+	status        InstanceStatus // Current lifecycle status
+	lastError     error          // Error from the last failed start attempt
+	retryCount    int            // Number of failed start attempts since last success
+	nextRetryTime time.Time      // When the next background start attempt is scheduled
 }
 
 type RuntimeOptions struct {
 	EnableLog        bool   `json:"enable_log"`         // Enable or disable logging
 	ConfigFolderPath string `json:"config_folder_path"` // Path to the folder where instance-specific configs will be stored
+	IdentityFilePath string `json:"identity_file_path"` // Path to the JSON file storing pinned instance IDs
+	ManualFilePath   string `json:"manual_file_path"`   // Path to the JSON file storing manually defined instances
+	DB               *db.DB `json:"-"`                  // System database for the instance registry, optional
+
+	HIDStatusPollInterval time.Duration `json:"hid_status_poll_interval"` // Interval of the keyboard LED and USB state polling, 0 disables it
 }
 type DezkVM struct {
-	UsbKvmInstance []*UsbKvmDeviceInstance
+	instances   []*UsbKvmDeviceInstance // Managed instances, use Instances() to get a snapshot
+	instancesMu sync.RWMutex            // Protect the instances slice
 
 	/* Config Folder Path */
-	ConfigFolderPath string `json:"config_folder_path"` // Path to the folder where instance-specific configs and logs will be stored
+	ConfigFolderPath       string `json:"config_folder_path"`        // Path to the folder where instance-specific configs and logs will be stored
+	IdentityFilePath       string `json:"identity_file_path"`        // Path to the JSON file storing pinned instance IDs
+	ManualInstanceFilePath string `json:"manual_instance_file_path"` // Path to the JSON file storing manually defined instances
 
 	/* Internals */
-	occupiedUUIDs map[string]bool // Track occupied UUIDs to prevent duplicate connections
-	option        *RuntimeOptions // Runtime options
+	option     *RuntimeOptions // Runtime options
+	db         *db.DB          // System database, nil if registry is not available
+	identityMu sync.Mutex      // Protect read-modify-write of the identity file
+	manualMu   sync.Mutex      // Serialize changes to the manual instances and their file
+	closeChan  chan struct{}   // Closed when the manager shuts down to stop background retries
+	closeOnce  sync.Once       // Guard closeChan from being closed twice
+	retryWg    sync.WaitGroup  // Tracks running background retry loops
+
+	macroPlaybacks macroPlaybacks // Last macro playback of each instance
+	scriptRuns     scriptRuns     // Last script run of each instance
 }
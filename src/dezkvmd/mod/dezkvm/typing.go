@@ -0,0 +1,147 @@
+package dezkvm
+
+/*
+	typing.go
+
+	Server-side text typing. The text is converted to key strokes with the
+	keyboard layout of the remote machine instead of going through the
+	JavaScript keycodes of the browser, so non-US layouts and symbols are
+	typed correctly. Multimedia and ACPI keys, which have no keyboard
+	usage, are sent from here as well.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+)
+
+// MaxTypeTextLength is the maximum number of characters typed by one request
+const MaxTypeTextLength = 10000
+
+// TypeTextRequest is the JSON body of a type text request
+type TypeTextRequest struct {
+	Text    string `json:"text"`
+	Layout  string `json:"layout"`   // Keyboard layout ID, the instance preference if empty
+	DelayMs *int   `json:"delay_ms"` // Delay between key strokes, kvmhid.DefaultTypeKeyDelay if not set
+	Strict  bool   `json:"strict"`   // Do not type anything if some characters cannot be typed
+}
+
+// TypeTextResult reports the outcome of a type text request
+type TypeTextResult struct {
+	Layout     string                 `json:"layout"`
+	Characters int                    `json:"characters"`  // Number of characters in the text
+	KeyStrokes int                    `json:"key_strokes"` // Number of key strokes needed to type the text
+	Sent       int                    `json:"sent"`        // Number of key strokes sent
+	Untypable  []kvmhid.UntypableChar `json:"untypable"`   // Characters skipped as they are not in the layout
+	Error      string                 `json:"error,omitempty"`
+}
+
+// HandleTypeText types the text of the request on the remote machine. The
+// request returns after the text has been typed, cancelling it stops typing.
+func (d *DezkVM) HandleTypeText(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req TypeTextRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*MaxTypeTextLength+1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	characters := utf8.RuneCountInString(req.Text)
+	if characters == 0 {
+		http.Error(w, "No text to type", http.StatusBadRequest)
+		return
+	}
+	if characters > MaxTypeTextLength {
+		http.Error(w, fmt.Sprintf("Text is longer than %d characters", MaxTypeTextLength), http.StatusRequestEntityTooLarge)
+		return
+	}
+	delay := kvmhid.DefaultTypeKeyDelay
+	if req.DelayMs != nil {
+		delay = time.Duration(*req.DelayMs) * time.Millisecond
+		if delay < 0 || delay > kvmhid.MaxTypeKeyDelay {
+			http.Error(w, fmt.Sprintf("delay_ms must be between 0 and %d", kvmhid.MaxTypeKeyDelay.Milliseconds()), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Layout == "" {
+		req.Layout = targetInstance.GetPreferences().KeyboardLayout
+	}
+	layout, err := kvmhid.GetKeyboardLayout(req.Layout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	strokes, untypable := layout.KeyStrokes(req.Text)
+	result := TypeTextResult{
+		Layout:     layout.ID,
+		Characters: characters,
+		KeyStrokes: len(strokes),
+		Untypable:  untypable,
+	}
+	status := http.StatusOK
+	if req.Strict && len(untypable) > 0 {
+		result.Error = "text contains characters that cannot be typed with the " + layout.Name + " layout"
+		status = http.StatusUnprocessableEntity
+	} else {
+		result.Sent, err = usbKVM.TypeKeyStrokes(r.Context(), strokes, delay)
+		if err != nil {
+			result.Error = "typing stopped: " + err.Error()
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleListKeyboardLayouts returns the keyboard layouts supported for typing text
+func (d *DezkVM) HandleListKeyboardLayouts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kvmhid.KeyboardLayouts())
+}
+
+// HandleConsumerKey presses and releases a multimedia or ACPI key on the
+// remote machine, e.g. "wake" to wake it from sleep or "mute".
+func (d *DezkVM) HandleConsumerKey(w http.ResponseWriter, r *http.Request, instanceUuid string, key string) {
+	if !kvmhid.IsConsumerKey(key) {
+		http.Error(w, "Unsupported consumer key: "+key, http.StatusBadRequest)
+		return
+	}
+	targetInstance, ok := d.getRunningInstance(w, instanceUuid)
+	if !ok {
+		return
+	}
+	usbKVM := targetInstance.hidController()
+	if usbKVM == nil {
+		http.Error(w, "HID controller is not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err := usbKVM.SendConsumerKey(key); err != nil {
+		http.Error(w, "Failed to send consumer key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	usbKVM.RecordActivity()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleListConsumerKeys returns the names of the supported consumer keys
+func (d *DezkVM) HandleListConsumerKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kvmhid.ConsumerKeys())
+}
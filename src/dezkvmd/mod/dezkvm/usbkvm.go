@@ -2,19 +2,109 @@ package dezkvm
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"time"
 
-	"github.com/google/uuid"
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux"
 	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
 	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
 )
 
 func (i *UsbKvmDeviceInstance) UUID() string {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
 	return i.uuid
 }
 
+// Identity returns the hardware identity resolved during start, or nil.
+func (i *UsbKvmDeviceInstance) Identity() *InstanceIdentity {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.identity
+}
+
+// hidController returns the HID controller, or nil if the instance is not running.
+func (i *UsbKvmDeviceInstance) hidController() *kvmhid.Controller {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.usbKVMController
+}
+
+// auxController returns the AuxMCU controller, or nil if the instance has no
+// AuxMCU or is not running.
+func (i *UsbKvmDeviceInstance) auxController() *kvmaux.AuxMcu {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.auxMCUController
+}
+
+// captureDevice returns the capture device, or nil if the instance is not
+// running or the capture device is being reconnected.
+func (i *UsbKvmDeviceInstance) captureDevice() *usbcapture.Instance {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.usbCaptureDevice
+}
+
+// CurrentResolution returns a copy of the current capture resolution.
+func (i *UsbKvmDeviceInstance) CurrentResolution() usbcapture.CaptureResolution {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return *i.videoResoltuionConfig
+}
+
+// Start starts all components of the instance. If any component fails to start,
+// the components that were already opened are released and the instance is
+// marked with the error so it can be reported and retried later.
 func (i *UsbKvmDeviceInstance) Start() error {
+	i.lifecycleMu.Lock()
+	defer i.lifecycleMu.Unlock()
+
+	i.setStatus(InstanceStatusStarting, nil)
+	err := i.start()
+	if err != nil {
+		i.stop()
+		i.stateMu.Lock()
+		i.status = InstanceStatusError
+		i.lastError = err
+		i.retryCount++
+		i.stateMu.Unlock()
+		return err
+	}
+
+	i.stateMu.Lock()
+	i.status = InstanceStatusRunning
+	i.lastError = nil
+	i.retryCount = 0
+	i.nextRetryTime = time.Time{}
+	i.stateMu.Unlock()
+	return nil
+}
+
+// newHIDController creates the HID controller with the backend of the instance config
+func (i *UsbKvmDeviceInstance) newHIDController() (*kvmhid.Controller, error) {
+	config := &kvmhid.Config{
+		PortName:          i.Config.USBKVMDevicePath,
+		BaudRate:          i.Config.USBKVMBaudrate,
+		ScrollSensitivity: 0x01, // Set mouse scroll sensitivity
+	}
+	switch i.Config.HIDBackend {
+	case "", HIDBackendCH9329:
+		return kvmhid.NewHIDController(config), nil
+	case HIDBackendGadget:
+		return kvmhid.NewHIDControllerWithBackend(config, kvmhid.NewGadgetBackend(kvmhid.GadgetConfig{
+			KeyboardPath:      i.Config.USBKVMDevicePath,
+			MousePath:         i.Config.HIDMouseDevicePath,
+			RelativeMousePath: i.Config.HIDRelMouseDevicePath,
+			UDC:               i.Config.HIDGadgetUDC,
+		})), nil
+	default:
+		return nil, errors.New("unknown HID backend: " + i.Config.HIDBackend)
+	}
+}
+
+func (i *UsbKvmDeviceInstance) start() error {
 	if i.Config.USBKVMDevicePath == "" {
 		return errors.New("USB KVM device path is not specified")
 	}
@@ -24,21 +114,26 @@ func (i *UsbKvmDeviceInstance) Start() error {
 	}
 
 	/* --------- Start HID Controller --------- */
-	usbKVM := kvmhid.NewHIDController(&kvmhid.Config{
-		PortName:          i.Config.USBKVMDevicePath,
-		BaudRate:          i.Config.USBKVMBaudrate,
-		ScrollSensitivity: 0x01, // Set mouse scroll sensitivity
-	})
+	usbKVM, err := i.newHIDController()
+	if err != nil {
+		return err
+	}
 
 	//Start the HID controller
-	err := usbKVM.Connect()
+	err = usbKVM.Connect()
 	if err != nil {
 		return err
 	}
 
+	i.stateMu.Lock()
 	i.usbKVMController = usbKVM
+	i.stateMu.Unlock()
+	if i.parent != nil && i.parent.option != nil {
+		usbKVM.StartStatusPolling(i.parent.option.HIDStatusPollInterval)
+	}
 
 	/* --------- Start AuxMCU Controller --------- */
+	var identity *InstanceIdentity
 	//Check if AuxMCU is configured, if so, start the connection
 	if i.Config.AuxMCUDevicePath != "" {
 		if i.Config.AuxMCUBaudrate == 0 {
@@ -50,107 +145,259 @@ func (i *UsbKvmDeviceInstance) Start() error {
 		if err != nil {
 			return err
 		}
+		i.stateMu.Lock()
 		i.auxMCUController = auxMCU
+		i.stateMu.Unlock()
 
 		//Try to get the UUID from the AuxMCU
 		uuid, err := auxMCU.GetUUID()
 		if err != nil {
 			return err
 		}
-		i.uuid = uuid
-
+		identity = &InstanceIdentity{AuxMCUUUID: uuid}
 	} else {
-		// Randomly generate a UUIDv4 if AuxMCU is not present
-		uuid, err := uuid.NewRandom()
+		// Derive a stable ID from the USB topology and serial numbers if AuxMCU is not present
+		identity, err = ResolveInstanceIdentity(i.Config)
 		if err != nil {
 			return err
 		}
-		i.uuid = uuid.String()
-		i.uuid = "10" + i.uuid[2:] //USB KVM device category is "1", type is "0" (unknown/unspecified)
 	}
 
+	// Fixed IDs from the device option and pinned IDs take precedence over the AuxMCU UUID or derived ID
+	var uuid string
+	if i.Config.InstanceID != "" {
+		uuid = i.Config.InstanceID
+	} else if i.parent != nil {
+		uuid = i.parent.resolveInstanceID(identity)
+	} else {
+		uuid = identity.DerivedID()
+	}
+	i.stateMu.Lock()
+	i.identity = identity
+	i.uuid = uuid
+	i.stateMu.Unlock()
+
 	/* --------- Start USB Capture Device --------- */
+	// Use the capture settings saved for this instance, if any
+	i.applyCaptureProfile(uuid)
 	usbCaptureDevice, err := usbcapture.NewInstance(i.captureConfig)
 	if err != nil {
 		return err
 	}
 
-	err = usbCaptureDevice.StartVideoCapture(i.videoResoltuionConfig)
+	resolution := i.supportedResolution(usbCaptureDevice)
+	err = usbCaptureDevice.StartVideoCapture(&resolution)
 	if err != nil {
 		usbCaptureDevice.Close()
 		return err
 	}
+	i.setResolution(&resolution)
+	i.stateMu.Lock()
 	i.usbCaptureDevice = usbCaptureDevice
+	i.stateMu.Unlock()
 
 	/* --------- Load Preferences --------- */
+	var prefs *UsbKvmPreferences
 	if i.parent != nil {
-		prefs, err := i.parent.LoadPreferences(i.uuid)
+		prefs, err = i.parent.LoadPreferences(uuid)
 		if err != nil {
-			log.Printf("Warning: failed to load preferences for %s: %v\n", i.uuid, err)
-		}
-		if prefs != nil {
-			i.Preferences = prefs
+			log.Printf("Warning: failed to load preferences for %s: %v\n", uuid, err)
 		}
 	}
-	if i.Preferences == nil {
-		i.Preferences = DefaultPreferences()
+	if prefs != nil {
+		i.SetPreferences(prefs)
+	} else {
+		i.ApplyPreferences()
 	}
-	i.ApplyPreferences()
 
 	// All components started successfully — turn off the status LED
-	if i.auxMCUController != nil {
-		_ = i.auxMCUController.SetStatusLED(kvmaux.StatusLEDOff)
+	if aux := i.auxController(); aux != nil {
+		_ = aux.SetStatusLED(kvmaux.StatusLEDOff)
 	}
 	return nil
 }
 
 func (i *UsbKvmDeviceInstance) Stop() error {
-	if i.usbKVMController != nil {
-		i.usbKVMController.Close()
-		i.usbKVMController = nil
+	i.lifecycleMu.Lock()
+	defer i.lifecycleMu.Unlock()
+	err := i.stop()
+	i.setStatus(InstanceStatusStopped, nil)
+	return err
+}
+
+func (i *UsbKvmDeviceInstance) stop() error {
+	// Detach the components first, so handlers no longer pick them up while
+	// they are being closed
+	i.stateMu.Lock()
+	usbKVM, auxMCU, usbCaptureDevice := i.usbKVMController, i.auxMCUController, i.usbCaptureDevice
+	i.usbKVMController = nil
+	i.auxMCUController = nil
+	i.usbCaptureDevice = nil
+	i.stateMu.Unlock()
+
+	if usbKVM != nil {
+		usbKVM.Close()
 	}
-	if i.auxMCUController != nil {
-		i.auxMCUController.Close()
-		i.auxMCUController = nil
+	if auxMCU != nil {
+		auxMCU.Close()
 	}
-	if i.usbCaptureDevice != nil {
-		i.usbCaptureDevice.Close()
-		i.usbCaptureDevice = nil
+	if usbCaptureDevice != nil {
+		usbCaptureDevice.Close()
 	}
 	return nil
 }
 
+// Status returns the current lifecycle status of the instance.
+func (i *UsbKvmDeviceInstance) Status() InstanceStatus {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	if i.status == "" {
+		return InstanceStatusStopped
+	}
+	return i.status
+}
+
+// IsRunning returns true if all components of the instance started successfully.
+func (i *UsbKvmDeviceInstance) IsRunning() bool {
+	return i.Status() == InstanceStatusRunning
+}
+
+// LastError returns the error from the last failed start attempt, or nil.
+func (i *UsbKvmDeviceInstance) LastError() error {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.lastError
+}
+
+func (i *UsbKvmDeviceInstance) setStatus(status InstanceStatus, err error) {
+	i.stateMu.Lock()
+	i.status = status
+	i.lastError = err
+	i.stateMu.Unlock()
+}
+
 // Remove removes the USB KVM device instance from its parent DezkVM manager.
 func (i *UsbKvmDeviceInstance) Remove() error {
 	return i.parent.RemoveUsbKvmDevice(i.UUID())
 }
 
 func (i *UsbKvmDeviceInstance) SetLEDStatus(status kvmaux.StatusLEDPattern) error {
-	if i.auxMCUController == nil {
+	aux := i.auxController()
+	if aux == nil {
 		return errors.New("AuxMCU controller is not initialized")
 	}
-	return i.auxMCUController.SetStatusLED(status)
+	return aux.SetStatusLED(status)
+}
+
+// GetPreferences returns a copy of the instance preferences, or the defaults
+// if the instance has not loaded any.
+func (i *UsbKvmDeviceInstance) GetPreferences() UsbKvmPreferences {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	if i.preferences == nil {
+		return *DefaultPreferences()
+	}
+	return *i.preferences
+}
+
+// SetPreferences replaces the instance preferences and applies them to the
+// running HID controller. The preferences are not saved to disk.
+func (i *UsbKvmDeviceInstance) SetPreferences(prefs *UsbKvmPreferences) {
+	copied := *prefs
+	i.stateMu.Lock()
+	i.preferences = &copied
+	i.stateMu.Unlock()
+	i.ApplyPreferences()
 }
 
 // ApplyPreferences applies the current preferences to the running HID controller.
 func (i *UsbKvmDeviceInstance) ApplyPreferences() {
-	if i.Preferences == nil || i.usbKVMController == nil {
+	usbKVM := i.hidController()
+	if usbKVM == nil {
 		return
 	}
-	// Scroll sensitivity
-	sens := i.Preferences.ScrollSensitivity
+	prefs := i.GetPreferences()
+
+	// Scroll sensitivity and direction
+	sens := prefs.ScrollSensitivity
 	if sens == 0 {
 		sens = 1
 	}
-	i.usbKVMController.Config.ScrollSensitivity = sens
-
-	// Invert scroll direction
-	i.usbKVMController.Config.InvertScrollDirection = i.Preferences.InvertScrollDirection
+	usbKVM.SetScrollConfig(sens, prefs.InvertScrollDirection)
 
 	// Mouse jiggler
-	if i.Preferences.EnableMouseJiggler {
-		i.usbKVMController.StartMouseJiggler()
+	if prefs.EnableMouseJiggler {
+		usbKVM.StartMouseJiggler()
 	} else {
-		i.usbKVMController.StopMouseJiggler()
+		usbKVM.StopMouseJiggler()
+	}
+
+	// Stuck key watchdog
+	usbKVM.SetStuckKeyTimeout(time.Duration(prefs.StuckKeyTimeout) * time.Second)
+}
+
+// ReconnectCapture closes the V4L2 and audio devices and opens them again
+// with the current resolution. Running streams end and must be reopened.
+func (i *UsbKvmDeviceInstance) ReconnectCapture() error {
+	i.lifecycleMu.Lock()
+	defer i.lifecycleMu.Unlock()
+	if !i.IsRunning() {
+		return errors.New("instance is not running")
 	}
+
+	// Close the existing capture device (stops video + audio)
+	i.stateMu.Lock()
+	oldDevice := i.usbCaptureDevice
+	i.usbCaptureDevice = nil
+	i.stateMu.Unlock()
+	if oldDevice != nil {
+		oldDevice.Close()
+	}
+
+	time.Sleep(1 * time.Second) // Short delay to ensure device is released
+
+	// Re-create and start the capture device
+	newDevice, err := usbcapture.NewInstance(i.captureConfig)
+	if err != nil {
+		return fmt.Errorf("failed to re-initialize capture device: %w", err)
+	}
+
+	resolution := i.supportedResolution(newDevice)
+	err = newDevice.StartVideoCapture(&resolution)
+	if err != nil {
+		newDevice.Close()
+		return fmt.Errorf("failed to restart video capture: %w", err)
+	}
+
+	i.setResolution(&resolution)
+	i.stateMu.Lock()
+	i.usbCaptureDevice = newDevice
+	i.stateMu.Unlock()
+	return nil
+}
+
+// ChangeResolution restarts the video capture with the new resolution, stores
+// it in the instance config and saves it in the capture profile. The current
+// pixel format is kept if the new resolution does not specify one.
+func (i *UsbKvmDeviceInstance) ChangeResolution(newResolution *usbcapture.CaptureResolution) error {
+	i.lifecycleMu.Lock()
+	defer i.lifecycleMu.Unlock()
+	usbCaptureDevice := i.captureDevice()
+	if usbCaptureDevice == nil {
+		return errors.New("capture device is not running")
+	}
+
+	resolution := *newResolution
+	if resolution.Format == "" {
+		resolution.Format = i.CurrentResolution().Format
+	}
+	err := usbCaptureDevice.ChangeResolution(&resolution)
+	if err != nil {
+		return err
+	}
+
+	// Update the instance config
+	i.setResolution(&resolution)
+	i.saveCaptureProfile()
+	return nil
 }
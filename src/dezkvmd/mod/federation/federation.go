@@ -0,0 +1,447 @@
+package federation
+
+/*
+	federation.go
+
+	Federation lets one dezkvmd node act as an aggregator for other nodes.
+	Peers are registered by URL and API token. Their instances are polled
+	in the background and merged into the instance list of the aggregator,
+	requests for remote instances are proxied to the peer owning them.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+)
+
+const (
+	peerBucket = "federation_peers"
+
+	defaultPollInterval = 15 * time.Second
+	requestTimeout      = 5 * time.Second
+)
+
+// Peer is a remote dezkvmd node
+type Peer struct {
+	ID                 string `json:"id"`
+	Name               string `json:"name"`
+	URL                string `json:"url"`                  // Base URL of the peer, e.g. https://10.0.0.12:9000
+	Token              string `json:"token,omitempty"`      // API token of the peer, never returned by the API
+	TLSFingerprint     string `json:"tls_fingerprint"`      // Hex SHA-256 of the peer certificate, pins self-signed certificates
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Do not verify the peer certificate at all
+	CreatedAt          int64  `json:"created_at"`
+}
+
+// PeerStatus is the health of a peer
+type PeerStatus struct {
+	Online        bool   `json:"online"`
+	NodeUUID      string `json:"node_uuid"`      // Node UUID reported by the peer
+	LastCheck     int64  `json:"last_check"`     // Unix timestamp of the last health check
+	LastSeen      int64  `json:"last_seen"`      // Unix timestamp of the last successful health check
+	LastError     string `json:"last_error"`     // Error of the last failed health check
+	LatencyMs     int64  `json:"latency_ms"`     // Duration of the last successful health check
+	InstanceCount int    `json:"instance_count"` // Number of instances of the peer
+}
+
+// PeerInfo is a peer and its status as returned by the API
+type PeerInfo struct {
+	Peer
+	Status PeerStatus `json:"status"`
+}
+
+// Options of the federation manager
+type Options struct {
+	DB            *db.DB        // System database storing the peers
+	LocalNodeUUID string        // Node UUID of this node, peers with the same UUID are ignored
+	PollInterval  time.Duration // Interval of the health checks, 15 seconds if zero
+
+	// Authorize checks if a request may be forwarded with the API token of a
+	// peer, e.g. that it comes from a login session and not from a token.
+	// All requests are forwarded if nil.
+	Authorize func(r *http.Request) bool
+}
+
+// Manager keeps track of the peers and proxies requests to them
+type Manager struct {
+	db            *db.DB
+	localNodeUUID string
+	pollInterval  time.Duration
+	authorize     func(r *http.Request) bool
+
+	mu    sync.RWMutex          // Protect peers
+	peers map[string]*peerState // Peers by ID
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// peerState is the runtime state of a peer
+type peerState struct {
+	peer      Peer
+	status    PeerStatus
+	instances []map[string]interface{} // Instances reported by the last successful health check
+	client    *http.Client
+	proxy     http.Handler
+}
+
+// NewManager loads the registered peers and starts the health checks
+func NewManager(opt Options) (*Manager, error) {
+	if opt.DB == nil {
+		return nil, errors.New("DB instance is required")
+	}
+	if err := opt.DB.NewBucket(peerBucket); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		db:            opt.DB,
+		localNodeUUID: strings.TrimSpace(opt.LocalNodeUUID),
+		pollInterval:  opt.PollInterval,
+		authorize:     opt.Authorize,
+		peers:         map[string]*peerState{},
+		closeChan:     make(chan struct{}),
+	}
+	if m.pollInterval <= 0 {
+		m.pollInterval = defaultPollInterval
+	}
+	err := opt.DB.List(peerBucket, func(key, value []byte) error {
+		peer := Peer{}
+		if err := json.Unmarshal(value, &peer); err != nil {
+			log.Printf("Warning: skipping invalid federation peer %s: %v\n", key, err)
+			return nil
+		}
+		state, err := newPeerState(peer)
+		if err != nil {
+			log.Printf("Warning: skipping invalid federation peer %s: %v\n", key, err)
+			return nil
+		}
+		m.peers[peer.ID] = state
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.wg.Add(1)
+	go m.pollLoop()
+	return m, nil
+}
+
+func newPeerState(peer Peer) (*peerState, error) {
+	target, err := url.Parse(peer.URL)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(&peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peerState{
+		peer:   peer,
+		client: &http.Client{Transport: transport, Timeout: requestTimeout},
+		proxy:  newReverseProxy(target, peer.Token, transport),
+	}, nil
+}
+
+// validate checks and normalizes the peer definition
+func (p *Peer) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.URL = strings.TrimRight(strings.TrimSpace(p.URL), "/")
+	p.Token = strings.TrimSpace(p.Token)
+	p.TLSFingerprint = normalizeFingerprint(p.TLSFingerprint)
+	target, err := url.Parse(p.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("peer URL must be an absolute http or https URL")
+	}
+	if target.Path != "" || target.RawQuery != "" {
+		return errors.New("peer URL must not contain a path or query")
+	}
+	if p.Token == "" {
+		return errors.New("peer API token is required")
+	}
+	if p.TLSFingerprint != "" && len(p.TLSFingerprint) != 64 {
+		return errors.New("TLS fingerprint must be a hex encoded SHA-256 hash")
+	}
+	if p.Name == "" {
+		p.Name = target.Host
+	}
+	return nil
+}
+
+// AddPeer registers a peer and checks its health immediately. The peer
+// is registered even if it is not reachable yet.
+func (m *Manager) AddPeer(peer Peer) (*PeerInfo, error) {
+	if err := peer.validate(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	for _, existing := range m.peers {
+		if existing.peer.URL == peer.URL {
+			m.mu.RUnlock()
+			return nil, errors.New("a peer with this URL is already registered")
+		}
+	}
+	m.mu.RUnlock()
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	peer.ID = hex.EncodeToString(idBytes)
+	peer.CreatedAt = time.Now().Unix()
+	state, err := newPeerState(peer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.db.Write(peerBucket, peer.ID, data); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.peers[peer.ID] = state
+	m.mu.Unlock()
+
+	m.checkPeer(peer.ID)
+	return m.GetPeer(peer.ID)
+}
+
+// RemovePeer unregisters a peer
+func (m *Manager) RemovePeer(id string) error {
+	m.mu.Lock()
+	_, ok := m.peers[id]
+	delete(m.peers, id)
+	m.mu.Unlock()
+	if !ok {
+		return errors.New("peer not found")
+	}
+	return m.db.Delete(peerBucket, id)
+}
+
+// GetPeer returns a peer and its status
+func (m *Manager) GetPeer(id string) (*PeerInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.peers[id]
+	if !ok {
+		return nil, errors.New("peer not found")
+	}
+	return state.info(), nil
+}
+
+// ListPeers returns all peers and their status, sorted by name
+func (m *Manager) ListPeers() []*PeerInfo {
+	m.mu.RLock()
+	peers := []*PeerInfo{}
+	for _, state := range m.peers {
+		peers = append(peers, state.info())
+	}
+	m.mu.RUnlock()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// info returns the peer without its token, the caller must hold the lock
+func (s *peerState) info() *PeerInfo {
+	info := &PeerInfo{Peer: s.peer, Status: s.status}
+	info.Token = ""
+	return info
+}
+
+// RemoteInstances returns the instances of all peers, tagged with the node
+// they belong to. Instances of offline peers are included with node_online
+// set to false. If tagFilter is not empty, only instances with the tag are
+// returned.
+func (m *Manager) RemoteInstances(tagFilter string) []map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	instances := []map[string]interface{}{}
+	for _, state := range m.sortedPeers() {
+		for _, instance := range state.instances {
+			if tagFilter != "" && !hasTag(instance, tagFilter) {
+				continue
+			}
+			copied := map[string]interface{}{}
+			for k, v := range instance {
+				copied[k] = v
+			}
+			copied["node_uuid"] = state.status.NodeUUID
+			copied["node_name"] = state.peer.Name
+			copied["node_online"] = state.status.Online
+			copied["peer_id"] = state.peer.ID
+			copied["remote"] = true
+			instances = append(instances, copied)
+		}
+	}
+	return instances
+}
+
+// sortedPeers returns the peers sorted by creation time, the caller must hold the lock
+func (m *Manager) sortedPeers() []*peerState {
+	peers := []*peerState{}
+	for _, state := range m.peers {
+		peers = append(peers, state)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].peer.CreatedAt != peers[j].peer.CreatedAt {
+			return peers[i].peer.CreatedAt < peers[j].peer.CreatedAt
+		}
+		return peers[i].peer.ID < peers[j].peer.ID
+	})
+	return peers
+}
+
+func hasTag(instance map[string]interface{}, tag string) bool {
+	tags, _ := instance["tags"].([]interface{})
+	for _, t := range tags {
+		if s, ok := t.(string); ok && strings.EqualFold(s, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// findInstancePeer returns the peer owning the instance. If several peers
+// report the same instance UUID, the peer registered first wins.
+func (m *Manager) findInstancePeer(instanceUUID string) *peerState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, state := range m.sortedPeers() {
+		for _, instance := range state.instances {
+			if uuid, _ := instance["uuid"].(string); uuid != "" && uuid == instanceUUID {
+				return state
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the health checks
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closeChan)
+	})
+	m.wg.Wait()
+}
+
+func (m *Manager) pollLoop() {
+	defer m.wg.Done()
+	m.CheckPeers()
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closeChan:
+			return
+		case <-ticker.C:
+			m.CheckPeers()
+		}
+	}
+}
+
+// CheckPeers checks the health of all peers concurrently
+func (m *Manager) CheckPeers() {
+	m.mu.RLock()
+	ids := []string{}
+	for id := range m.peers {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			m.checkPeer(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// checkPeer fetches the node info and instances of a peer and updates its status
+func (m *Manager) checkPeer(id string) {
+	m.mu.RLock()
+	state, ok := m.peers[id]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	node := struct {
+		NodeUUID string `json:"node_uuid"`
+	}{}
+	instances := []map[string]interface{}{}
+	err := state.getJSON("/api/v1/node", &node)
+	if err == nil && node.NodeUUID == "" {
+		err = errors.New("peer did not report a node UUID")
+	}
+	if err == nil && node.NodeUUID == m.localNodeUUID {
+		err = errors.New("peer is this node")
+	}
+	if err == nil {
+		// Only the instances of the peer itself, so aggregators can be chained without loops
+		err = state.getJSON("/api/v1/instances?scope=local", &instances)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[id]; !ok {
+		// Removed during the check
+		return
+	}
+	state.status.LastCheck = time.Now().Unix()
+	if err != nil {
+		if state.status.Online {
+			log.Printf("Federation peer %s (%s) is offline: %v\n", state.peer.Name, state.peer.URL, err)
+		}
+		state.status.Online = false
+		state.status.LastError = err.Error()
+		return
+	}
+	if !state.status.Online {
+		log.Printf("Federation peer %s (%s) is online with %d instances\n", state.peer.Name, state.peer.URL, len(instances))
+	}
+	state.status.Online = true
+	state.status.NodeUUID = node.NodeUUID
+	state.status.LastSeen = state.status.LastCheck
+	state.status.LastError = ""
+	state.status.LatencyMs = time.Since(start).Milliseconds()
+	state.status.InstanceCount = len(instances)
+	state.instances = instances
+}
+
+// getJSON sends an authenticated GET request to the peer and decodes the response
+func (s *peerState) getJSON(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, s.peer.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.peer.Token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,242 @@
+package federation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezkvm/dezkvmd/mod/db"
+)
+
+const testToken = "dzk_0011223344556677_secret"
+
+// newTestPeer starts a TLS server behaving like a dezkvmd node with one instance
+func newTestPeer(t *testing.T, nodeUUID string) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/node", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"node_uuid": nodeUUID})
+	})
+	mux.HandleFunc("/api/v1/instances", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "local" {
+			http.Error(w, "aggregated list requested", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"uuid": "remote-1", "tags": []string{"rack-a"}},
+		})
+	})
+	mux.HandleFunc("/api/v1/resolution/{uuid}", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "resolution of "+r.PathValue("uuid"))
+	})
+	mux.HandleFunc("/api/v1/hid/{uuid}/events", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(msgType, append([]byte("echo:"), data...))
+	})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	m, err := NewManager(Options{DB: database, LocalNodeUUID: "local-node", PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func fingerprintOf(server *httptest.Server) string {
+	sum := sha256.Sum256(server.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAddPeerAndRemoteInstances(t *testing.T) {
+	peerServer := newTestPeer(t, "peer-node")
+	m := newTestManager(t)
+
+	info, err := m.AddPeer(Peer{Name: "rack", URL: peerServer.URL, Token: testToken, TLSFingerprint: fingerprintOf(peerServer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Status.Online || info.Status.NodeUUID != "peer-node" || info.Status.InstanceCount != 1 {
+		t.Fatalf("unexpected peer status: %+v", info.Status)
+	}
+	if info.Token != "" {
+		t.Fatal("token returned in peer info")
+	}
+
+	instances := m.RemoteInstances("RACK-A")
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 remote instance, got %d", len(instances))
+	}
+	if instances[0]["node_uuid"] != "peer-node" || instances[0]["remote"] != true || instances[0]["node_online"] != true {
+		t.Fatalf("remote instance not tagged with its node: %v", instances[0])
+	}
+	if len(m.RemoteInstances("rack-b")) != 0 {
+		t.Fatal("tag filter not applied")
+	}
+
+	// Peers going away are kept but marked offline
+	peerServer.Close()
+	m.CheckPeers()
+	info, _ = m.GetPeer(info.ID)
+	if info.Status.Online || info.Status.LastError == "" {
+		t.Fatalf("peer not marked offline: %+v", info.Status)
+	}
+	if instances := m.RemoteInstances(""); len(instances) != 1 || instances[0]["node_online"] != false {
+		t.Fatalf("offline instance not reported: %v", instances)
+	}
+}
+
+func TestAddPeerRejectsInvalidPeers(t *testing.T) {
+	peerServer := newTestPeer(t, "local-node")
+	m := newTestManager(t)
+
+	cases := []Peer{
+		{URL: "ftp://example.com", Token: testToken},
+		{URL: peerServer.URL + "/api", Token: testToken},
+		{URL: peerServer.URL},
+		{URL: peerServer.URL, Token: testToken, TLSFingerprint: "abcd"},
+	}
+	for _, peer := range cases {
+		if _, err := m.AddPeer(peer); err == nil {
+			t.Errorf("peer %+v accepted", peer)
+		}
+	}
+
+	// The peer reporting our own node UUID is registered but never online
+	info, err := m.AddPeer(Peer{URL: peerServer.URL, Token: testToken, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status.Online {
+		t.Fatal("loop to the local node not detected")
+	}
+	if _, err := m.AddPeer(Peer{URL: peerServer.URL, Token: testToken}); err == nil {
+		t.Fatal("duplicated peer URL accepted")
+	}
+}
+
+func TestPinnedFingerprintMismatch(t *testing.T) {
+	peerServer := newTestPeer(t, "peer-node")
+	m := newTestManager(t)
+
+	info, err := m.AddPeer(Peer{URL: peerServer.URL, Token: testToken, TLSFingerprint: strings.Repeat("ab", 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status.Online || !strings.Contains(info.Status.LastError, "fingerprint") {
+		t.Fatalf("mismatching certificate accepted: %+v", info.Status)
+	}
+}
+
+func TestProxyInstanceRequest(t *testing.T) {
+	peerServer := newTestPeer(t, "peer-node")
+	m := newTestManager(t)
+	if _, err := m.AddPeer(Peer{URL: peerServer.URL, Token: testToken, TLSFingerprint: fingerprintOf(peerServer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")[1]
+		if !m.ProxyInstanceRequest(w, r, uuid) {
+			http.Error(w, "local", http.StatusTeapot)
+		}
+	}))
+	defer aggregator.Close()
+
+	// Plain request, the session cookie must be replaced by the API token
+	req, _ := http.NewRequest(http.MethodGet, aggregator.URL+"/api/v1/resolution/remote-1", nil)
+	req.Header.Set("Cookie", "session=abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "resolution of remote-1" {
+		t.Fatalf("unexpected proxied response %d: %s", resp.StatusCode, body)
+	}
+
+	// Unknown instances are left to the caller
+	resp, err = http.Get(aggregator.URL + "/api/v1/resolution/local-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Fatalf("unknown instance proxied, status %d", resp.StatusCode)
+	}
+
+	// Websocket upgrades are proxied as well
+	wsURL := "ws" + strings.TrimPrefix(aggregator.URL, "http") + "/api/v1/hid/remote-1/events"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {aggregator.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "echo:hello" {
+		t.Fatalf("unexpected websocket reply %q", data)
+	}
+}
+
+func TestProxyInstanceRequestAuthorize(t *testing.T) {
+	peerServer := newTestPeer(t, "peer-node")
+	m := newTestManager(t)
+	if _, err := m.AddPeer(Peer{URL: peerServer.URL, Token: testToken, TLSFingerprint: fingerprintOf(peerServer)}); err != nil {
+		t.Fatal(err)
+	}
+	m.authorize = func(r *http.Request) bool {
+		return r.Header.Get("Cookie") == "session=valid"
+	}
+
+	for cookie, want := range map[string]int{"session=valid": http.StatusOK, "session=forged": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/resolution/remote-1", nil)
+		r.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		if !m.ProxyInstanceRequest(w, r, "remote-1") {
+			t.Fatal("remote instance not handled by the proxy")
+		}
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", cookie, w.Code, want)
+		}
+	}
+}
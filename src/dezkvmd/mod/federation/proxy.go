@@ -0,0 +1,111 @@
+package federation
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// newTransport returns the HTTP transport used to talk to a peer. Peers
+// usually run with a self-signed certificate, which can be pinned by its
+// fingerprint instead of being verified against the system roots.
+func newTransport(peer *Peer) (*http.Transport, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case peer.TLSFingerprint != "":
+		want, err := hex.DecodeString(peer.TLSFingerprint)
+		if err != nil {
+			return nil, errors.New("invalid TLS fingerprint")
+		}
+		// Verified in VerifyPeerCertificate instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("peer did not present a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], want) != 1 {
+				return errors.New("peer certificate does not match the pinned fingerprint")
+			}
+			return nil
+		}
+	case peer.InsecureSkipVerify:
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   requestTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: requestTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 4,
+	}, nil
+}
+
+// normalizeFingerprint accepts fingerprints with colons and in upper case
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", "")
+	return strings.ToLower(fingerprint)
+}
+
+// newReverseProxy returns a proxy forwarding requests to the peer with its
+// API token. Websocket upgrades are handled by httputil.ReverseProxy and
+// responses are flushed immediately, so MJPEG streams are not buffered.
+func newReverseProxy(target *url.URL, token string, transport http.RoundTripper) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = target.Host
+			// The session cookie of the aggregator is of no use to the peer
+			pr.Out.Header.Del("Cookie")
+			pr.Out.Header.Set("Authorization", "Bearer "+token)
+			// The websocket upgraders of the peer check the origin against the host
+			if pr.Out.Header.Get("Origin") != "" {
+				pr.Out.Header.Set("Origin", target.Scheme+"://"+target.Host)
+			}
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Federation proxy error for %s: %v\n", r.URL.Path, err)
+			http.Error(w, "Peer node is not reachable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// ProxyInstanceRequest forwards the request to the peer owning the
+// instance. Returns false if no peer reports the instance, so the caller
+// can handle it locally.
+func (m *Manager) ProxyInstanceRequest(w http.ResponseWriter, r *http.Request, instanceUUID string) bool {
+	state := m.findInstancePeer(instanceUUID)
+	if state == nil {
+		return false
+	}
+	if m.authorize != nil && !m.authorize(r) {
+		// The request would be sent with the token of the peer
+		http.Error(w, "Instances of peer nodes require a login session", http.StatusForbidden)
+		return true
+	}
+	m.mu.RLock()
+	online := state.status.Online
+	m.mu.RUnlock()
+	if !online {
+		http.Error(w, "Peer node of this instance is offline", http.StatusBadGateway)
+		return true
+	}
+	state.proxy.ServeHTTP(w, r)
+	return true
+}
@@ -9,10 +9,11 @@ package kvmaux
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
-	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux/serial"
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
 )
 
 type USB_mass_storage_side int
@@ -32,13 +33,15 @@ type AuxMcu struct {
 	hdd_led_on bool
 
 	/* Communication */
-	port *serial.Port
-	mu   sync.Mutex
+	port    serial.Transport
+	mu      sync.Mutex // Protect the port and the cached states
+	queryMu sync.Mutex // Serialize queries so their replies are not interleaved
 }
 
-// NewAuxOutbandController initializes a new AuxMcu instance
+// NewAuxOutbandController initializes a new AuxMcu instance, portName is a
+// local serial port or a network address like tcp://10.0.0.5:4001
 func NewAuxOutbandController(portName string, baudRate int) (*AuxMcu, error) {
-	port, err := serial.OpenPort(&serial.Config{
+	port, err := serial.Open(&serial.Config{
 		Name:        portName,
 		Baud:        baudRate,
 		ReadTimeout: time.Second * 2,
@@ -53,6 +56,8 @@ func NewAuxOutbandController(portName string, baudRate int) (*AuxMcu, error) {
 }
 
 func (c *AuxMcu) Close() error {
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.port != nil {
@@ -68,19 +73,26 @@ func (c *AuxMcu) Close() error {
 func (c *AuxMcu) sendCommand(cmd byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.port == nil {
+		return fmt.Errorf("AuxMCU port is closed")
+	}
 	_, err := c.port.Write([]byte{cmd})
 	return err
 }
 
 // SwitchUSBToKVM switches USB mass storage to KVM side
 func (c *AuxMcu) SwitchUSBToKVM() error {
+	c.mu.Lock()
 	c.usb_mass_storage_side = USB_MASS_STORAGE_KVM
+	c.mu.Unlock()
 	return c.sendCommand('m')
 }
 
 // SwitchUSBToRemote switches USB mass storage to remote computer
 func (c *AuxMcu) SwitchUSBToRemote() error {
+	c.mu.Lock()
 	c.usb_mass_storage_side = USB_MASS_STORAGE_REMOTE
+	c.mu.Unlock()
 	return c.sendCommand('n')
 }
 
@@ -107,7 +119,7 @@ func (c *AuxMcu) ReleaseResetButton() error {
 // readByte reads a single byte from the serial port directly
 func (c *AuxMcu) readByte() (byte, error) {
 	buf := make([]byte, 1)
-	_, err := c.port.ReadFull(buf)
+	_, err := io.ReadFull(c.port, buf)
 	if err != nil {
 		return 0, err
 	}
@@ -117,7 +129,7 @@ func (c *AuxMcu) readByte() (byte, error) {
 // readBytes reads exactly n bytes from the serial port directly
 func (c *AuxMcu) readBytes(n int) ([]byte, error) {
 	buf := make([]byte, n)
-	_, err := c.port.ReadFull(buf)
+	_, err := io.ReadFull(c.port, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +139,8 @@ func (c *AuxMcu) readBytes(n int) ([]byte, error) {
 // GetUUID requests the device UUID and returns it as a string
 // Protocol: <Length> 0x62 <UUID String>
 func (c *AuxMcu) GetUUID() (string, error) {
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
 	if err := c.sendCommand('u'); err != nil {
 		return "", err
 	}
@@ -163,6 +177,8 @@ func (c *AuxMcu) GetUSBMassStorageSide() USB_mass_storage_side {
 	if c == nil {
 		return USB_MASS_STORAGE_UNKNOWN
 	}
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
 
 	if err := c.sendCommand('y'); err != nil {
 		return USB_MASS_STORAGE_UNKNOWN
@@ -219,6 +235,8 @@ func (c *AuxMcu) GetATXState() error {
 	if c == nil {
 		return fmt.Errorf("AuxMcu is nil")
 	}
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
 
 	if err := c.sendCommand('a'); err != nil {
 		return err
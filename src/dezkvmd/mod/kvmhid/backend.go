@@ -0,0 +1,54 @@
+package kvmhid
+
+/*
+	backend.go
+
+	The Controller keeps the keyboard and mouse state of the sessions and
+	sends it to the target machine through a HIDBackend, the hardware that
+	emulates the USB keyboard and mouse:
+
+	- CH9329Backend: CH9329 UART to USB HID bridge of the DezKVM
+	- GadgetBackend: USB gadget HID functions (/dev/hidg*) of Linux boards
+	  with an OTG port, which need no CH9329 cable at all
+
+	Features only some backends have, like consumer keys or the CH9329
+	configuration, are optional interfaces or methods of the backend type.
+*/
+
+import "errors"
+
+// ErrUnsupportedByBackend is returned for features the HID backend does not have
+var ErrUnsupportedByBackend = errors.New("not supported by the HID backend")
+
+// HIDBackend sends keyboard and mouse reports to the target machine
+type HIDBackend interface {
+	// Open connects to the hardware
+	Open() error
+
+	// KeyboardReport sends the modifier bits and the usage IDs of up to 6 pressed keys
+	KeyboardReport(modifiers uint8, keys [6]uint8) error
+
+	// MouseAbsolute moves the cursor to x, y in the range 0 to 4095
+	MouseAbsolute(buttons uint8, x, y uint16) error
+
+	// MouseRelative moves the cursor by dx, dy
+	MouseRelative(buttons uint8, dx, dy int8) error
+
+	// MouseScroll turns the wheel, positive is up
+	MouseScroll(buttons uint8, wheel int8) error
+
+	// Reset resets the emulated devices, nothing is pressed afterwards
+	Reset() error
+
+	// Status reports the keyboard LEDs and if the target has enumerated the device
+	Status() (ChipStatus, error)
+
+	// Close disconnects from the hardware
+	Close() error
+}
+
+// ConsumerKeyBackend is implemented by backends that can send the ACPI and
+// multimedia reports of consumer.go
+type ConsumerKeyBackend interface {
+	ConsumerReport(report uint8, bitmap []uint8) error
+}
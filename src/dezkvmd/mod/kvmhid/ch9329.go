@@ -6,128 +6,46 @@ import (
 	"time"
 )
 
+// ConfigureChipTo115200 sets the chip to keyboard and mouse mode at 115200
+// baud as required by DezKVM
 func (c *Controller) ConfigureChipTo115200() error {
-	// Send the command to get chip configuration and info
-	currentConfig, err := c.GetChipCurrentConfiguration()
+	cfg, err := c.ReadChipConfig()
 	if err != nil {
-		fmt.Printf("Error getting current configuration: %v\n", err)
-		return errors.New("failed to get current configuration")
+		return fmt.Errorf("failed to get current configuration: %v", err)
 	}
-
-	// Modify baudrate bytes in the response
-	currentConfig[0] = 0x02 // Set mode to 2 (Standard mouse & keyboard mode) as required for 115200 baudrate
-	currentConfig[3] = 0x00 // Baudrate byte 1
-	currentConfig[4] = 0x01 // Baudrate byte 2
-	currentConfig[5] = 0xC2 // Baudrate byte 3
-	currentConfig[6] = 0x00 // Baudrate byte 4
-
-	time.Sleep(1 * time.Second) // Wait for a second before sending the command
-	// Prepare the command to set the new configuration
-	setCmd := append([]byte{0x57, 0xAB, 0x00, 0x09, 0x32}, currentConfig[:50]...)
-	setCmd = append(setCmd, calcChecksum(setCmd[:len(setCmd)-1]))
-
-	err = c.Send(setCmd)
-	if err != nil {
-		fmt.Printf("Error sending configuration command: %v\n", err)
-		return errors.New("failed to send configuration command")
+	cfg.Mode = CHIP_MODE_KEYBOARD_MOUSE
+	cfg.Baudrate = 115200
+	if err := c.WriteChipConfig(cfg); err != nil {
+		return fmt.Errorf("failed to write configuration: %v", err)
 	}
-
-	// Wait for the reply
-	resp, err := c.WaitForReply(0x09)
-	if err != nil {
-		fmt.Printf("Error waiting for reply: %v\n", err)
-		return errors.New("failed to get reply")
-	}
-
-	fmt.Println()
-	fmt.Print("Reply: ")
-	for _, b := range resp {
-		fmt.Printf("0x%02X ", b)
-	}
-	fmt.Println()
 	fmt.Println("Baudrate updated to 115200 successfully")
 	return nil
 }
 
+// ConfigureChipToMode2 sets the chip to keyboard and mouse mode
 func (c *Controller) ConfigureChipToMode2() error {
-	// Send the command to get chip configuration and info
-	currentConfig, err := c.GetChipCurrentConfiguration()
+	cfg, err := c.ReadChipConfig()
 	if err != nil {
-		fmt.Printf("Error getting current configuration: %v\n", err)
-		return errors.New("failed to get current configuration")
+		return fmt.Errorf("failed to get current configuration: %v", err)
 	}
-
-	// Modify mode setting in the response
-	currentConfig[0] = 0x02
-
-	time.Sleep(1 * time.Second) // Wait for a second before sending the command
-	// Prepare the command to set the new configuration
-	setCmd := append([]byte{0x57, 0xAB, 0x00, 0x09, 0x32}, currentConfig[:50]...)
-	setCmd = append(setCmd, calcChecksum(setCmd[:len(setCmd)-1]))
-	err = c.Send(setCmd)
-	if err != nil {
-		fmt.Printf("Error sending configuration command: %v\n", err)
-		return errors.New("failed to send configuration command")
-	}
-
-	// Wait for the reply
-	resp, err := c.WaitForReply(0x09)
-	if err != nil {
-		fmt.Printf("Error waiting for reply: %v\n", err)
-		return errors.New("failed to get reply")
-	}
-
-	fmt.Println()
-	fmt.Print("Reply: ")
-	for _, b := range resp {
-		fmt.Printf("0x%02X ", b)
+	cfg.Mode = CHIP_MODE_KEYBOARD_MOUSE
+	if err := c.WriteChipConfig(cfg); err != nil {
+		return fmt.Errorf("failed to write configuration: %v", err)
 	}
-	fmt.Println()
 	fmt.Println("Chip mode updated to 2 successfully")
 	return nil
 }
 
+// WriteChipProperties writes the default DezKVM manufacturer and product strings
 func (c *Controller) WriteChipProperties() ([]byte, error) {
-	manufacturerString := []byte{
-		0x57, 0xAB, 0x00, 0x0B,
-		0x09, // Length of payload
-		0x00, // Set manufacturer string
-		0x07, // Length of the USB manufacturer string
-		'i', 'm', 'u', 's', 'l', 'a', 'b',
-		0x00, // Checksum placeholder
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	if err := c.setUSBString(chipStringManufacturer, DefaultChipManufacturer); err != nil {
+		return nil, fmt.Errorf("failed to set manufacturer string: %v", err)
 	}
-
-	manufacturerString[14] = calcChecksum(manufacturerString[:14])
-	// Send set manufacturer string
-	err := c.Send(manufacturerString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send manufacturer string: %v", err)
-	}
-	_, err = c.WaitForReply(0x0B)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get manufacturer string response: %v", err)
+	if err := c.setUSBString(chipStringProduct, DefaultChipProduct); err != nil {
+		return nil, fmt.Errorf("failed to set product string: %v", err)
 	}
-
-	productString := []byte{
-		0x57, 0xAB, 0x00, 0x0B,
-		0x08, // Length of the payload
-		0x01, // Set product string
-		0x06, // Length of the USB product string
-		'D', 'e', 'z', 'K', 'V', 'M',
-		0x00, // Checksum placeholder
-	}
-
-	productString[13] = calcChecksum(productString[:13])
-	// Send set product string
-	err = c.Send(productString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send product string: %v", err)
-	}
-	_, err = c.WaitForReply(0x0B)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get product string response: %v", err)
-	}
-
 	return []byte("OK"), nil
 }
 
@@ -142,15 +60,9 @@ func (c *Controller) GetChipCurrentConfiguration() ([]byte, error) {
 	}
 
 	cmd[5] = calcChecksum(cmd[:5])
-	err := c.Send(cmd)
+	resp, err := c.SendChipCommand(cmd)
 	if err != nil {
 		fmt.Printf("Error sending command: %v\n", err)
-		return nil, errors.New("failed to send command")
-	}
-
-	resp, err := c.WaitForReply(0x08)
-	if err != nil {
-		fmt.Printf("Error waiting for reply: %v\n", err)
 		return nil, errors.New("failed to get reply")
 	}
 
@@ -168,26 +80,11 @@ func (c *Controller) GetChipCurrentConfiguration() ([]byte, error) {
 	return resp, nil
 }
 
+// ChipSoftReset resets the emulated keyboard and mouse of the HID backend
 func (c *Controller) ChipSoftReset() error {
-	//Send the command to get chip configuration and info
-	cmd := []byte{0x57, 0xAB,
-		0x00, 0x0F, 0x00,
-		0x00, //placeholder for checksum
+	if err := c.backend.Reset(); err != nil {
+		return err
 	}
-
-	cmd[5] = calcChecksum(cmd[:5])
-	err := c.Send(cmd)
-	if err != nil {
-		fmt.Printf("Error sending command: %v\n", err)
-		return errors.New("failed to send command")
-	}
-
-	_, err = c.WaitForReply(0x0F)
-	if err != nil {
-		fmt.Printf("Error waiting for reply: %v\n", err)
-		return errors.New("failed to get reply")
-	}
-
 	fmt.Println("Chip soft reset successfully")
 	return nil
 }
@@ -204,9 +101,17 @@ func (c *Controller) IsModifierKeys(keycode int) bool {
 }
 
 // ConstructAndSendCmd constructs a HID command based on the provided HIDCommand and sends it.
+// It is safe to call from multiple sessions, e.g. a broadcast and a direct session.
 func (c *Controller) ConstructAndSendCmd(HIDCommand *HIDCommand) ([]byte, error) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	c.touchKeyWatchdog()
 	switch HIDCommand.Event {
 	case EventTypeKeyPress:
+		if HIDCommand.Code != "" {
+			// KeyboardEvent.code takes precedence over the legacy keycode
+			return c.SendKeyboardCodePress(HIDCommand.Code)
+		}
 		if IsModifierKey(uint8(HIDCommand.Keycode)) {
 			//modifier keys
 			return c.SetModifierKey(uint8(HIDCommand.Keycode), HIDCommand.IsRightModKey)
@@ -216,6 +121,9 @@ func (c *Controller) ConstructAndSendCmd(HIDCommand *HIDCommand) ([]byte, error)
 		}
 		return c.SendKeyboardPress(uint8(HIDCommand.Keycode))
 	case EventTypeKeyRelease:
+		if HIDCommand.Code != "" {
+			return c.SendKeyboardCodeRelease(HIDCommand.Code)
+		}
 		if IsModifierKey(uint8(HIDCommand.Keycode)) {
 			//modifier keys
 			return c.UnsetModifierKey(uint8(HIDCommand.Keycode), HIDCommand.IsRightModKey)
@@ -280,8 +188,19 @@ func (c *Controller) ConstructAndSendCmd(HIDCommand *HIDCommand) ([]byte, error)
 		}
 		c.lastCursorEventTime = time.Now().UnixMilli()
 		return c.MouseScroll(HIDCommand.MouseScroll)
+	case EventTypeConsumerKey:
+		return c.consumerKeyTap(HIDCommand.ConsumerKey)
+	case EventTypeKeepAlive:
+		return []byte{}, nil
 	case EventTypeHIDReset:
-		return []byte{}, c.ChipSoftReset()
+		if err := c.ChipSoftReset(); err != nil {
+			return []byte{}, err
+		}
+		// The target sees the chip reconnect, nothing is pressed afterwards
+		c.hidState.Modkey = 0x00
+		c.hidState.KeyboardButtons = [6]uint8{}
+		c.hidState.MouseButtons = 0x00
+		return []byte{}, nil
 	default:
 		return nil, fmt.Errorf("unsupported HID command event type: %d", HIDCommand.Event)
 	}
@@ -0,0 +1,207 @@
+package kvmhid
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+)
+
+// calcChecksum calculates the checksum for a given data slice.
+func calcChecksum(data []uint8) uint8 {
+	var sum uint8 = 0
+	for _, value := range data {
+		sum += value
+	}
+	return sum
+}
+
+// CH9329Backend sends HID reports through a CH9329 UART to USB HID bridge,
+// see ch9329_pipeline.go for how commands and replies are handled
+type CH9329Backend struct {
+	PortName    string
+	BaudRate    int
+	MaxInFlight int // Commands sent before their replies arrive, DefaultCH9329InFlight if 0
+
+	serialPort serial.Transport
+
+	/* Command pipeline, protected by pipeMu */
+	pipeMu       sync.Mutex
+	pipeCond     *sync.Cond // Signalled when the queue, the window or running changes
+	running      bool
+	generation   uint64           // Incremented by each Open, stops the loops of the previous port
+	queue        []*ch9329Request // Commands waiting to be sent
+	sentRequests []*ch9329Request // Commands sent, oldest first, including timed out ones
+	inFlight     int              // Sent commands waiting for their reply
+	counters     pipelineCounters
+}
+
+// NewCH9329Backend creates a backend for the CH9329 on the serial port
+func NewCH9329Backend(portName string, baudRate int) *CH9329Backend {
+	b := &CH9329Backend{
+		PortName: portName,
+		BaudRate: baudRate,
+	}
+	b.pipeCond = sync.NewCond(&b.pipeMu)
+	return b
+}
+
+// Open opens the serial port and starts the command pipeline. The port is a
+// local serial port or a network address like tcp://10.0.0.5:4001.
+func (b *CH9329Backend) Open() error {
+	// Open the serial port, 8N1
+	config := &serial.Config{
+		Name:        b.PortName,
+		Baud:        b.BaudRate,
+		ReadTimeout: time.Millisecond * 500,
+	}
+
+	port, err := serial.Open(config)
+	if err != nil {
+		return err
+	}
+
+	//Send over an opr queue reset signal
+	if _, err := port.Write([]byte{0xFF}); err != nil {
+		port.Close()
+		return err
+	}
+	b.serialPort = port
+	b.startPipeline(port)
+	return nil
+}
+
+// SendCommand sends a raw command packet and returns the data of its reply
+func (b *CH9329Backend) SendCommand(packet []byte) ([]byte, error) {
+	if len(packet) < 6 || packet[0] != 0x57 || packet[1] != 0xAB {
+		return nil, errors.New("invalid CH9329 command packet")
+	}
+	return b.sendCommand(packet)
+}
+
+// KeyboardReport sends a general keyboard report (0x02)
+func (b *CH9329Backend) KeyboardReport(modifiers uint8, keys [6]uint8) error {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x02, 0x08,
+		modifiers, 0x00,
+		keys[0], keys[1], keys[2], keys[3], keys[4], keys[5],
+		0x00, // Checksum placeholder
+	}
+	packet[13] = calcChecksum(packet[:13])
+	if _, err := b.sendCommand(packet); err != nil {
+		return errors.New("failed to send keyboard command: " + err.Error())
+	}
+	return nil
+}
+
+// mouseAbsolutePacket builds an absolute mouse report (0x04)
+func mouseAbsolutePacket(buttons uint8, x, y uint16) []byte {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x04, 0x07, 0x02,
+		buttons,
+		uint8(x), uint8(x >> 8), // X LSB, MSB
+		uint8(y), uint8(y >> 8), // Y LSB, MSB
+		0x00, // Scroll
+		0x00, // Checksum placeholder
+	}
+	packet[12] = calcChecksum(packet[:12])
+	return packet
+}
+
+// mouseRelativePacket builds a relative mouse report (0x05)
+func mouseRelativePacket(buttons uint8, dx, dy, wheel int8) []byte {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x05, 0x05, 0x01,
+		buttons,
+		uint8(dx),    // Delta X
+		uint8(dy),    // Delta Y
+		uint8(wheel), // Scroll wheel
+		0x00,         // Checksum placeholder
+	}
+	packet[10] = calcChecksum(packet[:10])
+	return packet
+}
+
+// MouseAbsolute queues an absolute mouse report (0x04), it does not wait for the reply
+func (b *CH9329Backend) MouseAbsolute(buttons uint8, x, y uint16) error {
+	if err := b.sendMouseReport(&mouseReport{absolute: true, buttons: buttons, x: x, y: y}); err != nil {
+		return errors.New("failed to send mouse move command: " + err.Error())
+	}
+	return nil
+}
+
+// MouseRelative queues a relative mouse report (0x05), it does not wait for the reply
+func (b *CH9329Backend) MouseRelative(buttons uint8, dx, dy int8) error {
+	if err := b.sendMouseReport(&mouseReport{buttons: buttons, dx: dx, dy: dy}); err != nil {
+		return errors.New("failed to send mouse move relative command: " + err.Error())
+	}
+	return nil
+}
+
+// MouseScroll queues a relative mouse report (0x05) with the wheel movement
+func (b *CH9329Backend) MouseScroll(buttons uint8, wheel int8) error {
+	if err := b.sendMouseReport(&mouseReport{buttons: buttons, wheel: wheel}); err != nil {
+		return errors.New("failed to send mouse scroll command: " + err.Error())
+	}
+	return nil
+}
+
+// ConsumerReport sends an ACPI or multimedia report (0x03)
+func (b *CH9329Backend) ConsumerReport(report uint8, bitmap []uint8) error {
+	if _, err := b.sendCommand(consumerKeyPacket(report, bitmap)); err != nil {
+		return errors.New("failed to send consumer key command: " + err.Error())
+	}
+	return nil
+}
+
+// Reset sends a RESET (0x0F) command to the chip
+func (b *CH9329Backend) Reset() error {
+	cmd := []byte{0x57, 0xAB,
+		0x00, 0x0F, 0x00,
+		0x00, //placeholder for checksum
+	}
+	cmd[5] = calcChecksum(cmd[:5])
+	if _, err := b.sendCommand(cmd); err != nil {
+		return errors.New("failed to reset chip: " + err.Error())
+	}
+	return nil
+}
+
+// Status sends a GET_INFO (0x01) command and returns the reported state
+func (b *CH9329Backend) Status() (ChipStatus, error) {
+	packet := []uint8{0x57, 0xAB, 0x00, 0x01, 0x00, 0x00}
+	packet[5] = calcChecksum(packet[:5])
+	data, err := b.sendCommand(packet)
+	if err != nil {
+		return ChipStatus{}, errors.New("failed to send GET_INFO command: " + err.Error())
+	}
+	return parseChipInfo(data)
+}
+
+// Close sends the queued reports and stops the serial port
+func (b *CH9329Backend) Close() error {
+	if b.serialPort == nil {
+		return nil
+	}
+	// Let queued reports like the release of all buttons reach the chip
+	if err := b.Sync(time.Second); err != nil {
+		log.Printf("Warning: %v, dropping the queued HID commands\n", err)
+	}
+	b.stopPipeline()
+	port := b.serialPort
+	b.serialPort = nil
+	done := make(chan struct{})
+	go func() {
+		port.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// Closed successfully
+	case <-time.After(3 * time.Second):
+		log.Println("serial port close timeout")
+	}
+	return nil
+}
@@ -0,0 +1,595 @@
+package kvmhid
+
+/*
+	ch9329_pipeline.go
+
+	Command pipeline of the CH9329 backend.
+
+	Commands are queued in the order they are issued and written by a single
+	writer, up to MaxInFlight of them before their replies arrive. A single
+	reader frames the incoming bytes (0x57 0xAB, address, command, length,
+	data, checksum) and matches each reply to the oldest sent command with
+	the same command code. The chip answers in order, so sent commands in
+	front of the matched one have lost their reply. A command without a reply
+	in time fails but stays in the sent list for a while, so its late reply
+	is dropped instead of being taken for the reply of a newer command.
+
+	A reply matching a timed out command while a newer one with the same code
+	is in flight is ambiguous, it is either the late reply or the reply of
+	the newer command with the late one lost. A late reply is followed by the
+	reply of the newer command right away, so the reply is held for a short
+	grace time. If no other reply comes, it goes to the newer command and the
+	timed out one is dropped, so one lost reply does not shift every reply
+	after it onto the command before.
+
+	Mouse reports do not wait for their reply. If the report at the tail of
+	the queue has not been sent yet and has the same buttons, a new report is
+	merged into it: absolute reports keep only the latest position, relative
+	reports add up their deltas. Button changes are never merged away.
+
+	A frame with a bad checksum or length is dropped from its first byte
+	only, the reader looks for the next header inside it, so a corrupted
+	byte does not cost the replies received right after it.
+
+	The chip handles one command at a time, but keeping a few commands in
+	flight keeps the UART busy while the replies travel back. With the
+	default window BenchmarkCH9329MouseMove in the simulator gets about half
+	more mouse reports to the chip than with one, each command waits longer
+	behind the others in flight though.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+)
+
+const (
+	ch9329ReplyTimeout    = 500 * time.Millisecond // Time the chip has to reply to a command
+	ch9329StaleAfter      = 4 * ch9329ReplyTimeout // Time a timed out command waits for its late reply
+	ch9329ReplyGrace      = 50 * time.Millisecond  // Time an ambiguous reply is held for a following one
+	ch9329MaxQueue        = 64                     // Commands waiting to be sent
+	ch9329LatencySamples  = 512                    // Samples kept for the latency statistics
+	ch9329MaxDataLength   = 64                     // Longest data of a packet, longer frames are corrupted
+	DefaultCH9329InFlight = 4                      // Default of CH9329Backend.MaxInFlight
+)
+
+var (
+	errCH9329NoReply    = errors.New("no reply from the chip, a later command was answered first")
+	errCH9329Timeout    = errors.New("timeout waiting for reply")
+	errCH9329ErrorReply = errors.New("device returned error reply")
+	errCH9329Closed     = errors.New("serial port is not running")
+)
+
+// ch9329Frame is a packet received from the chip
+type ch9329Frame struct {
+	cmd  byte // Command code of the reply, 0x80 or 0xC0 is set for success or error
+	data []byte
+}
+
+// ch9329Header starts every packet of the chip
+var ch9329Header = []byte{0x57, 0xAB}
+
+// ch9329Parser frames the bytes received from the chip into packets
+type ch9329Parser struct {
+	buf []byte
+}
+
+// feed adds received bytes and returns the packets they complete. Bytes
+// outside of a packet are dropped. A frame with a bad checksum or length
+// is dropped from its first byte only, so the parser resyncs at the next
+// header inside it.
+func (p *ch9329Parser) feed(data []byte) []ch9329Frame {
+	p.buf = append(p.buf, data...)
+	var frames []ch9329Frame
+	for {
+		start := bytes.Index(p.buf, ch9329Header)
+		if start < 0 {
+			// Keep a trailing 0x57, it may start the next header
+			if len(p.buf) > 0 && p.buf[len(p.buf)-1] == ch9329Header[0] {
+				p.buf = append(p.buf[:0], ch9329Header[0])
+			} else {
+				p.buf = p.buf[:0]
+			}
+			return frames
+		}
+		p.buf = p.buf[start:]
+		if len(p.buf) < 5 {
+			break
+		}
+
+		// Header, address, command, length, data and checksum
+		length := int(p.buf[4])
+		if length > ch9329MaxDataLength {
+			p.buf = p.buf[1:]
+			continue
+		}
+		if len(p.buf) < 5+length+1 {
+			break
+		}
+		if calcChecksum(p.buf[:5+length]) != p.buf[5+length] {
+			p.buf = p.buf[1:]
+			continue
+		}
+		frames = append(frames, ch9329Frame{
+			cmd:  p.buf[3],
+			data: append([]byte(nil), p.buf[5:5+length]...),
+		})
+		p.buf = p.buf[5+length+1:]
+	}
+	// Keep only the incomplete packet, not the bytes in front of it
+	p.buf = bytes.Clone(p.buf)
+	return frames
+}
+
+// ch9329Reply is the outcome of a command
+type ch9329Reply struct {
+	data []byte
+	err  error
+}
+
+// ch9329Request is a command in the pipeline
+type ch9329Request struct {
+	cmd      byte
+	packet   []byte
+	mouse    *mouseReport // Set for mouse reports, which can be merged
+	queued   time.Time
+	sent     time.Time
+	timer    *time.Timer
+	finished bool
+	held     *ch9329Frame // Ambiguous reply waiting for the grace time, see dispatch
+	grace    *time.Timer
+	done     chan ch9329Reply // Buffered, receives the outcome once
+}
+
+// newCH9329Request creates a request for a command packet
+func newCH9329Request(packet []byte) *ch9329Request {
+	return &ch9329Request{
+		cmd:    packet[3],
+		packet: packet,
+		done:   make(chan ch9329Reply, 1),
+	}
+}
+
+// mouseReport is an absolute or relative mouse report waiting to be sent
+type mouseReport struct {
+	absolute      bool
+	buttons       uint8
+	x, y          uint16
+	dx, dy, wheel int8
+}
+
+// merge merges next into the report if the result is the same as sending both
+func (m *mouseReport) merge(next *mouseReport) bool {
+	if m.absolute != next.absolute || m.buttons != next.buttons {
+		return false
+	}
+	if m.absolute {
+		m.x, m.y = next.x, next.y
+		return true
+	}
+	dx := int(m.dx) + int(next.dx)
+	dy := int(m.dy) + int(next.dy)
+	wheel := int(m.wheel) + int(next.wheel)
+	for _, v := range []int{dx, dy, wheel} {
+		// 0x80 is not used by the chip
+		if v < -127 || v > 127 {
+			return false
+		}
+	}
+	m.dx, m.dy, m.wheel = int8(dx), int8(dy), int8(wheel)
+	return true
+}
+
+// packet builds the CH9329 command of the report
+func (m *mouseReport) packet() []byte {
+	if m.absolute {
+		return mouseAbsolutePacket(m.buttons, m.x, m.y)
+	}
+	return mouseRelativePacket(m.buttons, m.dx, m.dy, m.wheel)
+}
+
+// PipelineStats are the statistics of the CH9329 command pipeline
+type PipelineStats struct {
+	MaxInFlight  int    `json:"max_in_flight"`  // Commands sent before their replies arrive
+	QueueLength  int    `json:"queue_length"`   // Commands waiting to be sent
+	InFlight     int    `json:"in_flight"`      // Commands sent and waiting for their reply
+	PeakInFlight int    `json:"peak_in_flight"` // Most commands in flight at once
+	Sent         uint64 `json:"sent"`           // Commands written to the chip
+	Replies      uint64 `json:"replies"`        // Successful replies
+	Errors       uint64 `json:"errors"`         // Error replies, lost replies and write errors
+	Timeouts     uint64 `json:"timeouts"`       // Commands without a reply in time
+	LateReplies  uint64 `json:"late_replies"`   // Replies of commands that timed out before
+	Unmatched    uint64 `json:"unmatched"`      // Replies without a command waiting for them
+	Coalesced    uint64 `json:"coalesced"`      // Mouse reports merged into a queued one
+	LastError    string `json:"last_error,omitempty"`
+
+	/* Over the last replies, in microseconds */
+	LatencySamples int   `json:"latency_samples"`
+	LatencyAvg     int64 `json:"latency_avg_us"` // Time from writing a command to its reply
+	LatencyP50     int64 `json:"latency_p50_us"`
+	LatencyP99     int64 `json:"latency_p99_us"`
+	LatencyMax     int64 `json:"latency_max_us"`
+	QueueDelayAvg  int64 `json:"queue_delay_avg_us"` // Time commands waited in the queue
+}
+
+// pipelineCounters are the counters of PipelineStats and the latency samples
+type pipelineCounters struct {
+	sent, replies, errors, timeouts, lateReplies, unmatched, coalesced uint64
+	lastError                                                          string
+	peakInFlight                                                       int
+
+	latencies   []time.Duration // Ring buffer of reply latencies
+	queueDelays []time.Duration // Queue delays of the same commands
+	next        int
+}
+
+// addSample records the latency and queue delay of an answered command
+func (p *pipelineCounters) addSample(latency time.Duration, queueDelay time.Duration) {
+	if len(p.latencies) < ch9329LatencySamples {
+		p.latencies = append(p.latencies, latency)
+		p.queueDelays = append(p.queueDelays, queueDelay)
+		return
+	}
+	p.latencies[p.next] = latency
+	p.queueDelays[p.next] = queueDelay
+	p.next = (p.next + 1) % ch9329LatencySamples
+}
+
+// startPipeline starts the reader and the writer of the port
+func (b *CH9329Backend) startPipeline(port serial.Transport) {
+	if b.MaxInFlight < 1 {
+		b.MaxInFlight = DefaultCH9329InFlight
+	}
+	b.pipeMu.Lock()
+	b.running = true
+	b.generation++
+	b.queue = nil
+	b.sentRequests = nil
+	b.inFlight = 0
+	generation := b.generation
+	b.pipeMu.Unlock()
+
+	go b.readLoop(port, generation)
+	go b.writeLoop(port, generation)
+}
+
+// pipelineRunning checks if the pipeline of the generation is still running.
+// The caller must hold pipeMu.
+func (b *CH9329Backend) pipelineRunning(generation uint64) bool {
+	return b.running && b.generation == generation
+}
+
+// stopPipeline stops the writer and fails all commands in the pipeline
+func (b *CH9329Backend) stopPipeline() {
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	b.running = false
+	for _, req := range b.queue {
+		b.finishLocked(req, nil, errCH9329Closed)
+	}
+	for _, req := range b.sentRequests {
+		b.finishLocked(req, nil, errCH9329Closed)
+	}
+	b.queue = nil
+	b.sentRequests = nil
+	b.pipeCond.Broadcast()
+}
+
+// enqueue adds a command to the pipeline. Mouse reports are merged into the
+// last queued report if possible.
+func (b *CH9329Backend) enqueue(req *ch9329Request) error {
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	if !b.running {
+		return errCH9329Closed
+	}
+	if req.mouse != nil && len(b.queue) > 0 {
+		last := b.queue[len(b.queue)-1]
+		if last.mouse != nil && last.mouse.merge(req.mouse) {
+			last.packet = last.mouse.packet()
+			b.counters.coalesced++
+			return nil
+		}
+	}
+	if len(b.queue) >= ch9329MaxQueue {
+		return errors.New("HID command queue is full")
+	}
+	req.queued = time.Now()
+	b.queue = append(b.queue, req)
+	b.pipeCond.Broadcast()
+	return nil
+}
+
+// sendCommand sends a command packet and waits for the chip to ACK it
+func (b *CH9329Backend) sendCommand(packet []byte) ([]byte, error) {
+	req := newCH9329Request(packet)
+	if err := b.enqueue(req); err != nil {
+		return nil, err
+	}
+	reply := <-req.done
+	return reply.data, reply.err
+}
+
+// sendMouseReport queues a mouse report without waiting for its reply
+func (b *CH9329Backend) sendMouseReport(report *mouseReport) error {
+	req := newCH9329Request(report.packet())
+	req.mouse = report
+	return b.enqueue(req)
+}
+
+// writeLoop writes the queued commands while the window allows it
+func (b *CH9329Backend) writeLoop(port serial.Transport, generation uint64) {
+	for {
+		b.pipeMu.Lock()
+		for b.pipelineRunning(generation) && (len(b.queue) == 0 || b.inFlight >= b.MaxInFlight) {
+			b.pipeCond.Wait()
+		}
+		if !b.pipelineRunning(generation) {
+			b.pipeMu.Unlock()
+			return
+		}
+		req := b.queue[0]
+		b.queue = b.queue[1:]
+		b.pruneSentLocked()
+		req.sent = time.Now()
+		b.sentRequests = append(b.sentRequests, req)
+		b.inFlight++
+		b.counters.peakInFlight = max(b.counters.peakInFlight, b.inFlight)
+		b.counters.sent++
+		req.timer = time.AfterFunc(ch9329ReplyTimeout, func() { b.expire(req) })
+		packet := req.packet
+		b.pipeMu.Unlock()
+
+		// Registered before writing, so a fast reply finds the command
+		if _, err := port.Write(packet); err != nil {
+			b.pipeMu.Lock()
+			b.removeSentLocked(req)
+			b.finishLocked(req, nil, err)
+			b.pipeMu.Unlock()
+		}
+	}
+}
+
+// readLoop frames the received bytes and dispatches the replies until the
+// pipeline is stopped
+func (b *CH9329Backend) readLoop(port serial.Transport, generation uint64) {
+	parser := ch9329Parser{}
+	buf := make([]byte, 256)
+	for {
+		n, err := port.Read(buf)
+		for _, frame := range parser.feed(buf[:max(n, 0)]) {
+			b.dispatch(frame)
+		}
+		if err == nil {
+			continue
+		}
+		b.pipeMu.Lock()
+		running := b.pipelineRunning(generation)
+		b.pipeMu.Unlock()
+		if !running {
+			return
+		}
+		if !errors.Is(err, serial.ErrReadTimeout) {
+			// Do not spin on a port that is gone, the commands time out meanwhile
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// dispatch matches a reply to the oldest sent command with its command code
+func (b *CH9329Backend) dispatch(frame ch9329Frame) {
+	if frame.cmd&0x80 == 0 {
+		// Not a reply
+		return
+	}
+	cmd := frame.cmd &^ 0xC0
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	i := b.indexSentLocked(cmd, 0, false)
+	if i < 0 {
+		b.counters.unmatched++
+		return
+	}
+	if b.sentRequests[i].finished {
+		next := b.indexSentLocked(cmd, i+1, true)
+		if next < 0 {
+			b.counters.lateReplies++
+			b.dropSentLocked(i + 1)
+			return
+		}
+		newer := b.sentRequests[next]
+		if newer.held == nil {
+			// Late reply or the reply of the newer command, the next reply tells
+			newer.held = &frame
+			newer.grace = time.AfterFunc(ch9329ReplyGrace, func() { b.releaseHeld(newer) })
+			return
+		}
+		// The held reply was the late one, this one is for the newer command
+		i = next
+	}
+	req := b.sentRequests[i]
+	if req.held != nil {
+		b.counters.lateReplies++
+		req.held = nil
+	}
+	b.completeLocked(req, frame)
+	b.dropSentLocked(i + 1)
+}
+
+// indexSentLocked returns the index of the first sent command with the
+// command code from index from on, only unfinished ones if pending is set.
+// The caller must hold pipeMu.
+func (b *CH9329Backend) indexSentLocked(cmd byte, from int, pending bool) int {
+	for i := from; i < len(b.sentRequests); i++ {
+		req := b.sentRequests[i]
+		if req.cmd == cmd && !(pending && req.finished) {
+			return i
+		}
+	}
+	return -1
+}
+
+// dropSentLocked removes the first n sent commands, the ones still waiting
+// have lost their reply. The caller must hold pipeMu.
+func (b *CH9329Backend) dropSentLocked(n int) {
+	for _, lost := range b.sentRequests[:n] {
+		b.finishLocked(lost, nil, errCH9329NoReply)
+	}
+	b.sentRequests = b.sentRequests[n:]
+}
+
+// completeLocked completes a command with its reply. The caller must hold pipeMu.
+func (b *CH9329Backend) completeLocked(req *ch9329Request, frame ch9329Frame) {
+	if frame.cmd&0x40 != 0 {
+		b.finishLocked(req, nil, errCH9329ErrorReply)
+		return
+	}
+	b.counters.addSample(time.Since(req.sent), req.sent.Sub(req.queued))
+	b.finishLocked(req, frame.data, nil)
+}
+
+// releaseHeld gives a held reply to its command once the grace time passed
+// without another reply. The timed out commands before it are dropped.
+func (b *CH9329Backend) releaseHeld(req *ch9329Request) {
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	b.releaseHeldLocked(req)
+}
+
+// releaseHeldLocked is releaseHeld for callers holding pipeMu
+func (b *CH9329Backend) releaseHeldLocked(req *ch9329Request) {
+	if req.finished || req.held == nil {
+		return
+	}
+	frame := *req.held
+	req.held = nil
+	for i, sent := range b.sentRequests {
+		if sent == req {
+			b.completeLocked(req, frame)
+			b.dropSentLocked(i + 1)
+			return
+		}
+	}
+}
+
+// expire fails a command without a reply in time. It stays in the sent list
+// to take its late reply.
+func (b *CH9329Backend) expire(req *ch9329Request) {
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	// A held reply only waited for the grace time
+	b.releaseHeldLocked(req)
+	if !req.finished {
+		b.counters.timeouts++
+		b.finishLocked(req, nil, errCH9329Timeout)
+	}
+}
+
+// finishLocked completes a command once. The caller must hold pipeMu.
+func (b *CH9329Backend) finishLocked(req *ch9329Request, data []byte, err error) {
+	if req.finished {
+		return
+	}
+	req.finished = true
+	if req.timer != nil {
+		req.timer.Stop()
+	}
+	if req.grace != nil {
+		req.grace.Stop()
+	}
+	if !req.sent.IsZero() {
+		b.inFlight--
+	}
+	if err == nil {
+		b.counters.replies++
+	} else {
+		if err != errCH9329Timeout {
+			b.counters.errors++
+		}
+		// Nobody waits for mouse reports, their errors only show up here
+		b.counters.lastError = err.Error()
+	}
+	req.done <- ch9329Reply{data: data, err: err}
+	b.pipeCond.Broadcast()
+}
+
+// removeSentLocked removes a command from the sent list. The caller must hold pipeMu.
+func (b *CH9329Backend) removeSentLocked(req *ch9329Request) {
+	for i, sent := range b.sentRequests {
+		if sent == req {
+			b.sentRequests = append(b.sentRequests[:i], b.sentRequests[i+1:]...)
+			return
+		}
+	}
+}
+
+// pruneSentLocked drops timed out commands that are unlikely to be answered
+// anymore. The caller must hold pipeMu.
+func (b *CH9329Backend) pruneSentLocked() {
+	for len(b.sentRequests) > 0 && b.sentRequests[0].finished && time.Since(b.sentRequests[0].sent) > ch9329StaleAfter {
+		b.sentRequests = b.sentRequests[1:]
+	}
+}
+
+// Sync waits until all queued commands are answered or failed
+func (b *CH9329Backend) Sync(timeout time.Duration) error {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		b.pipeMu.Lock()
+		expired = true
+		b.pipeCond.Broadcast()
+		b.pipeMu.Unlock()
+	})
+	defer timer.Stop()
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	for b.running && (len(b.queue) > 0 || b.inFlight > 0) {
+		if expired {
+			return errors.New("timeout waiting for the HID command queue")
+		}
+		b.pipeCond.Wait()
+	}
+	return nil
+}
+
+// PipelineStats returns the statistics of the command pipeline
+func (b *CH9329Backend) PipelineStats() PipelineStats {
+	b.pipeMu.Lock()
+	defer b.pipeMu.Unlock()
+	counters := &b.counters
+	stats := PipelineStats{
+		MaxInFlight:    b.MaxInFlight,
+		QueueLength:    len(b.queue),
+		InFlight:       b.inFlight,
+		PeakInFlight:   counters.peakInFlight,
+		Sent:           counters.sent,
+		Replies:        counters.replies,
+		Errors:         counters.errors,
+		Timeouts:       counters.timeouts,
+		LateReplies:    counters.lateReplies,
+		Unmatched:      counters.unmatched,
+		Coalesced:      counters.coalesced,
+		LastError:      counters.lastError,
+		LatencySamples: len(counters.latencies),
+	}
+	if len(counters.latencies) == 0 {
+		return stats
+	}
+	sorted := append([]time.Duration(nil), counters.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var latencySum, queueDelaySum time.Duration
+	for i := range counters.latencies {
+		latencySum += counters.latencies[i]
+		queueDelaySum += counters.queueDelays[i]
+	}
+	stats.LatencyAvg = (latencySum / time.Duration(len(sorted))).Microseconds()
+	stats.LatencyP50 = sorted[len(sorted)/2].Microseconds()
+	stats.LatencyP99 = sorted[len(sorted)*99/100].Microseconds()
+	stats.LatencyMax = sorted[len(sorted)-1].Microseconds()
+	stats.QueueDelayAvg = (queueDelaySum / time.Duration(len(sorted))).Microseconds()
+	return stats
+}
@@ -0,0 +1,305 @@
+package kvmhid
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+	"imuslab.com/dezkvm/dezkvmd/mod/simulator"
+)
+
+// scriptedChip answers the commands written to a pty with reply, which
+// returns the reply packets, if any
+type scriptedChip struct {
+	pty      *serial.Pty
+	mu       sync.Mutex
+	commands []ch9329Frame
+}
+
+func newScriptedChip(t *testing.T, reply func(cmd ch9329Frame, index int) [][]byte) *scriptedChip {
+	t.Helper()
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo terminals not available")
+	}
+	pty, err := serial.OpenPty()
+	if err != nil {
+		t.Fatalf("OpenPty: %v", err)
+	}
+	t.Cleanup(func() { pty.Close() })
+	chip := &scriptedChip{pty: pty}
+	go func() {
+		// Commands are framed like replies
+		parser := ch9329Parser{}
+		buf := make([]byte, 256)
+		for {
+			n, err := pty.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, frame := range parser.feed(buf[:n]) {
+				chip.mu.Lock()
+				chip.commands = append(chip.commands, frame)
+				index := len(chip.commands) - 1
+				chip.mu.Unlock()
+				for _, packet := range reply(frame, index) {
+					pty.Write(packet)
+				}
+			}
+		}
+	}()
+	return chip
+}
+
+// received returns the commands received so far
+func (c *scriptedChip) received() []ch9329Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ch9329Frame(nil), c.commands...)
+}
+
+// replyPacket builds a reply packet of the chip
+func replyPacket(cmd byte, data ...byte) []byte {
+	packet := append([]byte{0x57, 0xAB, 0x00, cmd, byte(len(data))}, data...)
+	return append(packet, calcChecksum(packet))
+}
+
+func newTestCH9329Backend(t *testing.T, chip *scriptedChip, maxInFlight int) *CH9329Backend {
+	t.Helper()
+	backend := NewCH9329Backend(chip.pty.Path(), 115200)
+	backend.MaxInFlight = maxInFlight
+	if err := backend.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestCH9329Parser(t *testing.T) {
+	good := replyPacket(0x81, 0x30, 0x01, 0x02)
+	bad := replyPacket(0x82, 0x00)
+	bad[len(bad)-1]++
+	stream := append([]byte{0x00, 0x57, 0x57}, good[1:]...)
+	stream = append(stream, bad...)
+	stream = append(stream, replyPacket(0xC4, 0xE5)...)
+
+	// A packet cut short by a lost byte is followed by a complete one,
+	// which is found inside the bad frame
+	cut := replyPacket(0x82, 0x00, 0x01, 0x02, 0x03)
+	stream = append(stream, cut[:len(cut)-2]...)
+	stream = append(stream, replyPacket(0x82, 0x00)...)
+	// A corrupted length does not swallow the packet after it
+	stream = append(stream, 0x57, 0xAB, 0x00, 0x82, 0xFF)
+	stream = append(stream, replyPacket(0x81, 0x30, 0x01, 0x00)...)
+
+	// Byte by byte and all at once give the same packets
+	byByte := ch9329Parser{}
+	var frames []ch9329Frame
+	for _, b := range stream {
+		frames = append(frames, byByte.feed([]byte{b})...)
+	}
+	whole := ch9329Parser{}
+	if all := whole.feed(stream); len(all) != len(frames) {
+		t.Errorf("got %d frames at once, %d byte by byte", len(all), len(frames))
+	}
+
+	want := []ch9329Frame{
+		{cmd: 0x81, data: []byte{0x30, 0x01, 0x02}},
+		{cmd: 0xC4, data: []byte{0xE5}},
+		{cmd: 0x82, data: []byte{0x00}},
+		{cmd: 0x81, data: []byte{0x30, 0x01, 0x00}},
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames, want %d: %+v", len(frames), len(want), frames)
+	}
+	for i, frame := range frames {
+		if frame.cmd != want[i].cmd || !bytes.Equal(frame.data, want[i].data) {
+			t.Errorf("frame %d = %+v, want %+v", i, frame, want[i])
+		}
+	}
+}
+
+func TestCH9329LateReplyIsNotMisattributed(t *testing.T) {
+	chip := newScriptedChip(t, func(cmd ch9329Frame, index int) [][]byte {
+		if index == 0 {
+			// The first GET_INFO is answered with the second one, after it timed out
+			return nil
+		}
+		return [][]byte{
+			replyPacket(0x81, 0x30, 0x01, LED_NUMLOCK),
+			replyPacket(0x81, 0x30, 0x01, LED_CAPSLOCK),
+		}
+	})
+	backend := newTestCH9329Backend(t, chip, 1)
+
+	if _, err := backend.Status(); err == nil {
+		t.Fatal("Status without reply succeeded")
+	}
+	status, err := backend.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if !status.CapsLock || status.NumLock {
+		t.Errorf("Status = %+v, took the late reply of the first command", status)
+	}
+	stats := backend.PipelineStats()
+	if stats.Timeouts != 1 || stats.LateReplies != 1 || stats.Replies != 1 {
+		t.Errorf("PipelineStats = %+v", stats)
+	}
+}
+
+func TestCH9329LostReplyDoesNotShiftLaterReplies(t *testing.T) {
+	chip := newScriptedChip(t, func(cmd ch9329Frame, index int) [][]byte {
+		if index == 0 {
+			return nil
+		}
+		return [][]byte{replyPacket(0x81, 0x30, 0x01, byte(index))}
+	})
+	backend := newTestCH9329Backend(t, chip, 1)
+
+	if _, err := backend.Status(); err == nil {
+		t.Fatal("Status without reply succeeded")
+	}
+	getInfo := []byte{0x57, 0xAB, 0x00, 0x01, 0x00}
+	getInfo = append(getInfo, calcChecksum(getInfo))
+	for i := 1; i < 5; i++ {
+		info, err := backend.SendCommand(getInfo)
+		if err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+		if info[2] != byte(i) {
+			t.Errorf("command %d took the reply of command %d", i, info[2])
+		}
+	}
+	stats := backend.PipelineStats()
+	if stats.Timeouts != 1 || stats.LateReplies != 0 || stats.Replies != 4 {
+		t.Errorf("PipelineStats = %+v", stats)
+	}
+}
+
+func TestCH9329ErrorAndLostReplies(t *testing.T) {
+	chip := newScriptedChip(t, func(cmd ch9329Frame, index int) [][]byte {
+		switch index {
+		case 0:
+			return [][]byte{replyPacket(cmd.cmd|0xC0, 0xE5)}
+		case 1:
+			// Lost, the chip answers the next keyboard report
+			return nil
+		}
+		return [][]byte{replyPacket(cmd.cmd|0x80, 0x00)}
+	})
+	backend := newTestCH9329Backend(t, chip, 2)
+
+	if err := backend.KeyboardReport(0, [6]uint8{0x04}); err == nil {
+		t.Error("error reply not reported")
+	}
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- backend.KeyboardReport(0, [6]uint8{}) }()
+		time.Sleep(20 * time.Millisecond)
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d commands failed, want only the one with the lost reply", failed)
+	}
+}
+
+func TestCH9329MouseCoalescing(t *testing.T) {
+	release := make(chan struct{})
+	chip := newScriptedChip(t, func(cmd ch9329Frame, index int) [][]byte {
+		if index == 0 {
+			<-release
+		}
+		return [][]byte{replyPacket(cmd.cmd|0x80, 0x00)}
+	})
+	backend := newTestCH9329Backend(t, chip, 1)
+
+	// The first report is in flight, the others wait in the queue
+	if err := backend.MouseAbsolute(0, 1, 200); err != nil {
+		t.Fatalf("MouseAbsolute: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(chip.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for x := uint16(2); x <= 100; x++ {
+		if err := backend.MouseAbsolute(0, x, 200); err != nil {
+			t.Fatalf("MouseAbsolute: %v", err)
+		}
+	}
+	// A button change is not merged, the relative reports after it are
+	backend.MouseRelative(0x01, 0, 0)
+	backend.MouseRelative(0x01, 5, -3)
+	backend.MouseScroll(0x01, 1)
+	close(release)
+	if err := backend.Sync(time.Second); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	want := [][]byte{
+		mouseAbsolutePacket(0, 1, 200),
+		mouseAbsolutePacket(0, 100, 200),
+		mouseRelativePacket(0x01, 5, -3, 1),
+	}
+	received := chip.received()
+	if len(received) != len(want) {
+		t.Fatalf("chip received %d commands, want %d", len(received), len(want))
+	}
+	for i, frame := range received {
+		if !bytes.Equal(frame.data, want[i][5:len(want[i])-1]) {
+			t.Errorf("command %d = % X, want % X", i, frame.data, want[i][5:len(want[i])-1])
+		}
+	}
+	if stats := backend.PipelineStats(); stats.Coalesced != 100 || stats.Replies != 3 {
+		t.Errorf("PipelineStats = %+v", stats)
+	}
+}
+
+func TestCH9329PipelineWithSimulator(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo terminals not available")
+	}
+	dev, err := simulator.NewDevice(&simulator.Options{HIDBaudRate: 115200})
+	if err != nil {
+		t.Fatalf("NewDevice: %v", err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	backend := NewCH9329Backend(dev.HIDDevicePath(), 115200)
+	if err := backend.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	// Button changes are not merged, so every report reaches the chip
+	const reports = 32
+	for i := 0; i < reports; i++ {
+		if err := backend.MouseRelative(uint8(i%2), 1, 0); err != nil {
+			t.Fatalf("MouseRelative: %v", err)
+		}
+	}
+	if err := backend.KeyboardReport(0, [6]uint8{0x04}); err != nil {
+		t.Fatalf("KeyboardReport: %v", err)
+	}
+	if err := backend.Sync(5 * time.Second); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	stats := backend.PipelineStats()
+	if stats.MaxInFlight != DefaultCH9329InFlight || stats.PeakInFlight < 2 {
+		t.Errorf("commands were not pipelined: %+v", stats)
+	}
+	if stats.Replies != reports+1 || stats.Errors != 0 || stats.Timeouts != 0 || stats.Unmatched != 0 {
+		t.Errorf("PipelineStats = %+v", stats)
+	}
+	state := dev.State().HID
+	if state.Packets != reports+1 || state.MouseRelX != reports || state.Keys[0] != 0x04 {
+		t.Errorf("chip state = %+v", state)
+	}
+}
@@ -0,0 +1,296 @@
+package kvmhid
+
+/*
+	chipconfig.go
+
+	Provisioning of the CH9329 parameter configuration. GET_PARA_CFG (0x08)
+	returns 50 bytes which SET_PARA_CFG (0x09) writes back:
+
+		0       Chip working mode
+		1       Serial communication mode
+		2       Serial address
+		3-6     Baudrate, big endian
+		7-8     Reserved
+		9-10    Serial packet interval in ms, big endian
+		11-12   USB VID, little endian
+		13-14   USB PID, little endian
+		15-16   Keyboard upload interval in ms, big endian
+		17-18   Keyboard release delay in ms, big endian
+		19      Auto enter flag
+		20-27   Enter characters
+		28-35   Filter start and end strings
+		36      Custom USB string descriptor flags
+		37      Keyboard fast upload flag
+		38-49   Reserved
+
+	The USB strings are read and written separately with GET_USB_STRING
+	(0x0A) and SET_USB_STRING (0x0B). The chip applies a new configuration
+	after it is power cycled, e.g. by unplugging the DezKVM.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	chipConfigLength = 50
+
+	// MaxChipUSBStringLength is the maximum length of a USB string of the chip
+	MaxChipUSBStringLength = 23
+
+	// Default USB strings of DezKVM port modules
+	DefaultChipManufacturer = "imuslab"
+	DefaultChipProduct      = "DezKVM"
+)
+
+// USB string types of GET_USB_STRING and SET_USB_STRING
+const (
+	chipStringManufacturer = 0x00
+	chipStringProduct      = 0x01
+	chipStringSerialNumber = 0x02
+)
+
+// Bits of the custom USB string descriptor flags
+const (
+	chipStringFlagSerialNumber = 0x01
+	chipStringFlagProduct      = 0x02
+	chipStringFlagManufacturer = 0x04
+	chipStringFlagEnabled      = 0x80
+)
+
+// Chip working modes, 0x80 - 0x83 are the same modes selected by the MODE pins
+const (
+	CHIP_MODE_KEYBOARD_MOUSE_CUSTOM = 0x00 // Keyboard, mouse and custom HID
+	CHIP_MODE_KEYBOARD              = 0x01 // Keyboard only
+	CHIP_MODE_KEYBOARD_MOUSE        = 0x02 // Keyboard and mouse, used by DezKVM
+	CHIP_MODE_CUSTOM                = 0x03 // Custom HID only
+)
+
+// ChipBaudrates are the baudrates supported by the chip
+var ChipBaudrates = []uint32{1200, 2400, 4800, 9600, 14400, 19200, 38400, 57600, 115200}
+
+// ChipCustomDescriptors selects which USB string descriptors of the chip
+// are replaced by the USB strings of the configuration
+type ChipCustomDescriptors struct {
+	Enabled      bool `json:"enabled"`
+	Manufacturer bool `json:"manufacturer"`
+	Product      bool `json:"product"`
+	SerialNumber bool `json:"serial_number"`
+}
+
+// ChipConfig is the decoded parameter configuration of the chip
+type ChipConfig struct {
+	Mode                   uint8                 `json:"mode"`                     // Chip working mode, see CHIP_MODE_*
+	SerialMode             uint8                 `json:"serial_mode"`              // 0 protocol, 1 ASCII, 2 transparent
+	Address                uint8                 `json:"address"`                  // Serial address of the chip, the controller talks to 0x00
+	Baudrate               uint32                `json:"baudrate"`                 // Serial baudrate, one of ChipBaudrates
+	PacketInterval         uint16                `json:"packet_interval"`          // Serial packet interval in ms
+	VID                    uint16                `json:"vid"`                      // USB vendor ID
+	PID                    uint16                `json:"pid"`                      // USB product ID
+	KeyboardUploadInterval uint16                `json:"keyboard_upload_interval"` // Interval between keyboard reports in ASCII mode, ms
+	KeyboardReleaseDelay   uint16                `json:"keyboard_release_delay"`   // Key release delay in ASCII mode, ms
+	KeyboardFastUpload     bool                  `json:"keyboard_fast_upload"`
+	CustomDescriptors      ChipCustomDescriptors `json:"custom_descriptors"`
+	Manufacturer           string                `json:"manufacturer"`
+	Product                string                `json:"product"`
+	SerialNumber           string                `json:"serial_number"`
+
+	raw [chipConfigLength]byte // Reserved and ASCII mode bytes written back as read
+}
+
+// ParseChipConfig decodes the data of a GET_PARA_CFG reply
+func ParseChipConfig(data []byte) (*ChipConfig, error) {
+	if len(data) < chipConfigLength {
+		return nil, fmt.Errorf("chip configuration is %d bytes, want %d", len(data), chipConfigLength)
+	}
+	cfg := &ChipConfig{
+		Mode:                   data[0],
+		SerialMode:             data[1],
+		Address:                data[2],
+		Baudrate:               binary.BigEndian.Uint32(data[3:7]),
+		PacketInterval:         binary.BigEndian.Uint16(data[9:11]),
+		VID:                    binary.LittleEndian.Uint16(data[11:13]),
+		PID:                    binary.LittleEndian.Uint16(data[13:15]),
+		KeyboardUploadInterval: binary.BigEndian.Uint16(data[15:17]),
+		KeyboardReleaseDelay:   binary.BigEndian.Uint16(data[17:19]),
+		KeyboardFastUpload:     data[37] != 0,
+		CustomDescriptors: ChipCustomDescriptors{
+			Enabled:      data[36]&chipStringFlagEnabled != 0,
+			Manufacturer: data[36]&chipStringFlagManufacturer != 0,
+			Product:      data[36]&chipStringFlagProduct != 0,
+			SerialNumber: data[36]&chipStringFlagSerialNumber != 0,
+		},
+	}
+	copy(cfg.raw[:], data[:chipConfigLength])
+	return cfg, nil
+}
+
+// Bytes encodes the configuration for SET_PARA_CFG
+func (cfg *ChipConfig) Bytes() []byte {
+	data := cfg.raw
+	data[0] = cfg.Mode
+	data[1] = cfg.SerialMode
+	data[2] = cfg.Address
+	binary.BigEndian.PutUint32(data[3:7], cfg.Baudrate)
+	binary.BigEndian.PutUint16(data[9:11], cfg.PacketInterval)
+	binary.LittleEndian.PutUint16(data[11:13], cfg.VID)
+	binary.LittleEndian.PutUint16(data[13:15], cfg.PID)
+	binary.BigEndian.PutUint16(data[15:17], cfg.KeyboardUploadInterval)
+	binary.BigEndian.PutUint16(data[17:19], cfg.KeyboardReleaseDelay)
+	data[37] = 0x00
+	if cfg.KeyboardFastUpload {
+		data[37] = 0x01
+	}
+	flags := uint8(0)
+	if cfg.CustomDescriptors.Enabled {
+		flags |= chipStringFlagEnabled
+	}
+	if cfg.CustomDescriptors.Manufacturer {
+		flags |= chipStringFlagManufacturer
+	}
+	if cfg.CustomDescriptors.Product {
+		flags |= chipStringFlagProduct
+	}
+	if cfg.CustomDescriptors.SerialNumber {
+		flags |= chipStringFlagSerialNumber
+	}
+	data[36] = flags
+	return data[:]
+}
+
+// Validate checks if the configuration can be written to the chip
+func (cfg *ChipConfig) Validate() error {
+	if cfg.Mode&0x7F > CHIP_MODE_CUSTOM {
+		return fmt.Errorf("invalid chip mode 0x%02X", cfg.Mode)
+	}
+	if cfg.SerialMode&0x7F > 0x02 {
+		return fmt.Errorf("invalid serial mode 0x%02X", cfg.SerialMode)
+	}
+	if cfg.Address == 0xFF {
+		return errors.New("address 0xFF is the broadcast address")
+	}
+	if !isChipBaudrate(cfg.Baudrate) {
+		return fmt.Errorf("unsupported baudrate %d", cfg.Baudrate)
+	}
+	if cfg.VID == 0 || cfg.PID == 0 {
+		return errors.New("VID and PID must not be 0")
+	}
+	for _, s := range []struct{ name, value string }{
+		{"manufacturer", cfg.Manufacturer},
+		{"product", cfg.Product},
+		{"serial number", cfg.SerialNumber},
+	} {
+		if err := validateChipUSBString(s.value); err != nil {
+			return fmt.Errorf("invalid %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// isChipBaudrate checks if the baudrate is supported by the chip
+func isChipBaudrate(baudrate uint32) bool {
+	for _, b := range ChipBaudrates {
+		if b == baudrate {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChipUSBString checks if a string fits the USB string storage of the chip
+func validateChipUSBString(s string) error {
+	if len(s) > MaxChipUSBStringLength {
+		return fmt.Errorf("longer than %d characters", MaxChipUSBStringLength)
+	}
+	for _, r := range s {
+		if r < 0x20 || r > 0x7E {
+			return errors.New("only printable ASCII characters are supported")
+		}
+	}
+	return nil
+}
+
+// ReadChipConfig reads the parameter configuration and USB strings of the chip
+func (c *Controller) ReadChipConfig() (*ChipConfig, error) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	packet := []uint8{0x57, 0xAB, 0x00, 0x08, 0x00, 0x00}
+	packet[5] = calcChecksum(packet[:5])
+	data, err := c.SendChipCommand(packet)
+	if err != nil {
+		return nil, errors.New("failed to send GET_PARA_CFG command: " + err.Error())
+	}
+	cfg, err := ParseChipConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	for stringType, value := range map[uint8]*string{
+		chipStringManufacturer: &cfg.Manufacturer,
+		chipStringProduct:      &cfg.Product,
+		chipStringSerialNumber: &cfg.SerialNumber,
+	} {
+		if *value, err = c.getUSBString(stringType); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// WriteChipConfig validates and writes the parameter configuration and USB
+// strings to the chip. They take effect after the chip is power cycled.
+func (c *Controller) WriteChipConfig(cfg *ChipConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	packet := append([]uint8{0x57, 0xAB, 0x00, 0x09, chipConfigLength}, cfg.Bytes()...)
+	packet = append(packet, calcChecksum(packet))
+	if _, err := c.SendChipCommand(packet); err != nil {
+		return errors.New("failed to send SET_PARA_CFG command: " + err.Error())
+	}
+	for _, s := range []struct {
+		stringType uint8
+		value      string
+	}{
+		{chipStringManufacturer, cfg.Manufacturer},
+		{chipStringProduct, cfg.Product},
+		{chipStringSerialNumber, cfg.SerialNumber},
+	} {
+		if err := c.setUSBString(s.stringType, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getUSBString reads a USB string of the chip. The caller must hold cmdMu.
+func (c *Controller) getUSBString(stringType uint8) (string, error) {
+	packet := []uint8{0x57, 0xAB, 0x00, 0x0A, 0x01, stringType, 0x00}
+	packet[6] = calcChecksum(packet[:6])
+	data, err := c.SendChipCommand(packet)
+	if err != nil {
+		return "", errors.New("failed to send GET_USB_STRING command: " + err.Error())
+	}
+	// Reply data is the string type, the length and the string
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return "", errors.New("GET_USB_STRING reply is too short")
+	}
+	return string(data[2 : 2+int(data[1])]), nil
+}
+
+// setUSBString writes a USB string of the chip. The caller must hold cmdMu.
+func (c *Controller) setUSBString(stringType uint8, value string) error {
+	if err := validateChipUSBString(value); err != nil {
+		return err
+	}
+	packet := []uint8{0x57, 0xAB, 0x00, 0x0B, uint8(len(value) + 2), stringType, uint8(len(value))}
+	packet = append(packet, value...)
+	packet = append(packet, calcChecksum(packet))
+	if _, err := c.SendChipCommand(packet); err != nil {
+		return errors.New("failed to send SET_USB_STRING command: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package kvmhid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChipConfigRoundTrip(t *testing.T) {
+	data := make([]byte, chipConfigLength)
+	data[0] = CHIP_MODE_KEYBOARD_MOUSE
+	data[3], data[4], data[5], data[6] = 0x00, 0x01, 0xC2, 0x00 // 115200 baud
+	data[10] = 0x03
+	data[11], data[12], data[13], data[14] = 0x86, 0x1A, 0x29, 0xE1
+	data[20] = 0x0D // Enter characters are not decoded but kept
+	data[36] = chipStringFlagEnabled | chipStringFlagProduct
+
+	cfg, err := ParseChipConfig(data)
+	if err != nil {
+		t.Fatalf("ParseChipConfig: %v", err)
+	}
+	if cfg.Baudrate != 115200 || cfg.VID != 0x1A86 || cfg.PID != 0xE129 || cfg.PacketInterval != 3 {
+		t.Fatalf("ParseChipConfig = %+v", cfg)
+	}
+	want := ChipCustomDescriptors{Enabled: true, Product: true}
+	if cfg.CustomDescriptors != want {
+		t.Errorf("CustomDescriptors = %+v, want %+v", cfg.CustomDescriptors, want)
+	}
+	if got := cfg.Bytes(); !bytes.Equal(got, data) {
+		t.Errorf("Bytes = % X, want % X", got, data)
+	}
+
+	cfg.VID, cfg.PID = 0x046D, 0xC31C
+	cfg.Baudrate = 9600
+	cfg.CustomDescriptors = ChipCustomDescriptors{}
+	got := cfg.Bytes()
+	if got[11] != 0x6D || got[12] != 0x04 || got[13] != 0x1C || got[14] != 0xC3 {
+		t.Errorf("VID/PID bytes = % X", got[11:15])
+	}
+	if got[3] != 0x00 || got[4] != 0x00 || got[5] != 0x25 || got[6] != 0x80 {
+		t.Errorf("baudrate bytes = % X", got[3:7])
+	}
+	if got[36] != 0x00 || got[20] != 0x0D {
+		t.Errorf("flags = 0x%02X, enter character = 0x%02X", got[36], got[20])
+	}
+}
+
+func TestChipConfigValidate(t *testing.T) {
+	valid := ChipConfig{Mode: CHIP_MODE_KEYBOARD_MOUSE, Baudrate: 115200, VID: 0x1A86, PID: 0xE129, Product: "DezKVM"}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	tests := map[string]func(*ChipConfig){
+		"mode":      func(c *ChipConfig) { c.Mode = 0x04 },
+		"baudrate":  func(c *ChipConfig) { c.Baudrate = 12345 },
+		"address":   func(c *ChipConfig) { c.Address = 0xFF },
+		"vid":       func(c *ChipConfig) { c.VID = 0 },
+		"long":      func(c *ChipConfig) { c.Product = "A product name longer than 23" },
+		"non-ascii": func(c *ChipConfig) { c.Manufacturer = "Tastatür" },
+	}
+	for name, modify := range tests {
+		cfg := valid
+		modify(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted %+v", name, cfg)
+		}
+	}
+}
+
+func TestChipConfigWithHIDController(t *testing.T) {
+	controller, _ := newSimulatedController(t)
+
+	cfg, err := controller.ReadChipConfig()
+	if err != nil {
+		t.Fatalf("ReadChipConfig: %v", err)
+	}
+	if cfg.Mode != CHIP_MODE_KEYBOARD_MOUSE || cfg.Baudrate != 115200 || cfg.VID != 0x1A86 || cfg.Product != "DezKVM" {
+		t.Fatalf("ReadChipConfig = %+v", cfg)
+	}
+
+	// Look like a generic keyboard
+	cfg.VID, cfg.PID = 0x046D, 0xC31C
+	cfg.Manufacturer, cfg.Product = "Logitech", "USB Keyboard"
+	cfg.CustomDescriptors = ChipCustomDescriptors{Enabled: true, Manufacturer: true, Product: true}
+	if err := controller.WriteChipConfig(cfg); err != nil {
+		t.Fatalf("WriteChipConfig: %v", err)
+	}
+	got, err := controller.ReadChipConfig()
+	if err != nil {
+		t.Fatalf("ReadChipConfig: %v", err)
+	}
+	if got.VID != 0x046D || got.PID != 0xC31C || got.Product != "USB Keyboard" || got.Manufacturer != "Logitech" || !got.CustomDescriptors.Product {
+		t.Errorf("config after write = %+v", got)
+	}
+
+	cfg.Baudrate = 12345
+	if err := controller.WriteChipConfig(cfg); err == nil {
+		t.Error("WriteChipConfig accepted an unsupported baudrate")
+	}
+}
@@ -0,0 +1,133 @@
+package kvmhid
+
+/*
+	consumer.go
+
+	Multimedia and ACPI keys sent with the CH9329 command 0x03. The chip
+	has two fixed reports for them:
+
+		ACPI:       0x01, 1 byte bitmap  (power, sleep, wake)
+		Multimedia: 0x02, 3 bytes bitmap (volume, media and browser keys)
+
+	Brightness keys are not part of the report descriptor of the chip and
+	cannot be sent.
+*/
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	consumerReportACPI       = 0x01
+	consumerReportMultimedia = 0x02
+)
+
+// consumerKey is the position of a key in the ACPI or multimedia report
+type consumerKey struct {
+	report uint8 // consumerReportACPI or consumerReportMultimedia
+	index  int   // Byte of the bitmap
+	bit    uint8
+}
+
+// consumerKeys maps the consumer key names used by the API to the report bits
+var consumerKeys = map[string]consumerKey{
+	// ACPI
+	"power": {consumerReportACPI, 0, 0x01},
+	"sleep": {consumerReportACPI, 0, 0x02},
+	"wake":  {consumerReportACPI, 0, 0x04},
+
+	// Multimedia, first byte
+	"volume_up":   {consumerReportMultimedia, 0, 0x01},
+	"volume_down": {consumerReportMultimedia, 0, 0x02},
+	"mute":        {consumerReportMultimedia, 0, 0x04},
+	"play_pause":  {consumerReportMultimedia, 0, 0x08},
+	"next_track":  {consumerReportMultimedia, 0, 0x10},
+	"prev_track":  {consumerReportMultimedia, 0, 0x20},
+	"stop":        {consumerReportMultimedia, 0, 0x40},
+	"eject":       {consumerReportMultimedia, 0, 0x80},
+
+	// Multimedia, second byte
+	"email":         {consumerReportMultimedia, 1, 0x01},
+	"www_search":    {consumerReportMultimedia, 1, 0x02},
+	"www_favorites": {consumerReportMultimedia, 1, 0x04},
+	"www_home":      {consumerReportMultimedia, 1, 0x08},
+	"www_back":      {consumerReportMultimedia, 1, 0x10},
+	"www_forward":   {consumerReportMultimedia, 1, 0x20},
+	"www_stop":      {consumerReportMultimedia, 1, 0x40},
+	"www_refresh":   {consumerReportMultimedia, 1, 0x80},
+
+	// Multimedia, third byte
+	"media":       {consumerReportMultimedia, 2, 0x01},
+	"explorer":    {consumerReportMultimedia, 2, 0x02},
+	"calculator":  {consumerReportMultimedia, 2, 0x04},
+	"screensaver": {consumerReportMultimedia, 2, 0x08},
+	"my_computer": {consumerReportMultimedia, 2, 0x10},
+	"minimize":    {consumerReportMultimedia, 2, 0x20},
+	"record":      {consumerReportMultimedia, 2, 0x40},
+	"rewind":      {consumerReportMultimedia, 2, 0x80},
+}
+
+// ConsumerKeys returns the names of the supported consumer keys, sorted
+func ConsumerKeys() []string {
+	names := make([]string, 0, len(consumerKeys))
+	for name := range consumerKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsConsumerKey checks if the name is a supported consumer key
+func IsConsumerKey(name string) bool {
+	_, ok := consumerKeys[name]
+	return ok
+}
+
+// consumerKeyPacket builds the 0x03 packet of a consumer report. A report
+// with an empty bitmap releases the keys of that report.
+func consumerKeyPacket(report uint8, bitmap []uint8) []uint8 {
+	packet := []uint8{0x57, 0xAB, 0x00, 0x03, uint8(len(bitmap) + 1), report}
+	packet = append(packet, bitmap...)
+	packet = append(packet, 0x00) // Checksum placeholder
+	packet[len(packet)-1] = calcChecksum(packet[:len(packet)-1])
+	return packet
+}
+
+// sendConsumerReport sends a consumer report if the backend supports them
+func (c *Controller) sendConsumerReport(report uint8, bitmap []uint8) error {
+	backend, ok := c.backend.(ConsumerKeyBackend)
+	if !ok {
+		return errors.New("consumer keys are " + ErrUnsupportedByBackend.Error())
+	}
+	return backend.ConsumerReport(report, bitmap)
+}
+
+// consumerKeyTap presses and releases a consumer key. The caller must hold cmdMu.
+func (c *Controller) consumerKeyTap(name string) ([]byte, error) {
+	key, ok := consumerKeys[name]
+	if !ok {
+		return nil, errors.New("unsupported consumer key: " + name)
+	}
+	size := 1
+	if key.report == consumerReportMultimedia {
+		size = 3
+	}
+	bitmap := make([]uint8, size)
+	bitmap[key.index] = key.bit
+	if err := c.sendConsumerReport(key.report, bitmap); err != nil {
+		return nil, err
+	}
+	if err := c.sendConsumerReport(key.report, make([]uint8, size)); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// SendConsumerKey presses and releases a consumer key, e.g. "mute" or "wake"
+func (c *Controller) SendConsumerKey(name string) error {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	_, err := c.consumerKeyTap(name)
+	return err
+}
@@ -0,0 +1,68 @@
+package kvmhid
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConsumerKeyPacket(t *testing.T) {
+	cases := []struct {
+		report uint8
+		bitmap []uint8
+		want   []uint8
+	}{
+		// Mute press and release
+		{consumerReportMultimedia, []uint8{0x04, 0x00, 0x00}, []uint8{0x57, 0xAB, 0x00, 0x03, 0x04, 0x02, 0x04, 0x00, 0x00, 0x0F}},
+		{consumerReportMultimedia, []uint8{0x00, 0x00, 0x00}, []uint8{0x57, 0xAB, 0x00, 0x03, 0x04, 0x02, 0x00, 0x00, 0x00, 0x0B}},
+		// Wake press
+		{consumerReportACPI, []uint8{0x04}, []uint8{0x57, 0xAB, 0x00, 0x03, 0x02, 0x01, 0x04, 0x0C}},
+	}
+	for _, c := range cases {
+		if got := consumerKeyPacket(c.report, c.bitmap); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("consumerKeyPacket(0x%02X, %v) = % X, want % X", c.report, c.bitmap, got, c.want)
+		}
+	}
+}
+
+func TestConsumerKeys(t *testing.T) {
+	for _, name := range []string{"volume_up", "volume_down", "mute", "play_pause", "sleep", "power", "wake"} {
+		if !IsConsumerKey(name) {
+			t.Errorf("%s is not a consumer key", name)
+		}
+	}
+	// Every key has its own bit
+	seen := map[consumerKey]string{}
+	for _, name := range ConsumerKeys() {
+		key := consumerKeys[name]
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s share a report bit", name, other)
+		}
+		seen[key] = name
+	}
+}
+
+func TestConsumerKeyWithHIDController(t *testing.T) {
+	controller, dev := newSimulatedController(t)
+
+	before := dev.CH9329.State().Packets
+	if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeConsumerKey, ConsumerKey: "mute"}); err != nil {
+		t.Fatalf("mute: %v", err)
+	}
+	// A press and a release report, the last one releases all multimedia keys
+	state := dev.CH9329.State()
+	if packets := state.Packets - before; packets != 2 {
+		t.Errorf("chip received %d packets, want 2", packets)
+	}
+	if want := []uint8{0x02, 0x00, 0x00, 0x00}; !reflect.DeepEqual(state.MediaKeys, want) {
+		t.Errorf("media keys = %v, want %v", state.MediaKeys, want)
+	}
+	if err := controller.SendConsumerKey("wake"); err != nil {
+		t.Fatalf("wake: %v", err)
+	}
+	if want := []uint8{0x01, 0x00}; !reflect.DeepEqual(dev.CH9329.State().MediaKeys, want) {
+		t.Errorf("media keys = %v, want %v", dev.CH9329.State().MediaKeys, want)
+	}
+	if err := controller.SendConsumerKey("brightness_up"); err == nil {
+		t.Error("unsupported consumer key accepted")
+	}
+}
@@ -0,0 +1,292 @@
+package kvmhid
+
+/*
+	ducky.go
+
+	Interpreter for DuckyScript 1.0 style keystroke scripts, e.g.
+
+		REM Open the run dialog
+		DEFAULT_DELAY 100
+		GUI r
+		DELAY 500
+		STRINGLN notepad
+		CTRL ALT DELETE
+		REPEAT 2
+
+	Scripts are parsed into key strokes with a keyboard layout first, so
+	all errors are reported with their line number before anything is
+	typed on the remote machine.
+*/
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Script limits
+const (
+	MaxDuckyScriptDelay  = 10 * time.Minute // Maximum DELAY and DEFAULT_DELAY
+	MaxDuckyScriptRepeat = 10000            // Maximum REPEAT count
+)
+
+// Modifier names of DuckyScript
+var duckyModifiers = map[string]uint8{
+	"CTRL":    MOD_LCTRL,
+	"CONTROL": MOD_LCTRL,
+	"SHIFT":   MOD_LSHIFT,
+	"ALT":     MOD_LALT,
+	"GUI":     MOD_LGUI,
+	"WINDOWS": MOD_LGUI,
+	"COMMAND": MOD_LGUI,
+	"META":    MOD_LGUI,
+}
+
+// Key names of DuckyScript and their HID usage
+var duckyKeys = map[string]uint8{
+	"ENTER": 0x28, "ESC": 0x29, "ESCAPE": 0x29, "BACKSPACE": 0x2A, "TAB": 0x2B, "SPACE": 0x2C,
+	"CAPSLOCK": 0x39, "PRINTSCREEN": 0x46, "SCROLLLOCK": 0x47, "PAUSE": 0x48, "BREAK": 0x48,
+	"INSERT": 0x49, "HOME": 0x4A, "PAGEUP": 0x4B, "DELETE": 0x4C, "DEL": 0x4C, "END": 0x4D, "PAGEDOWN": 0x4E,
+	"RIGHT": 0x4F, "RIGHTARROW": 0x4F, "LEFT": 0x50, "LEFTARROW": 0x50,
+	"DOWN": 0x51, "DOWNARROW": 0x51, "UP": 0x52, "UPARROW": 0x52,
+	"NUMLOCK": 0x53, "MENU": 0x65, "APP": 0x65,
+}
+
+func init() {
+	for i := 0; i < 12; i++ {
+		duckyKeys[fmt.Sprintf("F%d", i+1)] = uint8(0x3A + i)
+		duckyKeys[fmt.Sprintf("F%d", i+13)] = uint8(0x68 + i)
+	}
+}
+
+// ScriptError is a parse error of a script line
+type ScriptError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// DuckyCommand is a parsed script line
+type DuckyCommand struct {
+	Line         int           `json:"line"`
+	Source       string        `json:"source"`
+	Strokes      []KeyStroke   `json:"-"`      // Keys typed by the command
+	Delay        time.Duration `json:"-"`      // Pause of a DELAY command
+	DefaultDelay time.Duration `json:"-"`      // New default delay of a DEFAULT_DELAY command, -1 if not set
+	Repeat       int           `json:"repeat"` // Number of additional runs set by REPEAT
+}
+
+// DuckyScript is a parsed script ready to run
+type DuckyScript struct {
+	Commands   []*DuckyCommand `json:"commands"`
+	Untypable  []ScriptError   `json:"untypable"` // STRING characters skipped as they are not in the layout
+	LayoutID   string          `json:"layout"`
+	KeyStrokes int             `json:"key_strokes"` // Number of key strokes including repeats
+}
+
+// DuckyProgress reports the command being run
+type DuckyProgress struct {
+	Command  int `json:"command"`  // Index of the command, starting at 0
+	Commands int `json:"commands"` // Number of commands
+	Line     int `json:"line"`     // Line of the command in the script
+	Run      int `json:"run"`      // Run of the command, starting at 1, more than 1 when repeated
+}
+
+// ParseDuckyScript parses a script and converts its STRING commands with the
+// layout. All errors are returned with their line numbers, the script is
+// only valid if there are none.
+func ParseDuckyScript(source string, layout *KeyboardLayout) (*DuckyScript, []ScriptError) {
+	script := &DuckyScript{
+		Commands:  []*DuckyCommand{},
+		Untypable: []ScriptError{},
+		LayoutID:  layout.ID,
+	}
+	errs := []ScriptError{}
+	inRemBlock := false
+	var previous *DuckyCommand
+	for i, rawLine := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		lineNumber := i + 1
+		line := strings.TrimLeft(rawLine, " \t")
+		keyword, argument, _ := strings.Cut(line, " ")
+		keyword = strings.ToUpper(strings.TrimSpace(keyword))
+		if inRemBlock {
+			if keyword == "END_REM" {
+				inRemBlock = false
+			}
+			continue
+		}
+		if keyword == "" || keyword == "REM" || strings.HasPrefix(keyword, "//") {
+			continue
+		}
+
+		cmd := &DuckyCommand{Line: lineNumber, Source: strings.TrimSpace(line), DefaultDelay: -1}
+		var err error
+		switch keyword {
+		case "REM_BLOCK":
+			inRemBlock = true
+			continue
+		case "STRING", "STRINGLN":
+			if argument == "" && keyword == "STRING" {
+				err = fmt.Errorf("%s requires text", keyword)
+				break
+			}
+			text := argument
+			if keyword == "STRINGLN" {
+				text += "\n"
+			}
+			strokes, untypable := layout.KeyStrokes(text)
+			for _, u := range untypable {
+				script.Untypable = append(script.Untypable, ScriptError{
+					Line:    lineNumber,
+					Message: fmt.Sprintf("%q cannot be typed with the %s layout", u.Char, layout.Name),
+				})
+			}
+			cmd.Strokes = strokes
+		case "DELAY":
+			cmd.Delay, err = parseDuckyDelay(argument)
+		case "DEFAULT_DELAY", "DEFAULTDELAY":
+			cmd.DefaultDelay, err = parseDuckyDelay(argument)
+		case "REPEAT", "REPLAY":
+			var count int
+			count, err = strconv.Atoi(strings.TrimSpace(argument))
+			switch {
+			case err != nil || count < 1:
+				err = fmt.Errorf("%s requires a positive number", keyword)
+			case previous == nil || previous.DefaultDelay >= 0:
+				err = fmt.Errorf("%s has no command to repeat", keyword)
+			case previous.Repeat+count > MaxDuckyScriptRepeat:
+				err = fmt.Errorf("%s count must not exceed %d", keyword, MaxDuckyScriptRepeat)
+			default:
+				previous.Repeat += count
+			}
+			if err == nil {
+				continue
+			}
+		default:
+			var stroke KeyStroke
+			stroke, err = parseDuckyKeyCombination(line, layout)
+			cmd.Strokes = []KeyStroke{stroke}
+		}
+		if err != nil {
+			errs = append(errs, ScriptError{Line: lineNumber, Message: err.Error()})
+			continue
+		}
+		script.Commands = append(script.Commands, cmd)
+		previous = cmd
+	}
+	if inRemBlock {
+		errs = append(errs, ScriptError{Line: strings.Count(source, "\n") + 1, Message: "REM_BLOCK without END_REM"})
+	}
+	for _, cmd := range script.Commands {
+		script.KeyStrokes += len(cmd.Strokes) * (cmd.Repeat + 1)
+	}
+	return script, errs
+}
+
+// parseDuckyDelay parses the milliseconds argument of DELAY and DEFAULT_DELAY
+func parseDuckyDelay(argument string) (time.Duration, error) {
+	ms, err := strconv.Atoi(strings.TrimSpace(argument))
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("delay must be a number of milliseconds")
+	}
+	delay := time.Duration(ms) * time.Millisecond
+	if delay > MaxDuckyScriptDelay {
+		return 0, fmt.Errorf("delay must not exceed %d ms", MaxDuckyScriptDelay.Milliseconds())
+	}
+	return delay, nil
+}
+
+// parseDuckyKeyCombination parses a line of modifiers and at most one key,
+// e.g. "GUI r", "CTRL ALT DELETE" or "CTRL-SHIFT ESC". Single characters are
+// looked up in the layout, so "CTRL /" works on layouts where / needs Shift.
+func parseDuckyKeyCombination(line string, layout *KeyboardLayout) (KeyStroke, error) {
+	stroke := KeyStroke{}
+	tokens := []string{}
+	for _, field := range strings.Fields(line) {
+		if len(field) > 1 && strings.Contains(field, "-") {
+			for _, part := range strings.Split(field, "-") {
+				if part != "" {
+					tokens = append(tokens, part)
+				}
+			}
+			continue
+		}
+		tokens = append(tokens, field)
+	}
+	for _, token := range tokens {
+		name := strings.ToUpper(token)
+		if modifier, ok := duckyModifiers[name]; ok {
+			stroke.Modifiers |= modifier
+			continue
+		}
+		if stroke.Usage != 0 {
+			return stroke, fmt.Errorf("only one key can be combined with modifiers, got %q", token)
+		}
+		if usage, ok := duckyKeys[name]; ok {
+			stroke.Usage = usage
+			continue
+		}
+		chars := []rune(token)
+		if len(chars) != 1 {
+			return stroke, fmt.Errorf("unknown command or key %q", token)
+		}
+		// Letters are keys, "GUI R" presses GUI + r like "GUI r"
+		charStrokes, ok := layout.CharKeyStrokes([]rune(strings.ToLower(token))[0])
+		if !ok || len(charStrokes) != 1 {
+			return stroke, fmt.Errorf("%q cannot be typed with the %s layout", token, layout.Name)
+		}
+		stroke.Usage = charStrokes[0].Usage
+		stroke.Modifiers |= charStrokes[0].Modifiers
+	}
+	return stroke, nil
+}
+
+// RunDuckyScript runs a parsed script. keyDelay is the delay between the key
+// strokes of a STRING command. progress is called before each command runs.
+// Keys are released when the script is cancelled.
+func (c *Controller) RunDuckyScript(ctx context.Context, script *DuckyScript, keyDelay time.Duration, progress func(DuckyProgress)) error {
+	defaultDelay := time.Duration(0)
+	wait := func(delay time.Duration) error {
+		if delay <= 0 {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			return nil
+		}
+	}
+	for i, cmd := range script.Commands {
+		if cmd.DefaultDelay >= 0 {
+			defaultDelay = cmd.DefaultDelay
+			continue
+		}
+		for run := 1; run <= cmd.Repeat+1; run++ {
+			if progress != nil {
+				progress(DuckyProgress{Command: i, Commands: len(script.Commands), Line: cmd.Line, Run: run})
+			}
+			if cmd.Delay > 0 {
+				if err := wait(cmd.Delay); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := c.TypeKeyStrokes(ctx, cmd.Strokes, keyDelay); err != nil {
+				if ctx.Err() != nil {
+					c.ReleaseAll()
+				}
+				return err
+			}
+			if err := wait(defaultDelay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package kvmhid
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDuckyScript(t *testing.T) {
+	layout, err := GetKeyboardLayout("us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := "REM open notepad\r\n" +
+		"DEFAULT_DELAY 100\n" +
+		"GUI r\n" +
+		"DELAY 500\n" +
+		"STRINGLN ab\n" +
+		"\n" +
+		"CTRL-ALT DEL\n" +
+		"REPEAT 2\n" +
+		"REM_BLOCK\n" +
+		"not a command\n" +
+		"END_REM\n" +
+		"ALT F4\n"
+	script, errs := ParseDuckyScript(source, layout)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(script.Commands) != 6 {
+		t.Fatalf("got %d commands, want 6", len(script.Commands))
+	}
+	want := []struct {
+		line    int
+		strokes []KeyStroke
+		repeat  int
+	}{
+		{2, nil, 0},
+		{3, []KeyStroke{{0x15, MOD_LGUI}}, 0},
+		{4, nil, 0},
+		{5, []KeyStroke{{0x04, 0}, {0x05, 0}, {0x28, 0}}, 0},
+		{7, []KeyStroke{{0x4C, MOD_LCTRL | MOD_LALT}}, 2},
+		{12, []KeyStroke{{0x3D, MOD_LALT}}, 0},
+	}
+	for i, w := range want {
+		cmd := script.Commands[i]
+		if cmd.Line != w.line || !reflect.DeepEqual(cmd.Strokes, w.strokes) || cmd.Repeat != w.repeat {
+			t.Errorf("command %d = %+v, want %+v", i, cmd, w)
+		}
+	}
+	if script.Commands[0].DefaultDelay != 100*time.Millisecond || script.Commands[2].Delay != 500*time.Millisecond {
+		t.Errorf("unexpected delays %+v %+v", script.Commands[0], script.Commands[2])
+	}
+	// 1 + 3 + 3 runs of CTRL ALT DEL + 1
+	if script.KeyStrokes != 8 {
+		t.Errorf("KeyStrokes = %d, want 8", script.KeyStrokes)
+	}
+}
+
+func TestParseDuckyScriptErrors(t *testing.T) {
+	layout, err := GetKeyboardLayout("us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := "REPEAT 2\n" +
+		"DELAY soon\n" +
+		"STRING ok\n" +
+		"FOO\n" +
+		"CTRL a b\n" +
+		"REPEAT 0\n" +
+		"STRING a€\n" +
+		"DELAY 99999999\n"
+	script, errs := ParseDuckyScript(source, layout)
+	lines := []int{}
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	if want := []int{1, 2, 4, 5, 6, 8}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("errors on lines %v, want %v: %v", lines, want, errs)
+	}
+	// Untypable characters are reported but do not make the script invalid
+	if len(script.Untypable) != 1 || script.Untypable[0].Line != 7 {
+		t.Errorf("untypable = %v", script.Untypable)
+	}
+
+	if _, errs := ParseDuckyScript("REM_BLOCK\nSTRING a", layout); len(errs) != 1 || errs[0].Line != 2 {
+		t.Errorf("unterminated REM_BLOCK: %v", errs)
+	}
+}
+
+func TestParseDuckyScriptLayout(t *testing.T) {
+	layout, err := GetKeyboardLayout("de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Y and Z are swapped on German keyboards and / needs Shift
+	script, errs := ParseDuckyScript("CTRL z\nCTRL /", layout)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	want := []KeyStroke{{0x1C, MOD_LCTRL}, {0x24, MOD_LCTRL | MOD_LSHIFT}}
+	for i, cmd := range script.Commands {
+		if !reflect.DeepEqual(cmd.Strokes, want[i:i+1]) {
+			t.Errorf("command %d strokes = %v, want %v", i, cmd.Strokes, want[i])
+		}
+	}
+}
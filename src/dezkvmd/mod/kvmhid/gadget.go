@@ -0,0 +1,362 @@
+package kvmhid
+
+/*
+	gadget.go
+
+	HID backend for boards with a USB OTG port, e.g. a Raspberry Pi Zero 2
+	or 4, acting as a USB gadget with HID functions set up in configfs (see
+	CreateHIDGadget). Each function has a /dev/hidgN device and its reports
+	are written to it as they are:
+
+		Keyboard:       modifiers, reserved, 6 keys (8 bytes)
+		Absolute mouse: buttons, X LSB, X MSB, Y LSB, Y MSB, wheel (6 bytes)
+		Relative mouse: buttons, dX, dY, wheel (4 bytes)
+
+	The target writes the keyboard LEDs to the keyboard device as a one
+	byte output report.
+*/
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// gadgetWriteTimeout is the time to wait for the target to read a report
+const gadgetWriteTimeout = 500 * time.Millisecond
+
+// GadgetKeyboardReportDesc is the report descriptor of the keyboard
+// function, a boot keyboard accepting all usage IDs up to 0xFF
+var GadgetKeyboardReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xA1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xE0, //   Usage Minimum (Left Control)
+	0x29, 0xE7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Var, Abs), modifiers
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x03, //   Input (Const), reserved
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Var, Abs), LEDs
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x03, //   Output (Const), padding
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xFF, 0x00, //   Logical Maximum (255)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0xFF, //   Usage Maximum (255)
+	0x81, 0x00, //   Input (Data, Array), keys
+	0xC0, // End Collection
+}
+
+// GadgetMouseReportDesc is the report descriptor of the absolute mouse
+// function, using the 0 to 4095 range of the CH9329
+var GadgetMouseReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xA1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x03, //     Usage Maximum (3)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x03, //     Report Count (3)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Var, Abs), buttons
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x05, //     Report Size (5)
+	0x81, 0x03, //     Input (Const), padding
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x26, 0xFF, 0x0F, //     Logical Maximum (4095)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x02, //     Report Count (2)
+	0x81, 0x02, //     Input (Data, Var, Abs), position
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x06, //     Input (Data, Var, Rel), wheel
+	0xC0, //   End Collection
+	0xC0, // End Collection
+}
+
+// GadgetRelativeMouseReportDesc is the report descriptor of the relative
+// mouse function
+var GadgetRelativeMouseReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xA1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x03, //     Usage Maximum (3)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x03, //     Report Count (3)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Var, Abs), buttons
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x05, //     Report Size (5)
+	0x81, 0x03, //     Input (Const), padding
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x03, //     Report Count (3)
+	0x81, 0x06, //     Input (Data, Var, Rel), movement
+	0xC0, //   End Collection
+	0xC0, // End Collection
+}
+
+// GadgetConfig are the device nodes of the HID gadget functions
+type GadgetConfig struct {
+	KeyboardPath      string // Keyboard function, e.g. /dev/hidg0
+	MousePath         string // Absolute mouse function, e.g. /dev/hidg1
+	RelativeMousePath string // Relative mouse function, optional
+	UDC               string // UDC the gadget is bound to, e.g. fe980000.usb, optional
+}
+
+// GadgetDevices are opened HID functions given to NewGadgetBackendWithDevices
+type GadgetDevices struct {
+	Keyboard      io.WriteCloser // LED output reports are read from it if it is an io.Reader
+	Mouse         io.WriteCloser
+	RelativeMouse io.WriteCloser // Optional
+}
+
+// GadgetBackend sends HID reports through the HID functions of a USB gadget
+type GadgetBackend struct {
+	config   GadgetConfig
+	devices  *GadgetDevices // Used by Open instead of the device nodes if set
+	udcRoot  string         // Directory of the UDC sysfs entries
+	mu       sync.Mutex
+	keyboard io.WriteCloser
+	mouse    io.WriteCloser
+	relMouse io.WriteCloser
+	lastX    uint16 // Last absolute position, the wheel is sent with it
+	lastY    uint16
+	leds     atomic.Uint32 // Last LED output report of the target
+}
+
+// NewGadgetBackend creates a backend for the HID gadget functions
+func NewGadgetBackend(config GadgetConfig) *GadgetBackend {
+	return &GadgetBackend{
+		config:  config,
+		udcRoot: "/sys/class/udc",
+	}
+}
+
+// NewGadgetBackendWithDevices creates a backend writing the reports to
+// devices opened by the caller instead of the device nodes of config, e.g.
+// to record the reports. Close closes the devices, so the backend can only
+// be opened once.
+func NewGadgetBackendWithDevices(config GadgetConfig, devices GadgetDevices) *GadgetBackend {
+	backend := NewGadgetBackend(config)
+	backend.devices = &devices
+	return backend
+}
+
+// Open opens the device nodes of the HID functions
+func (g *GadgetBackend) Open() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.devices != nil {
+		if g.devices.Keyboard == nil || g.devices.Mouse == nil {
+			return errors.New("keyboard and mouse gadget devices must be specified")
+		}
+		g.keyboard, g.mouse, g.relMouse = g.devices.Keyboard, g.devices.Mouse, g.devices.RelativeMouse
+	} else {
+		if g.config.KeyboardPath == "" || g.config.MousePath == "" {
+			return errors.New("keyboard and mouse gadget devices must be specified")
+		}
+		var err error
+		if g.keyboard, err = openGadgetDevice(g.config.KeyboardPath, os.O_RDWR); err != nil {
+			return err
+		}
+		if g.mouse, err = openGadgetDevice(g.config.MousePath, os.O_WRONLY); err != nil {
+			g.closeFiles()
+			return err
+		}
+		if g.config.RelativeMousePath != "" {
+			if g.relMouse, err = openGadgetDevice(g.config.RelativeMousePath, os.O_WRONLY); err != nil {
+				g.closeFiles()
+				return err
+			}
+		}
+	}
+	if reader, ok := g.keyboard.(io.Reader); ok {
+		go g.readLEDs(reader)
+	}
+	return nil
+}
+
+// openGadgetDevice opens the device node of a HID function. A nil *os.File
+// must not end up in the io.WriteCloser fields, so it is opened here.
+func openGadgetDevice(path string, flag int) (io.WriteCloser, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readLEDs reads the LED output reports of the target until the keyboard is closed
+func (g *GadgetBackend) readLEDs(keyboard io.Reader) {
+	buf := make([]byte, 8)
+	for {
+		n, err := keyboard.Read(buf)
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			g.leds.Store(uint32(buf[0]))
+		}
+	}
+}
+
+// writeReport writes a report to a function, the target must read it within gadgetWriteTimeout
+func writeReport(f io.Writer, report []byte) error {
+	if f == nil {
+		return errors.New("HID gadget is not open")
+	}
+	// Devices without deadlines are expected not to block
+	if d, ok := f.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		if err := d.SetWriteDeadline(time.Now().Add(gadgetWriteTimeout)); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+			return err
+		}
+	}
+	_, err := f.Write(report)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errors.New("target did not read the HID report, is it powered on?")
+	}
+	return err
+}
+
+// KeyboardReport writes a keyboard report
+func (g *GadgetBackend) KeyboardReport(modifiers uint8, keys [6]uint8) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	report := append([]byte{modifiers, 0x00}, keys[:]...)
+	return writeReport(g.keyboard, report)
+}
+
+// mouseAbsoluteReport writes an absolute mouse report. The caller must hold mu.
+func (g *GadgetBackend) mouseAbsoluteReport(buttons uint8, x, y uint16, wheel int8) error {
+	g.lastX, g.lastY = x, y
+	return writeReport(g.mouse, []byte{buttons, uint8(x), uint8(x >> 8), uint8(y), uint8(y >> 8), uint8(wheel)})
+}
+
+// MouseAbsolute writes an absolute mouse report
+func (g *GadgetBackend) MouseAbsolute(buttons uint8, x, y uint16) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mouseAbsoluteReport(buttons, x, y, 0)
+}
+
+// MouseRelative writes a relative mouse report. Without a relative mouse
+// function only button changes can be sent, at the last absolute position.
+func (g *GadgetBackend) MouseRelative(buttons uint8, dx, dy int8) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.relMouse == nil {
+		if dx != 0 || dy != 0 {
+			return errors.New("relative mouse movement is " + ErrUnsupportedByBackend.Error())
+		}
+		return g.mouseAbsoluteReport(buttons, g.lastX, g.lastY, 0)
+	}
+	return writeReport(g.relMouse, []byte{buttons, uint8(dx), uint8(dy), 0x00})
+}
+
+// MouseScroll writes a mouse report with the wheel movement
+func (g *GadgetBackend) MouseScroll(buttons uint8, wheel int8) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.relMouse == nil {
+		return g.mouseAbsoluteReport(buttons, g.lastX, g.lastY, wheel)
+	}
+	return writeReport(g.relMouse, []byte{buttons, 0x00, 0x00, uint8(wheel)})
+}
+
+// Reset releases all keys and mouse buttons, the gadget itself has no state
+func (g *GadgetBackend) Reset() error {
+	if err := g.KeyboardReport(0x00, [6]uint8{}); err != nil {
+		return err
+	}
+	return g.MouseRelative(0x00, 0, 0)
+}
+
+// Status reports the LEDs set by the target and the state of the UDC
+func (g *GadgetBackend) Status() (ChipStatus, error) {
+	g.mu.Lock()
+	open := g.keyboard != nil
+	g.mu.Unlock()
+	if !open {
+		return ChipStatus{}, errors.New("HID gadget is not open")
+	}
+	leds := uint8(g.leds.Load())
+	status := ChipStatus{
+		Responding:    true,
+		Version:       "gadget",
+		USBEnumerated: true,
+		NumLock:       leds&LED_NUMLOCK != 0,
+		CapsLock:      leds&LED_CAPSLOCK != 0,
+		ScrollLock:    leds&LED_SCROLLLOCK != 0,
+	}
+	if g.config.UDC != "" {
+		state, err := os.ReadFile(filepath.Join(g.udcRoot, g.config.UDC, "state"))
+		if err != nil {
+			return ChipStatus{}, err
+		}
+		status.USBEnumerated = strings.TrimSpace(string(state)) == "configured"
+	}
+	return status, nil
+}
+
+// closeFiles closes the device nodes. The caller must hold mu.
+func (g *GadgetBackend) closeFiles() error {
+	var errs []error
+	for _, f := range []*io.WriteCloser{&g.keyboard, &g.mouse, &g.relMouse} {
+		if *f == nil {
+			continue
+		}
+		if err := (*f).Close(); err != nil {
+			errs = append(errs, err)
+		}
+		*f = nil
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the device nodes of the HID functions
+func (g *GadgetBackend) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closeFiles()
+}
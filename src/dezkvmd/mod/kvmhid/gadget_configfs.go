@@ -0,0 +1,140 @@
+package kvmhid
+
+/*
+	gadget_configfs.go
+
+	Creation of the HID gadget used by GadgetBackend in configfs. The
+	libcomposite module must be loaded and the board must have a UDC, i.e.
+	the dwc2 overlay on a Raspberry Pi. The functions are created in the
+	order keyboard, absolute mouse and relative mouse, so on a board
+	without other HID gadgets they are /dev/hidg0, /dev/hidg1 and /dev/hidg2.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultConfigFSGadgetRoot is the directory of the USB gadgets in configfs
+const DefaultConfigFSGadgetRoot = "/sys/kernel/config/usb_gadget"
+
+// GadgetSetup describes the HID gadget created by CreateHIDGadget
+type GadgetSetup struct {
+	Name          string // Directory of the gadget, e.g. "dezkvm"
+	VID           uint16
+	PID           uint16
+	Manufacturer  string
+	Product       string
+	SerialNumber  string
+	RelativeMouse bool   // Add a relative mouse function
+	UDC           string // UDC to bind the gadget to, the first one in /sys/class/udc if empty
+}
+
+// DefaultGadgetSetup returns a setup looking like a generic composite device
+func DefaultGadgetSetup() GadgetSetup {
+	return GadgetSetup{
+		Name:          "dezkvm",
+		VID:           0x1D6B, // Linux Foundation
+		PID:           0x0104, // Multifunction Composite Gadget
+		Manufacturer:  DefaultChipManufacturer,
+		Product:       DefaultChipProduct,
+		SerialNumber:  "0123456789",
+		RelativeMouse: true,
+	}
+}
+
+// gadgetFunction is a HID function of the gadget
+type gadgetFunction struct {
+	name         string
+	protocol     int // 1 keyboard, 2 mouse, 0 none
+	subclass     int // 1 boot interface
+	reportLength int
+	reportDesc   []byte
+}
+
+// configFSAttr is an attribute file of the gadget and its value
+type configFSAttr struct {
+	path  string
+	value []byte
+}
+
+// CreateHIDGadget creates the HID gadget under root, normally
+// DefaultConfigFSGadgetRoot, and binds it to the UDC
+func CreateHIDGadget(root string, setup GadgetSetup) error {
+	if setup.Name == "" || strings.ContainsAny(setup.Name, "/.") {
+		return errors.New("invalid gadget name")
+	}
+	udc := setup.UDC
+	if udc == "" {
+		entries, err := os.ReadDir("/sys/class/udc")
+		if err != nil || len(entries) == 0 {
+			return errors.New("no USB device controller found, is the board in OTG mode?")
+		}
+		udc = entries[0].Name()
+	}
+
+	gadget := filepath.Join(root, setup.Name)
+	if _, err := os.Stat(gadget); err == nil {
+		return fmt.Errorf("gadget %s already exists", gadget)
+	}
+	functions := []gadgetFunction{
+		{"hid.keyboard", 1, 1, 8, GadgetKeyboardReportDesc},
+		{"hid.mouse", 0, 0, 6, GadgetMouseReportDesc},
+	}
+	if setup.RelativeMouse {
+		functions = append(functions, gadgetFunction{"hid.relmouse", 2, 1, 4, GadgetRelativeMouseReportDesc})
+	}
+
+	// configfs creates the attribute files of a directory, writing them is
+	// all that is needed. Files are not truncated as configfs does not support it.
+	attrs := []configFSAttr{
+		{"idVendor", []byte(fmt.Sprintf("0x%04x", setup.VID))},
+		{"idProduct", []byte(fmt.Sprintf("0x%04x", setup.PID))},
+		{"bcdDevice", []byte("0x0100")},
+		{"bcdUSB", []byte("0x0200")},
+		{"strings/0x409/manufacturer", []byte(setup.Manufacturer)},
+		{"strings/0x409/product", []byte(setup.Product)},
+		{"strings/0x409/serialnumber", []byte(setup.SerialNumber)},
+		{"configs/c.1/strings/0x409/configuration", []byte("HID")},
+		{"configs/c.1/MaxPower", []byte("250")},
+	}
+	for _, f := range functions {
+		dir := filepath.Join("functions", f.name)
+		attrs = append(attrs,
+			configFSAttr{filepath.Join(dir, "protocol"), []byte(fmt.Sprint(f.protocol))},
+			configFSAttr{filepath.Join(dir, "subclass"), []byte(fmt.Sprint(f.subclass))},
+			configFSAttr{filepath.Join(dir, "report_length"), []byte(fmt.Sprint(f.reportLength))},
+			configFSAttr{filepath.Join(dir, "report_desc"), f.reportDesc},
+		)
+	}
+	for _, attr := range attrs {
+		if err := writeConfigFSAttr(filepath.Join(gadget, attr.path), attr.value); err != nil {
+			return err
+		}
+	}
+	for _, f := range functions {
+		if err := os.Symlink(filepath.Join(gadget, "functions", f.name), filepath.Join(gadget, "configs/c.1", f.name)); err != nil {
+			return err
+		}
+	}
+	return writeConfigFSAttr(filepath.Join(gadget, "UDC"), []byte(udc))
+}
+
+// writeConfigFSAttr writes an attribute, creating its directory like mkdir in configfs
+func writeConfigFSAttr(path string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,184 @@
+package kvmhid
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// reportRecorder records the reports written to a HID function
+type reportRecorder struct {
+	mu      sync.Mutex
+	reports []byte
+	closed  bool
+}
+
+func (r *reportRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	r.reports = append(r.reports, p...)
+	return len(p), nil
+}
+
+func (r *reportRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// written returns the reports written so far
+func (r *reportRecorder) written() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.reports...)
+}
+
+// fakeGadget are the recorded HID functions of a gadget backend
+type fakeGadget struct {
+	keyboard, mouse, relMouse *reportRecorder
+}
+
+// newFakeGadget creates a gadget backend recording its reports
+func newFakeGadget(t *testing.T, relativeMouse bool) (*GadgetBackend, *fakeGadget) {
+	t.Helper()
+	dir := t.TempDir()
+	fake := &fakeGadget{keyboard: &reportRecorder{}, mouse: &reportRecorder{}}
+	devices := GadgetDevices{Keyboard: fake.keyboard, Mouse: fake.mouse}
+	if relativeMouse {
+		fake.relMouse = &reportRecorder{}
+		devices.RelativeMouse = fake.relMouse
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "udc", "fake.usb"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "udc", "fake.usb", "state"), []byte("configured\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := NewGadgetBackendWithDevices(GadgetConfig{UDC: "fake.usb"}, devices)
+	backend.udcRoot = filepath.Join(dir, "udc")
+	return backend, fake
+}
+
+func readReports(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGadgetBackendReports(t *testing.T) {
+	backend, fake := newFakeGadget(t, false)
+	controller := NewHIDControllerWithBackend(&Config{ScrollSensitivity: 0x01}, backend)
+	if err := controller.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer controller.Close()
+
+	for _, cmd := range []HIDCommand{
+		{Event: EventTypeKeyPress, Code: "ShiftLeft"},
+		{Event: EventTypeKeyPress, Code: "KeyA"},
+		{Event: EventTypeKeyRelease, Code: "KeyA"},
+		{Event: EventTypeKeyRelease, Code: "ShiftLeft"},
+	} {
+		if _, err := controller.ConstructAndSendCmd(&cmd); err != nil {
+			t.Fatalf("%+v: %v", cmd, err)
+		}
+	}
+	want := []byte{
+		MOD_LSHIFT, 0, 0, 0, 0, 0, 0, 0,
+		MOD_LSHIFT, 0, 0x04, 0, 0, 0, 0, 0,
+		MOD_LSHIFT, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if got := fake.keyboard.written(); !bytes.Equal(got, want) {
+		t.Errorf("keyboard reports = % X, want % X", got, want)
+	}
+
+	// Without a relative mouse the buttons and wheel are sent at the last position
+	if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMouseMove, MouseAbsX: 0x0800, MouseAbsY: 0x0400}); err != nil {
+		t.Fatalf("mouse move: %v", err)
+	}
+	if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMousePress, MouseButton: 1}); err != nil {
+		t.Fatalf("mouse press: %v", err)
+	}
+	if _, err := controller.MouseMoveRelative(5, 0, 0); err == nil {
+		t.Error("relative movement without a relative mouse function succeeded")
+	}
+	want = []byte{
+		0x00, 0x00, 0x08, 0x00, 0x04, 0x00,
+		0x01, 0x00, 0x08, 0x00, 0x04, 0x00,
+	}
+	if got := fake.mouse.written(); !bytes.Equal(got, want) {
+		t.Errorf("mouse reports = % X, want % X", got, want)
+	}
+
+	status, err := controller.GetChipInfo()
+	if err != nil {
+		t.Fatalf("GetChipInfo: %v", err)
+	}
+	if !status.Responding || !status.USBEnumerated {
+		t.Errorf("GetChipInfo = %+v", status)
+	}
+	if err := controller.SendConsumerKey("mute"); err == nil {
+		t.Error("consumer key sent through a backend without consumer reports")
+	}
+}
+
+func TestGadgetBackendRelativeMouse(t *testing.T) {
+	backend, fake := newFakeGadget(t, true)
+	if err := backend.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer backend.Close()
+	if err := backend.MouseRelative(0x02, -3, 4); err != nil {
+		t.Fatalf("MouseRelative: %v", err)
+	}
+	if err := backend.MouseScroll(0x00, 1); err != nil {
+		t.Fatalf("MouseScroll: %v", err)
+	}
+	want := []byte{0x02, 0xFD, 0x04, 0x00, 0x00, 0x00, 0x00, 0x01}
+	if got := fake.relMouse.written(); !bytes.Equal(got, want) {
+		t.Errorf("relative mouse reports = % X, want % X", got, want)
+	}
+
+	os.WriteFile(filepath.Join(backend.udcRoot, "fake.usb", "state"), []byte("not attached\n"), 0644)
+	if status, err := backend.Status(); err != nil || status.USBEnumerated {
+		t.Errorf("Status after detach = %+v, %v", status, err)
+	}
+}
+
+func TestCreateHIDGadget(t *testing.T) {
+	root := t.TempDir()
+	setup := DefaultGadgetSetup()
+	setup.UDC = "fake.usb"
+	if err := CreateHIDGadget(root, setup); err != nil {
+		t.Fatalf("CreateHIDGadget: %v", err)
+	}
+	gadget := filepath.Join(root, setup.Name)
+	for path, want := range map[string]string{
+		"idVendor":                           "0x1d6b",
+		"strings/0x409/product":              DefaultChipProduct,
+		"functions/hid.keyboard/protocol":    "1",
+		"functions/hid.mouse/report_length":  "6",
+		"functions/hid.relmouse/report_desc": string(GadgetRelativeMouseReportDesc),
+		"UDC":                                "fake.usb",
+	} {
+		if got := readReports(t, filepath.Join(gadget, path)); string(got) != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(gadget, "configs/c.1/hid.keyboard/report_desc")); err != nil {
+		t.Errorf("keyboard function is not linked to the configuration: %v", err)
+	}
+	if err := CreateHIDGadget(root, setup); err == nil {
+		t.Error("CreateHIDGadget overwrote an existing gadget")
+	}
+}
@@ -26,6 +26,12 @@ type hidACKReply struct {
 	Status string `json:"status"` // "ok" or "error"
 }
 
+// hidStatusMessage is pushed to the client when the chip status changes
+type hidStatusMessage struct {
+	Type       string     `json:"type"` // Always "chip_status"
+	ChipStatus ChipStatus `json:"chip_status"`
+}
+
 // HIDWebSocketHandler handles incoming WebSocket connections for HID commands
 func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -35,6 +41,11 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 	}
 	defer conn.Close()
 
+	// Keys held by other sessions are released, and the keys held by this
+	// session are released if it is the last one when the socket closes
+	c.AttachClient()
+	defer c.DetachClient()
+
 	// Synchronize websocket writes (consumer ACKs vs. any future server pushes)
 	var wsMu sync.Mutex
 
@@ -46,6 +57,25 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 	cmdQueue := make(chan *HIDCommand, maxQueueSize)
 	done := make(chan struct{})
 
+	// Push the keyboard LEDs and USB state whenever the polling sees a change
+	statusUpdates, unsubscribe := c.SubscribeChipStatus()
+	defer unsubscribe()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case status := <-statusUpdates:
+				wsMu.Lock()
+				err := conn.WriteJSON(hidStatusMessage{Type: "chip_status", ChipStatus: status})
+				wsMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
 	// Consumer goroutine: sends commands to the HID serial device
 	go func() {
 		defer close(done)
@@ -86,8 +116,12 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 			continue
 		}
 
-		// Record activity for mouse jiggler idle detection
-		c.RecordActivity()
+		// Record activity for mouse jiggler idle detection, keep-alives
+		// are sent while the user is idle and are not part of macros
+		if hidCmd.Event != EventTypeKeepAlive {
+			c.RecordActivity()
+			c.recordCommand(&hidCmd)
+		}
 
 		// Commands with rid must not be dropped — they expect an ACK.
 		// Send them directly to the queue (blocking if full).
@@ -113,10 +113,52 @@ func (c *Controller) SendKeyboardPress(keycode uint8) ([]byte, error) {
 		// Not supported
 		return nil, errors.New("Unsupported keycode: " + string(keycode))
 	}
+	return c.pressKeyUsage(keycode)
+}
+
+// SendKeyboardRelease sends a keyboard release by JavaScript keycode
+func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
+	// Convert JavaScript keycode to HID
+	keycode = javaScriptKeycodeToHIDOpcode(keycode)
+	if keycode == 0x00 {
+		// Not supported
+		return nil, errors.New("Unsupported keycode: " + string(keycode))
+	}
+	return c.releaseKeyUsage(keycode)
+}
+
+// SendKeyboardCodePress sends a keyboard press by KeyboardEvent.code, e.g. "KeyA".
+// Modifier codes set the bit of their own side, e.g. "ShiftRight" sets right Shift.
+func (c *Controller) SendKeyboardCodePress(code string) ([]byte, error) {
+	usage, ok := KeyboardEventCodeToHIDUsage(code)
+	if !ok {
+		return nil, errors.New("Unsupported key code: " + code)
+	}
+	if modifierBit, ok := modifierBitOfUsage(usage); ok {
+		c.hidState.Modkey |= modifierBit
+		return keyboardSendKeyCombinations(c)
+	}
+	return c.pressKeyUsage(usage)
+}
+
+// SendKeyboardCodeRelease sends a keyboard release by KeyboardEvent.code
+func (c *Controller) SendKeyboardCodeRelease(code string) ([]byte, error) {
+	usage, ok := KeyboardEventCodeToHIDUsage(code)
+	if !ok {
+		return nil, errors.New("Unsupported key code: " + code)
+	}
+	if modifierBit, ok := modifierBitOfUsage(usage); ok {
+		c.hidState.Modkey &^= modifierBit
+		return keyboardSendKeyCombinations(c)
+	}
+	return c.releaseKeyUsage(usage)
+}
 
+// pressKeyUsage adds a HID usage ID to the pressed keys
+func (c *Controller) pressKeyUsage(usage uint8) ([]byte, error) {
 	// Already pressed? Skip
 	for i := 0; i < 6; i++ {
-		if c.hidState.KeyboardButtons[i] == keycode {
+		if c.hidState.KeyboardButtons[i] == usage {
 			return nil, nil
 		}
 	}
@@ -124,27 +166,20 @@ func (c *Controller) SendKeyboardPress(keycode uint8) ([]byte, error) {
 	// Get the empty slot in the current HID list
 	for i := 0; i < 6; i++ {
 		if c.hidState.KeyboardButtons[i] == 0x00 {
-			c.hidState.KeyboardButtons[i] = keycode
+			c.hidState.KeyboardButtons[i] = usage
 			return keyboardSendKeyCombinations(c)
 		}
 	}
 
 	// No space left
-	return nil, errors.New("No space left in keyboard state to press key: " + string(keycode))
+	return nil, errors.New("No space left in keyboard state to press key: " + string(usage))
 }
 
-// SendKeyboardRelease sends a keyboard release by JavaScript keycode
-func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
-	// Convert JavaScript keycode to HID
-	keycode = javaScriptKeycodeToHIDOpcode(keycode)
-	if keycode == 0x00 {
-		// Not supported
-		return nil, errors.New("Unsupported keycode: " + string(keycode))
-	}
-
+// releaseKeyUsage removes a HID usage ID from the pressed keys
+func (c *Controller) releaseKeyUsage(usage uint8) ([]byte, error) {
 	// Find the position where the key is pressed
 	for i := 0; i < 6; i++ {
-		if c.hidState.KeyboardButtons[i] == keycode {
+		if c.hidState.KeyboardButtons[i] == usage {
 			c.hidState.KeyboardButtons[i] = 0x00
 			return keyboardSendKeyCombinations(c)
 		}
@@ -154,31 +189,12 @@ func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
 	return nil, nil
 }
 
-// keyboardSendKeyCombinations simulates sending the current key combinations
+// keyboardSendKeyCombinations sends the current key combinations
 func keyboardSendKeyCombinations(c *Controller) ([]byte, error) {
-	// Prepare the packet
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x02, 0x08,
-		c.hidState.Modkey, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00,
-	}
-
-	// Populate the HID keycodes
-	for i := 0; i < len(c.hidState.KeyboardButtons); i++ {
-		packet[7+i] = c.hidState.KeyboardButtons[i]
+	if err := c.backend.KeyboardReport(c.hidState.Modkey, c.hidState.KeyboardButtons); err != nil {
+		return nil, err
 	}
-
-	// Calculate checksum
-	packet[13] = calcChecksum(packet[:13])
-
-	err := c.Send(packet)
-	if err != nil {
-		return nil, errors.New("failed to send mouse move command: " + err.Error())
-	}
-
-	// Wait for a reply from the device
-	return c.WaitForReply(0x02)
+	return []byte{}, nil
 }
 
 // JavaScriptKeycodeToHIDOpcode converts JavaScript keycode into HID keycode
@@ -0,0 +1,152 @@
+package kvmhid
+
+/*
+	keycodes.go
+
+	Mapping of the KeyboardEvent.code values of browsers to HID keyboard
+	usage IDs (USB HID Usage Tables, page 0x07). Unlike the deprecated
+	keyCode, code names the physical key, so it covers keys like the ISO
+	IntlBackslash or the JIS IntlRo and IntlYen keys and does not depend
+	on the keyboard layout of the client.
+*/
+
+import "fmt"
+
+// keyboardEventCodes maps KeyboardEvent.code to HID usage IDs
+var keyboardEventCodes = map[string]uint8{
+	// Writing system keys
+	"Backquote":     0x35,
+	"Backslash":     0x31,
+	"BracketLeft":   0x2F,
+	"BracketRight":  0x30,
+	"Comma":         0x36,
+	"Equal":         0x2E,
+	"IntlBackslash": 0x64, // ISO key between left Shift and Z
+	"IntlRo":        0x87, // JIS \ and _ key
+	"IntlYen":       0x89, // JIS ¥ key
+	"Minus":         0x2D,
+	"Period":        0x37,
+	"Quote":         0x34,
+	"Semicolon":     0x33,
+	"Slash":         0x38,
+
+	// Functional keys
+	"Backspace":   0x2A,
+	"CapsLock":    0x39,
+	"ContextMenu": 0x65,
+	"Enter":       0x28,
+	"Space":       0x2C,
+	"Tab":         0x2B,
+	"Convert":     0x8A, // Henkan
+	"NonConvert":  0x8B, // Muhenkan
+	"KanaMode":    0x88, // Katakana/Hiragana
+	"Lang1":       0x90, // Hangul/English, Kana on Mac
+	"Lang2":       0x91, // Hanja, Eisu on Mac
+	"Lang3":       0x92, // Katakana
+	"Lang4":       0x93, // Hiragana
+	"Lang5":       0x94, // Zenkaku/Hankaku
+
+	// Control pad
+	"Delete":   0x4C,
+	"End":      0x4D,
+	"Help":     0x75,
+	"Home":     0x4A,
+	"Insert":   0x49,
+	"PageDown": 0x4E,
+	"PageUp":   0x4B,
+
+	// Arrow pad
+	"ArrowDown":  0x51,
+	"ArrowLeft":  0x50,
+	"ArrowRight": 0x4F,
+	"ArrowUp":    0x52,
+
+	// Numpad
+	"NumLock":              0x53,
+	"NumpadAdd":            0x57,
+	"NumpadBackspace":      0xBB,
+	"NumpadClear":          0xD8,
+	"NumpadClearEntry":     0xD9,
+	"NumpadComma":          0x85,
+	"NumpadDecimal":        0x63,
+	"NumpadDivide":         0x54,
+	"NumpadEnter":          0x58,
+	"NumpadEqual":          0x67,
+	"NumpadMultiply":       0x55,
+	"NumpadParenLeft":      0xB6,
+	"NumpadParenRight":     0xB7,
+	"NumpadSubtract":       0x56,
+	"NumpadMemoryAdd":      0xD3,
+	"NumpadMemoryClear":    0xD2,
+	"NumpadMemoryRecall":   0xD1,
+	"NumpadMemoryStore":    0xD0,
+	"NumpadMemorySubtract": 0xD4,
+
+	// Function section
+	"Escape":      0x29,
+	"PrintScreen": 0x46,
+	"ScrollLock":  0x47,
+	"Pause":       0x48,
+	"Power":       0x66,
+
+	// Editing and media keys of the keyboard page
+	"Again":           0x79,
+	"Copy":            0x7C,
+	"Cut":             0x7B,
+	"Find":            0x7E,
+	"Open":            0x74, // Execute
+	"Paste":           0x7D,
+	"Props":           0x76, // Menu
+	"Select":          0x77,
+	"Undo":            0x7A,
+	"AudioVolumeMute": 0x7F,
+	"AudioVolumeUp":   0x80,
+	"AudioVolumeDown": 0x81,
+
+	// Modifiers, "OS" is the name used by older Firefox versions
+	"ControlLeft":  0xE0,
+	"ShiftLeft":    0xE1,
+	"AltLeft":      0xE2,
+	"MetaLeft":     0xE3,
+	"OSLeft":       0xE3,
+	"ControlRight": 0xE4,
+	"ShiftRight":   0xE5,
+	"AltRight":     0xE6,
+	"MetaRight":    0xE7,
+	"OSRight":      0xE7,
+}
+
+func init() {
+	for i := 0; i < 26; i++ {
+		keyboardEventCodes["Key"+string(rune('A'+i))] = uint8(0x04 + i)
+	}
+	// Digit1 to Digit9 are 0x1E to 0x26, Digit0 follows them
+	for i := 1; i <= 9; i++ {
+		keyboardEventCodes["Digit"+string(rune('0'+i))] = uint8(0x1E + i - 1)
+		keyboardEventCodes["Numpad"+string(rune('0'+i))] = uint8(0x59 + i - 1)
+	}
+	keyboardEventCodes["Digit0"] = 0x27
+	keyboardEventCodes["Numpad0"] = 0x62
+	for i := 1; i <= 24; i++ {
+		usage := 0x3A + i - 1 // F1 to F12
+		if i > 12 {
+			usage = 0x68 + i - 13 // F13 to F24
+		}
+		keyboardEventCodes[fmt.Sprintf("F%d", i)] = uint8(usage)
+	}
+}
+
+// KeyboardEventCodeToHIDUsage returns the HID usage ID of a KeyboardEvent.code
+func KeyboardEventCodeToHIDUsage(code string) (uint8, bool) {
+	usage, ok := keyboardEventCodes[code]
+	return usage, ok
+}
+
+// modifierBitOfUsage returns the modifier byte bit of a modifier usage ID
+// (0xE0 to 0xE7). The left and right keys of a modifier have their own bits.
+func modifierBitOfUsage(usage uint8) (uint8, bool) {
+	if usage < 0xE0 || usage > 0xE7 {
+		return 0, false
+	}
+	return 1 << (usage - 0xE0), true
+}
@@ -0,0 +1,135 @@
+package kvmhid
+
+import "testing"
+
+func TestKeyboardEventCodeToHIDUsage(t *testing.T) {
+	cases := []struct {
+		code  string
+		usage uint8
+	}{
+		{"KeyA", 0x04},
+		{"KeyZ", 0x1D},
+		{"Digit1", 0x1E},
+		{"Digit0", 0x27},
+		{"Enter", 0x28},
+		{"Backquote", 0x35},
+		{"F1", 0x3A},
+		{"F12", 0x45},
+		{"F13", 0x68},
+		{"F24", 0x73},
+		{"PrintScreen", 0x46},
+		{"ScrollLock", 0x47},
+		{"Pause", 0x48},
+		{"ArrowUp", 0x52},
+		{"NumLock", 0x53},
+		{"NumpadDivide", 0x54},
+		{"NumpadMultiply", 0x55},
+		{"NumpadSubtract", 0x56},
+		{"NumpadAdd", 0x57},
+		{"NumpadEnter", 0x58},
+		{"Numpad1", 0x59},
+		{"Numpad9", 0x61},
+		{"Numpad0", 0x62},
+		{"NumpadDecimal", 0x63},
+		{"NumpadEqual", 0x67},
+		{"IntlBackslash", 0x64},
+		{"ContextMenu", 0x65},
+		{"IntlRo", 0x87},
+		{"KanaMode", 0x88},
+		{"IntlYen", 0x89},
+		{"Convert", 0x8A},
+		{"NonConvert", 0x8B},
+		{"Lang1", 0x90},
+		{"ControlLeft", 0xE0},
+		{"MetaRight", 0xE7},
+		{"OSLeft", 0xE3},
+	}
+	for _, c := range cases {
+		usage, ok := KeyboardEventCodeToHIDUsage(c.code)
+		if !ok || usage != c.usage {
+			t.Errorf("%s = 0x%02X, %v, want 0x%02X", c.code, usage, ok, c.usage)
+		}
+	}
+	for _, code := range []string{"", "keya", "Unidentified", "F25"} {
+		if _, ok := KeyboardEventCodeToHIDUsage(code); ok {
+			t.Errorf("%q is mapped", code)
+		}
+	}
+}
+
+func TestKeyboardEventCodesUnique(t *testing.T) {
+	aliases := map[string]bool{"OSLeft": true, "OSRight": true}
+	seen := map[uint8]string{}
+	for code, usage := range keyboardEventCodes {
+		if usage == 0x00 {
+			t.Errorf("%s maps to no key", code)
+		}
+		if aliases[code] {
+			continue
+		}
+		if other, ok := seen[usage]; ok {
+			t.Errorf("%s and %s both map to 0x%02X", code, other, usage)
+		}
+		seen[usage] = code
+	}
+}
+
+func TestModifierBitOfUsage(t *testing.T) {
+	cases := []struct {
+		code string
+		bit  uint8
+	}{
+		{"ControlLeft", MOD_LCTRL},
+		{"ShiftLeft", MOD_LSHIFT},
+		{"AltLeft", MOD_LALT},
+		{"MetaLeft", MOD_LGUI},
+		{"ControlRight", MOD_RCTRL},
+		{"ShiftRight", MOD_RSHIFT},
+		{"AltRight", MOD_RALT},
+		{"MetaRight", MOD_RGUI},
+	}
+	for _, c := range cases {
+		usage, _ := KeyboardEventCodeToHIDUsage(c.code)
+		if bit, ok := modifierBitOfUsage(usage); !ok || bit != c.bit {
+			t.Errorf("%s: modifier bit 0x%02X, %v, want 0x%02X", c.code, bit, ok, c.bit)
+		}
+	}
+	if _, ok := modifierBitOfUsage(0x04); ok {
+		t.Error("KeyA is a modifier")
+	}
+}
+
+func TestKeyboardEventCodeWithHIDController(t *testing.T) {
+	controller, dev := newSimulatedController(t)
+
+	// Right Shift + the ISO key next to left Shift, which has no legacy keycode
+	for _, code := range []string{"ShiftRight", "IntlBackslash"} {
+		if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeyPress, Code: code}); err != nil {
+			t.Fatalf("press %s: %v", code, err)
+		}
+	}
+	state := dev.CH9329.State()
+	if state.Modifiers != MOD_RSHIFT || state.Keys != [6]uint8{0x64} {
+		t.Fatalf("unexpected state after press: %+v", state)
+	}
+	for _, code := range []string{"IntlBackslash", "ShiftRight"} {
+		if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeyRelease, Code: code}); err != nil {
+			t.Fatalf("release %s: %v", code, err)
+		}
+	}
+	state = dev.CH9329.State()
+	if state.Modifiers != 0 || state.Keys != [6]uint8{} {
+		t.Fatalf("keys still pressed after release: %+v", state)
+	}
+
+	// The code takes precedence over the legacy keycode
+	if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeyPress, Code: "NumpadAdd", Keycode: 65}); err != nil {
+		t.Fatalf("press NumpadAdd: %v", err)
+	}
+	if keys := dev.CH9329.State().Keys; keys[0] != 0x57 {
+		t.Errorf("keys = %v, want NumpadAdd", keys)
+	}
+	if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeyPress, Code: "Unidentified"}); err == nil {
+		t.Error("unknown code accepted")
+	}
+}
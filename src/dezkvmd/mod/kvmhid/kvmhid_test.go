@@ -0,0 +1,27 @@
+package kvmhid
+
+import (
+	"os"
+	"testing"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/simulator"
+)
+
+// newSimulatedController connects a controller to a simulated DezKVM device
+func newSimulatedController(t *testing.T) (*Controller, *simulator.Device) {
+	t.Helper()
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo terminals not available")
+	}
+	dev, err := simulator.NewDevice(&simulator.Options{})
+	if err != nil {
+		t.Fatalf("NewDevice: %v", err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	controller := NewHIDController(&Config{PortName: dev.HIDDevicePath(), BaudRate: 115200})
+	if err := controller.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(controller.Close)
+	return controller, dev
+}
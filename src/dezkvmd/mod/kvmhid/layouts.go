@@ -0,0 +1,244 @@
+package kvmhid
+
+/*
+	layouts.go
+
+	Keyboard layouts map characters to the HID usage and modifiers that
+	produce them on a host configured with that layout. HID reports carry
+	key positions, not characters, so the same text needs different key
+	strokes depending on the layout selected on the remote machine.
+
+	Each key is described by the characters it produces without modifier,
+	with Shift, with AltGr and with Shift + AltGr. Characters only reachable
+	through a dead key are typed as the dead key followed by the base
+	letter, or followed by a space for the accent itself.
+*/
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// DefaultKeyboardLayout is the layout used if none is selected
+const DefaultKeyboardLayout = "us"
+
+// Modifiers of the characters on a key, in the order they are listed in the layout tables
+var layoutLevelModifiers = [4]uint8{0x00, MOD_LSHIFT, MOD_RALT, MOD_RALT | MOD_LSHIFT}
+
+// KeyStroke is a single key press with the modifiers held while pressing it
+type KeyStroke struct {
+	Usage     uint8 // HID usage ID of the key
+	Modifiers uint8 // Modifier bits, see MOD_*
+}
+
+// UntypableChar is a character that cannot be typed with a layout
+type UntypableChar struct {
+	Index int    `json:"index"` // Position of the character in the text, counted in characters
+	Char  string `json:"char"`
+}
+
+// KeyboardLayout maps characters to key strokes
+type KeyboardLayout struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	keys map[rune]KeyStroke // Characters produced directly by a key
+	dead map[rune]KeyStroke // Accents produced by dead keys
+}
+
+// layoutKeys lists the characters of each key by HID usage. "\x00" marks
+// a level without a character.
+type layoutKeys map[uint8]string
+
+// Keys shared by all layouts
+var layoutCommonKeys = map[rune]KeyStroke{
+	' ':  {Usage: 0x2C},
+	'\n': {Usage: 0x28},
+	'\t': {Usage: 0x2B},
+}
+
+// Characters composed with a dead key, by accent
+var deadKeyCompositions = map[rune][2]string{
+	'^': {"aeiouAEIOU", "âêîôûÂÊÎÔÛ"},
+	'`': {"aeiouAEIOU", "àèìòùÀÈÌÒÙ"},
+	'´': {"aeiouyAEIOUY", "áéíóúýÁÉÍÓÚÝ"},
+	'¨': {"aeiouyAEIOU", "äëïöüÿÄËÏÖÜ"},
+	'~': {"anoANO", "ãñõÃÑÕ"},
+}
+
+var keyboardLayouts = map[string]*KeyboardLayout{}
+
+func init() {
+	registerKeyboardLayout("us", "English (US)", mergeLayoutKeys(qwertyLetterKeys(), layoutKeys{
+		0x1E: "1!", 0x1F: "2@", 0x20: "3#", 0x21: "4$", 0x22: "5%",
+		0x23: "6^", 0x24: "7&", 0x25: "8*", 0x26: "9(", 0x27: "0)",
+		0x2D: "-_", 0x2E: "=+", 0x2F: "[{", 0x30: "]}", 0x31: "\\|",
+		0x33: ";:", 0x34: "'\"", 0x35: "`~", 0x36: ",<", 0x37: ".>", 0x38: "/?",
+	}), nil)
+
+	registerKeyboardLayout("uk", "English (UK)", mergeLayoutKeys(qwertyLetterKeys(), layoutKeys{
+		0x04: "aAáÁ", 0x08: "eEéÉ", 0x0C: "iIíÍ", 0x12: "oOóÓ", 0x18: "uUúÚ",
+		0x1E: "1!", 0x1F: "2\"", 0x20: "3£", 0x21: "4$€", 0x22: "5%",
+		0x23: "6^", 0x24: "7&", 0x25: "8*", 0x26: "9(", 0x27: "0)",
+		0x2D: "-_", 0x2E: "=+", 0x2F: "[{", 0x30: "]}", 0x32: "#~",
+		0x33: ";:", 0x34: "'@", 0x35: "`¬¦", 0x36: ",<", 0x37: ".>", 0x38: "/?",
+		0x64: "\\|",
+	}), nil)
+
+	registerKeyboardLayout("de", "German", mergeLayoutKeys(qwertyLetterKeys(), layoutKeys{
+		0x08: "eE€", 0x10: "mMµ", 0x14: "qQ@", 0x1C: "zZ", 0x1D: "yY",
+		0x1E: "1!", 0x1F: "2\"²", 0x20: "3§³", 0x21: "4$", 0x22: "5%",
+		0x23: "6&", 0x24: "7/{", 0x25: "8([", 0x26: "9)]", 0x27: "0=}",
+		0x2D: "ß?\\", 0x2F: "üÜ", 0x30: "+*~", 0x32: "#'",
+		0x33: "öÖ", 0x34: "äÄ", 0x35: "\x00°", 0x36: ",;", 0x37: ".:", 0x38: "-_",
+		0x64: "<>|",
+	}), layoutKeys{
+		0x2E: "´`", 0x35: "^",
+	})
+
+	registerKeyboardLayout("fr", "French", mergeLayoutKeys(qwertyLetterKeys(), layoutKeys{
+		0x04: "qQ", 0x08: "eE€", 0x10: ",?", 0x14: "aA", 0x1A: "zZ", 0x1D: "wW",
+		0x1E: "&1", 0x1F: "é2", 0x20: "\"3#", 0x21: "'4{", 0x22: "(5[",
+		0x23: "-6|", 0x24: "è7", 0x25: "_8\\", 0x26: "ç9^", 0x27: "à0@",
+		0x2D: ")°]", 0x2E: "=+}", 0x30: "$£¤", 0x32: "*µ",
+		0x33: "mM", 0x34: "ù%", 0x35: "²", 0x36: ";.", 0x37: ":/", 0x38: "!§",
+		0x64: "<>",
+	}), layoutKeys{
+		0x1F: "\x00\x00~", 0x24: "\x00\x00`", 0x2F: "^¨",
+	})
+
+	registerKeyboardLayout("jp", "Japanese", mergeLayoutKeys(qwertyLetterKeys(), layoutKeys{
+		0x1E: "1!", 0x1F: "2\"", 0x20: "3#", 0x21: "4$", 0x22: "5%",
+		0x23: "6&", 0x24: "7'", 0x25: "8(", 0x26: "9)", 0x27: "0",
+		0x2D: "-=", 0x2E: "^~", 0x2F: "@`", 0x30: "[{", 0x32: "]}",
+		0x33: ";+", 0x34: ":*", 0x36: ",<", 0x37: ".>", 0x38: "/?",
+		0x87: "\\_", 0x89: "\\|",
+	}), nil)
+}
+
+// qwertyLetterKeys returns the letter keys of a QWERTY keyboard
+func qwertyLetterKeys() layoutKeys {
+	keys := layoutKeys{}
+	for i := 0; i < 26; i++ {
+		keys[uint8(0x04+i)] = string(rune('a'+i)) + string(rune('A'+i))
+	}
+	return keys
+}
+
+// mergeLayoutKeys returns base with the keys of override replaced
+func mergeLayoutKeys(base layoutKeys, override layoutKeys) layoutKeys {
+	for usage, chars := range override {
+		base[usage] = chars
+	}
+	return base
+}
+
+// registerKeyboardLayout builds a layout from its key tables. If a character
+// is produced by several keys, the key with the lowest usage ID wins.
+func registerKeyboardLayout(id string, name string, keys layoutKeys, deadKeys layoutKeys) {
+	layout := &KeyboardLayout{
+		ID:   id,
+		Name: name,
+		keys: map[rune]KeyStroke{},
+		dead: map[rune]KeyStroke{},
+	}
+	addKeys := func(table layoutKeys, target map[rune]KeyStroke) {
+		usages := []int{}
+		for usage := range table {
+			usages = append(usages, int(usage))
+		}
+		sort.Ints(usages)
+		for _, usage := range usages {
+			level := 0
+			for _, char := range table[uint8(usage)] {
+				if level >= len(layoutLevelModifiers) {
+					break
+				}
+				if _, exists := target[char]; char != 0 && !exists {
+					target[char] = KeyStroke{Usage: uint8(usage), Modifiers: layoutLevelModifiers[level]}
+				}
+				level++
+			}
+		}
+	}
+	addKeys(keys, layout.keys)
+	addKeys(deadKeys, layout.dead)
+	keyboardLayouts[id] = layout
+}
+
+// KeyboardLayouts returns all supported keyboard layouts sorted by ID
+func KeyboardLayouts() []*KeyboardLayout {
+	layouts := []*KeyboardLayout{}
+	for _, layout := range keyboardLayouts {
+		layouts = append(layouts, layout)
+	}
+	sort.Slice(layouts, func(i, j int) bool {
+		return layouts[i].ID < layouts[j].ID
+	})
+	return layouts
+}
+
+// GetKeyboardLayout returns the layout with the given ID, e.g. "us" or "de"
+func GetKeyboardLayout(id string) (*KeyboardLayout, error) {
+	layout, ok := keyboardLayouts[strings.ToLower(strings.TrimSpace(id))]
+	if !ok {
+		return nil, errors.New("unsupported keyboard layout: " + id)
+	}
+	return layout, nil
+}
+
+// CharKeyStrokes returns the key strokes typing the character, or false if
+// the character cannot be typed with this layout
+func (l *KeyboardLayout) CharKeyStrokes(char rune) ([]KeyStroke, bool) {
+	if stroke, ok := layoutCommonKeys[char]; ok {
+		return []KeyStroke{stroke}, true
+	}
+	if stroke, ok := l.keys[char]; ok {
+		return []KeyStroke{stroke}, true
+	}
+	if stroke, ok := l.dead[char]; ok {
+		// The accent itself is typed as dead key + space
+		return []KeyStroke{stroke, layoutCommonKeys[' ']}, true
+	}
+	for accent, composition := range deadKeyCompositions {
+		deadStroke, ok := l.dead[accent]
+		if !ok {
+			continue
+		}
+		bases, composed := []rune(composition[0]), []rune(composition[1])
+		for i, c := range composed {
+			if c != char {
+				continue
+			}
+			if baseStroke, ok := l.keys[bases[i]]; ok {
+				return []KeyStroke{deadStroke, baseStroke}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// KeyStrokes returns the key strokes typing the text and the characters
+// that cannot be typed with this layout, which are skipped. Carriage
+// returns are typed as Enter, except when followed by a line feed.
+func (l *KeyboardLayout) KeyStrokes(text string) ([]KeyStroke, []UntypableChar) {
+	chars := []rune(text)
+	strokes := []KeyStroke{}
+	untypable := []UntypableChar{}
+	for i, char := range chars {
+		if char == '\r' {
+			if i+1 < len(chars) && chars[i+1] == '\n' {
+				continue
+			}
+			char = '\n'
+		}
+		charStrokes, ok := l.CharKeyStrokes(char)
+		if !ok {
+			untypable = append(untypable, UntypableChar{Index: i, Char: string(char)})
+			continue
+		}
+		strokes = append(strokes, charStrokes...)
+	}
+	return strokes, untypable
+}
@@ -0,0 +1,95 @@
+package kvmhid
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestKeyboardLayoutKeyStrokes(t *testing.T) {
+	shift := uint8(MOD_LSHIFT)
+	altGr := uint8(MOD_RALT)
+	cases := []struct {
+		layout string
+		text   string
+		want   []KeyStroke
+	}{
+		{"us", "aZ1!", []KeyStroke{{0x04, 0}, {0x1D, shift}, {0x1E, 0}, {0x1E, shift}}},
+		{"us", "a\r\nb\rc", []KeyStroke{{0x04, 0}, {0x28, 0}, {0x05, 0}, {0x28, 0}, {0x06, 0}}},
+		{"uk", "\"@#£", []KeyStroke{{0x1F, shift}, {0x34, shift}, {0x32, 0}, {0x20, shift}}},
+		{"de", "zy@ß", []KeyStroke{{0x1C, 0}, {0x1D, 0}, {0x14, altGr}, {0x2D, 0}}},
+		// Dead keys: accent + base letter, or accent + space
+		{"de", "é^", []KeyStroke{{0x2E, 0}, {0x08, 0}, {0x35, 0}, {0x2C, 0}}},
+		{"fr", "aqm1", []KeyStroke{{0x14, 0}, {0x04, 0}, {0x33, 0}, {0x1E, shift}}},
+		{"fr", "êÄ", []KeyStroke{{0x2F, 0}, {0x08, 0}, {0x2F, shift}, {0x14, shift}}},
+		{"jp", "@\\_", []KeyStroke{{0x2F, 0}, {0x87, 0}, {0x87, shift}}},
+	}
+	for _, c := range cases {
+		layout, err := GetKeyboardLayout(c.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		strokes, untypable := layout.KeyStrokes(c.text)
+		if len(untypable) != 0 {
+			t.Errorf("%s %q: unexpected untypable characters %v", c.layout, c.text, untypable)
+		}
+		if !reflect.DeepEqual(strokes, c.want) {
+			t.Errorf("%s %q: got %v, want %v", c.layout, c.text, strokes, c.want)
+		}
+	}
+}
+
+func TestKeyboardLayoutUntypable(t *testing.T) {
+	layout, err := GetKeyboardLayout("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strokes, untypable := layout.KeyStrokes("a€bä")
+	want := []UntypableChar{{Index: 1, Char: "€"}, {Index: 3, Char: "ä"}}
+	if !reflect.DeepEqual(untypable, want) {
+		t.Fatalf("untypable = %v, want %v", untypable, want)
+	}
+	if len(strokes) != 2 {
+		t.Fatalf("got %d key strokes, want 2", len(strokes))
+	}
+	if _, err := GetKeyboardLayout("xx"); err == nil {
+		t.Fatal("unknown layout accepted")
+	}
+}
+
+func TestKeyboardLayoutsTypeASCII(t *testing.T) {
+	// Printable ASCII is typable on all layouts
+	for _, layout := range KeyboardLayouts() {
+		for char := rune(0x20); char < 0x7F; char++ {
+			if _, ok := layout.CharKeyStrokes(char); !ok {
+				t.Errorf("%s: %q is not typable", layout.ID, char)
+			}
+		}
+	}
+}
+
+func TestTypeTextWithHIDController(t *testing.T) {
+	controller, dev := newSimulatedController(t)
+
+	layout, err := GetKeyboardLayout("de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strokes, _ := layout.KeyStrokes("Zé")
+	before := dev.CH9329.State().Packets
+	sent, err := controller.TypeKeyStrokes(context.Background(), strokes, 0)
+	if err != nil {
+		t.Fatalf("TypeKeyStrokes: %v", err)
+	}
+	if sent != 3 {
+		t.Errorf("sent %d key strokes, want 3", sent)
+	}
+	// Every stroke is a press and a release report, each acknowledged by the chip
+	state := dev.CH9329.State()
+	if packets := state.Packets - before; packets != 6 {
+		t.Errorf("chip received %d packets, want 6", packets)
+	}
+	if state.Keys != [6]uint8{} || state.Modifiers != 0 {
+		t.Errorf("keys still pressed after typing: %+v", state)
+	}
+}
@@ -0,0 +1,83 @@
+package kvmhid
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MaxMacroSteps is the maximum number of commands recorded in one macro
+const MaxMacroSteps = 50000
+
+// MacroStep is a recorded HID command and its delay after the previous step
+type MacroStep struct {
+	DelayMs int64      `json:"delay_ms"`
+	Command HIDCommand `json:"command"`
+}
+
+// macroRecorder records the commands received on the HID websocket
+type macroRecorder struct {
+	mu        sync.Mutex
+	recording bool
+	steps     []MacroStep
+	last      time.Time // Time of the previous step, or of the recording start
+	truncated bool      // More than MaxMacroSteps commands were received
+}
+
+// StartMacroRecording starts recording the commands received on the HID websocket
+func (c *Controller) StartMacroRecording() error {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	if c.recorder.recording {
+		return errors.New("macro recording is already running")
+	}
+	c.recorder.recording = true
+	c.recorder.steps = []MacroStep{}
+	c.recorder.last = time.Now()
+	c.recorder.truncated = false
+	return nil
+}
+
+// StopMacroRecording stops recording and returns the recorded steps.
+// truncated is true if the recording hit MaxMacroSteps.
+func (c *Controller) StopMacroRecording() (steps []MacroStep, truncated bool, err error) {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	if !c.recorder.recording {
+		return nil, false, errors.New("macro recording is not running")
+	}
+	steps, truncated = c.recorder.steps, c.recorder.truncated
+	c.recorder.recording = false
+	c.recorder.steps = nil
+	return steps, truncated, nil
+}
+
+// MacroRecordingStatus returns if a recording is running and the number of recorded steps
+func (c *Controller) MacroRecordingStatus() (recording bool, steps int) {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	return c.recorder.recording, len(c.recorder.steps)
+}
+
+// recordCommand appends the command to the running recording, if any.
+// The first step has no delay, so idle time before it is not replayed.
+func (c *Controller) recordCommand(cmd *HIDCommand) {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	if !c.recorder.recording {
+		return
+	}
+	if len(c.recorder.steps) >= MaxMacroSteps {
+		c.recorder.truncated = true
+		return
+	}
+	now := time.Now()
+	step := MacroStep{Command: *cmd}
+	if len(c.recorder.steps) > 0 {
+		step.DelayMs = now.Sub(c.recorder.last).Milliseconds()
+	}
+	// The reply ID belongs to the websocket session that sent the command
+	step.Command.Rid = ""
+	c.recorder.steps = append(c.recorder.steps, step)
+	c.recorder.last = now
+}
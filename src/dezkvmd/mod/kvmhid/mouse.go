@@ -1,48 +1,19 @@
 package kvmhid
 
-import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-)
-
-// calcChecksum calculates the checksum for a given data slice.
-func calcChecksum(data []uint8) uint8 {
-	var sum uint8 = 0
-	for _, value := range data {
-		sum += value
-	}
-	return sum
-}
+import "errors"
 
+// MouseMoveAbsolute moves the cursor to the position given as little endian
+// bytes, the range is 0 to 4095
 func (c *Controller) MouseMoveAbsolute(xLSB, xMSB, yLSB, yMSB uint8) ([]byte, error) {
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x04, 0x07, 0x02,
-		c.hidState.MouseButtons,
-		xLSB, // X LSB
-		xMSB, // X MSB
-		yLSB, // Y LSB
-		yMSB, // Y MSB
-		0x00, // Scroll
-		0x00, // Checksum placeholder
-	}
-
-	packet[12] = calcChecksum(packet[:12])
-
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.LittleEndian, packet); err != nil {
-		return nil, errors.New("failed to write packet to buffer")
-	}
-
-	err := c.Send(buf.Bytes())
-	if err != nil {
-		return nil, errors.New("failed to send mouse move command: " + err.Error())
+	x := uint16(xLSB) | uint16(xMSB)<<8
+	y := uint16(yLSB) | uint16(yMSB)<<8
+	if err := c.backend.MouseAbsolute(c.hidState.MouseButtons, x, y); err != nil {
+		return nil, err
 	}
-
-	// Wait for a reply from the device
-	return c.WaitForReply(0x04)
+	return []byte{}, nil
 }
 
+// MouseMoveRelative moves the cursor and turns the wheel by two's complement deltas
 func (c *Controller) MouseMoveRelative(dx, dy, wheel uint8) ([]byte, error) {
 	// Ensure 0x80 is not used
 	if dx == 0x80 {
@@ -52,28 +23,18 @@ func (c *Controller) MouseMoveRelative(dx, dy, wheel uint8) ([]byte, error) {
 		dy = 0x81
 	}
 
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x05, 0x05, 0x01,
-		c.hidState.MouseButtons,
-		dx,    // Delta X
-		dy,    // Delta Y
-		wheel, // Scroll wheel
-		0x00,  // Checksum placeholder
-	}
-
-	packet[10] = calcChecksum(packet[:10])
-
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.LittleEndian, packet); err != nil {
-		return nil, errors.New("failed to write packet to buffer")
+	// A report without movement still updates the buttons
+	if dx != 0 || dy != 0 || wheel == 0 {
+		if err := c.backend.MouseRelative(c.hidState.MouseButtons, int8(dx), int8(dy)); err != nil {
+			return nil, err
+		}
 	}
-
-	err := c.Send(buf.Bytes())
-	if err != nil {
-		return nil, errors.New("failed to send mouse move relative command: " + err.Error())
+	if wheel != 0 {
+		if err := c.backend.MouseScroll(c.hidState.MouseButtons, int8(wheel)); err != nil {
+			return nil, err
+		}
 	}
-
-	return c.WaitForReply(0x05)
+	return []byte{}, nil
 }
 
 // Handle mouse button press events
@@ -112,6 +73,15 @@ func (c *Controller) MouseButtonRelease(button uint8) ([]byte, error) {
 	return c.MouseMoveRelative(0, 0, 0)
 }
 
+// SetScrollConfig changes the scroll sensitivity and direction of a running
+// controller. Scroll commands read them under cmdMu.
+func (c *Controller) SetScrollConfig(sensitivity uint8, invert bool) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	c.Config.ScrollSensitivity = sensitivity
+	c.Config.InvertScrollDirection = invert
+}
+
 func (c *Controller) MouseScroll(tilt int) ([]byte, error) {
 	if tilt == 0 {
 		// No need to scroll
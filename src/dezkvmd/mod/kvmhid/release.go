@@ -0,0 +1,169 @@
+package kvmhid
+
+/*
+	release.go
+
+	Protection against keys left pressed on the target. A key stays pressed
+	on the target until a report without it is sent, so a browser tab that
+	dies between a key down and key up event would leave e.g. Ctrl held on
+	a production machine. Keys are released when
+
+	- the last input session of the controller disconnects
+	- a new input session takes over the keyboard
+	- the controller is closed, e.g. on daemon shutdown
+	- the optional watchdog sees keys held without any event or keep-alive
+*/
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// MaxStuckKeyTimeout is the maximum time keys can be held without a
+// keep-alive before the watchdog releases them
+const MaxStuckKeyTimeout = time.Hour
+
+// keyWatchdog releases keys held longer than timeout without an event
+type keyWatchdog struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	stopCh    chan struct{}    // nil if the watchdog is not running
+	lastEvent time.Time        // Last HID command or keep-alive
+	now       func() time.Time // Clock of the watchdog, time.Now if nil
+}
+
+// clock returns the current time of the watchdog. The caller must hold mu.
+func (w *keyWatchdog) clock() time.Time {
+	if w.now != nil {
+		return w.now()
+	}
+	return time.Now()
+}
+
+// ReleaseAll releases all keys, modifiers and mouse buttons, e.g. after an
+// aborted macro left some of them pressed
+func (c *Controller) ReleaseAll() error {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	return c.releaseAll()
+}
+
+// releaseAll sends empty keyboard and mouse button reports. The caller must hold cmdMu.
+func (c *Controller) releaseAll() error {
+	c.hidState.Modkey = 0x00
+	c.hidState.KeyboardButtons = [6]uint8{}
+	if _, err := keyboardSendKeyCombinations(c); err != nil {
+		return err
+	}
+	_, err := c.MouseButtonRelease(0x00)
+	return err
+}
+
+// keysHeld reports if any key, modifier or mouse button is pressed. The caller must hold cmdMu.
+func (c *Controller) keysHeld() bool {
+	return c.hidState.Modkey != 0 || c.hidState.KeyboardButtons != [6]uint8{} || c.hidState.MouseButtons != 0
+}
+
+// AttachClient registers an input session, e.g. a HID websocket. The new
+// session takes over the keyboard, keys held by other sessions are released.
+func (c *Controller) AttachClient() {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	c.clients++
+	if c.clients > 1 && c.keysHeld() {
+		if err := c.releaseAll(); err != nil {
+			log.Printf("Warning: failed to release keys on session takeover: %v\n", err)
+		}
+	}
+}
+
+// DetachClient unregisters an input session. Keys are released when the
+// last session is gone, so a closed browser tab cannot leave keys pressed.
+func (c *Controller) DetachClient() {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	if c.clients > 0 {
+		c.clients--
+	}
+	if c.clients == 0 && c.keysHeld() {
+		if err := c.releaseAll(); err != nil {
+			log.Printf("Warning: failed to release keys after the last session left: %v\n", err)
+		}
+	}
+}
+
+// touchKeyWatchdog records a HID command or keep-alive for the watchdog
+func (c *Controller) touchKeyWatchdog() {
+	c.watchdog.mu.Lock()
+	c.watchdog.lastEvent = c.watchdog.clock()
+	c.watchdog.mu.Unlock()
+}
+
+// SetStuckKeyTimeout starts the watchdog releasing keys held for longer than
+// timeout without a HID command or keep-alive, 0 stops it. Browsers repeat
+// the key down event of a held key, so a key held by a live client is not
+// released.
+func (c *Controller) SetStuckKeyTimeout(timeout time.Duration) {
+	c.watchdog.mu.Lock()
+	defer c.watchdog.mu.Unlock()
+	if timeout > MaxStuckKeyTimeout {
+		timeout = MaxStuckKeyTimeout
+	}
+	if timeout == c.watchdog.timeout && (timeout <= 0) == (c.watchdog.stopCh == nil) {
+		return
+	}
+	if c.watchdog.stopCh != nil {
+		close(c.watchdog.stopCh)
+		c.watchdog.stopCh = nil
+	}
+	c.watchdog.timeout = timeout
+	if timeout <= 0 {
+		return
+	}
+	c.watchdog.stopCh = make(chan struct{})
+	c.watchdog.lastEvent = c.watchdog.clock()
+	stopCh := c.watchdog.stopCh
+
+	go func() {
+		ticker := time.NewTicker(max(timeout/4, 50*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				c.checkStuckKeys(timeout)
+			}
+		}
+	}()
+}
+
+// StuckKeyTimeout returns the timeout of the watchdog, 0 if it is not running
+func (c *Controller) StuckKeyTimeout() time.Duration {
+	c.watchdog.mu.Lock()
+	defer c.watchdog.mu.Unlock()
+	if c.watchdog.stopCh == nil {
+		return 0
+	}
+	return c.watchdog.timeout
+}
+
+// checkStuckKeys releases held keys if there was no event within timeout
+func (c *Controller) checkStuckKeys(timeout time.Duration) {
+	c.watchdog.mu.Lock()
+	idle := c.watchdog.clock().Sub(c.watchdog.lastEvent)
+	c.watchdog.mu.Unlock()
+	if idle < timeout {
+		return
+	}
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	if !c.keysHeld() {
+		return
+	}
+	log.Printf("Keys held for %s without a keep-alive, releasing them\n", idle.Round(time.Second))
+	if err := c.releaseAll(); err != nil {
+		log.Printf("Warning: failed to release stuck keys: %v\n", err)
+	}
+}
@@ -0,0 +1,86 @@
+package kvmhid
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyReleaseWithHIDController(t *testing.T) {
+	controller, dev := newSimulatedController(t)
+
+	press := func(code string) {
+		t.Helper()
+		if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeyPress, Code: code}); err != nil {
+			t.Fatalf("press %s: %v", code, err)
+		}
+	}
+	held := func() bool {
+		state := dev.CH9329.State()
+		return state.Modifiers != 0 || state.Keys != [6]uint8{}
+	}
+
+	// The last session leaving releases the keys, the first one does not
+	controller.AttachClient()
+	controller.AttachClient()
+	press("ControlLeft")
+	controller.DetachClient()
+	if !held() {
+		t.Fatal("keys released while a session is still attached")
+	}
+	controller.DetachClient()
+	if held() {
+		t.Fatalf("keys held after the last session left: %+v", dev.CH9329.State())
+	}
+
+	// A new session takes over the keys of the old one
+	controller.AttachClient()
+	press("KeyA")
+	controller.AttachClient()
+	if held() {
+		t.Fatal("keys held after a session takeover")
+	}
+	controller.DetachClient()
+	controller.DetachClient()
+
+	// Keep-alives keep the keys pressed until they stop. The watchdog checks
+	// every 50ms on its own clock, which only moves when the test says so.
+	var clockMu sync.Mutex
+	now := time.Now()
+	controller.watchdog.mu.Lock()
+	controller.watchdog.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	controller.watchdog.mu.Unlock()
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		now = now.Add(d)
+		clockMu.Unlock()
+	}
+	controller.SetStuckKeyTimeout(200 * time.Millisecond)
+	press("ShiftLeft")
+	for i := 0; i < 6; i++ {
+		advance(150 * time.Millisecond)
+		if _, err := controller.ConstructAndSendCmd(&HIDCommand{Event: EventTypeKeepAlive}); err != nil {
+			t.Fatalf("keep-alive: %v", err)
+		}
+	}
+	controller.checkStuckKeys(200 * time.Millisecond)
+	if !held() {
+		t.Fatal("keys released although keep-alives were sent")
+	}
+	advance(200 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for held() {
+		if time.Now().After(deadline) {
+			t.Fatal("watchdog did not release the stuck keys")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	controller.SetStuckKeyTimeout(0)
+	if controller.StuckKeyTimeout() != 0 {
+		t.Errorf("StuckKeyTimeout = %v after stopping the watchdog", controller.StuckKeyTimeout())
+	}
+}
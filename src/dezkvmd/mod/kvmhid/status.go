@@ -0,0 +1,192 @@
+package kvmhid
+
+/*
+	status.go
+
+	Polling of the CH9329 GET_INFO (0x01) command. Its reply carries the
+	chip version, whether the target has enumerated the USB HID device and
+	the keyboard LEDs set by the target. A target that has not enumerated
+	the device is usually powered off or has not booted yet. Other HID
+	backends report the same state through HIDBackend.Status.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultStatusPollInterval is the default interval of the chip status polling
+const DefaultStatusPollInterval = time.Second
+
+// Keyboard LED bits of the GET_INFO reply
+const (
+	LED_NUMLOCK    = 0x01
+	LED_CAPSLOCK   = 0x02
+	LED_SCROLLLOCK = 0x04
+)
+
+// ChipStatus is the state reported by the HID backend, e.g. the GET_INFO
+// command of the CH9329
+type ChipStatus struct {
+	Responding    bool   `json:"responding"`     // The chip answered the last GET_INFO command
+	Version       string `json:"version"`        // Chip version, e.g. "1.0"
+	USBEnumerated bool   `json:"usb_enumerated"` // The target has enumerated the HID device
+	NumLock       bool   `json:"num_lock"`
+	CapsLock      bool   `json:"caps_lock"`
+	ScrollLock    bool   `json:"scroll_lock"`
+	UpdatedAt     int64  `json:"updated_at"` // Unix time of the last poll
+}
+
+// chipStatusPoller tracks the chip status polling of a controller
+type chipStatusPoller struct {
+	mu          sync.Mutex
+	stopCh      chan struct{} // nil if the polling is not running
+	last        ChipStatus
+	polled      bool // last is valid
+	subscribers map[chan ChipStatus]struct{}
+}
+
+// sameState reports if two statuses differ only in their poll time
+func (s ChipStatus) sameState(other ChipStatus) bool {
+	s.UpdatedAt = other.UpdatedAt
+	return s == other
+}
+
+// leds returns the LED bits of the status
+func (s ChipStatus) leds() uint8 {
+	leds := uint8(0)
+	if s.NumLock {
+		leds |= LED_NUMLOCK
+	}
+	if s.CapsLock {
+		leds |= LED_CAPSLOCK
+	}
+	if s.ScrollLock {
+		leds |= LED_SCROLLLOCK
+	}
+	return leds
+}
+
+// parseChipInfo parses the data of a GET_INFO reply
+func parseChipInfo(data []byte) (ChipStatus, error) {
+	if len(data) < 3 {
+		return ChipStatus{}, errors.New("GET_INFO reply is too short")
+	}
+	return ChipStatus{
+		Responding:    true,
+		Version:       fmt.Sprintf("%d.%d", data[0]>>4, data[0]&0x0F),
+		USBEnumerated: data[1] == 0x01,
+		NumLock:       data[2]&LED_NUMLOCK != 0,
+		CapsLock:      data[2]&LED_CAPSLOCK != 0,
+		ScrollLock:    data[2]&LED_SCROLLLOCK != 0,
+	}, nil
+}
+
+// GetChipInfo queries the keyboard LEDs and USB state from the HID backend
+func (c *Controller) GetChipInfo() (ChipStatus, error) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	status, err := c.backend.Status()
+	if err != nil {
+		return ChipStatus{}, err
+	}
+	c.hidState.Leds = status.leds()
+	return status, nil
+}
+
+// LastChipStatus returns the state of the last poll, ok is false if the
+// chip has not been polled yet
+func (c *Controller) LastChipStatus() (status ChipStatus, ok bool) {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	return c.status.last, c.status.polled
+}
+
+// SubscribeChipStatus returns a channel receiving the chip status when it
+// changes, starting with the current one if the chip has been polled. Slow
+// subscribers only get the latest status. Call cancel to unsubscribe.
+func (c *Controller) SubscribeChipStatus() (updates <-chan ChipStatus, cancel func()) {
+	ch := make(chan ChipStatus, 1)
+	c.status.mu.Lock()
+	if c.status.subscribers == nil {
+		c.status.subscribers = map[chan ChipStatus]struct{}{}
+	}
+	c.status.subscribers[ch] = struct{}{}
+	if c.status.polled {
+		ch <- c.status.last
+	}
+	c.status.mu.Unlock()
+	return ch, func() {
+		c.status.mu.Lock()
+		defer c.status.mu.Unlock()
+		delete(c.status.subscribers, ch)
+	}
+}
+
+// StartStatusPolling polls the chip status every interval until the
+// controller is closed. It does nothing if the polling is already running.
+func (c *Controller) StartStatusPolling(interval time.Duration) {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	if c.status.stopCh != nil || interval <= 0 {
+		return
+	}
+	c.status.stopCh = make(chan struct{})
+	stopCh := c.status.stopCh
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.pollChipStatus()
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopStatusPolling stops the chip status polling
+func (c *Controller) StopStatusPolling() {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	if c.status.stopCh == nil {
+		return
+	}
+	close(c.status.stopCh)
+	c.status.stopCh = nil
+}
+
+// pollChipStatus updates the chip status and notifies the subscribers if it changed
+func (c *Controller) pollChipStatus() {
+	status, err := c.GetChipInfo()
+	if err != nil {
+		// Keep the last known LEDs, only the chip stopped answering
+		c.status.mu.Lock()
+		status = c.status.last
+		c.status.mu.Unlock()
+		status.Responding = false
+	}
+	status.UpdatedAt = time.Now().Unix()
+
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	changed := !c.status.polled || !c.status.last.sameState(status)
+	c.status.last = status
+	c.status.polled = true
+	if !changed {
+		return
+	}
+	for ch := range c.status.subscribers {
+		// Replace a status the subscriber has not read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
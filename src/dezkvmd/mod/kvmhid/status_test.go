@@ -0,0 +1,40 @@
+package kvmhid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChipStatusWithHIDController(t *testing.T) {
+	controller, dev := newSimulatedController(t)
+
+	dev.CH9329.SetLEDs(LED_CAPSLOCK | LED_NUMLOCK)
+	status, err := controller.GetChipInfo()
+	if err != nil {
+		t.Fatalf("GetChipInfo: %v", err)
+	}
+	want := ChipStatus{Responding: true, Version: "3.0", USBEnumerated: true, NumLock: true, CapsLock: true}
+	if status != want {
+		t.Fatalf("GetChipInfo = %+v, want %+v", status, want)
+	}
+
+	// Changes seen by the polling are pushed to the subscribers
+	updates, cancel := controller.SubscribeChipStatus()
+	defer cancel()
+	controller.StartStatusPolling(20 * time.Millisecond)
+	if status := <-updates; !status.CapsLock || !status.USBEnumerated {
+		t.Fatalf("first status = %+v", status)
+	}
+	dev.CH9329.SetUSBEnumerated(false)
+	select {
+	case status := <-updates:
+		if status.USBEnumerated || !status.Responding {
+			t.Fatalf("status after power off = %+v", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no status update after the target was powered off")
+	}
+	if status, ok := controller.LastChipStatus(); !ok || status.USBEnumerated {
+		t.Errorf("LastChipStatus = %+v, %v", status, ok)
+	}
+}
@@ -2,9 +2,8 @@ package kvmhid
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
-
-	tserial "github.com/tarm/serial"
 )
 
 type EventType int
@@ -17,13 +16,15 @@ const (
 	EventTypeMouseRelease
 	EventTypeMouseScroll
 	EventTypeHIDCommand
-	EventTypeHIDReset = 0xFF
+	EventTypeConsumerKey // Press and release of the consumer key in ConsumerKey
+	EventTypeKeepAlive   // Keeps held keys pressed when the stuck key watchdog is enabled
+	EventTypeHIDReset    = 0xFF
 )
 
 const MinCusorEventInterval = 25 // Minimum interval between cursor events in milliseconds
 
 type Config struct {
-	/* Serial port configs */
+	/* Serial port configs of the CH9329 backend */
 	PortName              string
 	BaudRate              int
 	ScrollSensitivity     uint8 // Mouse scroll sensitivity, range 0x00 to 0x7E
@@ -47,24 +48,34 @@ type Controller struct {
 	Config *Config
 
 	/* Internal state */
-	serialPort          *tserial.Port
-	hidState            HIDState // Current state of the HID device
-	serialRunning       bool
-	writeQueue          chan []byte
-	incomingDataQueue   chan []byte // Queue for incoming data
+	backend             HIDBackend // Hardware sending the HID reports
+	hidState            HIDState   // Current state of the HID device
+	connected           atomic.Bool
 	lastCursorEventTime int64
-	readCloseChan       chan bool
+	cmdMu               sync.Mutex // Serialize commands sent by concurrent sessions
 
 	/* Mouse Jiggler */
 	jiggler          jigglerState
 	activityMu       sync.Mutex
 	lastActivityTime time.Time
+
+	/* Macro recording */
+	recorder macroRecorder
+
+	/* Chip status polling */
+	status chipStatusPoller
+
+	/* Stuck key protection */
+	clients  int // Attached input sessions, protected by cmdMu
+	watchdog keyWatchdog
 }
 
 type HIDCommand struct {
 	Event                EventType `json:"event"`
 	Rid                  string    `json:"rid,omitempty"`                    // Reply ID — if set, backend sends an ACK after the command is processed
-	Keycode              int       `json:"keycode,omitempty"`
+	Keycode              int       `json:"keycode,omitempty"`                 // Deprecated JavaScript keyCode, used if Code is empty
+	Code                 string    `json:"code,omitempty"`                    // KeyboardEvent.code of the key, e.g. "KeyA" or "NumpadAdd"
+	ConsumerKey          string    `json:"consumer_key,omitempty"`            // Consumer key of EventTypeConsumerKey, e.g. "mute" or "wake"
 	IsRightModKey        bool      `json:"is_right_modifier_key,omitempty"`   // true if the key is a right modifier key (Ctrl, Shift, Alt, GUI)
 	MouseAbsX            int       `json:"mouse_x,omitempty"`                 // Absolute mouse position in X direction
 	MouseAbsY            int       `json:"mouse_y,omitempty"`                 // Absolute mouse position in Y direction
@@ -0,0 +1,59 @@
+package kvmhid
+
+/*
+	typing.go
+
+	Type key strokes produced by a keyboard layout. Each stroke is sent as
+	a press report followed by a release report, and every report waits for
+	the CH9329 to acknowledge it, so the typing speed adapts to the device.
+*/
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	DefaultTypeKeyDelay = 10 * time.Millisecond // Default delay between two key strokes
+	MaxTypeKeyDelay     = time.Second           // Maximum delay between two key strokes
+)
+
+// TypeKeyStrokes types the key strokes with the given delay between them.
+// Typing stops when ctx is cancelled. Returns the number of strokes sent.
+func (c *Controller) TypeKeyStrokes(ctx context.Context, strokes []KeyStroke, delay time.Duration) (int, error) {
+	for i, stroke := range strokes {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := c.typeKeyStroke(stroke); err != nil {
+			return i, err
+		}
+		c.RecordActivity()
+		if delay > 0 && i < len(strokes)-1 {
+			select {
+			case <-ctx.Done():
+				return i + 1, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+	return len(strokes), nil
+}
+
+// typeKeyStroke presses and releases a key. The keys held by other sessions
+// are released while the key is pressed and restored afterwards, so they
+// do not change the typed character.
+func (c *Controller) typeKeyStroke(stroke KeyStroke) error {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	modkey, buttons := c.hidState.Modkey, c.hidState.KeyboardButtons
+	c.hidState.Modkey = stroke.Modifiers
+	c.hidState.KeyboardButtons = [6]uint8{stroke.Usage}
+	_, err := keyboardSendKeyCombinations(c)
+	c.hidState.Modkey, c.hidState.KeyboardButtons = modkey, buttons
+	if err != nil {
+		return err
+	}
+	_, err = keyboardSendKeyCombinations(c)
+	return err
+}
@@ -0,0 +1,200 @@
+package mdns
+
+/*
+	browse.go
+
+	DNS-SD browser. Queries are sent from an ephemeral port, so responders
+	reply with legacy unicast responses and the browser can run next to a
+	responder or another mDNS daemon on the same host.
+*/
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Entry is a service instance found by Browse
+type Entry struct {
+	Instance string            `json:"instance"` // Instance name without the service type
+	Host     string            `json:"host"`     // Target host of the SRV record
+	Port     int               `json:"port"`
+	Addrs    []net.IP          `json:"addrs"`
+	Text     map[string]string `json:"text"` // TXT record as key value pairs
+}
+
+// Browse queries the service type, e.g. "_dezkvm._tcp", and returns the
+// instances that responded within timeout. The query is repeated once
+// halfway through the timeout to cover lost packets.
+func Browse(config *Config, service string, timeout time.Duration) ([]*Entry, error) {
+	ifaces, err := multicastInterfaces(config.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no interface available for mDNS")
+	}
+	typeName := canonicalName(service + ".local")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := &Message{
+		ID:        uint16(rand.Intn(0xFFFF)),
+		Questions: []Question{{Name: typeName, Type: TypePTR, Class: classIN}},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	group := &net.UDPAddr{IP: GroupIPv4, Port: config.port()}
+	sendQuery := func() error {
+		var lastErr error
+		sent := false
+		for _, iface := range ifaces {
+			if err := setMulticastInterface(conn, iface); err != nil {
+				lastErr = err
+				continue
+			}
+			if _, err := conn.WriteToUDP(data, group); err != nil {
+				lastErr = err
+				continue
+			}
+			sent = true
+		}
+		if !sent {
+			return lastErr
+		}
+		return nil
+	}
+	if err := sendQuery(); err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	deadline := time.Now().Add(timeout)
+	resend := time.Now().Add(timeout / 2)
+	buf := make([]byte, 9000)
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		if !resend.IsZero() && !now.Before(resend) {
+			sendQuery()
+			resend = time.Time{}
+		}
+		wait := deadline
+		if !resend.IsZero() {
+			wait = resend
+		}
+		conn.SetReadDeadline(wait)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		msg, err := Unpack(buf[:n])
+		if err != nil || !msg.IsResponse() {
+			continue
+		}
+		records = append(records, msg.Answers...)
+		records = append(records, msg.Additionals...)
+	}
+	return collectEntries(records, typeName), nil
+}
+
+// collectEntries assembles the service instances of typeName from the records
+func collectEntries(records []Record, typeName string) []*Entry {
+	entries := map[string]*Entry{}
+	for _, r := range records {
+		if r.Type != TypePTR || !sameName(r.Name, typeName) || r.TTL == 0 {
+			continue
+		}
+		// The instance name is the first label of the target
+		target := r.Target
+		if !strings.HasSuffix(target, ".") {
+			target += "."
+		}
+		if len(target) <= len(typeName) || !sameName(target[len(target)-len(typeName):], typeName) {
+			continue
+		}
+		name := canonicalName(target)
+		if _, ok := entries[name]; !ok {
+			entries[name] = &Entry{
+				Instance: strings.TrimSuffix(target[:len(target)-len(typeName)], "."),
+				Text:     map[string]string{},
+			}
+		}
+	}
+
+	hosts := map[string][]net.IP{}
+	for _, r := range records {
+		switch r.Type {
+		case TypeSRV:
+			if e, ok := entries[canonicalName(r.Name)]; ok {
+				e.Host = r.Target
+				e.Port = int(r.Port)
+			}
+		case TypeTXT:
+			if e, ok := entries[canonicalName(r.Name)]; ok {
+				for _, kv := range r.Text {
+					key, value, _ := strings.Cut(kv, "=")
+					e.Text[key] = value
+				}
+			}
+		case TypeA, TypeAAAA:
+			host := canonicalName(r.Name)
+			duplicate := false
+			for _, ip := range hosts[host] {
+				if ip.Equal(r.IP) {
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				hosts[host] = append(hosts[host], r.IP)
+			}
+		}
+	}
+
+	result := []*Entry{}
+	for _, e := range entries {
+		if e.Host == "" {
+			// SRV record not received
+			continue
+		}
+		e.Addrs = hosts[canonicalName(e.Host)]
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Instance < result[j].Instance
+	})
+	return result
+}
+
+// setMulticastInterface sets the outgoing interface of multicast packets
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(iface.Index)})
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
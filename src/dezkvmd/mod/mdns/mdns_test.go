@@ -0,0 +1,126 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPackUnpack(t *testing.T) {
+	m := &Message{
+		ID:    0x1234,
+		Flags: flagResponse | flagAuthoritative,
+		Answers: []Record{
+			{Name: "_dezkvm._tcp.local.", Type: TypePTR, Class: classIN, TTL: 4500, Target: "DezKVM rack1._dezkvm._tcp.local."},
+			{Name: "DezKVM rack1._dezkvm._tcp.local.", Type: TypeSRV, Class: classIN | classCacheFlush, TTL: 120, Target: "rack1.local.", Port: 9000},
+			{Name: "DezKVM rack1._dezkvm._tcp.local.", Type: TypeTXT, Class: classIN, TTL: 4500, Text: []string{"api=v1", "instances=2"}},
+			{Name: "rack1.local.", Type: TypeA, Class: classIN, TTL: 120, IP: net.IPv4(192, 168, 1, 20).To4()},
+		},
+	}
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	got, err := Unpack(data)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got.ID != m.ID || !got.IsResponse() || len(got.Answers) != 4 {
+		t.Fatalf("unexpected message %+v", got)
+	}
+	if got.Answers[0].Target != m.Answers[0].Target || got.Answers[1].Port != 9000 || got.Answers[1].Class != classIN|classCacheFlush {
+		t.Errorf("PTR/SRV records = %+v", got.Answers[:2])
+	}
+	if len(got.Answers[2].Text) != 2 || got.Answers[2].Text[1] != "instances=2" {
+		t.Errorf("TXT record = %+v", got.Answers[2])
+	}
+	if !got.Answers[3].IP.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("A record = %+v", got.Answers[3])
+	}
+
+	// Compressed names, the PTR target points back into the question name
+	compressed := []byte{
+		0x00, 0x00, 0x84, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, '_', 'd', 'e', 'z', 'k', 'v', 'm', 0x04, '_', 't', 'c', 'p', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+		0x00, 0x0c, 0x00, 0x01,
+		0xC0, 0x0C, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x11, 0x94, 0x00, 0x07,
+		0x04, 'n', 'o', 'd', 'e', 0xC0, 0x0C,
+	}
+	got, err = Unpack(compressed)
+	if err != nil {
+		t.Fatalf("Unpack compressed: %v", err)
+	}
+	if got.Answers[0].Name != "_dezkvm._tcp.local." || got.Answers[0].Target != "node._dezkvm._tcp.local." {
+		t.Errorf("compressed PTR = %+v", got.Answers[0])
+	}
+
+	// Pointer loops and truncated messages must not hang or panic
+	loop := append([]byte{}, compressed[:12]...)
+	loop = append(loop, 0xC0, 0x0C, 0x00, 0x0c, 0x00, 0x01)
+	if _, err := Unpack(loop); err == nil {
+		t.Error("pointer loop accepted")
+	}
+	for i := range data {
+		Unpack(data[:i])
+	}
+}
+
+// loopbackConfig returns a config using the loopback interface and a free
+// port, so the test does not interfere with the mDNS daemon of the host
+func loopbackConfig(t *testing.T, hostName string) *Config {
+	t.Helper()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("loopback interface not available")
+	}
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	return &Config{HostName: hostName, Interfaces: []*net.Interface{lo}, Port: port}
+}
+
+func TestAdvertiseAndBrowse(t *testing.T) {
+	config := loopbackConfig(t, "rack1")
+	responder, err := NewResponder(config, []*Service{
+		{Instance: "DezKVM rack1", Service: "_dezkvm._tcp", Port: 9000, Text: []string{"node_uuid=abc", "instances=1"}},
+		{Instance: "DezKVM rack1", Service: "_https._tcp", Port: 9000, Text: []string{"path=/"}},
+	})
+	if err != nil {
+		t.Skipf("multicast on loopback not available: %v", err)
+	}
+	defer responder.Close()
+	responder.SetText([]string{"node_uuid=abc", "instances=2"})
+
+	entries, err := Browse(&Config{Interfaces: config.Interfaces, Port: config.Port}, "_dezkvm._tcp", 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Browse: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("found %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Instance != "DezKVM rack1" || e.Host != "rack1.local." || e.Port != 9000 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Text["node_uuid"] != "abc" || e.Text["instances"] != "2" {
+		t.Errorf("TXT = %v", e.Text)
+	}
+	foundLoopback := false
+	for _, ip := range e.Addrs {
+		if ip.IsLoopback() {
+			foundLoopback = true
+		}
+	}
+	if !foundLoopback {
+		t.Errorf("addresses %v do not include the loopback address", e.Addrs)
+	}
+
+	// Other service types are not mixed into the result
+	entries, err = Browse(&Config{Interfaces: config.Interfaces, Port: config.Port}, "_ssh._tcp", 200*time.Millisecond)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("browsing another service type = %v, %v", entries, err)
+	}
+}
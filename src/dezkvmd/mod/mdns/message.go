@@ -0,0 +1,333 @@
+package mdns
+
+/*
+	message.go
+
+	Minimal DNS message encoding and decoding for mDNS / DNS-SD. Only the
+	record types needed to advertise and browse services are supported,
+	other records are decoded with their raw data only.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS record types
+const (
+	TypeA    uint16 = 1
+	TypePTR  uint16 = 12
+	TypeTXT  uint16 = 16
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeANY  uint16 = 255
+)
+
+const (
+	classIN         uint16 = 1
+	classCacheFlush uint16 = 1 << 15 // Top bit of the class of mDNS records, replace cached records
+	classUnicast    uint16 = 1 << 15 // Top bit of the class of mDNS questions, unicast response requested
+
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+)
+
+var errTruncated = errors.New("truncated DNS message")
+
+// Question is a question of a DNS message
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Record is a resource record of a DNS message
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	Target string   // PTR and SRV target
+	Port   uint16   // SRV port
+	Text   []string // TXT strings
+	IP     net.IP   // A and AAAA address
+	Data   []byte   // Raw data of unsupported record types
+}
+
+// Message is a DNS message
+type Message struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []Question
+	Answers     []Record
+	Authorities []Record
+	Additionals []Record
+}
+
+// IsResponse checks if the message is a response
+func (m *Message) IsResponse() bool {
+	return m.Flags&flagResponse != 0
+}
+
+// canonicalName returns the name in lower case with a trailing dot
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// sameName compares two domain names case insensitively
+func sameName(a, b string) bool {
+	return canonicalName(a) == canonicalName(b)
+}
+
+/* Encoding */
+
+// Pack encodes the message. Names are not compressed.
+func (m *Message) Pack() ([]byte, error) {
+	buf := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(buf[0:], m.ID)
+	binary.BigEndian.PutUint16(buf[2:], m.Flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = appendName(buf, q.Name); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, q.Type)
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
+	}
+	for _, section := range [][]Record{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range section {
+			if buf, err = appendRecord(buf, &r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+func appendName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("invalid label in name " + name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), nil
+}
+
+func appendRecord(buf []byte, r *Record) ([]byte, error) {
+	var err error
+	if buf, err = appendName(buf, r.Name); err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, r.Type)
+	buf = binary.BigEndian.AppendUint16(buf, r.Class)
+	buf = binary.BigEndian.AppendUint32(buf, r.TTL)
+
+	// Reserve the data length and fill it in after the data is written
+	lengthOffset := len(buf)
+	buf = append(buf, 0, 0)
+	switch r.Type {
+	case TypeA:
+		ip := r.IP.To4()
+		if ip == nil {
+			return nil, errors.New("invalid IPv4 address")
+		}
+		buf = append(buf, ip...)
+	case TypeAAAA:
+		ip := r.IP.To16()
+		if ip == nil {
+			return nil, errors.New("invalid IPv6 address")
+		}
+		buf = append(buf, ip...)
+	case TypePTR:
+		if buf, err = appendName(buf, r.Target); err != nil {
+			return nil, err
+		}
+	case TypeSRV:
+		buf = binary.BigEndian.AppendUint16(buf, 0) // Priority
+		buf = binary.BigEndian.AppendUint16(buf, 0) // Weight
+		buf = binary.BigEndian.AppendUint16(buf, r.Port)
+		if buf, err = appendName(buf, r.Target); err != nil {
+			return nil, err
+		}
+	case TypeTXT:
+		if len(r.Text) == 0 {
+			// A TXT record must contain at least one string
+			buf = append(buf, 0)
+		}
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return nil, errors.New("TXT string too long")
+			}
+			buf = append(buf, byte(len(s)))
+			buf = append(buf, s...)
+		}
+	default:
+		buf = append(buf, r.Data...)
+	}
+	binary.BigEndian.PutUint16(buf[lengthOffset:], uint16(len(buf)-lengthOffset-2))
+	return buf, nil
+}
+
+/* Decoding */
+
+// Unpack decodes a DNS message
+func Unpack(data []byte) (*Message, error) {
+	if len(data) < 12 {
+		return nil, errTruncated
+	}
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(data[0:]),
+		Flags: binary.BigEndian.Uint16(data[2:]),
+	}
+	qdCount := int(binary.BigEndian.Uint16(data[4:]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(data[6:])),
+		int(binary.BigEndian.Uint16(data[8:])),
+		int(binary.BigEndian.Uint16(data[10:])),
+	}
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, errTruncated
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[next:]),
+			Class: binary.BigEndian.Uint16(data[next+2:]),
+		})
+		offset = next + 4
+	}
+
+	sections := []*[]Record{&m.Answers, &m.Authorities, &m.Additionals}
+	for s, count := range counts {
+		for i := 0; i < count; i++ {
+			r, next, err := readRecord(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			*sections[s] = append(*sections[s], *r)
+			offset = next
+		}
+	}
+	return m, nil
+}
+
+// readName reads a possibly compressed name at offset and returns it with
+// the offset following the name
+func readName(data []byte, offset int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	// Limit the number of pointers followed, so a pointer loop cannot hang the decoder
+	for jumps := 0; ; {
+		if offset >= len(data) {
+			return "", 0, errTruncated
+		}
+		length := int(data[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(data) {
+				return "", 0, errTruncated
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			jumps++
+			if jumps > 16 {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errors.New("invalid label length")
+		default:
+			if offset+1+length > len(data) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func readRecord(data []byte, offset int) (*Record, int, error) {
+	name, offset, err := readName(data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset+10 > len(data) {
+		return nil, 0, errTruncated
+	}
+	r := &Record{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(data[offset:]),
+		Class: binary.BigEndian.Uint16(data[offset+2:]),
+		TTL:   binary.BigEndian.Uint32(data[offset+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(data[offset+8:]))
+	start := offset + 10
+	end := start + length
+	if end > len(data) {
+		return nil, 0, errTruncated
+	}
+	rdata := data[start:end]
+
+	switch r.Type {
+	case TypeA, TypeAAAA:
+		if (r.Type == TypeA && length != 4) || (r.Type == TypeAAAA && length != 16) {
+			return nil, 0, errors.New("invalid address record")
+		}
+		r.IP = net.IP(append([]byte{}, rdata...))
+	case TypePTR:
+		if r.Target, _, err = readName(data, start); err != nil {
+			return nil, 0, err
+		}
+	case TypeSRV:
+		if length < 7 {
+			return nil, 0, errTruncated
+		}
+		r.Port = binary.BigEndian.Uint16(rdata[4:])
+		if r.Target, _, err = readName(data, start+6); err != nil {
+			return nil, 0, err
+		}
+	case TypeTXT:
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				return nil, 0, errTruncated
+			}
+			if l > 0 {
+				r.Text = append(r.Text, string(rdata[i+1:i+1+l]))
+			}
+			i += 1 + l
+		}
+	default:
+		r.Data = append([]byte{}, rdata...)
+	}
+	return r, end, nil
+}
@@ -0,0 +1,425 @@
+package mdns
+
+/*
+	responder.go
+
+	mDNS responder advertising DNS-SD services of this host (RFC 6762 and
+	RFC 6763). The responder answers queries for the service types, the
+	service instances and the host name, announces the services on start
+	and sends goodbye packets when it is closed.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPort is the mDNS port
+const DefaultPort = 5353
+
+// GroupIPv4 is the IPv4 mDNS multicast group
+var GroupIPv4 = net.IPv4(224, 0, 0, 251)
+
+const (
+	hostTTL    = 120  // TTL of the host and SRV records
+	serviceTTL = 4500 // TTL of the PTR and TXT records
+
+	serviceTypeEnumeration = "_services._dns-sd._udp.local."
+)
+
+// Service is a DNS-SD service instance
+type Service struct {
+	Instance string   // Instance name, e.g. "DezKVM rack1"
+	Service  string   // Service type, e.g. "_dezkvm._tcp"
+	Port     int      // Port of the service
+	Text     []string // TXT record as key=value strings
+}
+
+// Config of the responder and browser
+type Config struct {
+	HostName   string           // Host name advertised in SRV records, ".local" is appended
+	Interfaces []*net.Interface // Interfaces to use, all multicast capable interfaces if empty
+	Port       int              // mDNS port, DefaultPort if zero. Other ports are used by tests.
+	Logger     *log.Logger      // Optional logger for errors of the responder
+}
+
+// Responder advertises services over mDNS
+type Responder struct {
+	config *Config
+	host   string         // Fully qualified host name, e.g. dezkvm.local.
+	conns  []*ifaceConn   // One multicast socket per interface
+	mu     sync.RWMutex   // Protect services
+	wg     sync.WaitGroup // Tracks the read loops
+
+	services  []*Service
+	closeOnce sync.Once
+}
+
+// ifaceConn is the multicast socket of an interface
+type ifaceConn struct {
+	iface *net.Interface
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// NewResponder starts a responder for the services. The services are
+// announced immediately.
+func NewResponder(config *Config, services []*Service) (*Responder, error) {
+	if config.HostName == "" {
+		return nil, errors.New("host name is required")
+	}
+	for _, s := range services {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+	}
+	ifaces, err := multicastInterfaces(config.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{
+		config:   config,
+		host:     canonicalName(sanitizeLabel(config.HostName) + ".local"),
+		services: services,
+	}
+	group := &net.UDPAddr{IP: GroupIPv4, Port: config.port()}
+	for _, iface := range ifaces {
+		conn, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			r.logf("mDNS: failed to listen on %s: %v", iface.Name, err)
+			continue
+		}
+		// Only receive packets of the group joined on this interface,
+		// otherwise every socket receives the queries of all interfaces
+		if err := setMulticastAll(conn, false); err != nil {
+			r.logf("mDNS: failed to configure socket of %s: %v", iface.Name, err)
+		}
+		r.conns = append(r.conns, &ifaceConn{iface: iface, conn: conn, group: group})
+	}
+	if len(r.conns) == 0 {
+		return nil, errors.New("no interface available for mDNS")
+	}
+
+	for _, c := range r.conns {
+		r.wg.Add(1)
+		go r.serve(c)
+	}
+	go r.announce()
+	return r, nil
+}
+
+func (c *Config) port() int {
+	if c.Port == 0 {
+		return DefaultPort
+	}
+	return c.Port
+}
+
+func (r *Responder) logf(format string, args ...interface{}) {
+	if r.config.Logger != nil {
+		r.config.Logger.Printf(format, args...)
+	}
+}
+
+func (s *Service) validate() error {
+	if s.Instance == "" || s.Port <= 0 || s.Port > 65535 {
+		return errors.New("invalid service instance")
+	}
+	if !strings.HasPrefix(s.Service, "_") || !(strings.HasSuffix(s.Service, "._tcp") || strings.HasSuffix(s.Service, "._udp")) {
+		return errors.New("invalid service type " + s.Service)
+	}
+	return nil
+}
+
+// typeName returns the name of the service type, e.g. _dezkvm._tcp.local.
+func (s *Service) typeName() string {
+	return canonicalName(s.Service + ".local")
+}
+
+// instanceName returns the name of the service instance
+func (s *Service) instanceName() string {
+	return sanitizeLabel(s.Instance) + "." + s.typeName()
+}
+
+// sanitizeLabel makes name usable as a single DNS label
+func sanitizeLabel(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), ".", "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// SetText replaces the TXT record of all services and announces the change
+func (r *Responder) SetText(text []string) {
+	r.mu.Lock()
+	services := []*Service{}
+	for _, s := range r.services {
+		copied := *s
+		copied.Text = append([]string{}, text...)
+		services = append(services, &copied)
+	}
+	r.services = services
+	r.mu.Unlock()
+	for _, c := range r.conns {
+		r.send(c, r.allRecords(c.iface, serviceTTL, hostTTL), c.group)
+	}
+}
+
+// Close sends goodbye packets and stops the responder
+func (r *Responder) Close() error {
+	r.closeOnce.Do(func() {
+		for _, c := range r.conns {
+			r.send(c, r.allRecords(c.iface, 0, 0), c.group)
+			c.conn.Close()
+		}
+		r.wg.Wait()
+	})
+	return nil
+}
+
+// announce sends unsolicited responses with all records, repeated once
+// after a second as recommended by RFC 6762
+func (r *Responder) announce() {
+	for i := 0; i < 2; i++ {
+		for _, c := range r.conns {
+			if err := r.send(c, r.allRecords(c.iface, serviceTTL, hostTTL), c.group); err != nil {
+				return
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (r *Responder) serve(c *ifaceConn) {
+	defer r.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logf("mDNS: read error on %s: %v", c.iface.Name, err)
+			return
+		}
+		query, err := Unpack(buf[:n])
+		if err != nil || query.IsResponse() {
+			continue
+		}
+		r.handleQuery(c, query, src)
+	}
+}
+
+// handleQuery answers the questions of a query. Queries from a port other
+// than the mDNS port are legacy unicast queries and answered directly to
+// the sender (RFC 6762 section 6.7).
+func (r *Responder) handleQuery(c *ifaceConn, query *Message, src *net.UDPAddr) {
+	answers, additionals := r.answer(c.iface, query.Questions)
+	if len(answers) == 0 {
+		return
+	}
+	legacy := src.Port != c.group.Port
+	if legacy {
+		reply := &Message{
+			ID:          query.ID,
+			Flags:       flagResponse | flagAuthoritative,
+			Questions:   query.Questions,
+			Answers:     clearCacheFlush(answers),
+			Additionals: clearCacheFlush(additionals),
+		}
+		r.sendMessage(c, reply, src)
+		return
+	}
+	dest := c.group
+	for _, q := range query.Questions {
+		if q.Class&classUnicast != 0 {
+			dest = src
+		}
+	}
+	r.sendMessage(c, &Message{
+		Flags:       flagResponse | flagAuthoritative,
+		Answers:     answers,
+		Additionals: additionals,
+	}, dest)
+}
+
+// answer returns the records answering the questions and the related
+// records for the additional section
+func (r *Responder) answer(iface *net.Interface, questions []Question) (answers []Record, additionals []Record) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	matches := func(q Question, name string, qtype uint16) bool {
+		return sameName(q.Name, name) && (q.Type == qtype || q.Type == TypeANY)
+	}
+	addresses := r.addressRecords(iface, hostTTL)
+	for _, q := range questions {
+		for _, s := range r.services {
+			if matches(q, serviceTypeEnumeration, TypePTR) {
+				answers = append(answers, Record{Name: serviceTypeEnumeration, Type: TypePTR, Class: classIN, TTL: serviceTTL, Target: s.typeName()})
+			}
+			if matches(q, s.typeName(), TypePTR) {
+				answers = append(answers, r.ptrRecord(s, serviceTTL))
+				additionals = append(additionals, r.srvRecord(s, hostTTL), r.txtRecord(s, serviceTTL))
+				additionals = append(additionals, addresses...)
+			}
+			if matches(q, s.instanceName(), TypeSRV) {
+				answers = append(answers, r.srvRecord(s, hostTTL))
+				additionals = append(additionals, addresses...)
+			}
+			if matches(q, s.instanceName(), TypeTXT) {
+				answers = append(answers, r.txtRecord(s, serviceTTL))
+			}
+		}
+		if sameName(q.Name, r.host) {
+			for _, a := range addresses {
+				if q.Type == a.Type || q.Type == TypeANY {
+					answers = append(answers, a)
+				}
+			}
+		}
+	}
+	return dedupRecords(answers), dedupRecords(additionals)
+}
+
+// allRecords returns the records of all services and the host, used for
+// announcements and goodbyes
+func (r *Responder) allRecords(iface *net.Interface, serviceTTL uint32, hostTTL uint32) []Record {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	records := []Record{}
+	for _, s := range r.services {
+		records = append(records, r.ptrRecord(s, serviceTTL), r.srvRecord(s, hostTTL), r.txtRecord(s, serviceTTL))
+	}
+	records = append(records, r.addressRecords(iface, hostTTL)...)
+	return records
+}
+
+func (r *Responder) ptrRecord(s *Service, ttl uint32) Record {
+	return Record{Name: s.typeName(), Type: TypePTR, Class: classIN, TTL: ttl, Target: s.instanceName()}
+}
+
+func (r *Responder) srvRecord(s *Service, ttl uint32) Record {
+	return Record{Name: s.instanceName(), Type: TypeSRV, Class: classIN | classCacheFlush, TTL: ttl, Target: r.host, Port: uint16(s.Port)}
+}
+
+func (r *Responder) txtRecord(s *Service, ttl uint32) Record {
+	return Record{Name: s.instanceName(), Type: TypeTXT, Class: classIN | classCacheFlush, TTL: ttl, Text: s.Text}
+}
+
+// addressRecords returns the A and AAAA records of the interface addresses
+func (r *Responder) addressRecords(iface *net.Interface, ttl uint32) []Record {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	records := []Record{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			records = append(records, Record{Name: r.host, Type: TypeA, Class: classIN | classCacheFlush, TTL: ttl, IP: ip4})
+		} else if !ipNet.IP.IsLinkLocalUnicast() || iface.Flags&net.FlagLoopback != 0 {
+			records = append(records, Record{Name: r.host, Type: TypeAAAA, Class: classIN | classCacheFlush, TTL: ttl, IP: ipNet.IP})
+		}
+	}
+	return records
+}
+
+// send sends an unsolicited response with the records
+func (r *Responder) send(c *ifaceConn, records []Record, dest *net.UDPAddr) error {
+	return r.sendMessage(c, &Message{
+		Flags:   flagResponse | flagAuthoritative,
+		Answers: records,
+	}, dest)
+}
+
+func (r *Responder) sendMessage(c *ifaceConn, m *Message, dest *net.UDPAddr) error {
+	data, err := m.Pack()
+	if err != nil {
+		r.logf("mDNS: failed to encode response: %v", err)
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, dest)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		r.logf("mDNS: failed to send response on %s: %v", c.iface.Name, err)
+	}
+	return err
+}
+
+// clearCacheFlush removes the cache flush bit, which must not be set in
+// legacy unicast responses
+func clearCacheFlush(records []Record) []Record {
+	cleared := make([]Record, len(records))
+	for i, rec := range records {
+		rec.Class &^= classCacheFlush
+		cleared[i] = rec
+	}
+	return cleared
+}
+
+// dedupRecords removes records with the same name, type and target
+func dedupRecords(records []Record) []Record {
+	seen := map[string]bool{}
+	result := []Record{}
+	for _, rec := range records {
+		key := fmt.Sprintf("%s|%d|%s|%s", canonicalName(rec.Name), rec.Type, rec.Target, rec.IP)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, rec)
+	}
+	return result
+}
+
+// multicastInterfaces returns the given interfaces, or all interfaces that
+// are up and support multicast
+func multicastInterfaces(ifaces []*net.Interface) ([]*net.Interface, error) {
+	if len(ifaces) > 0 {
+		return ifaces, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	result := []*net.Interface{}
+	for i := range all {
+		iface := all[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		result = append(result, &iface)
+	}
+	return result, nil
+}
+
+// setMulticastAll sets IP_MULTICAST_ALL of the socket
+func setMulticastAll(conn *net.UDPConn, enabled bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if enabled {
+		value = 1
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_ALL, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
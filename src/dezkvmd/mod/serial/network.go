@@ -0,0 +1,285 @@
+package serial
+
+/*
+	network.go
+
+	Serial devices shared over TCP, e.g. by ser2net on another box.
+
+	Raw TCP passes the bytes as they are and the baudrate is whatever the
+	server configured. RFC2217 wraps the stream in telnet, so 0xFF in the
+	data is escaped and the baudrate and framing are set through the
+	COM-PORT-OPTION. Only the parts of telnet needed for that are handled,
+	other options requested by the server are refused.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	networkDialTimeout  = 3 * time.Second
+	networkWriteTimeout = 2 * time.Second
+	networkFlushWindow  = 20 * time.Millisecond
+)
+
+// Telnet commands and options, RFC854, RFC856 and RFC2217
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary   = 0
+	telnetOptSGA      = 3
+	telnetOptComPort  = 44
+	comPortSetBaud    = 1
+	comPortSetData    = 2
+	comPortSetParity  = 3
+	comPortSetStop    = 4
+	comPortPurgeData  = 12
+	comPortParityNone = 1
+	comPortPurgeBoth  = 3
+)
+
+// telnet decoder states
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption // After WILL, WONT, DO or DONT
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// NetworkPort is a serial device reached over TCP
+type NetworkPort struct {
+	conn        net.Conn
+	readTimeout time.Duration
+	writeMu     sync.Mutex // Keep writes and telnet replies from interleaving
+
+	/* Telnet, only used with RFC2217 */
+	telnet   bool
+	state    int
+	verb     byte
+	willSent [256]bool
+	doSent   [256]bool
+}
+
+// dialNetworkPort connects to the serial server at address
+func dialNetworkPort(address string, cfg *Config, telnet bool) (*NetworkPort, error) {
+	conn, err := net.DialTimeout("tcp", address, networkDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.Name, err)
+	}
+	p := &NetworkPort{
+		conn:        conn,
+		readTimeout: cfg.ReadTimeout,
+		telnet:      telnet,
+	}
+	if telnet {
+		if err := p.negotiate(cfg.Baud); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to configure %s: %w", cfg.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// negotiate enables binary mode and the COM-PORT-OPTION and sets the port to
+// baud 8N1. The server confirms asynchronously, replies are consumed by Read.
+func (p *NetworkPort) negotiate(baud int) error {
+	if baud <= 0 {
+		return fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	p.willSent[telnetOptBinary] = true
+	p.doSent[telnetOptBinary] = true
+	p.willSent[telnetOptComPort] = true
+	packet := []byte{
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptBinary,
+		telnetIAC, telnetWILL, telnetOptComPort,
+	}
+	baudBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(baudBytes, uint32(baud))
+	packet = append(packet, comPortCommand(comPortSetBaud, baudBytes...)...)
+	packet = append(packet, comPortCommand(comPortSetData, 8)...)
+	packet = append(packet, comPortCommand(comPortSetParity, comPortParityNone)...)
+	packet = append(packet, comPortCommand(comPortSetStop, 1)...)
+	return p.writeRaw(packet)
+}
+
+// comPortCommand builds a COM-PORT-OPTION subnegotiation
+func comPortCommand(command byte, value ...byte) []byte {
+	packet := []byte{telnetIAC, telnetSB, telnetOptComPort, command}
+	packet = append(packet, escapeIAC(value)...)
+	return append(packet, telnetIAC, telnetSE)
+}
+
+// escapeIAC doubles 0xFF so it is sent as data instead of a telnet command
+func escapeIAC(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+}
+
+// writeRaw writes bytes to the connection without escaping
+func (p *NetworkPort) writeRaw(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(networkWriteTimeout))
+	_, err := p.conn.Write(data)
+	return err
+}
+
+// Read reads up to len(b) bytes from the device. Like Port.Read, it returns
+// ErrReadTimeout if nothing arrived within the read timeout.
+func (p *NetworkPort) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	deadline := time.Time{}
+	if p.readTimeout > 0 {
+		deadline = time.Now().Add(p.readTimeout)
+	}
+	p.conn.SetReadDeadline(deadline)
+	for {
+		n, err := p.conn.Read(b)
+		if p.telnet && n > 0 {
+			n = p.decode(b[:n])
+		}
+		if n > 0 {
+			// A pending error is returned again by the next read
+			return n, nil
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, ErrReadTimeout
+			}
+			return 0, err
+		}
+	}
+}
+
+// decode strips the telnet commands from buf in place, answers option
+// requests and returns the number of data bytes left at the start of buf
+func (p *NetworkPort) decode(buf []byte) int {
+	n := 0
+	var replies []byte
+	for _, c := range buf {
+		switch p.state {
+		case telnetStateData:
+			if c == telnetIAC {
+				p.state = telnetStateIAC
+			} else {
+				buf[n] = c
+				n++
+			}
+		case telnetStateIAC:
+			switch c {
+			case telnetIAC:
+				// Escaped 0xFF
+				buf[n] = c
+				n++
+				p.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				p.verb = c
+				p.state = telnetStateOption
+			case telnetSB:
+				p.state = telnetStateSB
+			default:
+				// NOP, GA and friends carry no data
+				p.state = telnetStateData
+			}
+		case telnetStateOption:
+			replies = append(replies, p.answerOption(p.verb, c)...)
+			p.state = telnetStateData
+		case telnetStateSB:
+			// Subnegotiations from the server only acknowledge our settings
+			if c == telnetIAC {
+				p.state = telnetStateSBIAC
+			}
+		case telnetStateSBIAC:
+			if c == telnetSE {
+				p.state = telnetStateData
+			} else {
+				p.state = telnetStateSB
+			}
+		}
+	}
+	if len(replies) > 0 {
+		if err := p.writeRaw(replies); err != nil {
+			// The next Write fails with the same error
+			return n
+		}
+	}
+	return n
+}
+
+// answerOption returns the reply to an option request of the server. Each
+// option is only agreed to once, so the negotiation cannot loop.
+func (p *NetworkPort) answerOption(verb byte, option byte) []byte {
+	switch verb {
+	case telnetDO:
+		if option != telnetOptBinary && option != telnetOptComPort && option != telnetOptSGA {
+			return []byte{telnetIAC, telnetWONT, option}
+		}
+		if !p.willSent[option] {
+			p.willSent[option] = true
+			return []byte{telnetIAC, telnetWILL, option}
+		}
+	case telnetWILL:
+		if option != telnetOptBinary && option != telnetOptSGA {
+			return []byte{telnetIAC, telnetDONT, option}
+		}
+		if !p.doSent[option] {
+			p.doSent[option] = true
+			return []byte{telnetIAC, telnetDO, option}
+		}
+	}
+	return nil
+}
+
+// Write writes data to the device
+func (p *NetworkPort) Write(b []byte) (int, error) {
+	data := b
+	if p.telnet {
+		data = escapeIAC(b)
+	}
+	if err := p.writeRaw(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush discards the data received but not read yet. With RFC2217 the
+// server is asked to purge the buffers of its serial port as well.
+func (p *NetworkPort) Flush() error {
+	if p.telnet {
+		if err := p.writeRaw(comPortCommand(comPortPurgeData, comPortPurgeBoth)); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 256)
+	p.conn.SetReadDeadline(time.Now().Add(networkFlushWindow))
+	for {
+		n, err := p.conn.Read(buf)
+		if p.telnet && n > 0 {
+			p.decode(buf[:n])
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// Close closes the connection
+func (p *NetworkPort) Close() error {
+	return p.conn.Close()
+}
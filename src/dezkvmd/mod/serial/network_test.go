@@ -0,0 +1,128 @@
+package serial
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenServer returns the address of a local server handing its only
+// connection to serve
+func listenServer(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func TestRFC2217Transport(t *testing.T) {
+	negotiation := []byte{
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptBinary,
+		telnetIAC, telnetWILL, telnetOptComPort,
+		telnetIAC, telnetSB, telnetOptComPort, comPortSetBaud, 0x00, 0x00, 0x25, 0x80, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptComPort, comPortSetData, 8, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptComPort, comPortSetParity, comPortParityNone, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptComPort, comPortSetStop, 1, telnetIAC, telnetSE,
+	}
+	received := make(chan []byte, 1)
+	address := listenServer(t, func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len(negotiation)+4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			received <- nil
+			return
+		}
+		received <- buf
+
+		// Baudrate acknowledgement, an option request and data with an escaped 0xFF
+		conn.Write([]byte{
+			telnetIAC, telnetSB, telnetOptComPort, 101, 0x00, 0x00, 0x25, 0x80, telnetIAC, telnetSE,
+			0x57, telnetIAC, telnetIAC,
+			telnetIAC, telnetWILL, 1, // Echo
+			0xAB,
+		})
+		reply := make([]byte, 3)
+		io.ReadFull(conn, reply)
+		received <- reply
+	})
+
+	port, err := Open(&Config{Name: "rfc2217://" + address, Baud: 9600, ReadTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer port.Close()
+	if _, err := port.Write([]byte{0x01, 0xFF, 0x02}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want := append(negotiation, 0x01, telnetIAC, telnetIAC, 0x02)
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Fatalf("server received % X, want % X", got, want)
+	}
+
+	data := make([]byte, 3)
+	if _, err := io.ReadFull(port, data); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x57, 0xFF, 0xAB}) {
+		t.Errorf("read % X, want 57 FF AB", data)
+	}
+	if got := <-received; !bytes.Equal(got, []byte{telnetIAC, telnetDONT, 1}) {
+		t.Errorf("option reply = % X, want IAC DONT ECHO", got)
+	}
+}
+
+func TestTCPTransportReadTimeout(t *testing.T) {
+	address := listenServer(t, func(conn net.Conn) {
+		conn.Write([]byte{0xFF, 0x00})
+		io.Copy(io.Discard, conn)
+	})
+	port, err := Open(&Config{Name: "tcp://" + address, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer port.Close()
+
+	// Raw TCP passes 0xFF through
+	data := make([]byte, 2)
+	if _, err := io.ReadFull(port, data); err != nil || !bytes.Equal(data, []byte{0xFF, 0x00}) {
+		t.Fatalf("ReadFull = % X, %v", data, err)
+	}
+	if _, err := port.Read(data); !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("Read without data = %v, want ErrReadTimeout", err)
+	}
+}
+
+func TestParseNetworkPath(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"tcp://10.0.0.5:4001":     true,
+		"rfc2217://kvm-box:2217":  true,
+		"tcp://10.0.0.5":          false,
+		"udp://10.0.0.5:4001":     false,
+		"rfc2217://[::1]:2217":    true,
+		"telnet://10.0.0.5:23000": false,
+	} {
+		if _, _, err := ParseNetworkPath(path); (err == nil) != valid {
+			t.Errorf("ParseNetworkPath(%q) = %v, want valid %v", path, err, valid)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package serial
+
+/*
+	pty.go
+
+	Pseudo terminal pairs for tests and the simulator. An emulated device
+	sits on the master side, the slave side (/dev/pts/N) is opened with
+	Open by the regular kvmhid and kvmaux drivers like any USB serial device.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pty is the master side of a pseudo terminal, it is the Transport of the
+// emulated device
+type Pty struct {
+	master    *os.File
+	slave     *os.File // Kept open so reads on master do not fail while no driver is attached
+	slavePath string
+	closeOnce sync.Once
+}
+
+// OpenPty creates a new pseudo terminal pair in raw mode
+func OpenPty() (*Pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+	fd := int(master.Fd())
+
+	// Unlock the slave and get its number
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	ptn, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", ptn)
+
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", slavePath, err)
+	}
+
+	// Raw mode, so nothing is echoed back before a driver configures the port
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err == nil {
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		err = unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios)
+	}
+	if err != nil {
+		slave.Close()
+		master.Close()
+		return nil, fmt.Errorf("failed to set pty to raw mode: %w", err)
+	}
+
+	return &Pty{
+		master:    master,
+		slave:     slave,
+		slavePath: slavePath,
+	}, nil
+}
+
+// Path returns the slave side of the terminal, the device path for Open
+func (p *Pty) Path() string {
+	return p.slavePath
+}
+
+// Read reads from the master side. Errors caused by the driver closing its
+// side of the terminal are retried, so the emulator survives reconnects.
+func (p *Pty) Read(buf []byte) (int, error) {
+	for {
+		n, err := p.master.Read(buf)
+		if err == nil || errors.Is(err, os.ErrClosed) {
+			return n, err
+		}
+		if errors.Is(err, unix.EIO) {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write writes to the master side, which the driver reads from the slave side.
+func (p *Pty) Write(data []byte) (int, error) {
+	return p.master.Write(data)
+}
+
+// Flush discards the data written by the driver but not read yet
+func (p *Pty) Flush() error {
+	return unix.IoctlSetInt(int(p.master.Fd()), unix.TCFLSH, unix.TCIFLUSH)
+}
+
+// Close closes both sides of the pseudo terminal.
+func (p *Pty) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.slave.Close()
+		err = p.master.Close()
+	})
+	return err
+}
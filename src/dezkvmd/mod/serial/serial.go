@@ -14,6 +14,7 @@ package serial
 */
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -22,6 +23,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// ErrReadTimeout is returned by Read if no data arrived within the read timeout
+var ErrReadTimeout = errors.New("serial read timeout")
+
 // Port represents an open serial port on Linux.
 type Port struct {
 	file        *os.File
@@ -30,7 +34,7 @@ type Port struct {
 
 // Config holds the configuration for opening a serial port.
 type Config struct {
-	Name        string        // Device path, e.g. /dev/ttyACM0
+	Name        string        // Device path, e.g. /dev/ttyACM0, or a network address, see Open
 	Baud        int           // Baud rate, e.g. 115200
 	ReadTimeout time.Duration // Read timeout; 0 means blocking
 }
@@ -137,7 +141,7 @@ func (p *Port) Read(b []byte) (int, error) {
 	// On Linux, VTIME expiry with no data returns n=0, err=nil.
 	// Convert to a timeout error so io.ReadFull works correctly.
 	if n == 0 && err == nil {
-		return 0, fmt.Errorf("serial read timeout")
+		return 0, ErrReadTimeout
 	}
 	return n, err
 }
@@ -158,12 +162,13 @@ func (p *Port) Flush() error {
 	return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
 }
 
-// Close closes the serial port.
+// Close closes the serial port. It is safe to call while another goroutine
+// is reading, the read returns an error.
 func (p *Port) Close() error {
-	if p.file != nil {
-		err := p.file.Close()
-		p.file = nil
-		return err
+	err := p.file.Close()
+	if errors.Is(err, os.ErrClosed) {
+		// Already closed
+		return nil
 	}
-	return nil
+	return err
 }
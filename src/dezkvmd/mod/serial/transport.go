@@ -0,0 +1,74 @@
+package serial
+
+/*
+	transport.go
+
+	Transport is the byte stream to a CH9329 or AuxMCU, no matter if the
+	device is plugged into this host or shared over the network by ser2net
+	on another box. The device path decides the implementation
+
+	- /dev/ttyUSB0        local serial port, see OpenPort
+	- tcp://host:port     raw TCP, ser2net "raw" or "tcp" ports
+	- rfc2217://host:port telnet with RFC2217, ser2net "telnet" ports with
+	                      the remctl option, the baudrate is set remotely
+*/
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Transport is an open connection to a serial device
+type Transport interface {
+	io.ReadWriteCloser
+	Flush() error // Discard data received but not read yet
+}
+
+// Network transport schemes of the device path
+const (
+	SchemeTCP     = "tcp"
+	SchemeRFC2217 = "rfc2217"
+)
+
+// Open opens the device in cfg.Name with the transport of its path
+func Open(cfg *Config) (Transport, error) {
+	if !IsNetworkPath(cfg.Name) {
+		port, err := OpenPort(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return port, nil
+	}
+	scheme, address, err := ParseNetworkPath(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	port, err := dialNetworkPort(address, cfg, scheme == SchemeRFC2217)
+	if err != nil {
+		return nil, err
+	}
+	return port, nil
+}
+
+// IsNetworkPath checks if the device path is a network address instead of a
+// local device, so it has no sysfs entry and cannot be sniffed or stat'ed.
+func IsNetworkPath(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// ParseNetworkPath splits a network device path into its scheme and host:port
+func ParseNetworkPath(path string) (scheme string, address string, err error) {
+	scheme, address, ok := strings.Cut(path, "://")
+	if !ok {
+		return "", "", fmt.Errorf("%s is not a network device path", path)
+	}
+	if scheme != SchemeTCP && scheme != SchemeRFC2217 {
+		return "", "", fmt.Errorf("unsupported serial transport %q in %s", scheme, path)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid serial server address in %s: %w", path, err)
+	}
+	return scheme, address, nil
+}
@@ -0,0 +1,100 @@
+package simulator
+
+/*
+	audio.go
+
+	Tone generator used as the audio source of a simulated device. It
+	produces a sine wave as interleaved S16_LE PCM, paced in real time like
+	arecord reading from a capture card.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+// ToneGenerator implements usbcapture.AudioSource
+type ToneGenerator struct {
+	Frequency float64 // Tone frequency in Hz
+	Amplitude float64 // Amplitude from 0 to 1
+}
+
+// Open starts a new tone stream with the given audio config
+func (g *ToneGenerator) Open(config *usbcapture.AudioConfig) (io.ReadCloser, error) {
+	if config == nil || config.SampleRate <= 0 || config.Channels <= 0 {
+		return nil, errors.New("invalid audio config")
+	}
+	if config.BytesPerSample != 2 {
+		return nil, errors.New("tone generator only supports 16-bit samples")
+	}
+	frameSize := config.FrameSize
+	if frameSize <= 0 {
+		frameSize = config.SampleRate / 25
+	}
+	return &toneStream{
+		frequency:  g.Frequency,
+		amplitude:  g.Amplitude,
+		sampleRate: config.SampleRate,
+		channels:   config.Channels,
+		frameSize:  frameSize,
+		start:      time.Now(),
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// toneStream is a single stream of the tone generator
+type toneStream struct {
+	frequency  float64
+	amplitude  float64
+	sampleRate int
+	channels   int
+	frameSize  int // Maximum number of samples per channel returned by one Read
+	start      time.Time
+	produced   int64 // Samples per channel produced so far
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// Read fills buf with whole sample frames, blocking until they are due
+func (s *toneStream) Read(buf []byte) (int, error) {
+	bytesPerFrame := 2 * s.channels
+	count := len(buf) / bytesPerFrame
+	if count > s.frameSize {
+		count = s.frameSize
+	}
+	if count == 0 {
+		return 0, io.ErrShortBuffer
+	}
+
+	// Wait until the last requested sample is due
+	due := s.start.Add(time.Duration(s.produced+int64(count)) * time.Second / time.Duration(s.sampleRate))
+	select {
+	case <-s.closed:
+		return 0, io.EOF
+	case <-time.After(time.Until(due)):
+	}
+
+	for i := 0; i < count; i++ {
+		t := float64(s.produced+int64(i)) / float64(s.sampleRate)
+		value := int16(s.amplitude * math.MaxInt16 * math.Sin(2*math.Pi*s.frequency*t))
+		for ch := 0; ch < s.channels; ch++ {
+			binary.LittleEndian.PutUint16(buf[(i*s.channels+ch)*2:], uint16(value))
+		}
+	}
+	s.produced += int64(count)
+	return count * bytesPerFrame, nil
+}
+
+// Close stops the stream, pending and future reads return io.EOF
+func (s *toneStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
@@ -0,0 +1,140 @@
+package simulator
+
+/*
+	auxmcu.go
+
+	Emulated AuxMCU (CH552G) of the DezKVM port module. Commands are single
+	bytes, only queries are answered:
+
+	'u'        -> <len> 0x62 <uuid>   (len includes the 0x62 byte)
+	'a'        -> 0x02 0x61 <status>  (bit 0 PWR LED, bit 1 HDD LED, bit 2 USB on remote side)
+	'y'        -> 0x02 0x63 <side>    (0x00 KVM side, 0x01 remote side)
+	'm' / 'n'  switch USB mass storage to KVM / remote side
+	'p' / 's'  press / release the power button
+	'r' / 'd'  press / release the reset button
+	'0' - '3'  set the status LED pattern
+
+	A virtual target machine is attached to the ATX header: releasing the
+	power button toggles its power state, which drives the PWR LED.
+*/
+
+import (
+	"io"
+	"sync"
+)
+
+// AuxMCUState is the state of the emulated AuxMCU and the virtual target machine
+type AuxMCUState struct {
+	UUID               string `json:"uuid"`
+	MassStorageRemote  bool   `json:"mass_storage_remote"`  // USB mass storage is switched to the remote computer
+	PowerButtonPressed bool   `json:"power_button_pressed"` // Power button is currently held
+	ResetButtonPressed bool   `json:"reset_button_pressed"` // Reset button is currently held
+	PowerPresses       int    `json:"power_presses"`        // Number of power button presses
+	ResetPresses       int    `json:"reset_presses"`        // Number of reset button presses
+	PowerOn            bool   `json:"power_on"`             // Power state of the virtual target machine (PWR LED)
+	HDDActive          bool   `json:"hdd_active"`           // HDD LED of the virtual target machine
+	StatusLED          int    `json:"status_led"`           // Status LED pattern, 0 off, 1 on, 2 slow blink, 3 fast blink
+}
+
+// AuxMCU emulates the AuxMCU on a serial port
+type AuxMCU struct {
+	port  io.ReadWriter
+	mu    sync.Mutex
+	state AuxMCUState
+}
+
+// newAuxMCU creates an emulated AuxMCU with the given UUID and starts serving the port.
+func newAuxMCU(port io.ReadWriter, uuid string) *AuxMCU {
+	a := &AuxMCU{
+		port: port,
+		state: AuxMCUState{
+			UUID:      uuid,
+			PowerOn:   true,
+			StatusLED: 2, // Firmware blinks until the host takes over
+		},
+	}
+	go a.serve()
+	return a
+}
+
+// State returns a snapshot of the AuxMCU state
+func (a *AuxMCU) State() AuxMCUState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// SetHDDActive sets the HDD LED input, as if the target machine accessed its disk
+func (a *AuxMCU) SetHDDActive(active bool) {
+	a.mu.Lock()
+	a.state.HDDActive = active
+	a.mu.Unlock()
+}
+
+// serve reads from the port until it is closed
+func (a *AuxMCU) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, err := a.port.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, b := range buf[:n] {
+			if reply := a.handle(b); reply != nil {
+				a.port.Write(reply)
+			}
+		}
+	}
+}
+
+// handle executes a command byte and returns the reply, if any
+func (a *AuxMCU) handle(cmd byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch cmd {
+	case 'u':
+		return append([]byte{byte(len(a.state.UUID) + 1), 0x62}, a.state.UUID...)
+	case 'a':
+		var status byte
+		if a.state.PowerOn {
+			status |= 0x01
+		}
+		if a.state.HDDActive && a.state.PowerOn {
+			status |= 0x02
+		}
+		if a.state.MassStorageRemote {
+			status |= 0x04
+		}
+		return []byte{0x02, 0x61, status}
+	case 'y':
+		side := byte(0x00)
+		if a.state.MassStorageRemote {
+			side = 0x01
+		}
+		return []byte{0x02, 0x63, side}
+	case 'm':
+		a.state.MassStorageRemote = false
+	case 'n':
+		a.state.MassStorageRemote = true
+	case 'p':
+		if !a.state.PowerButtonPressed {
+			a.state.PowerButtonPressed = true
+			a.state.PowerPresses++
+		}
+	case 's':
+		if a.state.PowerButtonPressed {
+			a.state.PowerButtonPressed = false
+			a.state.PowerOn = !a.state.PowerOn
+		}
+	case 'r':
+		if !a.state.ResetButtonPressed {
+			a.state.ResetButtonPressed = true
+			a.state.ResetPresses++
+		}
+	case 'd':
+		a.state.ResetButtonPressed = false
+	case '0', '1', '2', '3':
+		a.state.StatusLED = int(cmd - '0')
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package simulator
+
+/*
+	ch9329.go
+
+	Software CH9329 UART to USB HID bridge. Packets have the format
+
+	0x57 0xAB <addr> <cmd> <len> <data...> <checksum>
+
+	where the checksum is the sum of all previous bytes. Successful commands
+	are answered with cmd | 0x80 and failed ones with cmd | 0xC0, followed
+	by the reply data (a single status byte for most commands).
+*/
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// CH9329 command codes
+const (
+	ch9329CmdGetInfo         = 0x01
+	ch9329CmdSendKbGeneral   = 0x02
+	ch9329CmdSendKbMedia     = 0x03
+	ch9329CmdSendMsAbs       = 0x04
+	ch9329CmdSendMsRel       = 0x05
+	ch9329CmdSendMyHID       = 0x06
+	ch9329CmdGetParaCfg      = 0x08
+	ch9329CmdSetParaCfg      = 0x09
+	ch9329CmdGetUsbString    = 0x0A
+	ch9329CmdSetUsbString    = 0x0B
+	ch9329CmdSetDefaultCfg   = 0x0C
+	ch9329CmdReset           = 0x0F
+	ch9329StatusSuccess      = 0x00
+	ch9329StatusErrCmd       = 0xE3
+	ch9329StatusErrChecksum  = 0xE4
+	ch9329StatusErrParameter = 0xE5
+)
+
+// HIDState is the state of the virtual keyboard and mouse behind the emulated CH9329
+type HIDState struct {
+	Modifiers    uint8    `json:"modifiers"`     // Modifier key bits of the last keyboard report
+	Keys         [6]uint8 `json:"keys"`          // HID usage codes of the pressed keys
+	MediaKeys    []uint8  `json:"media_keys"`    // Data of the last multimedia key report
+	LEDs         uint8    `json:"leds"`          // Num / Caps / Scroll lock LED bits reported by GET_INFO
+	USBDetached  bool     `json:"usb_detached"`  // The target has not enumerated the chip, e.g. it is powered off
+	MouseButtons uint8    `json:"mouse_buttons"` // Mouse button bits of the last mouse report
+	MouseX       int      `json:"mouse_x"`       // Absolute cursor position, 0 - 4095
+	MouseY       int      `json:"mouse_y"`       // Absolute cursor position, 0 - 4095
+	MouseRelX    int      `json:"mouse_rel_x"`   // Sum of all relative X movements
+	MouseRelY    int      `json:"mouse_rel_y"`   // Sum of all relative Y movements
+	Scroll       int      `json:"scroll"`        // Sum of all wheel movements, positive is up
+	Packets      int      `json:"packets"`       // Number of valid packets received
+	Errors       int      `json:"errors"`        // Number of invalid packets received
+}
+
+// CH9329 emulates a CH9329 chip on a serial port
+type CH9329 struct {
+	port     io.ReadWriter
+	mu       sync.Mutex
+	state    HIDState
+	config   [50]byte      // Parameter configuration returned by GET_PARA_CFG
+	strings  [3]string     // Manufacturer, product and serial number USB strings
+	pending  []byte        // Bytes of the packet being received
+	byteTime time.Duration // Transfer time of a byte on the emulated UART, 0 for none
+	rxDone   time.Time     // When the bytes read so far are received on the emulated UART
+}
+
+// newCH9329 creates an emulated CH9329 configured like a DezKVM port module
+// (mode 2, 115200 baud) and starts serving the port. If baudRate is not 0,
+// the bytes are delayed by their transfer time on a UART with 8N1 framing.
+func newCH9329(port io.ReadWriter, baudRate int) *CH9329 {
+	c := &CH9329{
+		port:  port,
+		state: HIDState{MediaKeys: []uint8{}},
+	}
+	if baudRate > 0 {
+		c.byteTime = 10 * time.Second / time.Duration(baudRate)
+	}
+	c.config[0] = 0x02                                                          // Keyboard + mouse mode
+	c.config[3], c.config[4], c.config[5], c.config[6] = 0x00, 0x01, 0xC2, 0x00 // 115200 baud
+	c.config[10] = 0x03                                                         // Packet interval 3ms
+	c.config[11], c.config[12], c.config[13], c.config[14] = 0x86, 0x1A, 0x29, 0xE1
+	c.strings = [3]string{"imuslab", "DezKVM", ""}
+	go c.serve()
+	return c
+}
+
+// State returns a snapshot of the virtual keyboard and mouse state
+func (c *CH9329) State() HIDState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.state
+	state.MediaKeys = append([]uint8{}, c.state.MediaKeys...)
+	return state
+}
+
+// SetLEDs sets the keyboard LED state reported to the host, as if the
+// target machine toggled Num / Caps / Scroll lock
+func (c *CH9329) SetLEDs(leds uint8) {
+	c.mu.Lock()
+	c.state.LEDs = leds
+	c.mu.Unlock()
+}
+
+// SetUSBEnumerated sets the USB enumeration state reported by GET_INFO, as
+// if the target machine was powered off (false) or booted (true)
+func (c *CH9329) SetUSBEnumerated(enumerated bool) {
+	c.mu.Lock()
+	c.state.USBDetached = !enumerated
+	c.mu.Unlock()
+}
+
+// serve reads from the port until it is closed
+func (c *CH9329) serve() {
+	buf := make([]byte, 256)
+	for {
+		n, err := c.port.Read(buf)
+		if err != nil {
+			return
+		}
+		if c.byteTime > 0 {
+			// The bytes are received one after another at the baudrate
+			c.rxDone = maxTime(c.rxDone, time.Now()).Add(time.Duration(n) * c.byteTime)
+		}
+		for _, b := range buf[:n] {
+			c.feed(b)
+		}
+	}
+}
+
+// feed adds a byte to the packet being received and handles complete packets
+func (c *CH9329) feed(b byte) {
+	c.pending = append(c.pending, b)
+	switch len(c.pending) {
+	case 1:
+		if b != 0x57 {
+			c.pending = c.pending[:0]
+		}
+		return
+	case 2:
+		if b != 0xAB {
+			c.pending = c.pending[:0]
+			if b == 0x57 {
+				c.pending = append(c.pending, b)
+			}
+		}
+		return
+	}
+	if len(c.pending) < 5 || len(c.pending) < 6+int(c.pending[4]) {
+		return
+	}
+
+	packet := c.pending
+	c.pending = nil
+	cmd := packet[3]
+	data := packet[5 : len(packet)-1]
+	if checksum(packet[:len(packet)-1]) != packet[len(packet)-1] {
+		c.mu.Lock()
+		c.state.Errors++
+		c.mu.Unlock()
+		c.reply(cmd|0xC0, []byte{ch9329StatusErrChecksum})
+		return
+	}
+	c.handle(cmd, data)
+}
+
+// handle executes a valid packet and sends the reply
+func (c *CH9329) handle(cmd byte, data []byte) {
+	c.mu.Lock()
+	c.state.Packets++
+	status := byte(ch9329StatusSuccess)
+	var replyData []byte
+	switch cmd {
+	case ch9329CmdGetInfo:
+		enumerated := byte(0x01)
+		if c.state.USBDetached {
+			enumerated = 0x00
+		}
+		replyData = []byte{0x30, enumerated, c.state.LEDs, 0x00, 0x00, 0x00, 0x00, 0x00}
+	case ch9329CmdSendKbGeneral:
+		if len(data) != 8 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		c.state.Modifiers = data[0]
+		copy(c.state.Keys[:], data[2:8])
+	case ch9329CmdSendKbMedia:
+		c.state.MediaKeys = append([]uint8{}, data...)
+	case ch9329CmdSendMsAbs:
+		if len(data) != 7 || data[0] != 0x02 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		c.state.MouseButtons = data[1]
+		c.state.MouseX = int(data[2]) | int(data[3])<<8
+		c.state.MouseY = int(data[4]) | int(data[5])<<8
+		c.state.Scroll += int(int8(data[6]))
+	case ch9329CmdSendMsRel:
+		if len(data) != 5 || data[0] != 0x01 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		c.state.MouseButtons = data[1]
+		c.state.MouseRelX += int(int8(data[2]))
+		c.state.MouseRelY += int(int8(data[3]))
+		c.state.Scroll += int(int8(data[4]))
+	case ch9329CmdGetParaCfg:
+		replyData = append([]byte{}, c.config[:]...)
+	case ch9329CmdSetParaCfg:
+		if len(data) != 50 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		copy(c.config[:], data)
+	case ch9329CmdSetUsbString:
+		if len(data) < 2 || data[0] > 0x02 || len(data) != 2+int(data[1]) || data[1] > 23 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		c.strings[data[0]] = string(data[2:])
+	case ch9329CmdGetUsbString:
+		if len(data) != 1 || data[0] > 0x02 {
+			status = ch9329StatusErrParameter
+			break
+		}
+		value := c.strings[data[0]]
+		replyData = append([]byte{data[0], byte(len(value))}, value...)
+	case ch9329CmdSendMyHID, ch9329CmdSetDefaultCfg:
+		// Accepted but has no effect on the virtual devices
+	case ch9329CmdReset:
+		c.state.Modifiers = 0
+		c.state.Keys = [6]uint8{}
+		c.state.MouseButtons = 0
+	default:
+		status = ch9329StatusErrCmd
+	}
+	if status != ch9329StatusSuccess {
+		c.state.Errors++
+	}
+	c.mu.Unlock()
+
+	if status != ch9329StatusSuccess {
+		c.reply(cmd|0xC0, []byte{status})
+		return
+	}
+	if replyData == nil {
+		replyData = []byte{status}
+	}
+	c.reply(cmd|0x80, replyData)
+}
+
+// reply writes a reply packet to the port
+func (c *CH9329) reply(cmd byte, data []byte) {
+	packet := append([]byte{0x57, 0xAB, 0x00, cmd, byte(len(data))}, data...)
+	packet = append(packet, checksum(packet))
+	if c.byteTime > 0 {
+		// Sleep once, short sleeps per byte take much longer than a byte
+		time.Sleep(time.Until(c.rxDone.Add(time.Duration(len(packet)) * c.byteTime)))
+	}
+	c.port.Write(packet)
+}
+
+// maxTime returns the later of two times
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// checksum returns the sum of all bytes
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
@@ -0,0 +1,115 @@
+package simulator
+
+/*
+	DezKVM Hardware Simulator
+
+	Emulates a DezKVM port module for development and CI without the
+	physical hardware. Each simulated device provides
+
+	- a CH9329 HID bridge and an AuxMCU on pseudo terminals, speaking the
+	  real byte protocols so the kvmhid and kvmaux drivers are used as-is
+	- a synthetic MJPEG video source (color bars with a clock, or a looped
+	  JPEG sequence)
+	- a sine tone generator for audio
+*/
+
+import (
+	"fmt"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/serial"
+)
+
+// Options configures a simulated device
+type Options struct {
+	Index         int     // Device number, used in the UUID and the video overlay
+	FramesDir     string  // Optional folder of JPEG files to loop instead of the test pattern
+	ToneFrequency float64 // Frequency of the audio tone in Hz, defaults to 440
+	HIDBaudRate   int     // Emulate the UART transfer time of the CH9329 at this baudrate, 0 for none
+}
+
+// Device is a simulated DezKVM port module
+type Device struct {
+	Index  int
+	UUID   string
+	CH9329 *CH9329
+	AuxMCU *AuxMCU
+	Video  *VideoSource
+	Audio  *ToneGenerator
+
+	hidPort *serial.Pty
+	auxPort *serial.Pty
+}
+
+// DeviceState is the queryable state of a simulated device
+type DeviceState struct {
+	Index  int         `json:"index"`
+	UUID   string      `json:"uuid"`
+	HID    HIDState    `json:"hid"`
+	AuxMCU AuxMCUState `json:"aux_mcu"`
+}
+
+// NewDevice creates a simulated device and starts its emulated chips
+func NewDevice(option *Options) (*Device, error) {
+	if option == nil {
+		option = &Options{}
+	}
+	frequency := option.ToneFrequency
+	if frequency <= 0 {
+		frequency = 440
+	}
+
+	video, err := newVideoSource(option.Index, option.FramesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	hidPort, err := serial.OpenPty()
+	if err != nil {
+		return nil, err
+	}
+	auxPort, err := serial.OpenPty()
+	if err != nil {
+		hidPort.Close()
+		return nil, err
+	}
+
+	// Category 1 (KVM port), type 1 (form factor 1), like the real AuxMCU
+	uuid := fmt.Sprintf("11%06d-0000-4000-8000-53494d554c41", option.Index)
+	return &Device{
+		Index:   option.Index,
+		UUID:    uuid,
+		CH9329:  newCH9329(hidPort, option.HIDBaudRate),
+		AuxMCU:  newAuxMCU(auxPort, uuid),
+		Video:   video,
+		Audio:   &ToneGenerator{Frequency: frequency, Amplitude: 0.2},
+		hidPort: hidPort,
+		auxPort: auxPort,
+	}, nil
+}
+
+// HIDDevicePath returns the serial port of the emulated CH9329
+func (d *Device) HIDDevicePath() string {
+	return d.hidPort.Path()
+}
+
+// AuxMCUDevicePath returns the serial port of the emulated AuxMCU
+func (d *Device) AuxMCUDevicePath() string {
+	return d.auxPort.Path()
+}
+
+// State returns a snapshot of the device state
+func (d *Device) State() DeviceState {
+	return DeviceState{
+		Index:  d.Index,
+		UUID:   d.UUID,
+		HID:    d.CH9329.State(),
+		AuxMCU: d.AuxMCU.State(),
+	}
+}
+
+// Close stops the video source and closes the emulated serial ports
+func (d *Device) Close() error {
+	d.Video.Stop()
+	d.auxPort.Close()
+	return d.hidPort.Close()
+}
@@ -0,0 +1,297 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmaux"
+	"imuslab.com/dezkvm/dezkvmd/mod/kvmhid"
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+func newTestDevice(t *testing.T) *Device {
+	t.Helper()
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo terminals not available")
+	}
+	dev, err := NewDevice(&Options{Index: 3})
+	if err != nil {
+		t.Fatalf("NewDevice: %v", err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+// waitFor polls cond until it returns true or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCH9329WithHIDController(t *testing.T) {
+	dev := newTestDevice(t)
+	controller := kvmhid.NewHIDController(&kvmhid.Config{
+		PortName:          dev.HIDDevicePath(),
+		BaudRate:          115200,
+		ScrollSensitivity: 0x01,
+	})
+	if err := controller.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer controller.Close()
+
+	cfg, err := controller.GetChipCurrentConfiguration()
+	if err != nil {
+		t.Fatalf("GetChipCurrentConfiguration: %v", err)
+	}
+	if cfg[0] != 0x02 {
+		t.Errorf("chip mode = 0x%02x, want 0x02", cfg[0])
+	}
+
+	// JavaScript keycode 65 is the A key, HID usage 0x04
+	if _, err := controller.SendKeyboardPress(65); err != nil {
+		t.Fatalf("SendKeyboardPress: %v", err)
+	}
+	waitFor(t, "key press", func() bool { return dev.CH9329.State().Keys[0] == 0x04 })
+	if _, err := controller.SendKeyboardRelease(65); err != nil {
+		t.Fatalf("SendKeyboardRelease: %v", err)
+	}
+	waitFor(t, "key release", func() bool { return dev.CH9329.State().Keys[0] == 0x00 })
+
+	if _, err := controller.MouseMoveAbsolute(0x34, 0x02, 0x00, 0x01); err != nil {
+		t.Fatalf("MouseMoveAbsolute: %v", err)
+	}
+	waitFor(t, "mouse move", func() bool {
+		state := dev.CH9329.State()
+		return state.MouseX == 0x0234 && state.MouseY == 0x0100
+	})
+
+	if state := dev.CH9329.State(); state.Errors != 0 {
+		t.Errorf("emulated CH9329 reported %d invalid packets", state.Errors)
+	}
+}
+
+func TestAuxMCUWithAuxController(t *testing.T) {
+	dev := newTestDevice(t)
+	aux, err := kvmaux.NewAuxOutbandController(dev.AuxMCUDevicePath(), 115200)
+	if err != nil {
+		t.Fatalf("NewAuxOutbandController: %v", err)
+	}
+	defer aux.Close()
+
+	uuid, err := aux.GetUUID()
+	if err != nil {
+		t.Fatalf("GetUUID: %v", err)
+	}
+	if uuid != dev.UUID {
+		t.Errorf("GetUUID = %q, want %q", uuid, dev.UUID)
+	}
+
+	if err := aux.SwitchUSBToRemote(); err != nil {
+		t.Fatalf("SwitchUSBToRemote: %v", err)
+	}
+	if side := aux.GetUSBMassStorageSide(); side != kvmaux.USB_MASS_STORAGE_REMOTE {
+		t.Errorf("GetUSBMassStorageSide = %v, want remote", side)
+	}
+
+	// A power button click turns the virtual target machine off
+	aux.PressPowerButton()
+	aux.ReleasePowerButton()
+	if err := aux.GetATXState(); err != nil {
+		t.Fatalf("GetATXState: %v", err)
+	}
+	if aux.GetPowerLEDState() {
+		t.Error("power LED still on after power button click")
+	}
+	state := dev.AuxMCU.State()
+	if state.PowerPresses != 1 || state.PowerOn || !state.MassStorageRemote {
+		t.Errorf("unexpected AuxMCU state %+v", state)
+	}
+}
+
+// serveTCP accepts one connection on a local port and serves it with serve,
+// like ser2net in raw mode on another box
+func serveTCP(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		serve(conn)
+	}()
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestNetworkTransport(t *testing.T) {
+	var chip *CH9329
+	chipReady := make(chan struct{})
+	hidPath := serveTCP(t, func(conn net.Conn) {
+		chip = newCH9329(conn, 0)
+		close(chipReady)
+	})
+	auxPath := serveTCP(t, func(conn net.Conn) { newAuxMCU(conn, "110000042") })
+
+	controller := kvmhid.NewHIDController(&kvmhid.Config{PortName: hidPath, BaudRate: 115200})
+	if err := controller.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer controller.Close()
+	<-chipReady
+	if _, err := controller.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyPress, Code: "KeyB"}); err != nil {
+		t.Fatalf("press KeyB: %v", err)
+	}
+	if keys := chip.State().Keys; keys[0] != 0x05 {
+		t.Errorf("keys = %v, want KeyB", keys)
+	}
+
+	aux, err := kvmaux.NewAuxOutbandController(auxPath, 115200)
+	if err != nil {
+		t.Fatalf("NewAuxOutbandController: %v", err)
+	}
+	defer aux.Close()
+	if uuid, err := aux.GetUUID(); err != nil || uuid != "110000042" {
+		t.Errorf("GetUUID = %q, %v", uuid, err)
+	}
+}
+
+func TestVideoSource(t *testing.T) {
+	video, err := newVideoSource(1, "")
+	if err != nil {
+		t.Fatalf("newVideoSource: %v", err)
+	}
+	frames, err := video.Start(&usbcapture.CaptureResolution{Width: 640, Height: 480, FPS: 30})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	select {
+	case frame := <-frames:
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("frame is not a valid JPEG: %v", err)
+		}
+		if img.Bounds().Dx() != 640 || img.Bounds().Dy() != 480 {
+			t.Errorf("frame size = %v, want 640x480", img.Bounds().Size())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame received")
+	}
+	video.Stop()
+	for range frames {
+	}
+}
+
+func TestToneGenerator(t *testing.T) {
+	tone := &ToneGenerator{Frequency: 440, Amplitude: 0.5}
+	stream, err := tone.Open(usbcapture.GetDefaultAudioConfig())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	buf := make([]byte, 4096)
+	n, err := stream.Read(buf)
+	if err != nil || n == 0 || n%4 != 0 {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	stream.Close()
+	if _, err := stream.Read(buf); err != io.EOF {
+		t.Errorf("Read after Close = %v, want io.EOF", err)
+	}
+}
+
+// newBenchmarkController connects a controller to a simulated device with
+// the UART timing of the real chip at 115200 baud
+func newBenchmarkController(b *testing.B, maxInFlight int) (*kvmhid.Controller, *kvmhid.CH9329Backend) {
+	b.Helper()
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		b.Skip("pseudo terminals not available")
+	}
+	dev, err := NewDevice(&Options{HIDBaudRate: 115200})
+	if err != nil {
+		b.Fatalf("NewDevice: %v", err)
+	}
+	b.Cleanup(func() { dev.Close() })
+	controller := kvmhid.NewHIDController(&kvmhid.Config{PortName: dev.HIDDevicePath(), BaudRate: 115200})
+	backend := controller.Backend().(*kvmhid.CH9329Backend)
+	backend.MaxInFlight = maxInFlight
+	if err := controller.Connect(); err != nil {
+		b.Fatalf("Connect: %v", err)
+	}
+	b.Cleanup(controller.Close)
+	return controller, backend
+}
+
+// reportLatency adds the latency statistics of the pipeline to the benchmark result
+func reportLatency(b *testing.B, backend *kvmhid.CH9329Backend) {
+	stats := backend.PipelineStats()
+	b.ReportMetric(float64(stats.LatencyP50), "p50-us")
+	b.ReportMetric(float64(stats.LatencyP99), "p99-us")
+	b.ReportMetric(float64(stats.Sent)/float64(b.N), "sent/op")
+	b.ReportMetric(float64(stats.QueueDelayAvg), "queue-us")
+	if stats.Errors > 0 || stats.Timeouts > 0 {
+		b.Errorf("pipeline errors: %+v", stats)
+	}
+}
+
+// BenchmarkCH9329KeyPress measures the round trip of keyboard reports, which
+// wait for the reply of the chip
+func BenchmarkCH9329KeyPress(b *testing.B) {
+	controller, backend := newBenchmarkController(b, kvmhid.DefaultCH9329InFlight)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := controller.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyPress, Code: "KeyA"}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := controller.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyRelease, Code: "KeyA"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	reportLatency(b, backend)
+}
+
+// BenchmarkCH9329MouseMove sends absolute mouse moves like a 1000 Hz mouse,
+// faster than the chip takes them at 115200 baud, and waits for the chip to
+// catch up at the end. sent/op shows how many moves reached the chip.
+func BenchmarkCH9329MouseMove(b *testing.B) {
+	for _, maxInFlight := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("inflight=%d", maxInFlight), func(b *testing.B) {
+			controller, backend := newBenchmarkController(b, maxInFlight)
+			ticker := time.NewTicker(time.Millisecond)
+			defer ticker.Stop()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				<-ticker.C
+				if _, err := controller.ConstructAndSendCmd(&kvmhid.HIDCommand{
+					Event:     kvmhid.EventTypeMouseMove,
+					MouseAbsX: 1 + i%4000,
+					MouseAbsY: 1 + i%3000,
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := backend.Sync(5 * time.Second); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			reportLatency(b, backend)
+		})
+	}
+}
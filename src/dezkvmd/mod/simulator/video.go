@@ -0,0 +1,254 @@
+package simulator
+
+/*
+	video.go
+
+	Synthetic MJPEG video source. By default it renders color bars with the
+	device number and a clock, re-encoded once per second so many simulated
+	devices can run on a laptop. If a folder of JPEG files is given, the
+	files are looped in name order instead, at whatever size they are.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
+)
+
+// VideoSource implements usbcapture.VideoSource
+type VideoSource struct {
+	name     string
+	index    int
+	sequence [][]byte // Looped JPEG sequence, empty for the test pattern
+
+	mu       sync.Mutex
+	running  bool
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+// newVideoSource creates a video source. If framesDir is not empty, the JPEG
+// files in it are used instead of the test pattern.
+func newVideoSource(index int, framesDir string) (*VideoSource, error) {
+	v := &VideoSource{
+		name:  fmt.Sprintf("DezKVM Simulator %d", index),
+		index: index,
+	}
+	if framesDir == "" {
+		return v, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(framesDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file))
+		if ext != ".jpg" && ext != ".jpeg" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		v.sequence = append(v.sequence, data)
+	}
+	if len(v.sequence) == 0 {
+		return nil, fmt.Errorf("no JPEG files found in %s", framesDir)
+	}
+	return v, nil
+}
+
+// Name returns the name shown in the stream info
+func (v *VideoSource) Name() string {
+	return v.name
+}
+
+// SupportedResolutions returns the resolutions of a typical MS2109 capture card
+func (v *VideoSource) SupportedResolutions() []usbcapture.FormatInfo {
+	fps := []int{30, 25, 20, 15, 10}
+	return []usbcapture.FormatInfo{
+		{
+			Format: "MJPG",
+			Sizes: []usbcapture.SizeInfo{
+				{Width: 640, Height: 480, FPS: fps},
+				{Width: 1280, Height: 720, FPS: fps},
+				{Width: 1920, Height: 1080, FPS: fps},
+			},
+		},
+	}
+}
+
+// Start starts producing frames. The channel is closed when Stop is called.
+func (v *VideoSource) Start(resolution *usbcapture.CaptureResolution) (<-chan []byte, error) {
+	if resolution == nil || resolution.Width <= 0 || resolution.Height <= 0 || resolution.FPS <= 0 {
+		return nil, errors.New("invalid resolution")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.running {
+		return nil, errors.New("video source already started")
+	}
+	frames := make(chan []byte, 2)
+	v.stopChan = make(chan struct{})
+	v.done = make(chan struct{})
+	v.running = true
+	go v.produce(frames, *resolution, v.stopChan, v.done)
+	return frames, nil
+}
+
+// Stop stops producing frames and waits for the producer to exit
+func (v *VideoSource) Stop() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.running {
+		return nil
+	}
+	close(v.stopChan)
+	<-v.done
+	v.running = false
+	return nil
+}
+
+// produce sends frames at the requested frame rate. Like a real capture
+// device, frames are dropped if the consumer does not keep up.
+func (v *VideoSource) produce(frames chan []byte, resolution usbcapture.CaptureResolution, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer close(frames)
+
+	ticker := time.NewTicker(time.Second / time.Duration(resolution.FPS))
+	defer ticker.Stop()
+
+	var frame []byte
+	var renderedAt int64 = -1
+	count := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if len(v.sequence) > 0 {
+				frame = v.sequence[count%len(v.sequence)]
+			} else if now.Unix() != renderedAt {
+				rendered, err := renderTestPattern(resolution.Width, resolution.Height, v.index, now)
+				if err != nil {
+					continue
+				}
+				frame = rendered
+				renderedAt = now.Unix()
+			}
+			count++
+			select {
+			case frames <- frame:
+			default:
+			}
+		}
+	}
+}
+
+// Colors of the SMPTE-like color bars
+var testPatternBars = []color.RGBA{
+	{192, 192, 192, 255},
+	{192, 192, 0, 255},
+	{0, 192, 192, 255},
+	{0, 192, 0, 255},
+	{192, 0, 192, 255},
+	{192, 0, 0, 255},
+	{0, 0, 192, 255},
+}
+
+// renderTestPattern renders color bars with the device number and the time as JPEG
+func renderTestPattern(width int, height int, index int, now time.Time) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	barHeight := height * 2 / 3
+	for i, c := range testPatternBars {
+		x0 := width * i / len(testPatternBars)
+		x1 := width * (i + 1) / len(testPatternBars)
+		draw.Draw(img, image.Rect(x0, 0, x1, barHeight), &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+	draw.Draw(img, image.Rect(0, barHeight, width, height), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+
+	// Device number on the left, clock on the right
+	digitHeight := (height - barHeight) * 2 / 3
+	y := barHeight + (height-barHeight-digitHeight)/2
+	margin := digitHeight / 2
+	drawSevenSegment(img, fmt.Sprintf("%d", index), margin, y, digitHeight)
+	clock := now.Format("15:04:05")
+	drawSevenSegment(img, clock, width-margin-sevenSegmentWidth(clock, digitHeight), y, digitHeight)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Segments of each digit, bit 0 to 6 are segment a to g
+var sevenSegmentDigits = [10]uint8{0x3F, 0x06, 0x5B, 0x4F, 0x66, 0x6D, 0x7D, 0x07, 0x7F, 0x6F}
+
+// sevenSegmentWidth returns the width of a string drawn by drawSevenSegment
+func sevenSegmentWidth(text string, height int) int {
+	width := 0
+	for _, ch := range text {
+		if ch == ':' {
+			width += height / 4
+		} else {
+			width += height/2 + height/6
+		}
+	}
+	return width
+}
+
+// drawSevenSegment draws digits and colons in white at the given position
+func drawSevenSegment(img *image.RGBA, text string, x int, y int, height int) {
+	white := &image.Uniform{color.White}
+	fill := func(x0, y0, x1, y1 int) {
+		draw.Draw(img, image.Rect(x+x0, y+y0, x+x1, y+y1), white, image.Point{}, draw.Src)
+	}
+	w := height / 2
+	t := height / 10
+	if t < 1 {
+		t = 1
+	}
+	for _, ch := range text {
+		if ch == ':' {
+			fill(height/12, height/4, height/12+t, height/4+t)
+			fill(height/12, height*3/4-t, height/12+t, height*3/4)
+			x += height / 4
+			continue
+		}
+		if ch < '0' || ch > '9' {
+			x += w + height/6
+			continue
+		}
+		segments := sevenSegmentDigits[ch-'0']
+		rects := [7][4]int{
+			{t, 0, w - t, t},                               // a
+			{w - t, t, w, height / 2},                      // b
+			{w - t, height / 2, w, height - t},             // c
+			{t, height - t, w - t, height},                 // d
+			{0, height / 2, t, height - t},                 // e
+			{0, t, t, height / 2},                          // f
+			{t, height/2 - t/2, w - t, height/2 + t/2 + 1}, // g
+		}
+		for i, r := range rects {
+			if segments&(1<<i) != 0 {
+				fill(r[0], r[1], r[2], r[3])
+			}
+		}
+		x += w + height/6
+	}
+}
@@ -3,12 +3,14 @@ package usbcapture
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -134,10 +136,10 @@ func (i *Instance) AudioStreamingHandler(w http.ResponseWriter, r *http.Request,
 	}
 	defer conn.Close()
 
-	if alsa_device_occupied(i.Config.AudioDeviceName) {
-		//Another instance already running
-		log.Println("Audio pipe already running, stopping previous instance")
-		i.audiostopchan <- true
+	// Only one audio stream per instance, stop the previous one first
+	i.StopAudioStreaming()
+	if i.Config.AudioSource == nil && alsa_device_occupied(i.Config.AudioDeviceName) {
+		//The device may take a moment to be released after arecord exits
 		retryCounter := 0
 		for alsa_device_occupied(i.Config.AudioDeviceName) {
 			time.Sleep(500 * time.Millisecond) //Wait a bit for the previous instance to stop
@@ -149,54 +151,30 @@ func (i *Instance) AudioStreamingHandler(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
-	pcmdev := devicePath
-	if pcmdev == "" {
-		//Try finding the HDMI capture card automatically
-		pcmdev, err = FindHDMICapturePCMPath()
-		if err != nil {
-			log.Println("Failed to find HDMI capture PCM path:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	log.Println("Found HDMI capture PCM path:", pcmdev)
-
-	// Convert PCM device to hardware device name
-	hwdev, err := pcmDeviceToHW(pcmdev)
+	stream, err := i.openAudioStream(devicePath)
 	if err != nil {
-		log.Println("Failed to convert PCM device to hardware device:", err)
+		log.Println("Failed to open audio stream:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Println("Using hardware device:", hwdev)
-
-	// Create a buffered reader to read audio data
-	log.Println("Starting audio pipe with arecord...")
-
-	// Start arecord with 48kHz, 16-bit, stereo
-	cmd := exec.Command("arecord",
-		"-f", "S16_LE", // Format: 16-bit little-endian
-		"-r", fmt.Sprint(i.Config.AudioConfig.SampleRate),
-		"-c", fmt.Sprint(i.Config.AudioConfig.Channels),
-		"-D", hwdev, // Use the hardware device
-	)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Println("Failed to get arecord stdout pipe:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	session := &audioSession{
+		stream: stream,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
 	}
-
-	if err := cmd.Start(); err != nil {
-		log.Println("Failed to start arecord:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	i.audioMu.Lock()
+	if i.audioSession != nil {
+		// Another client started streaming in the meantime
+		i.audioMu.Unlock()
+		stream.Close()
+		log.Println("Audio pipe already running, rejecting new client")
 		return
 	}
+	i.audioSession = session
+	i.audioMu.Unlock()
 
-	reader := bufio.NewReader(stdout)
+	reader := bufio.NewReader(stream)
 	bufferSize := i.Config.AudioConfig.FrameSize * i.Config.AudioConfig.Channels * i.Config.AudioConfig.BytesPerSample
 	log.Printf("Buffer size: %d bytes (FrameSize: %d, Channels: %d, BytesPerSample: %d)",
 		bufferSize, i.Config.AudioConfig.FrameSize, i.Config.AudioConfig.Channels, i.Config.AudioConfig.BytesPerSample)
@@ -209,26 +187,22 @@ func (i *Instance) AudioStreamingHandler(w http.ResponseWriter, r *http.Request,
 		if err == nil {
 			if string(msg) == "exit" {
 				log.Println("Received exit command from client")
-				i.audiostopchan <- true // Signal to stop the audio pipe
+				session.Stop() // Signal to stop the audio pipe
 				return
 			}
 		}
 	}()
 
 	log.Println("Starting audio capture loop...")
-	i.isAudioStreaming = true
 	for {
 		select {
-		case <-i.audiostopchan:
+		case <-session.stop:
 			log.Println("Audio pipe stopped")
 			goto DONE
 		default:
 			n, err := reader.Read(buf)
 			if err != nil {
 				log.Println("Read error:", err)
-				if i.audiostopchan != nil {
-					i.audiostopchan <- true // Signal to stop the audio pipe
-				}
 				goto DONE
 			}
 
@@ -262,34 +236,107 @@ func (i *Instance) AudioStreamingHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 DONE:
-	i.isAudioStreaming = false
-	cmd.Process.Kill()
+	session.Stop()
+	i.audioMu.Lock()
+	if i.audioSession == session {
+		i.audioSession = nil
+	}
+	i.audioMu.Unlock()
+	close(session.done)
 	log.Println("Audio pipe finished")
 }
 
-// StopAudioStreaming stops the audio streaming by sending a stop signal to the audio capture loop
-func (i *Instance) StopAudioStreaming() {
-	if !i.isAudioStreaming {
-		return // Already stopped or not started
+// audioSession is a running audio stream of an instance
+type audioSession struct {
+	stream   io.ReadCloser
+	stop     chan struct{} // Closed to stop the capture loop
+	stopOnce sync.Once
+	done     chan struct{} // Closed when the capture loop has exited
+}
+
+// Stop signals the capture loop to exit. The stream is closed as well, so a
+// capture loop blocked on reading returns immediately.
+func (s *audioSession) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.stream.Close()
+	})
+}
+
+// arecordStream is the stdout of an arecord process, closing it kills the process
+type arecordStream struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (s *arecordStream) Close() error {
+	s.cmd.Process.Kill()
+	return s.cmd.Wait()
+}
+
+// openAudioStream opens the raw PCM stream of the instance, either from the
+// configured audio source or by starting arecord on the capture device
+func (i *Instance) openAudioStream(devicePath string) (io.ReadCloser, error) {
+	if i.Config.AudioSource != nil {
+		return i.Config.AudioSource.Open(i.Config.AudioConfig)
 	}
 
-	// Send stop signal to the audio capture loop
-	select {
-	case i.audiostopchan <- true:
-		log.Println("Sent stop signal to audio streaming")
-	default:
-		// Channel might be full or already stopped
-		log.Println("Audio streaming already stopping or stopped")
+	pcmdev := devicePath
+	if pcmdev == "" {
+		//Try finding the HDMI capture card automatically
+		var err error
+		pcmdev, err = FindHDMICapturePCMPath()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find HDMI capture PCM path: %w", err)
+		}
 	}
 
-	// Wait for audio streaming to actually stop
-	maxWait := 10
-	for i.isAudioStreaming && maxWait > 0 {
-		time.Sleep(100 * time.Millisecond)
-		maxWait--
+	log.Println("Found HDMI capture PCM path:", pcmdev)
+
+	// Convert PCM device to hardware device name
+	hwdev, err := pcmDeviceToHW(pcmdev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert PCM device to hardware device: %w", err)
 	}
 
-	if i.isAudioStreaming {
+	log.Println("Using hardware device:", hwdev)
+	log.Println("Starting audio pipe with arecord...")
+
+	// Start arecord with 48kHz, 16-bit, stereo
+	cmd := exec.Command("arecord",
+		"-f", "S16_LE", // Format: 16-bit little-endian
+		"-r", fmt.Sprint(i.Config.AudioConfig.SampleRate),
+		"-c", fmt.Sprint(i.Config.AudioConfig.Channels),
+		"-D", hwdev, // Use the hardware device
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get arecord stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start arecord: %w", err)
+	}
+	return &arecordStream{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// StopAudioStreaming stops the audio streaming and waits for the capture loop to exit
+func (i *Instance) StopAudioStreaming() {
+	i.audioMu.Lock()
+	session := i.audioSession
+	i.audioMu.Unlock()
+	if session == nil {
+		return // Already stopped or not started
+	}
+
+	log.Println("Sent stop signal to audio streaming")
+	session.Stop()
+
+	// Wait for audio streaming to actually stop
+	select {
+	case <-session.done:
+	case <-time.After(1 * time.Second):
 		log.Println("Warning: Audio streaming did not stop in time")
 	}
 }
@@ -2,6 +2,8 @@ package usbcapture
 
 import (
 	"context"
+	"io"
+	"sync"
 
 	"github.com/vladimirvivien/go4vl/device"
 	"github.com/vladimirvivien/go4vl/v4l2"
@@ -12,6 +14,7 @@ type CaptureResolution struct {
 	Width  int
 	Height int
 	FPS    int
+	Format string // Pixel format as FourCC, e.g. MJPG. Empty means MJPEG
 }
 
 type AudioConfig struct {
@@ -26,21 +29,40 @@ type VideoConfig struct {
 	Profile string // H264 profile, e.g., 480p, 720p, 1080p
 }
 
+// VideoSource produces MJPEG frames in place of a V4L2 capture device,
+// e.g. the synthetic video source of the hardware simulator
+type VideoSource interface {
+	Name() string                                               // Name shown in the stream info
+	SupportedResolutions() []FormatInfo                         // Resolutions the source can produce
+	Start(resolution *CaptureResolution) (<-chan []byte, error) // Start producing frames at the given resolution
+	Stop() error                                                // Stop producing frames and close the frame channel
+}
+
+// AudioSource produces raw S16_LE PCM data in place of arecord
+type AudioSource interface {
+	Open(config *AudioConfig) (io.ReadCloser, error)
+}
+
 type Config struct {
 	VideoDeviceName string       // The video device name, e.g., /dev/video0
 	AudioDeviceName string       // The audio device name, e.g., /dev/snd
 	AudioConfig     *AudioConfig // The audio configuration
 	VideoConfig     *VideoConfig // The video configuration
+	VideoSource     VideoSource  // Optional, use this source instead of opening VideoDeviceName
+	AudioSource     AudioSource  // Optional, use this source instead of capturing from AudioDeviceName
 }
 
 type Instance struct {
 	/* Runtime configuration */
 	Config               *Config
 	SupportedResolutions []FormatInfo //The supported resolutions of the video device
-	Capturing            bool
 
 	/* Internals */
+	videoMu sync.Mutex   // Serialize starting and stopping the video capture, guards camera and cameraStartContext
+	stateMu sync.RWMutex // Protect the capture state below, which is read by the stream handlers
+
 	/* Video capture device */
+	capturing          bool
 	camera             *device.Device
 	cameraStartContext context.CancelFunc
 	frames_buff        <-chan []byte
@@ -51,10 +73,10 @@ type Instance struct {
 	streamInfo         string
 
 	/* audio capture device */
-	isAudioStreaming bool      // Whether audio is currently being captured
-	audiostopchan    chan bool // Channel to stop audio capture
+	audioMu      sync.Mutex    // Protect audioSession
+	audioSession *audioSession // Running audio stream, nil if audio is not being captured
 
 	/* Concurrent access */
-	accessCount       int       // The number of current access, in theory each instance should at most have 1 access
-	videoTakeoverChan chan bool // Channel to signal video takeover request
+	accessCount int           // The number of current access, in theory each instance should at most have 1 access
+	videoClient chan struct{} // Closed to signal the current video client that another client takes over
 }
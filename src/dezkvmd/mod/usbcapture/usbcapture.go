@@ -12,27 +12,16 @@ func NewInstance(config *Config) (*Instance, error) {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 
-	//Check if the video device exists
-	if _, err := os.Stat(config.VideoDeviceName); os.IsNotExist(err) {
-		return nil, fmt.Errorf("video device %s does not exist", config.VideoDeviceName)
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to check video device: %w", err)
-	}
-
-	//Check if the device file actualy points to a video device
-	isValidDevice, err := CheckVideoCaptureDevice(config.VideoDeviceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check video device: %w", err)
-	}
-
-	if !isValidDevice {
-		return nil, fmt.Errorf("device %s is not a video capture device", config.VideoDeviceName)
-	}
-
-	//Get the supported resolutions of the video device
-	formatInfo, err := GetV4L2FormatInfo(config.VideoDeviceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get video device format info: %w", err)
+	var formatInfo []FormatInfo
+	if config.VideoSource != nil {
+		// Synthetic sources do not have a device node to check
+		formatInfo = config.VideoSource.SupportedResolutions()
+	} else {
+		var err error
+		formatInfo, err = checkVideoDevice(config.VideoDeviceName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(formatInfo) == 0 {
@@ -41,49 +30,79 @@ func NewInstance(config *Config) (*Instance, error) {
 
 	return &Instance{
 		Config:               config,
-		Capturing:            false,
 		SupportedResolutions: formatInfo,
 
 		// Videos
+		capturing:  false,
 		camera:     nil,
 		pixfmt:     0,
 		width:      0,
 		height:     0,
 		streamInfo: "",
 
-		//Audio
-		audiostopchan: make(chan bool, 1),
-
 		// Access control
-		videoTakeoverChan: make(chan bool, 1),
-		accessCount:       0,
+		accessCount: 0,
 	}, nil
 }
 
+// checkVideoDevice checks that the device node is a video capture device and
+// returns its supported formats
+func checkVideoDevice(devicePath string) ([]FormatInfo, error) {
+	//Check if the video device exists
+	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("video device %s does not exist", devicePath)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check video device: %w", err)
+	}
+
+	//Check if the device file actualy points to a video device
+	isValidDevice, err := CheckVideoCaptureDevice(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check video device: %w", err)
+	}
+
+	if !isValidDevice {
+		return nil, fmt.Errorf("device %s is not a video capture device", devicePath)
+	}
+
+	//Get the supported resolutions of the video device
+	formatInfo, err := GetV4L2FormatInfo(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get video device format info: %w", err)
+	}
+	return formatInfo, nil
+}
+
 // GetStreamInfo returns the stream information string
 func (i *Instance) GetStreamInfo() string {
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
 	return i.streamInfo
 }
 
 // IsCapturing checks if the camera is currently capturing video
 func (i *Instance) IsCapturing() bool {
-	return i.Capturing
+	i.stateMu.RLock()
+	defer i.stateMu.RUnlock()
+	return i.capturing
 }
 
 // IsAudioStreaming checks if the audio is currently being captured
 func (i *Instance) IsAudioStreaming() bool {
-	return i.isAudioStreaming
+	i.audioMu.Lock()
+	defer i.audioMu.Unlock()
+	return i.audioSession != nil
 }
 
 // Close closes the camera device and releases resources
 func (i *Instance) Close() error {
-	if i.camera != nil {
-		i.StopVideoCapture()
+	i.videoMu.Lock()
+	if i.camera != nil || i.IsCapturing() {
+		i.stopVideoCapture()
 	}
+	i.videoMu.Unlock()
 
-	if i.isAudioStreaming {
-		i.StopAudioStreaming()
-	}
+	i.StopAudioStreaming()
 	return nil
 }
 
@@ -124,7 +143,7 @@ func (i *Instance) ChangeResolution(newResolution *CaptureResolution) error {
 	}
 
 	// Validate that the new resolution is supported
-	resolutionIsSupported, err := deviceSupportResolution(i.Config.VideoDeviceName, newResolution)
+	resolutionIsSupported, err := i.supportsResolution(newResolution)
 	if err != nil {
 		return fmt.Errorf("failed to validate resolution: %w", err)
 	}
@@ -133,13 +152,16 @@ func (i *Instance) ChangeResolution(newResolution *CaptureResolution) error {
 			newResolution.Width, newResolution.Height, newResolution.FPS)
 	}
 
+	// Hold the video lock so no other start, stop or screenshot can
+	// interleave with the resolution change
+	i.videoMu.Lock()
+	defer i.videoMu.Unlock()
+
 	// Stop the audio streaming if active
-	if i.isAudioStreaming {
-		i.StopAudioStreaming()
-	}
+	i.StopAudioStreaming()
 
 	// Stop the current capture
-	err = i.StopVideoCapture()
+	err = i.stopVideoCapture()
 	if err != nil {
 		return fmt.Errorf("failed to stop capture: %w", err)
 	}
@@ -149,7 +171,7 @@ func (i *Instance) ChangeResolution(newResolution *CaptureResolution) error {
 
 	// Start capture with the new resolution, retry up to 3 times
 	for attempt := 0; attempt < 3; attempt++ {
-		err = i.StartVideoCapture(newResolution)
+		err = i.startVideoCapture(newResolution)
 		if err == nil {
 			break
 		}
@@ -1,7 +1,6 @@
 package usbcapture
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
@@ -13,9 +12,6 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
-	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -57,23 +53,39 @@ var endOfStreamJPG []byte
 
 // start video capture
 func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) error {
-	if i.Capturing {
+	i.videoMu.Lock()
+	defer i.videoMu.Unlock()
+	return i.startVideoCapture(openWithResolution)
+}
+
+// startVideoCapture starts the video capture, the caller must hold videoMu
+func (i *Instance) startVideoCapture(openWithResolution *CaptureResolution) error {
+	if i.IsCapturing() {
 		return fmt.Errorf("video capture already started")
 	}
 
+	if openWithResolution == nil {
+		return fmt.Errorf("resolution not provided")
+	}
 	if openWithResolution.FPS == 0 {
 		openWithResolution.FPS = 25 //Default to 25 FPS
 	}
 
 	devName := i.Config.VideoDeviceName
-	if openWithResolution == nil {
-		return fmt.Errorf("resolution not provided")
+	if i.Config.VideoSource != nil {
+		return i.startSourceCapture(openWithResolution)
 	}
 	frameRate := openWithResolution.FPS
 	buffSize := 2 //No. of frames to buffer
 	//Default to MJPEG
 	//Other formats that are commonly supported are YUYV, H264, MJPEG
 	format := "mjpeg"
+	if openWithResolution.Format != "" {
+		if !IsStreamableFormat(openWithResolution.Format) {
+			return fmt.Errorf("pixel format %s cannot be streamed", openWithResolution.Format)
+		}
+		format = openWithResolution.Format
+	}
 
 	//Check if the video device is a capture device
 	isCaptureDev, err := CheckVideoCaptureDevice(devName)
@@ -125,7 +137,6 @@ func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) erro
 		return fmt.Errorf("failed to open video device: %w", err)
 	}
 
-	i.camera = camera
 	caps := camera.Capability()
 	log.Printf("device [%s] opened\n", devName)
 	log.Printf("device info: %s", caps.String())
@@ -135,6 +146,7 @@ func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) erro
 	// set device format
 	currFmt, err := camera.GetPixFormat()
 	if err != nil {
+		camera.Close()
 		return fmt.Errorf("failed to get current pixel format: %w", err)
 	}
 
@@ -142,50 +154,93 @@ func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) erro
 	// 2025/03/16 15:45:25 Current format: Motion-JPEG [1920x1080]; field=any; bytes per line=0; size image=0; colorspace=Default; YCbCr=Default; Quant=Default; XferFunc=Default
 	log.Printf("Current format: %s", currFmt)
 
-	// store format info
+	// start capture
+	ctx, cancel := context.WithCancel(context.TODO())
+	if err := camera.Start(ctx); err != nil {
+		cancel()
+		camera.Close()
+		return fmt.Errorf("failed to start stream capture: %w", err)
+	}
+	i.camera = camera
+	i.cameraStartContext = cancel
+
+	// store format info and the video stream
+	i.stateMu.Lock()
 	i.pixfmt = currFmt.PixelFormat
 	i.width = int(currFmt.Width)
 	i.height = int(currFmt.Height)
 	i.fps = frameRate
-
 	i.streamInfo = fmt.Sprintf("%s - %s [%dx%d] %d fps",
 		caps.Card,
 		v4l2.PixelFormats[currFmt.PixelFormat],
 		currFmt.Width, currFmt.Height, frameRate,
 	)
+	i.frames_buff = camera.GetOutput()
+	i.capturing = true
+	i.stateMu.Unlock()
 
-	// start capture
-	ctx, cancel := context.WithCancel(context.TODO())
-	if err := camera.Start(ctx); err != nil {
-		log.Fatalf("stream capture: %s", err)
+	log.Printf("device capture started (buffer size set %d)", camera.BufferCount())
+	return nil
+}
+
+// startSourceCapture starts capturing from the configured synthetic video source
+func (i *Instance) startSourceCapture(resolution *CaptureResolution) error {
+	source := i.Config.VideoSource
+	resolutionIsSupported, err := i.supportsResolution(resolution)
+	if err != nil {
+		return err
+	}
+	if !resolutionIsSupported {
+		return errors.New("this device do not support the required resolution settings")
 	}
-	i.cameraStartContext = cancel
 
-	// video stream
-	i.frames_buff = camera.GetOutput()
+	frames, err := source.Start(resolution)
+	if err != nil {
+		return fmt.Errorf("failed to start video source: %w", err)
+	}
 
-	log.Printf("device capture started (buffer size set %d)", camera.BufferCount())
-	i.Capturing = true
+	i.stateMu.Lock()
+	i.frames_buff = frames
+	i.pixfmt = v4l2.PixelFmtMJPEG
+	i.width = resolution.Width
+	i.height = resolution.Height
+	i.fps = resolution.FPS
+	i.streamInfo = fmt.Sprintf("%s - %s [%dx%d] %d fps",
+		source.Name(),
+		v4l2.PixelFormats[v4l2.PixelFmtMJPEG],
+		resolution.Width, resolution.Height, resolution.FPS,
+	)
+	i.capturing = true
+	i.stateMu.Unlock()
+	log.Printf("video source [%s] started", source.Name())
 	return nil
 }
 
 // start http service
 func (i *Instance) ServeVideoStream(w http.ResponseWriter, req *http.Request) {
 	//Check if the access count is already 1, if so, kick out the previous access
-	if i.accessCount >= 1 {
+	i.stateMu.Lock()
+	if i.accessCount >= 1 && i.videoClient != nil {
 		log.Println("Another client is already connected, kicking out the previous client...")
-		if i.videoTakeoverChan != nil {
-			i.videoTakeoverChan <- true
-		}
-		log.Println("Previous client kicked out, taking over the stream...")
+		close(i.videoClient)
 	}
+	takeover := make(chan struct{})
+	i.videoClient = takeover
 	i.accessCount++
+	frames := i.frames_buff
+	i.stateMu.Unlock()
 
-	err := i.streamMJPEG(w, req)
+	err := i.streamMJPEG(w, req, frames, takeover)
 	if err != nil {
 		log.Printf("video stream error: %v", err)
 	}
+
+	i.stateMu.Lock()
 	i.accessCount--
+	if i.videoClient == takeover {
+		i.videoClient = nil
+	}
+	i.stateMu.Unlock()
 }
 
 func isJPEG(frame []byte) bool {
@@ -202,7 +257,13 @@ func isJPEG(frame []byte) bool {
 	return start >= 0 && end > start
 }
 
-func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request) error {
+// streamMJPEG writes the frames to the client until the client disconnects,
+// the frame channel is closed or the takeover channel is closed
+func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request, frames <-chan []byte, takeover <-chan struct{}) error {
+	if frames == nil {
+		return errors.New("video capture is not running")
+	}
+
 	// Set up the multipart response
 	mimeWriter := multipart.NewWriter(w)
 	w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mimeWriter.Boundary()))
@@ -211,23 +272,23 @@ func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request) error {
 
 	//Chrome MJPEG decoder cannot decode the first frame from MS2109 capture card for unknown reason
 	//Thus we are discarding the first frame here
-	if i.frames_buff != nil {
-		select {
-		case <-i.frames_buff:
-			// Discard the first frame
-		default:
-			// No frame to discard
-		}
+	select {
+	case <-frames:
+		// Discard the first frame
+	default:
+		// No frame to discard
 	}
 
 	// Streaming loop
 	var frame []byte
-	for frame = range i.frames_buff {
+	for frame = range frames {
 		// Drain 2 frames every frame if there are buffered frames
 		// This helps in reducing latency when the network is congested
 		select {
-		case f := <-i.frames_buff:
-			frame = f
+		case f, ok := <-frames:
+			if ok {
+				frame = f
+			}
 		default:
 		}
 
@@ -263,7 +324,7 @@ func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request) error {
 		case <-req.Context().Done():
 			// Client disconnected, exit the loop
 			return nil
-		case <-i.videoTakeoverChan:
+		case <-takeover:
 			// Another client is taking over, exit the loop
 
 			//Send the endofstream.jpg as last frame before exit
@@ -286,6 +347,13 @@ func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request) error {
 
 // StopVideoCapture stops the video capture and closes the camera device
 func (i *Instance) StopVideoCapture() error {
+	i.videoMu.Lock()
+	defer i.videoMu.Unlock()
+	return i.stopVideoCapture()
+}
+
+// stopVideoCapture stops the video capture, the caller must hold videoMu
+func (i *Instance) stopVideoCapture() error {
 	if i.camera != nil {
 		i.cameraStartContext()
 		err := i.camera.Close()
@@ -295,10 +363,19 @@ func (i *Instance) StopVideoCapture() error {
 		i.camera = nil
 		time.Sleep(300 * time.Millisecond)
 		log.Println("video capture stopped")
+	} else if i.Config.VideoSource != nil && i.IsCapturing() {
+		err := i.Config.VideoSource.Stop()
+		if err != nil {
+			return err
+		}
+		log.Println("video source stopped")
 	} else {
 		log.Println("video capture is not running")
 	}
-	i.Capturing = false
+	i.stateMu.Lock()
+	i.capturing = false
+	i.frames_buff = nil
+	i.stateMu.Unlock()
 
 	return nil
 }
@@ -321,19 +398,32 @@ func IsCaptureCardVideoInterface(device string) bool {
 
 // CheckVideoCaptureDevice checks if the given video device is a video capture device
 func CheckVideoCaptureDevice(device string) (bool, error) {
-	// Run v4l2-ctl to get device capabilities
-	cmd := exec.Command("v4l2-ctl", "--device", device, "--all")
-	output, err := cmd.CombinedOutput()
+	isCapture := false
+	err := queryV4L2Device(device, func(fd uintptr) error {
+		caps, err := v4l2.GetCapability(fd)
+		if err != nil {
+			return err
+		}
+		// Use the capabilities of this node instead of the whole driver, so
+		// metadata nodes of UVC devices are not reported as capture devices
+		isCapture = caps.GetCapabilities()&v4l2.CapVideoCapture != 0
+		return nil
+	})
 	if err != nil {
-		return false, fmt.Errorf("failed to execute v4l2-ctl: %w", err)
+		return false, fmt.Errorf("failed to query video device capabilities: %w", err)
 	}
+	return isCapture, nil
+}
 
-	// Convert output to string and check for the "Video Capture" capability
-	outputStr := string(output)
-	if strings.Contains(outputStr, "Video Capture") {
-		return true, nil
+// queryV4L2Device opens the video device for issuing query ioctls only, no
+// stream is started and the device is closed when fn returns.
+func queryV4L2Device(devicePath string, fn func(fd uintptr) error) error {
+	fd, err := v4l2.OpenDevice(devicePath, syscall.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
 	}
-	return false, nil
+	defer v4l2.CloseDevice(fd)
+	return fn(fd)
 }
 
 // GetDefaultVideoDevice returns the first available video capture device, e.g., /dev/video0
@@ -352,30 +442,103 @@ func GetDefaultVideoDevice() (string, error) {
 	return "", fmt.Errorf("no video capture device found")
 }
 
+// supportsResolution checks if the capture device or video source of this
+// instance supports the specified resolution and frame rate
+func (i *Instance) supportsResolution(resolution *CaptureResolution) (bool, error) {
+	if i.Config.VideoSource == nil {
+		return deviceSupportResolution(i.Config.VideoDeviceName, resolution)
+	}
+	return formatsSupportResolution(i.SupportedResolutions, resolution), nil
+}
+
 // deviceSupportResolution checks if the given video device supports the specified resolution and frame rate
 func deviceSupportResolution(devicePath string, resolution *CaptureResolution) (bool, error) {
 	formatInfo, err := GetV4L2FormatInfo(devicePath)
 	if err != nil {
 		return false, err
 	}
+	return formatsSupportResolution(formatInfo, resolution), nil
+}
 
+// formatsSupportResolution checks if the resolution and frame rate is in the list of formats
+func formatsSupportResolution(formatInfo []FormatInfo, resolution *CaptureResolution) bool {
 	// Yes, this is an O(N^3) operation, but a video decices rarely have supported resolution
 	// more than 20 combinations. The compute time should be fine
 	for _, res := range formatInfo {
+		if resolution.Format != "" && !strings.EqualFold(res.Format, resolution.Format) {
+			continue
+		}
 		for _, size := range res.Sizes {
 			//Check if there is a matching resolution
 			if size.Height == resolution.Height && size.Width == resolution.Width {
 				//Matching resolution. Check if the required FPS is supported
 				for _, fps := range size.FPS {
 					if fps == resolution.FPS {
-						return true, nil
+						return true
 					}
 				}
 			}
 		}
 	}
 
-	return false, nil
+	return false
+}
+
+// IsStreamableFormat checks if frames of the pixel format can be served as
+// MJPEG stream without transcoding
+func IsStreamableFormat(format string) bool {
+	switch strings.ToUpper(format) {
+	case "MJPG", "JPEG":
+		return true
+	}
+	return false
+}
+
+// ClosestResolution returns the streamable mode in formatInfo that is closest
+// to want. A mode of the requested pixel format is preferred, then the frame
+// size closest in area and then the closest frame rate. exact is true if want
+// itself is supported.
+func ClosestResolution(formatInfo []FormatInfo, want *CaptureResolution) (closest CaptureResolution, exact bool, found bool) {
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	// Score of a mode, compared in order. Lower is better.
+	var best [4]int
+	for _, res := range formatInfo {
+		if !IsStreamableFormat(res.Format) {
+			continue
+		}
+		formatMismatch := 0
+		if want.Format != "" && !strings.EqualFold(res.Format, want.Format) {
+			formatMismatch = 1
+		}
+		for _, size := range res.Sizes {
+			areaDiff := abs(size.Width*size.Height - want.Width*want.Height)
+			for _, fps := range size.FPS {
+				score := [4]int{formatMismatch, areaDiff, abs(fps - want.FPS), -fps}
+				if found && !lessScore(score, best) {
+					continue
+				}
+				best = score
+				closest = CaptureResolution{Width: size.Width, Height: size.Height, FPS: fps, Format: res.Format}
+				found = true
+			}
+		}
+	}
+	exact = found && best[0] == 0 && closest.Width == want.Width && closest.Height == want.Height && closest.FPS == want.FPS
+	return closest, exact, found
+}
+
+func lessScore(a, b [4]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
 }
 
 // PrintV4L2FormatInfo prints the supported formats, resolutions, and frame rates of the given video device
@@ -408,87 +571,69 @@ func PrintV4L2FormatInfo(devicePath string) {
 	}
 }
 
-// Function to run the v4l2-ctl command and parse the output
+// GetV4L2FormatInfo lists the supported formats, discrete frame sizes and frame
+// rates of the given video device using the VIDIOC_ENUM_* ioctls
 func GetV4L2FormatInfo(devicePath string) ([]FormatInfo, error) {
-	// Run the v4l2-ctl command to list formats
-	cmd := exec.Command("v4l2-ctl", "--list-formats-ext", "-d", devicePath)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse the output
 	var formats []FormatInfo
-	var currentFormat *FormatInfo
-	scanner := bufio.NewScanner(&out)
-
-	formatRegex := regexp.MustCompile(`\[(\d+)\]: '(\S+)'`)
-	sizeRegex := regexp.MustCompile(`Size: Discrete (\d+)x(\d+)`)
-	intervalRegex := regexp.MustCompile(`Interval: Discrete (\d+\.\d+)s \((\d+\.\d+) fps\)`)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Match format line
-		if matches := formatRegex.FindStringSubmatch(line); matches != nil {
-			if currentFormat != nil {
-				formats = append(formats, *currentFormat)
-			}
-			// Start a new format entry
-			currentFormat = &FormatInfo{
-				Format: matches[2],
-			}
+	err := queryV4L2Device(devicePath, func(fd uintptr) error {
+		descs, err := v4l2.GetAllFormatDescriptions(fd)
+		if len(descs) == 0 && err != nil {
+			return err
 		}
-
-		// Match size line
-		if matches := sizeRegex.FindStringSubmatch(line); matches != nil {
-			width, _ := strconv.Atoi(matches[1])
-			height, _ := strconv.Atoi(matches[2])
-
-			// Initialize the size entry
-			sizeInfo := SizeInfo{
-				Width:  width,
-				Height: height,
+		for _, desc := range descs {
+			format := FormatInfo{
+				Format: fourCCString(desc.PixelFormat),
 			}
-
-			// Match FPS intervals for the current size
-			for scanner.Scan() {
-				line = scanner.Text()
-
-				if fpsMatches := intervalRegex.FindStringSubmatch(line); fpsMatches != nil {
-					fps, _ := strconv.ParseFloat(fpsMatches[2], 32)
+			frameSizes, err := v4l2.GetFormatFrameSizes(fd, desc.PixelFormat)
+			if err != nil {
+				formats = append(formats, format)
+				continue
+			}
+			for _, frameSize := range frameSizes {
+				if frameSize.Type != v4l2.FrameSizeTypeDiscrete {
+					continue
+				}
+				sizeInfo := SizeInfo{
+					Width:  int(frameSize.Size.MinWidth),
+					Height: int(frameSize.Size.MinHeight),
+				}
+				for index := uint32(0); ; index++ {
+					interval, err := v4l2.GetFormatFrameInterval(fd, index, desc.PixelFormat, frameSize.Size.MinWidth, frameSize.Size.MinHeight)
+					if err != nil || interval.Type != v4l2.FrameIntervalTypeDiscrete {
+						break
+					}
+					if interval.Interval.Min.Numerator == 0 {
+						continue
+					}
+					// Frame interval is in seconds per frame, e.g. 1/30
+					fps := float64(interval.Interval.Min.Denominator) / float64(interval.Interval.Min.Numerator)
 					sizeInfo.FPS = append(sizeInfo.FPS, int(fps))
-				} else {
-					// Stop parsing FPS intervals when no more matches are found
-					break
 				}
+				format.Sizes = append(format.Sizes, sizeInfo)
 			}
-			// Add the size information to the current format
-			currentFormat.Sizes = append(currentFormat.Sizes, sizeInfo)
+			formats = append(formats, format)
 		}
-	}
-
-	// Append the last format if present
-	if currentFormat != nil {
-		formats = append(formats, *currentFormat)
-	}
-
-	if err := scanner.Err(); err != nil {
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-
 	return formats, nil
 }
 
+// fourCCString converts a pixel format code to its four character string, e.g. MJPG
+func fourCCString(code v4l2.FourCCType) string {
+	b := []byte{byte(code), byte(code >> 8), byte(code >> 16), byte(code >> 24)}
+	return strings.TrimRight(string(b), " \x00")
+}
+
 func getFormatType(fmtStr string) v4l2.FourCCType {
 	switch strings.ToLower(fmtStr) {
 	case "jpeg":
 		return v4l2.PixelFmtJPEG
 	case "mpeg":
 		return v4l2.PixelFmtMPEG
-	case "mjpeg":
+	case "mjpeg", "mjpg":
 		return v4l2.PixelFmtMJPEG
 	case "h264", "h.264":
 		return v4l2.PixelFmtH264
@@ -505,19 +650,26 @@ func getFormatType(fmtStr string) v4l2.FourCCType {
 // If the device is already capturing, it will use the current stream
 // If not, it will temporarily open the device, capture one frame, and close it
 func (i *Instance) CaptureScreenshot() ([]byte, error) {
+	// Keep the capture from being started or stopped while taking the screenshot
+	i.videoMu.Lock()
+	defer i.videoMu.Unlock()
+
 	// If device is already capturing, grab a frame from the current stream
-	if i.Capturing && i.frames_buff != nil {
+	i.stateMu.RLock()
+	capturing, frames := i.capturing, i.frames_buff
+	i.stateMu.RUnlock()
+	if capturing && frames != nil {
 		// Flush the first 5 frames as they may be blank/invalid
 		for j := 0; j < 5; j++ {
 			select {
-			case <-i.frames_buff:
+			case <-frames:
 				// Discard this frame
 			case <-time.After(1 * time.Second):
 				// Timeout flushing, continue
 			}
 		}
 		select {
-		case frame := <-i.frames_buff:
+		case frame := <-frames:
 			if len(frame) > 0 && isJPEG(frame) {
 				return frame, nil
 			}
@@ -528,6 +680,9 @@ func (i *Instance) CaptureScreenshot() ([]byte, error) {
 	}
 
 	// Device is not capturing, we need to temporarily open it
+	if i.Config.VideoSource != nil {
+		return i.captureSourceScreenshot()
+	}
 	devName := i.Config.VideoDeviceName
 
 	// Check if the video device is a capture device
@@ -549,7 +704,7 @@ func (i *Instance) CaptureScreenshot() ([]byte, error) {
 	var width, height, fps int
 	found := false
 	for _, format := range formats {
-		if strings.ToLower(format.Format) == "mjpeg" && len(format.Sizes) > 0 {
+		if IsStreamableFormat(format.Format) && len(format.Sizes) > 0 {
 			// Pick the first available size
 			size := format.Sizes[0]
 			width = size.Width
@@ -594,7 +749,7 @@ func (i *Instance) CaptureScreenshot() ([]byte, error) {
 	}
 
 	// Get frames channel
-	frames := camera.GetOutput()
+	frames = camera.GetOutput()
 
 	// Flush the first 5 frames as they may be blank/invalid
 	log.Printf("Flushing first 5 frames from newly opened device...")
@@ -620,6 +775,35 @@ func (i *Instance) CaptureScreenshot() ([]byte, error) {
 	}
 }
 
+// captureSourceScreenshot temporarily starts the synthetic video source and
+// returns its first frame
+func (i *Instance) captureSourceScreenshot() ([]byte, error) {
+	if len(i.SupportedResolutions) == 0 || len(i.SupportedResolutions[0].Sizes) == 0 {
+		return nil, fmt.Errorf("no supported resolution found for video source")
+	}
+	size := i.SupportedResolutions[0].Sizes[0]
+	fps := 15
+	if len(size.FPS) > 0 {
+		fps = size.FPS[0]
+	}
+	source := i.Config.VideoSource
+	frames, err := source.Start(&CaptureResolution{Width: size.Width, Height: size.Height, FPS: fps})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start video source for screenshot: %w", err)
+	}
+	defer source.Stop()
+
+	select {
+	case frame := <-frames:
+		if len(frame) > 0 && isJPEG(frame) {
+			return frame, nil
+		}
+		return nil, fmt.Errorf("invalid frame captured")
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("timeout capturing screenshot")
+	}
+}
+
 // ServeScreenshot serves a single JPEG screenshot via HTTP
 // This is useful for preview thumbnails in the web UI
 func (i *Instance) ServeScreenshot(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,89 @@
+package main
+
+/*
+	simulate.go
+
+	Simulate mode runs the IP-KVM server against emulated port modules, so
+	dezkvmd can be developed and tested without DezKVM hardware.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"imuslab.com/dezkvm/dezkvmd/mod/dezkvm"
+	"imuslab.com/dezkvm/dezkvmd/mod/simulator"
+)
+
+var (
+	simCount   = flag.Int("sim-count", 1, "Number of simulated devices, must be used with -mode=simulate")
+	simFrames  = flag.String("sim-frames", "", "Folder of JPEG files to loop as simulated video, defaults to a test pattern")
+	simHIDBaud = flag.Int("sim-hid-baud", 0, "Emulate the UART transfer time of the simulated CH9329 at this baudrate, 0 disables it")
+	simDevices []*simulator.Device
+)
+
+// add_simulated_devices creates the simulated devices and registers them as USB KVM instances
+func add_simulated_devices() error {
+	if *simCount < 1 {
+		return fmt.Errorf("invalid simulated device count: %d", *simCount)
+	}
+	for i := 0; i < *simCount; i++ {
+		dev, err := simulator.NewDevice(&simulator.Options{
+			Index:       i,
+			FramesDir:   *simFrames,
+			HIDBaudRate: *simHIDBaud,
+		})
+		if err != nil {
+			return err
+		}
+		simDevices = append(simDevices, dev)
+
+		err = dezkvmManager.AddUsbKvmDevice(&dezkvm.UsbKvmDeviceOption{
+			USBKVMDevicePath:              dev.HIDDevicePath(),
+			AuxMCUDevicePath:              dev.AuxMCUDevicePath(),
+			VideoCaptureDevicePath:        fmt.Sprintf("simulator:%d:video", i),
+			AudioCaptureDevicePath:        fmt.Sprintf("simulator:%d:audio", i),
+			CaptureVideoResolutionWidth:   1280,
+			CaptureeVideoResolutionHeight: 720,
+			CaptureeVideoFPS:              25,
+			USBKVMBaudrate:                115200,
+			AuxMCUBaudrate:                115200,
+			VideoSource:                   dev.Video,
+			AudioSource:                   dev.Audio,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Simulated device %d: HID %s, AuxMCU %s\n", i, dev.HIDDevicePath(), dev.AuxMCUDevicePath())
+	}
+	return nil
+}
+
+// close_simulated_devices stops all simulated devices
+func close_simulated_devices() {
+	for _, dev := range simDevices {
+		dev.Close()
+	}
+}
+
+// register_simulator_apis registers the simulator state API, only used in simulate mode
+func register_simulator_apis(mux *http.ServeMux) {
+	authManager.HandleFunc("/api/v1/simulator/state", handleSimulatorState, mux)
+}
+
+// handleSimulatorState returns the virtual keyboard, mouse and AuxMCU state of each simulated device
+func handleSimulatorState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	states := []simulator.DeviceState{}
+	for _, dev := range simDevices {
+		states = append(states, dev.State())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
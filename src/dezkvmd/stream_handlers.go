@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"imuslab.com/dezkvm/dezkvmd/mod/usbcapture"
 	"imuslab.com/dezkvm/dezkvmd/mod/utils"
@@ -12,21 +15,74 @@ import (
 func handleVideoStream(w http.ResponseWriter, r *http.Request) {
 	instanceUUID := r.PathValue("uuid")
 	log.Println("Requested video stream for instance UUID:", instanceUUID)
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleVideoStreams(w, r, instanceUUID)
 }
 
 // handleAudioStream handles audio streaming for a specific instance
 func handleAudioStream(w http.ResponseWriter, r *http.Request) {
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleAudioStreams(w, r, instanceUUID)
 }
 
 // handleHIDEvents handles HID events for a specific instance
 func handleHIDEvents(w http.ResponseWriter, r *http.Request) {
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleHIDEvents(w, r, instanceUUID)
 }
 
+// handleTypeText types UTF-8 text on an instance with a keyboard layout
+func handleTypeText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	dezkvmManager.HandleTypeText(w, r, instanceUUID)
+}
+
+// handleListKeyboardLayouts lists the keyboard layouts supported for typing text
+func handleListKeyboardLayouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListKeyboardLayouts(w, r)
+}
+
+// handleConsumerKey presses a multimedia or ACPI key, e.g. wake or mute
+func handleConsumerKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	dezkvmManager.HandleConsumerKey(w, r, instanceUUID, r.PathValue("key"))
+}
+
+// handleListConsumerKeys lists the supported multimedia and ACPI keys
+func handleListConsumerKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListConsumerKeys(w, r)
+}
+
 // handleMassStorageSwitch switches mass storage between KVM and remote
 func handleMassStorageSwitch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -38,6 +94,9 @@ func handleMassStorageSwitch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing or invalid uuid parameter", http.StatusBadRequest)
 		return
 	}
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	side, err := utils.PostPara(r, "side")
 	if err != nil {
 		http.Error(w, "Missing or invalid side parameter", http.StatusBadRequest)
@@ -53,13 +112,25 @@ func handleMassStorageSwitch(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleListInstances lists all available instances
+// handleListInstances lists all available instances, optionally filtered by ?tag=.
+// The instances of federation peers are included unless ?scope=local is set.
 func handleListInstances(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		dezkvmManager.HandleListInstances(w, r)
-	} else {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tag, _ := utils.GetPara(r, "tag")
+	scope, _ := utils.GetPara(r, "scope")
+	instances := dezkvmManager.ListInstanceInfo(tag)
+	for _, instance := range instances {
+		instance["node_uuid"] = strings.TrimSpace(nodeUUID)
+		instance["remote"] = false
+	}
+	if scope != "local" && federationManager != nil {
+		instances = append(instances, federationManager.RemoteInstances(tag)...)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instances)
 }
 
 // handleGetSupportedResolutions returns supported resolutions for an instance
@@ -69,6 +140,9 @@ func handleGetSupportedResolutions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleGetSupportedResolutions(w, r, instanceUUID)
 }
 
@@ -79,6 +153,9 @@ func handleGetCurrentResolution(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleGetCurrentResolution(w, r, instanceUUID)
 }
 
@@ -93,6 +170,9 @@ func handleChangeResolution(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing or invalid uuid parameter", http.StatusBadRequest)
 		return
 	}
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	width, err := utils.PostInt(r, "width")
 	if err != nil {
 		http.Error(w, "Missing or invalid width parameter", http.StatusBadRequest)
@@ -109,14 +189,53 @@ func handleChangeResolution(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional, the current pixel format is kept if not set
+	pixelFormat, _ := utils.PostPara(r, "pixel_format")
+
 	newResolution := &usbcapture.CaptureResolution{
 		Width:  width,
 		Height: height,
 		FPS:    fps,
+		Format: pixelFormat,
 	}
 	dezkvmManager.HandleChangeResolution(w, r, instanceUUID, newResolution)
 }
 
+// handleGetCaptureProfile returns the saved capture settings of an instance
+func handleGetCaptureProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	dezkvmManager.HandleGetCaptureProfile(w, r, instanceUUID)
+}
+
+// handleSetAudioQuality sets the default audio quality of an instance
+func handleSetAudioQuality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		http.Error(w, "Missing or invalid uuid parameter", http.StatusBadRequest)
+		return
+	}
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	quality, err := utils.PostPara(r, "quality")
+	if err != nil {
+		http.Error(w, "Missing or invalid quality parameter", http.StatusBadRequest)
+		return
+	}
+	dezkvmManager.HandleSetAudioQuality(w, r, instanceUUID, quality)
+}
+
 // handleScreenshot captures a single frame from the video device
 func handleScreenshot(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -124,15 +243,47 @@ func handleScreenshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleScreenshot(w, r, instanceUUID)
 }
 
 // handleMouseJiggler toggles mouse jiggler for an instance
 func handleMouseJiggler(w http.ResponseWriter, r *http.Request) {
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleMouseJiggler(w, r, instanceUUID)
 }
 
+// handleChipStatus returns the keyboard LEDs and USB state of the target
+func handleChipStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	dezkvmManager.HandleChipStatus(w, r, instanceUUID)
+}
+
+// handleHIDStats returns the HID command pipeline statistics of the target
+func handleHIDStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	dezkvmManager.HandleHIDStats(w, r, instanceUUID)
+}
+
 // handleReconnectCapture closes and restarts the V4L2 + audio capture device
 func handleReconnectCapture(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -140,18 +291,235 @@ func handleReconnectCapture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	dezkvmManager.HandleReconnectCapture(w, r, instanceUUID)
 }
 
-// handlePreferences handles GET/POST for instance preferences
+// handlePreferences handles GET/POST/PATCH for instance preferences,
+// POST replaces all preferences while PATCH only updates the given fields
 func handlePreferences(w http.ResponseWriter, r *http.Request) {
 	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		dezkvmManager.HandleGetPreferences(w, r, instanceUUID)
 	case http.MethodPost:
-		dezkvmManager.HandleSetPreferences(w, r, instanceUUID)
+		dezkvmManager.HandleSetPreferences(w, r, instanceUUID, false)
+	case http.MethodPatch:
+		dezkvmManager.HandleSetPreferences(w, r, instanceUUID, true)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListRegistry lists all instance registry entries, optionally filtered by ?tag=
+func handleListRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tag, _ := utils.GetPara(r, "tag")
+	dezkvmManager.HandleListRegistry(w, r, tag)
+}
+
+// handleRegistryEntry handles GET/POST/DELETE for the registry entry of an instance
+func handleRegistryEntry(w http.ResponseWriter, r *http.Request) {
+	instanceUUID := r.PathValue("uuid")
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleGetRegistryEntry(w, r, instanceUUID)
+	case http.MethodPost, http.MethodPut:
+		dezkvmManager.HandleSetRegistryEntry(w, r, instanceUUID)
+	case http.MethodDelete:
+		dezkvmManager.HandleDeleteRegistryEntry(w, r, instanceUUID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListGroups lists all instance groups
+func handleListGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListGroups(w, r)
+}
+
+// handleGroup handles GET/POST/DELETE for an instance group
+func handleGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleGetGroup(w, r, name)
+	case http.MethodPost, http.MethodPut:
+		dezkvmManager.HandleSetGroup(w, r, name)
+	case http.MethodDelete:
+		dezkvmManager.HandleDeleteGroup(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListMacros lists all HID macros
+func handleListMacros(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListMacros(w, r)
+}
+
+// handleMacro handles GET/PUT/DELETE for a HID macro
+func handleMacro(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleGetMacro(w, r, name)
+	case http.MethodPost, http.MethodPut:
+		dezkvmManager.HandleSetMacro(w, r, name)
+	case http.MethodDelete:
+		dezkvmManager.HandleDeleteMacro(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInstanceMacro handles the macro recording and playback of an instance.
+// The action is one of record, stop, play or abort.
+func handleInstanceMacro(w http.ResponseWriter, r *http.Request) {
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	action := r.PathValue("action")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dezkvmManager.HandleMacroStatus(w, r, instanceUUID)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "record":
+		dezkvmManager.HandleStartMacroRecording(w, r, instanceUUID)
+	case "stop":
+		dezkvmManager.HandleStopMacroRecording(w, r, instanceUUID)
+	case "play":
+		dezkvmManager.HandlePlayMacro(w, r, instanceUUID)
+	case "abort":
+		dezkvmManager.HandleAbortMacro(w, r, instanceUUID)
+	default:
+		http.Error(w, "Unknown macro action", http.StatusNotFound)
+	}
+}
+
+// handleListScripts lists all DuckyScripts
+func handleListScripts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleListScripts(w, r)
+}
+
+// handleValidateScript parses a DuckyScript and reports its errors per line
+func handleValidateScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dezkvmManager.HandleValidateScript(w, r)
+}
+
+// handleScript handles GET/PUT/DELETE for a DuckyScript
+func handleScript(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		dezkvmManager.HandleGetScript(w, r, name)
+	case http.MethodPost, http.MethodPut:
+		dezkvmManager.HandleSetScript(w, r, name)
+	case http.MethodDelete:
+		dezkvmManager.HandleDeleteScript(w, r, name)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// handleInstanceScript handles the DuckyScript runs of an instance.
+// The action is run or cancel.
+func handleInstanceScript(w http.ResponseWriter, r *http.Request) {
+	instanceUUID := r.PathValue("uuid")
+	if proxy_remote_instance(w, r, instanceUUID) {
+		return
+	}
+	action := r.PathValue("action")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dezkvmManager.HandleScriptStatus(w, r, instanceUUID)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "run":
+		dezkvmManager.HandleRunScript(w, r, instanceUUID)
+	case "cancel":
+		dezkvmManager.HandleCancelScript(w, r, instanceUUID)
+	default:
+		http.Error(w, "Unknown script action", http.StatusNotFound)
+	}
+}
+
+// handleBroadcastHIDEvents sends HID events to all instances of ?group= or
+// to the comma separated UUIDs in ?targets=. The optional ?width= and
+// ?height= set the resolution the client positions the mouse in.
+func handleBroadcastHIDEvents(w http.ResponseWriter, r *http.Request) {
+	var targets []string
+	if groupName, err := utils.GetPara(r, "group"); err == nil {
+		group, err := dezkvmManager.GetGroup(groupName)
+		if err != nil {
+			http.Error(w, "Failed to read instance group: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		targets = group.Members
+	} else if targetList, err := utils.GetPara(r, "targets"); err == nil {
+		targets = strings.Split(targetList, ",")
+	} else {
+		http.Error(w, "Missing group or targets parameter", http.StatusBadRequest)
+		return
+	}
+
+	var reference *usbcapture.CaptureResolution
+	widthStr, _ := utils.GetPara(r, "width")
+	heightStr, _ := utils.GetPara(r, "height")
+	if widthStr != "" || heightStr != "" {
+		width, err := strconv.Atoi(widthStr)
+		if err != nil || width <= 0 {
+			http.Error(w, "Invalid width parameter", http.StatusBadRequest)
+			return
+		}
+		height, err := strconv.Atoi(heightStr)
+		if err != nil || height <= 0 {
+			http.Error(w, "Invalid height parameter", http.StatusBadRequest)
+			return
+		}
+		reference = &usbcapture.CaptureResolution{Width: width, Height: height}
+	}
+	dezkvmManager.HandleBroadcastHIDEvents(w, r, targets, reference)
+}
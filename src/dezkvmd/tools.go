@@ -18,7 +18,11 @@ func handle_debug_tool() error {
 			return err
 		}
 	case "list-usbkvm-json":
-		result, err := dezkvm.DiscoverUsbKvmSubtree()
+		filter, err := dezkvm.LoadScanFilter(SCAN_FILTER_PATH)
+		if err != nil {
+			return err
+		}
+		result, err := dezkvm.DiscoverUsbKvmSubtree(filter)
 		if err != nil {
 			return err
 		}
@@ -37,6 +41,11 @@ func handle_debug_tool() error {
 		if err != nil {
 			return err
 		}
+	case "discover":
+		err := run_discover_tool()
+		if err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("please specify a valid tool with -tool option")
 	}
@@ -46,33 +55,29 @@ func handle_debug_tool() error {
 // run_dependency_precheck checks if required dependencies are available in the system
 func run_dependency_precheck() error {
 	log.Println("Running precheck...")
-	// Dependencies of USB capture card
-	if _, err := exec.LookPath("v4l2-ctl"); err != nil {
-		return fmt.Errorf("v4l2-ctl not found in PATH")
-	}
+	// Dependencies of USB capture card, video devices are queried
+	// natively via V4L2 ioctls so only the audio capture tool is needed
 	if _, err := exec.LookPath("arecord"); err != nil {
 		return fmt.Errorf("arecord not found in PATH")
 	}
-	log.Println("v4l2-ctl and arecord found in PATH.")
+	log.Println("arecord found in PATH.")
 	return nil
 }
 
-// list_usb_kvm_devcies lists all discovered USB KVM devices and their associated sub-devices
+// list_usb_kvm_devcies prints every device node considered during scanning and
+// why it was accepted or rejected. This is a dry run, no device is opened.
 func list_usb_kvm_devcies() error {
-	result, err := dezkvm.DiscoverUsbKvmSubtree()
+	filter, err := dezkvm.LoadScanFilter(SCAN_FILTER_PATH)
 	if err != nil {
 		return err
 	}
-	for i, dev := range result {
-		log.Printf("USB KVM Device Tree %d:\n", i)
-		log.Printf(" - USB KVM Device: %s\n", dev.USBKVMDevicePath)
-		log.Printf(" - Aux MCU Device: %s\n", dev.AuxMCUDevicePath)
-		for _, cap := range dev.CaptureDevicePaths {
-			log.Printf(" - Capture Device: %s\n", cap)
-		}
-		for _, snd := range dev.AlsaDevicePaths {
-			log.Printf(" - ALSA Device: %s\n", snd)
+	log.Println("Scan candidates:")
+	for _, c := range dezkvm.ScanCandidates(filter) {
+		verdict := "REJECTED"
+		if c.Accepted {
+			verdict = "ACCEPTED"
 		}
+		log.Printf(" - [%s] %s (%s) %s:%s %q class=%s: %s\n", verdict, c.DevicePath, c.Kind, c.VendorID, c.ProductID, c.Product, c.InterfaceClass, c.Reason)
 	}
 	return nil
 }
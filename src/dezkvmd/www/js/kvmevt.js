@@ -17,11 +17,15 @@ const HIDEvent = Object.freeze({
     MOUSE_BTN_DOWN:   3,
     MOUSE_BTN_UP:     4,
     MOUSE_SCROLL:     5,
+    CONSUMER_KEY:     7,
+    KEEP_ALIVE:       8,
     RESET:            0xFF,
 });
 
 let hidsocket;
 let hidWebSocketReady = false;
+let hidKeepAliveTimer = null;
+const hidKeepAliveInterval = 2000; // Keeps held keys pressed when stuck key protection is enabled
 let protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
 let port = window.location.port ? window.location.port : (protocol === 'wss' ? 443 : 80);
 let hidSocketURL = `${protocol}://${window.location.hostname}:${port}/api/v1/hid/{uuid}/events`;
@@ -37,6 +41,7 @@ let askOnPaste = true; // Prompt user when pasting
 let pausePasteCapture = false; // Used to temporarily disable paste event handling when modals are open
 let keyStackingEnabled = false; // Whether key stacking mode feature is enabled
 let stackToggleKey = 'ShiftRight'; // event.code of the key that activates/deactivates key stacking (default: Right Shift)
+let keyboardLayout = 'us'; // Keyboard layout of the remote machine, used by the paste box
 let keyStackingActive = false;  // Whether key stacking is currently active (keys are being stacked)
 let keyStack = [];              // Array of { keycode, isRightModKey } to be sent as a combo
 let _suppressKeyUpCodes = new Set(); // event.code values whose keyUp should be swallowed (keys captured during stacking)
@@ -82,6 +87,9 @@ if (window.location.hash.length > 1){
             if(prefs.stack_toggle_key){
                 stackToggleKey = prefs.stack_toggle_key;
             }
+            if(prefs.keyboard_layout){
+                keyboardLayout = prefs.keyboard_layout;
+            }
             // If relative mouse mode is saved, prompt user to click viewport to acquire pointer lock
             if(!mouseMoveAbsolute){
                 $.toast({
@@ -311,6 +319,16 @@ function applyCtrlCmdSwapKey(key) {
     return key;
 }
 
+// Swap the KeyboardEvent.code of CTRL and Meta/CMD when swap is enabled
+function applyCtrlCmdSwapCode(code) {
+    if (!swapCtrlCmd) return code;
+    const swapped = {
+        ControlLeft: 'MetaLeft', ControlRight: 'MetaRight',
+        MetaLeft: 'ControlLeft', MetaRight: 'ControlRight'
+    };
+    return swapped[code] || code;
+}
+
 // handleStackToggleKeyDown manages entering/exiting key stacking mode when the toggle key is pressed
 function handleStackToggleKeyDown(event){
     if (!keyStackingActive) {
@@ -363,7 +381,7 @@ function handleStackModeKeyDown(event){
     }
     // Ignore repeated keydown events (key held)
     if (!keyStack.some(k => k.code === event.code)) {
-        keyStack.push({ key: event.key, keycode: stackKeyCode, isRightModKey: isRight, code: event.code });
+        keyStack.push({ key: event.key, keycode: stackKeyCode, isRightModKey: isRight, code: event.code, hidCode: applyCtrlCmdSwapCode(event.code) });
         _suppressKeyUpCodes.add(event.code);
         console.log(`[KeyStack] + ${event.key} (keyCode=${stackKeyCode})  stack: [${keyStack.map(k => k.key).join(', ')}]`);
 
@@ -403,7 +421,8 @@ function handleKeyDown(event) {
     let swappedKey = applyCtrlCmdSwapKey(key);
     let hidCommand = {
         event: HIDEvent.KEY_DOWN,
-        keycode: keyCode
+        keycode: keyCode,
+        code: applyCtrlCmdSwapCode(event.code)
     };
 
     if (enableKvmEventDebugPrintout) {
@@ -454,7 +473,8 @@ function handleKeyUp(event) {
 
     let hidCommand = {
         event: HIDEvent.KEY_UP,
-        keycode: keyCode
+        keycode: keyCode,
+        code: applyCtrlCmdSwapCode(event.code)
     };
 
     if (enableKvmEventDebugPrintout) {
@@ -564,11 +584,11 @@ function pastePromptSendKey() {
 async function sendKeyStackWithAck(stack) {
     // All key-downs in order
     for (const entry of stack) {
-        await sendHidWithAck({ event: HIDEvent.KEY_DOWN, keycode: entry.keycode, is_right_modifier_key: entry.isRightModKey });
+        await sendHidWithAck({ event: HIDEvent.KEY_DOWN, keycode: entry.keycode, code: entry.hidCode, is_right_modifier_key: entry.isRightModKey });
     }
     // All key-ups in the same order
     for (const entry of stack) {
-        await sendHidWithAck({ event: HIDEvent.KEY_UP, keycode: entry.keycode, is_right_modifier_key: entry.isRightModKey });
+        await sendHidWithAck({ event: HIDEvent.KEY_UP, keycode: entry.keycode, code: entry.hidCode, is_right_modifier_key: entry.isRightModKey });
     }
     console.log('[KeyStack] Combo sent.');
 }
@@ -681,12 +701,30 @@ function startHidWebSocket(){
             event: HIDEvent.RESET
         };
         hidsocket.send(JSON.stringify(hidResetCommand));
+
+        // Tell the server this client is still alive, so held keys are
+        // only released by the stuck key watchdog if the client hangs
+        clearInterval(hidKeepAliveTimer);
+        hidKeepAliveTimer = setInterval(function(){
+            if (hidsocket && hidsocket.readyState === WebSocket.OPEN) {
+                hidsocket.send(JSON.stringify({ event: HIDEvent.KEEP_ALIVE }));
+            }
+        }, hidKeepAliveInterval);
+    });
+
+    hidsocket.addEventListener('close', function(event) {
+        clearInterval(hidKeepAliveTimer);
+        hidKeepAliveTimer = null;
     });
 
     hidsocket.addEventListener('message', function(event) {
-        // Handle ACK replies from backend
+        // Handle ACK replies and chip status updates from backend
         try {
             var msg = JSON.parse(event.data);
+            if (msg.type === 'chip_status') {
+                renderChipStatus(msg.chip_status);
+                return;
+            }
             if (msg.rid && _hidPendingAcks[msg.rid]) {
                 clearTimeout(_hidPendingAcks[msg.rid].timer);
                 _hidPendingAcks[msg.rid].resolve(msg.status);
@@ -700,6 +738,22 @@ function startHidWebSocket(){
   
 }
 
+// renderChipStatus shows the keyboard LEDs of the target and whether it has
+// enumerated the HID device, which is a sign that it is powered on
+function renderChipStatus(status) {
+    $("#chipStatusDisplay").show();
+    if (!status.responding) {
+        $("#chipStatusUSB").attr("class", "ui mini red label").text("HID not responding");
+    } else if (!status.usb_enumerated) {
+        $("#chipStatusUSB").attr("class", "ui mini orange label").text("Target USB offline");
+    } else {
+        $("#chipStatusUSB").attr("class", "ui mini green label").text("USB");
+    }
+    $("#chipStatusNum").toggleClass("blue", status.num_lock);
+    $("#chipStatusCaps").toggleClass("blue", status.caps_lock);
+    $("#chipStatusScroll").toggleClass("blue", status.scroll_lock);
+}
+
 // Attach event listeners on page load
 attachHidEventListeners();
 
@@ -221,6 +221,9 @@ function startSession(sessionId) {
 
 function renderInstance(instance) {
     let metadata = encodeURIComponent(JSON.stringify(instance));
+    if (instance.status && instance.status !== 'running') {
+        return renderFailedInstance(instance, metadata);
+    }
     return `
         <div class="kvm-instance" data-metadata="${metadata}">
             <div class="instance-body">
@@ -233,7 +236,7 @@ function renderInstance(instance) {
                     ${instance.uuid}
                 </div>
                 <h3 class="ui header">
-                    <span>${instance.video_capture_dev}</span>
+                    <span>${instance.display_name ? $('<div>').text(instance.display_name).html() : instance.video_capture_dev}</span>
                     <div class="sub header">${instance.stream_info}</div>
                 </h3>
                 <div class="instance-actions">
@@ -246,6 +249,34 @@ function renderInstance(instance) {
     `;
 }
 
+// renderFailedInstance renders an instance that is not running, together with
+// the error of its last start attempt. The backend keeps retrying in background.
+function renderFailedInstance(instance, metadata) {
+    let title = instance.display_name || instance.uuid || instance.usb_kvm_device;
+    let statusText = instance.status === 'starting' ? 'Starting...' : 'Unavailable';
+    let retryText = '';
+    if (instance.next_retry) {
+        retryText = `Retrying at ${new Date(instance.next_retry * 1000).toLocaleTimeString()} (attempt ${instance.retry_count + 1})`;
+    }
+    return `
+        <div class="kvm-instance failed" data-metadata="${metadata}">
+            <div class="instance-body">
+                <div class="screenshot"></div>
+            </div>
+            <div class="instance-overlay">
+                <div class="ui small circular basic red label">
+                    ${statusText}
+                </div>
+                <h3 class="ui header">
+                    <span>${$('<div>').text(title).html()}</span>
+                    <div class="sub header">${$('<div>').text(instance.last_error || '').html()}</div>
+                    <div class="sub header">${retryText}</div>
+                </h3>
+            </div>
+        </div>
+    `;
+}
+
 function listInstances(callback=undefined) {
     $.get('/api/v1/instances', function(data) {
         let instances = [];
@@ -254,7 +285,15 @@ function listInstances(callback=undefined) {
         } catch (e) {
             instances = [];
         }
-        instances.sort((a, b) => a.uuid.localeCompare(b.uuid));
+        instances.sort((a, b) => {
+            // Sort by registry sort order, then display name, then uuid
+            let orderA = a.sort_order || 0;
+            let orderB = b.sort_order || 0;
+            if (orderA !== orderB) return orderA - orderB;
+            let nameCmp = (a.display_name || '').localeCompare(b.display_name || '');
+            if (nameCmp !== 0) return nameCmp;
+            return a.uuid.localeCompare(b.uuid);
+        });
         const $list = $('#instanceList');
         $list.empty();
         if (instances.length === 0) {
@@ -2,14 +2,17 @@
     paste-box.js
 
     This script implements the Paste Box functionality, allowing users to
-    input text and send it as simulated keyboard input to the remote system
-    via HID over WebSocket.
+    input text and send it as simulated keyboard input to the remote system.
+    The server converts the text to key strokes with the keyboard layout
+    selected in the settings.
 */
 
 const PASTE_BOX_MAX_CHARS = 1000; // Maximum characters allowed in paste box
+const PASTE_BOX_CHUNK_CHARS = 50; // Characters typed per request, so the progress can be updated and cancelled
 
 let pasteBoxActive = false;
 let pasteCancelled = false;
+let pasteAbortController = null; // Aborts the pending typing request on cancel
 
 // Set the UI pastebox max chars
 document.addEventListener('DOMContentLoaded', () => {
@@ -17,45 +20,6 @@ document.addEventListener('DOMContentLoaded', () => {
     document.getElementById('pasteCharCounter').textContent = `0 / ${PASTE_BOX_MAX_CHARS}`;
 });
 
-// Character to keycode mapping for HID-supported characters
-const charToKeyCode = {
-    // Numbers
-    '0': 48, '1': 49, '2': 50, '3': 51, '4': 52,
-    '5': 53, '6': 54, '7': 55, '8': 56, '9': 57,
-    // Lowercase letters
-    'a': 65, 'b': 66, 'c': 67, 'd': 68, 'e': 69,
-    'f': 70, 'g': 71, 'h': 72, 'i': 73, 'j': 74,
-    'k': 75, 'l': 76, 'm': 77, 'n': 78, 'o': 79,
-    'p': 80, 'q': 81, 'r': 82, 's': 83, 't': 84,
-    'u': 85, 'v': 86, 'w': 87, 'x': 88, 'y': 89, 'z': 90,
-    // Special characters that need shift
-    '!': {keycode: 49, shift: true},  // Shift + 1
-    '@': {keycode: 50, shift: true},  // Shift + 2
-    '#': {keycode: 51, shift: true},  // Shift + 3
-    '$': {keycode: 52, shift: true},  // Shift + 4
-    '%': {keycode: 53, shift: true},  // Shift + 5
-    '^': {keycode: 54, shift: true},  // Shift + 6
-    '&': {keycode: 55, shift: true},  // Shift + 7
-    '*': {keycode: 56, shift: true},  // Shift + 8
-    '(': {keycode: 57, shift: true},  // Shift + 9
-    ')': {keycode: 48, shift: true},  // Shift + 0
-    // Other common symbols
-    ' ': 32,  // Space
-    '-': 189, '_': {keycode: 189, shift: true},
-    '=': 187, '+': {keycode: 187, shift: true},
-    '[': 219, '{': {keycode: 219, shift: true},
-    ']': 221, '}': {keycode: 221, shift: true},
-    '\\': 220, '|': {keycode: 220, shift: true},
-    ';': 186, ':': {keycode: 186, shift: true},
-    "'": 222, '"': {keycode: 222, shift: true},
-    ',': 188, '<': {keycode: 188, shift: true},
-    '.': 190, '>': {keycode: 190, shift: true},
-    '/': 191, '?': {keycode: 191, shift: true},
-    '`': 192, '~': {keycode: 192, shift: true},
-    '\n': 13, // Enter
-    '\t': 9,  // Tab
-};
-
 function updatePasteBoxCharCounter() {
     const textarea = document.getElementById('pasteTextarea');
     const counter = document.getElementById('pasteCharCounter');
@@ -102,47 +66,11 @@ function clearPasteBox() {
     updatePasteBoxCharCounter();
 }
 
-function sendKeyPress(keycode, needsShift = false) {
-    if (!hidsocket || hidsocket.readyState !== WebSocket.OPEN) {
-        console.error('HID WebSocket not connected');
-        return;
-    }
-
-    // Press shift if needed
-    if (needsShift) {
-        hidsocket.send(JSON.stringify({
-            event: HIDEvent.KEY_DOWN,
-            keycode: 16, // Shift key
-            is_right_modifier_key: false
-        }));
-    }
-
-    // Press the key
-    hidsocket.send(JSON.stringify({
-        event: HIDEvent.KEY_DOWN,
-        keycode: keycode,
-        is_right_modifier_key: false
-    }));
-
-    // Release the key
-    hidsocket.send(JSON.stringify({
-        event: HIDEvent.KEY_UP,
-        keycode: keycode,
-        is_right_modifier_key: false
-    }));
-
-    // Release shift if needed
-    if (needsShift) {
-        hidsocket.send(JSON.stringify({
-            event: HIDEvent.KEY_UP,
-            keycode: 16, // Shift key
-            is_right_modifier_key: false
-        }));
-    }
-}
-
 function cancelPasteText() {
     pasteCancelled = true;
+    if (pasteAbortController) {
+        pasteAbortController.abort();
+    }
     $.toast({
         message: '<i class="orange exclamation icon"></i> Paste operation cancelled',
     });
@@ -163,13 +91,6 @@ async function sendPasteText() {
         return;
     }
 
-    if (!hidsocket || hidsocket.readyState !== WebSocket.OPEN) {
-        $.toast({
-            message: '<i class="red circle times icon"></i> HID WebSocket not connected',
-        });
-        return;
-    }
-
     // Reset cancel flag
     pasteCancelled = false;
 
@@ -184,83 +105,54 @@ async function sendPasteText() {
     });
 
     let sentCount = 0;
-    let skippedCount = 0;
-
-    // Check if ACK-based sending is available
-    const useAck = (typeof sendKeyPressWithAck === 'function');
-
-    // Process each character, waiting for MCU ACK before proceeding
-    for (let i = 0; i < text.length; i++) {
-        // Check if cancelled
-        if (pasteCancelled) {
-            console.log('Paste operation cancelled by user');
-            break;
-        }
-
-        const char = text[i];
-        let sent = false;
-        
-        // Check if uppercase letter
-        if (char >= 'A' && char <= 'Z') {
-            const keycode = char.charCodeAt(0);
-            if (useAck) {
-                await sendKeyPressWithAck(keycode, true);
-            } else {
-                sendKeyPress(keycode, true);
+    let skippedChars = [];
+    let failed = false;
+
+    // The server types the text with the keyboard layout of the remote machine.
+    // Split by code points, so surrogate pairs are not cut in half.
+    const chars = Array.from(text.replace(/\r\n?/g, '\n'));
+    for (let i = 0; i < chars.length && !pasteCancelled; i += PASTE_BOX_CHUNK_CHARS) {
+        const chunk = chars.slice(i, i + PASTE_BOX_CHUNK_CHARS).join('');
+        pasteAbortController = new AbortController();
+        try {
+            const response = await fetch(`/api/v1/hid/${kvmDeviceUUID}/type`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ text: chunk, layout: keyboardLayout }),
+                signal: pasteAbortController.signal,
+            });
+            const contentType = response.headers.get('Content-Type') || '';
+            const result = contentType.includes('application/json') ? await response.json() : { error: await response.text() };
+            if (result.untypable) {
+                skippedChars.push(...result.untypable.map(c => c.char));
             }
-            sent = true;
-        }
-        // Check if lowercase letter
-        else if (char >= 'a' && char <= 'z') {
-            const keycode = char.toUpperCase().charCodeAt(0);
-            if (useAck) {
-                await sendKeyPressWithAck(keycode, false);
-            } else {
-                sendKeyPress(keycode, false);
+            if (!response.ok) {
+                throw new Error(result.error || response.statusText);
             }
-            sent = true;
-        }
-        // Check if number or mapped character
-        else if (charToKeyCode[char] !== undefined) {
-            const mapping = charToKeyCode[char];
-            if (typeof mapping === 'object') {
-                if (useAck) {
-                    await sendKeyPressWithAck(mapping.keycode, mapping.shift);
-                } else {
-                    sendKeyPress(mapping.keycode, mapping.shift);
-                }
-            } else {
-                if (useAck) {
-                    await sendKeyPressWithAck(mapping, false);
-                } else {
-                    sendKeyPress(mapping, false);
-                }
+            sentCount += result.characters - result.untypable.length;
+        } catch (err) {
+            if (!pasteCancelled) {
+                failed = true;
+                console.error('Failed to type text:', err);
+                $.toast({
+                    message: '<i class="red circle times icon"></i> Failed to type text: ' + $('<div>').text(err.message).html(),
+                });
             }
-            sent = true;
-        }
-
-        if (sent) {
-            sentCount++;
-        } else {
-            skippedCount++;
-            console.warn(`Unsupported character: '${char}' (code: ${char.charCodeAt(0)})`);
+            break;
         }
 
         // Update progress bar
-        const progress = ((i + 1) / text.length) * 100;
+        const progress = (Math.min(i + PASTE_BOX_CHUNK_CHARS, chars.length) / chars.length) * 100;
         $('#pasteProgressBar').progress('set percent', progress);
-
-        // Fallback delay only when ACK is not available
-        if (!useAck) {
-            await new Promise(resolve => setTimeout(resolve, 30));
-        }
     }
+    pasteAbortController = null;
 
     // Show completion message only if not cancelled
-    if (!pasteCancelled) {
+    if (!pasteCancelled && !failed) {
         let message = `<i class="green check circle icon"></i> Sent ${sentCount} characters`;
-        if (skippedCount > 0) {
-            message += `, skipped ${skippedCount} unsupported characters`;
+        if (skippedChars.length > 0) {
+            const skipped = $('<div>').text([...new Set(skippedChars)].join(' ')).html();
+            message += `, skipped ${skippedChars.length} characters not in the ${keyboardLayout.toUpperCase()} layout: ${skipped}`;
         }
 
         $.toast({
@@ -277,7 +169,7 @@ async function sendPasteText() {
     $('#pasteProgressBar').progress('set percent', 0);
 
     // Clear and close only if not cancelled
-    if (!pasteCancelled) {
+    if (!pasteCancelled && !failed) {
         clearPasteBox();
         closePasteBox();
     }
@@ -9,6 +9,7 @@ let massStorageSwitchURL = "/api/v1/mass_storage/switch"; //side accept kvm or r
 let resolutionsAPIURL = "/api/v1/resolutions/{uuid}";
 let currentResolutionAPIURL = "/api/v1/resolution/{uuid}";
 let changeResolutionAPIURL = "/api/v1/resolution/change";
+let audioQualityAPIURL = "/api/v1/audio/quality";
 
 // Audio quality setting (low, standard, high)
 // Check if localStorage has audio quality, set default to 'standard' if not
@@ -198,6 +199,20 @@ function changeAudioQuality(quality) {
     // Save the quality preference
     currentAudioQuality = quality;
     localStorage.setItem('audioQuality', quality);
+    if (quality !== 'disabled') {
+        // Also save it on the server as the default of this instance
+        $.cjax({
+            url: audioQualityAPIURL,
+            type: 'POST',
+            data: {
+                uuid: kvmDeviceUUID,
+                quality: quality
+            },
+            error: function(xhr, status, error) {
+                console.error('Failed to save audio quality:', xhr.responseText || error);
+            }
+        });
+    }
     
     // Handle disabled audio
     if (quality === 'disabled') {